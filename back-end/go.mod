@@ -6,5 +6,9 @@ require (
 	github.com/antchfx/htmlquery v1.2.3
 	github.com/creack/pty v1.1.11 // indirect
 	github.com/gin-gonic/gin v1.6.3
+	github.com/go-playground/validator/v10 v10.2.0
+	github.com/golang/groupcache v0.0.0-20200121045136-8c9f03a8e57e
+	golang.org/x/net v0.0.0-20200822124328-c89045814202
 	google.golang.org/api v0.33.0 // indirect
+	gopkg.in/yaml.v2 v2.2.8
 )
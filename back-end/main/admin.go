@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const adminActorKey = "adminActor"
+
+// adminAuthMiddleware only lets through requests bearing the shared admin token, an
+// account's session token or an API key scoped for the route, the admin token is
+// looked up per request so it can be changed by a config reload
+func adminAuthMiddleware(adminToken func() string, auth *authService, keys *apiKeyRoutes) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := adminToken()
+		providedToken := authToken(c)
+
+		if strings.HasPrefix(providedToken, apiKeyPrefix) {
+			if keys.authorize(c, providedToken) {
+				c.Next()
+			}
+
+			return
+		}
+
+		if token != "" && providedToken != "" && subtle.ConstantTimeCompare([]byte(providedToken), []byte(token)) == 1 {
+			c.Set(adminActorKey, "admin-token")
+
+			c.Next()
+
+			return
+		}
+
+		if _, account, err := auth.authenticate(providedToken); err == nil {
+			c.Set(adminActorKey, "account:"+account.Name)
+
+			c.Next()
+
+			return
+		}
+
+		if token == "" && !auth.hasAccounts() {
+			abortWithError(c, http.StatusServiceUnavailable, "admin API disabled")
+
+			return
+		}
+
+		abortWithError(c, http.StatusUnauthorized, "unauthorized")
+	}
+}
+
+type adminAPI struct {
+	audit      *auditLog
+	playlists  map[string]*PlaylistHandler
+	soundCloud *soundCloudSource
+}
+
+func (aa *adminAPI) registerRoutes(adminGroup *gin.RouterGroup, keys *apiKeyRoutes) {
+	adminGroup.GET("/playlists", aa.listPlaylists)
+	keys.scoped(adminGroup, http.MethodPost, "/playlists/:name/refresh", scopePlaylistsRefresh, aa.refreshPlaylist)
+	adminGroup.PUT("/playlists/:name/title", aa.setPlaylistTitle)
+	adminGroup.GET("/playlists/:name/snapshots", aa.listSnapshots)
+	adminGroup.POST("/playlists/:name/snapshots/:snapshotID/rollback", aa.rollbackPlaylist)
+	adminGroup.POST("/soundcloud/client-id", aa.rotateClientID)
+	adminGroup.GET("/audit", aa.listAuditEntries)
+}
+
+func (aa *adminAPI) playlistHandler(c *gin.Context) (*PlaylistHandler, bool) {
+	playlistHandler, ok := aa.playlists[c.Param("name")]
+
+	if !ok {
+		abortWithError(c, http.StatusNotFound, "unknown playlist")
+	}
+
+	return playlistHandler, ok
+}
+
+func (aa *adminAPI) listPlaylists(c *gin.Context) {
+	statuses := make(map[string]playlistStatus, len(aa.playlists))
+
+	for name, playlistHandler := range aa.playlists {
+		statuses[name] = playlistHandler.status()
+	}
+
+	respondWithData(c, statuses)
+}
+
+func (aa *adminAPI) refreshPlaylist(c *gin.Context) {
+	playlistHandler, ok := aa.playlistHandler(c)
+
+	if !ok {
+		return
+	}
+
+	err := playlistHandler.refreshNow(c.Request.Context())
+
+	aa.audit.recordRequest(c, "playlist.refresh", c.Param("name"), nil, err)
+
+	if err != nil {
+		abortWithError(c, http.StatusBadGateway, err.Error())
+
+		return
+	}
+
+	respondWithData(c, playlistHandler.status())
+}
+
+type setPlaylistTitleRequest struct {
+	Title string `json:"title" binding:"required"`
+}
+
+func (aa *adminAPI) setPlaylistTitle(c *gin.Context) {
+	playlistHandler, ok := aa.playlistHandler(c)
+
+	if !ok {
+		return
+	}
+
+	var request setPlaylistTitleRequest
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		abortWithError(c, http.StatusBadRequest, "a title is required")
+
+		return
+	}
+
+	previousTitle := playlistHandler.currentPlaylistName()
+
+	_, err := playlistHandler.setPlaylistName(c.Request.Context(), request.Title)
+
+	aa.audit.recordRequest(c, "playlist.set_title", c.Param("name"), gin.H{
+		"previous_title": previousTitle,
+		"title":          request.Title,
+	}, err)
+
+	if err != nil {
+		abortWithError(c, http.StatusBadGateway, err.Error())
+
+		return
+	}
+
+	respondWithData(c, playlistHandler.status())
+}
+
+func (aa *adminAPI) listSnapshots(c *gin.Context) {
+	playlistHandler, ok := aa.playlistHandler(c)
+
+	if !ok {
+		return
+	}
+
+	snapshots, err := playlistHandler.snapshots.list()
+
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, "could not list snapshots")
+
+		return
+	}
+
+	respondWithData(c, snapshots)
+}
+
+func (aa *adminAPI) rollbackPlaylist(c *gin.Context) {
+	playlistHandler, ok := aa.playlistHandler(c)
+
+	if !ok {
+		return
+	}
+
+	snapshotID := c.Param("snapshotID")
+
+	_, err := playlistHandler.rollback(snapshotID)
+
+	aa.audit.recordRequest(c, "playlist.rollback", c.Param("name"), gin.H{"snapshot_id": snapshotID}, err)
+
+	if err == errSnapshotNotFound {
+		abortWithError(c, http.StatusNotFound, err.Error())
+
+		return
+	}
+
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, "could not load snapshot")
+
+		return
+	}
+
+	respondWithData(c, playlistHandler.status())
+}
+
+type rotateClientIDRequest struct {
+	// When empty a new client ID is scraped from SoundCloud
+	ClientID string `json:"client_id"`
+}
+
+func (aa *adminAPI) rotateClientID(c *gin.Context) {
+	if aa.soundCloud == nil {
+		abortWithError(c, http.StatusNotFound, "soundcloud is not a configured playlist source")
+
+		return
+	}
+
+	var request rotateClientIDRequest
+
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			abortWithError(c, http.StatusBadRequest, "invalid request body")
+
+			return
+		}
+	}
+
+	var err error
+
+	if request.ClientID != "" {
+		aa.soundCloud.token.setClientID(request.ClientID)
+	} else {
+		_, err = aa.soundCloud.token.rotateClientID(c.Request.Context())
+	}
+
+	aa.audit.recordRequest(c, "soundcloud.rotate_client_id", "", gin.H{"manual": request.ClientID != ""}, err)
+
+	if err != nil {
+		abortWithError(c, http.StatusBadGateway, err.Error())
+
+		return
+	}
+
+	respondWithData(c, nil)
+}
+
+func (aa *adminAPI) listAuditEntries(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+
+	if err != nil || limit < 1 || limit > 1000 {
+		abortWithError(c, http.StatusBadRequest, "limit must be between 1 and 1000")
+
+		return
+	}
+
+	entries, err := aa.audit.recent(limit)
+
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, "could not read audit log")
+
+		return
+	}
+
+	respondWithData(c, entries)
+}
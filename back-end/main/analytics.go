@@ -0,0 +1,794 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type analyticsConfig struct {
+	// Raw events older than this are deleted, the daily rollups made from them are kept
+	EventRetention time.Duration `yaml:"event_retention" env:"ANALYTICS_EVENT_RETENTION" validate:"mindur=24h" reload:"true"`
+	// Daily rollups older than this are deleted, reports only cover the days still kept
+	RollupRetention time.Duration `yaml:"rollup_retention" env:"ANALYTICS_ROLLUP_RETENTION" validate:"mindur=24h" reload:"true"`
+	// Case-insensitive user agent substrings that mark a visitor as a bot, on top of the built in ones
+	BotUserAgents []string `yaml:"bot_user_agents" env:"ANALYTICS_BOT_USER_AGENTS" validate:"dive,required" reload:"true"`
+}
+
+func defaultAnalyticsConfig() analyticsConfig {
+	return analyticsConfig{
+		EventRetention:  time.Hour * 24 * 30,
+		RollupRetention: time.Hour * 24 * 730,
+	}
+}
+
+const (
+	analyticsPageview = "pageview"
+	analyticsEvent    = "event"
+	// Bots are only counted, nothing else about them is kept
+	analyticsBot = "bot"
+
+	analyticsDateLayout = "2006-01-02"
+	// How many pages, referrers and event names a report lists
+	analyticsReportSize = 100
+
+	// Pages, referrers and event names past this many in a day are counted together,
+	// any client can send paths and referrers so they could otherwise grow without end
+	analyticsMaxPages      = 1000
+	analyticsMaxReferrers  = 500
+	analyticsMaxEventNames = 200
+	analyticsOther         = "other"
+)
+
+var analyticsBotPattern = regexp.MustCompile(`(?i)bot|crawl|spider|slurp|scrape|curl|wget|python|go-http-client|java/|okhttp|headless|phantomjs|lighthouse|pingdom|uptime|monitor|preview|facebookexternalhit|embedly`)
+
+// analyticsRecord is a line of a day's event file, visitors are a hash that can't be
+// linked to the visitor's hash on any other day
+type analyticsRecord struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Path     string    `json:"path"`
+	Referrer string    `json:"referrer,omitempty"`
+	Name     string    `json:"name,omitempty"`
+	Category string    `json:"category,omitempty"`
+	Label    string    `json:"label,omitempty"`
+	Value    *float64  `json:"value,omitempty"`
+	Visitor  string    `json:"visitor,omitempty"`
+}
+
+type AnalyticsPage struct {
+	Path      string `json:"path"`
+	Pageviews int    `json:"pageviews"`
+	Visitors  int    `json:"visitors"`
+}
+
+type AnalyticsCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// analyticsRollup is what is kept of a day once its events are deleted
+type analyticsRollup struct {
+	Date       string                    `json:"date"`
+	Pageviews  int                       `json:"pageviews"`
+	Visitors   int                       `json:"visitors"`
+	Events     int                       `json:"events"`
+	Bots       int                       `json:"bots"`
+	Pages      map[string]*AnalyticsPage `json:"pages"`
+	Referrers  map[string]int            `json:"referrers"`
+	EventNames map[string]int            `json:"event_names"`
+}
+
+func newAnalyticsRollup(date string) *analyticsRollup {
+	return &analyticsRollup{
+		Date:       date,
+		Pages:      make(map[string]*AnalyticsPage),
+		Referrers:  make(map[string]int),
+		EventNames: make(map[string]int),
+	}
+}
+
+// analyticsDay is a day's rollup, while the day can still get events its visitors are
+// remembered so each is only counted once
+type analyticsDay struct {
+	rollup       *analyticsRollup
+	visitors     map[string]bool
+	pageVisitors map[string]map[string]bool
+}
+
+func (ad *analyticsDay) final() bool {
+	return ad.visitors == nil
+}
+
+func (ad *analyticsDay) add(record analyticsRecord) {
+	rollup := ad.rollup
+
+	switch record.Type {
+	case analyticsBot:
+		rollup.Bots++
+
+		return
+	case analyticsEvent:
+		rollup.Events++
+
+		name := record.Name
+
+		if _, seen := rollup.EventNames[name]; !seen && len(rollup.EventNames) >= analyticsMaxEventNames {
+			name = analyticsOther
+		}
+
+		rollup.EventNames[name]++
+	case analyticsPageview:
+		rollup.Pageviews++
+
+		path := record.Path
+
+		page, ok := rollup.Pages[path]
+
+		if !ok && len(rollup.Pages) >= analyticsMaxPages {
+			path = analyticsOther
+			page, ok = rollup.Pages[path]
+		}
+
+		if !ok {
+			page = &AnalyticsPage{Path: path}
+
+			rollup.Pages[path] = page
+		}
+
+		page.Pageviews++
+
+		if referrer := record.Referrer; referrer != "" {
+			if _, seen := rollup.Referrers[referrer]; !seen && len(rollup.Referrers) >= analyticsMaxReferrers {
+				referrer = analyticsOther
+			}
+
+			rollup.Referrers[referrer]++
+		}
+
+		visitors, ok := ad.pageVisitors[path]
+
+		if !ok {
+			visitors = make(map[string]bool)
+
+			ad.pageVisitors[path] = visitors
+		}
+
+		if !visitors[record.Visitor] {
+			visitors[record.Visitor] = true
+			page.Visitors++
+		}
+	}
+
+	if !ad.visitors[record.Visitor] {
+		ad.visitors[record.Visitor] = true
+		rollup.Visitors++
+	}
+}
+
+// analyticsSalt is mixed into the day's visitor hashes, it is replaced every day and
+// the old one forgotten so hashes can't be recomputed afterwards
+type analyticsSalt struct {
+	Date string `json:"date"`
+	Salt string `json:"salt"`
+}
+
+// analyticsCollector counts page views and events without cookies, appending them to
+// a file per day and keeping rollups by day, page and referrer
+type analyticsCollector struct {
+	config    func() analyticsConfig
+	days      map[string]*analyticsDay
+	directory string
+	done      chan struct{}
+	mutex     *sync.Mutex
+	salt      analyticsSalt
+	site      func() siteConfig
+	stop      chan struct{}
+	stopOnce  *sync.Once
+}
+
+var analyticsLog = newLogger("analytics")
+
+func newAnalyticsCollector(ctx context.Context, directory string, site func() siteConfig, config func() analyticsConfig) (*analyticsCollector, error) {
+	ac := &analyticsCollector{
+		config:    config,
+		days:      make(map[string]*analyticsDay),
+		directory: directory,
+		done:      make(chan struct{}),
+		mutex:     &sync.Mutex{},
+		site:      site,
+		stop:      make(chan struct{}),
+		stopOnce:  &sync.Once{},
+	}
+
+	if err := readJSONFile(ac.saltPath(), &ac.salt); err != nil {
+		return nil, err
+	}
+
+	fileInfos, err := ioutil.ReadDir(directory)
+
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// Rollups are read first, a day with both was finalized before its events were deleted
+	sort.Slice(fileInfos, func(i, j int) bool {
+		return strings.HasPrefix(fileInfos[i].Name(), "rollup-") && !strings.HasPrefix(fileInfos[j].Name(), "rollup-")
+	})
+
+	for _, fileInfo := range fileInfos {
+		name := fileInfo.Name()
+
+		switch {
+		case strings.HasPrefix(name, "rollup-") && strings.HasSuffix(name, ".json"):
+			rollup := newAnalyticsRollup("")
+
+			if err = readJSONFile(filepath.Join(directory, name), rollup); err != nil {
+				return nil, err
+			}
+
+			ac.days[rollup.Date] = &analyticsDay{rollup: rollup}
+		case strings.HasPrefix(name, "events-") && strings.HasSuffix(name, ".jsonl"):
+			date := strings.TrimSuffix(strings.TrimPrefix(name, "events-"), ".jsonl")
+
+			if _, ok := ac.days[date]; ok {
+				continue
+			}
+
+			if err = ac.replay(ctx, date); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err = ac.finalize(ctx, time.Now()); err != nil {
+		return nil, err
+	}
+
+	return ac, nil
+}
+
+func (ac *analyticsCollector) saltPath() string {
+	return filepath.Join(ac.directory, "salt.json")
+}
+
+func (ac *analyticsCollector) eventsPath(date string) string {
+	return filepath.Join(ac.directory, "events-"+date+".jsonl")
+}
+
+func (ac *analyticsCollector) rollupPath(date string) string {
+	return filepath.Join(ac.directory, "rollup-"+date+".json")
+}
+
+// dayLocked returns the day's rollup, creating it for a day that can still get events
+func (ac *analyticsCollector) dayLocked(date string) *analyticsDay {
+	day, ok := ac.days[date]
+
+	if !ok {
+		day = &analyticsDay{
+			rollup:       newAnalyticsRollup(date),
+			visitors:     make(map[string]bool),
+			pageVisitors: make(map[string]map[string]bool),
+		}
+
+		ac.days[date] = day
+	}
+
+	return day
+}
+
+// replay rebuilds a day's rollup from its event file
+func (ac *analyticsCollector) replay(ctx context.Context, date string) error {
+	events, err := os.Open(ac.eventsPath(date))
+
+	if err != nil {
+		return err
+	}
+
+	defer events.Close()
+
+	day := ac.dayLocked(date)
+	skipped := 0
+
+	scanner := bufio.NewScanner(events)
+
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+
+		if len(line) == 0 {
+			continue
+		}
+
+		var record analyticsRecord
+
+		if err = json.Unmarshal(line, &record); err != nil {
+			skipped++
+
+			continue
+		}
+
+		day.add(record)
+	}
+
+	if skipped != 0 {
+		analyticsLog.warn(ctx, "skipped unreadable events", logFields{
+			"date":    date,
+			"skipped": skipped,
+		})
+	}
+
+	return scanner.Err()
+}
+
+// finalize writes the rollups of days that are over and deletes events and rollups
+// past their retention
+func (ac *analyticsCollector) finalize(ctx context.Context, now time.Time) error {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+
+	today := now.UTC().Format(analyticsDateLayout)
+
+	for date, day := range ac.days {
+		if date >= today || day.final() {
+			continue
+		}
+
+		if err := writeJSONFile(ac.rollupPath(date), day.rollup); err != nil {
+			return err
+		}
+
+		day.visitors = nil
+		day.pageVisitors = nil
+
+		analyticsLog.info(ctx, "finalized analytics rollup", logFields{
+			"date":      date,
+			"pageviews": day.rollup.Pageviews,
+		})
+	}
+
+	config := ac.config()
+	oldestEvents := now.Add(-config.EventRetention).UTC().Format(analyticsDateLayout)
+	oldestRollup := now.Add(-config.RollupRetention).UTC().Format(analyticsDateLayout)
+
+	for date, day := range ac.days {
+		// A day's events go with its rollup, or the day would be replayed after a restart
+		if !day.final() || (date >= oldestEvents && date >= oldestRollup) {
+			continue
+		}
+
+		if err := os.Remove(ac.eventsPath(date)); err == nil {
+			analyticsLog.info(ctx, "deleted expired analytics events", logFields{"date": date})
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+
+		if date >= oldestRollup {
+			continue
+		}
+
+		if err := os.Remove(ac.rollupPath(date)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		delete(ac.days, date)
+
+		analyticsLog.info(ctx, "deleted expired analytics rollup", logFields{"date": date})
+	}
+
+	return nil
+}
+
+// visitorHashLocked identifies a visitor for the day without a cookie, from what
+// their requests carry anyway
+func (ac *analyticsCollector) visitorHashLocked(date, clientIP, userAgent string) (string, error) {
+	if ac.salt.Date != date {
+		salt := make([]byte, 32)
+
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+
+		next := analyticsSalt{Date: date, Salt: hex.EncodeToString(salt)}
+
+		if err := writeJSONFile(ac.saltPath(), next); err != nil {
+			return "", err
+		}
+
+		ac.salt = next
+	}
+
+	sum := sha256.Sum256([]byte(ac.salt.Salt + "\x00" + ac.site().BaseURL + "\x00" + clientIP + "\x00" + userAgent))
+
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+func (ac *analyticsCollector) record(record analyticsRecord, clientIP, userAgent string) error {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+
+	date := record.Time.Format(analyticsDateLayout)
+
+	if record.Type != analyticsBot {
+		visitor, err := ac.visitorHashLocked(date, clientIP, userAgent)
+
+		if err != nil {
+			return err
+		}
+
+		record.Visitor = visitor
+	}
+
+	line, err := json.Marshal(record)
+
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(ac.directory, 0755); err != nil {
+		return err
+	}
+
+	events, err := os.OpenFile(ac.eventsPath(date), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = events.Write(append(line, '\n')); err != nil {
+		events.Close()
+
+		return err
+	}
+
+	if err = events.Close(); err != nil {
+		return err
+	}
+
+	day := ac.dayLocked(date)
+
+	// A day finalized while this event waited on the lock keeps its rollup as written
+	if !day.final() {
+		day.add(record)
+	}
+
+	return nil
+}
+
+// run finalizes each day's rollup once the day is over until the collector is closed
+func (ac *analyticsCollector) run(interval time.Duration) {
+	defer close(ac.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ctx := contextWithRequestID(context.Background(), "analytics-"+newRequestID())
+
+			if err := ac.finalize(ctx, time.Now()); err != nil {
+				analyticsLog.error(ctx, "could not finalize analytics", logFields{"error": err})
+			}
+		case <-ac.stop:
+			return
+		}
+	}
+}
+
+func (ac *analyticsCollector) close(ctx context.Context) error {
+	ac.stopOnce.Do(func() {
+		close(ac.stop)
+	})
+
+	select {
+	case <-ac.done:
+	case <-ctx.Done():
+		analyticsLog.warn(ctx, "timed out waiting for the analytics collector to stop", nil)
+	}
+
+	return nil
+}
+
+func (ac *analyticsCollector) registerRoutes(apiGroup *gin.RouterGroup, limiter gin.HandlerFunc) {
+	apiGroup.POST("/analytics/event", limiter, ac.collect)
+}
+
+func (ac *analyticsCollector) registerAdminRoutes(adminGroup *gin.RouterGroup, keys *apiKeyRoutes) {
+	keys.scoped(adminGroup, http.MethodGet, "/analytics", scopeAnalyticsRead, ac.report)
+}
+
+func (ac *analyticsCollector) isBot(userAgent string) bool {
+	if userAgent == "" || analyticsBotPattern.MatchString(userAgent) {
+		return true
+	}
+
+	lowerUserAgent := strings.ToLower(userAgent)
+
+	for _, botUserAgent := range ac.config().BotUserAgents {
+		if strings.Contains(lowerUserAgent, strings.ToLower(botUserAgent)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// referrerHost keeps only the host of a Referer, without any "www."
+func referrerHost(referrer string) string {
+	referrerURL, err := url.Parse(referrer)
+
+	if err != nil || (referrerURL.Scheme != "http" && referrerURL.Scheme != "https") {
+		return ""
+	}
+
+	return strings.TrimPrefix(strings.ToLower(referrerURL.Hostname()), "www.")
+}
+
+// analyticsReferrer keeps only the host a visitor came from, links within the site are dropped
+func (ac *analyticsCollector) analyticsReferrer(referrer string) string {
+	host := referrerHost(referrer)
+
+	if host == referrerHost(ac.site().BaseURL) {
+		return ""
+	}
+
+	return host
+}
+
+type analyticsEventRequest struct {
+	Type string `json:"type" binding:"required,oneof=pageview event"`
+	// The page's path, any query string or fragment is dropped
+	Path     string `json:"path" binding:"required,startswith=/,max=2000"`
+	Referrer string `json:"referrer" binding:"max=2000"`
+	// Events need a name, the rest mirror Google Analytics' event fields
+	Name     string   `json:"name" binding:"max=100"`
+	Category string   `json:"category" binding:"max=100"`
+	Label    string   `json:"label" binding:"max=200"`
+	Value    *float64 `json:"value"`
+}
+
+// collect records a page view or event, navigator.sendBeacon posts them as text/plain
+func (ac *analyticsCollector) collect(c *gin.Context) {
+	var request analyticsEventRequest
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		abortWithError(c, http.StatusBadRequest, bindingErrorMessage(err))
+
+		return
+	}
+
+	if request.Type == analyticsEvent && request.Name == "" {
+		abortWithError(c, http.StatusBadRequest, "events need a name")
+
+		return
+	}
+
+	// Visitors asking not to be tracked aren't, even anonymously
+	if c.GetHeader("DNT") == "1" {
+		respondWithData(c, nil)
+
+		return
+	}
+
+	path := request.Path
+
+	if end := strings.IndexAny(path, "?#"); end != -1 {
+		path = path[:end]
+	}
+
+	record := analyticsRecord{
+		Time: time.Now().UTC(),
+		Type: request.Type,
+		Path: path,
+	}
+
+	if ac.isBot(c.Request.UserAgent()) {
+		record.Type = analyticsBot
+	} else {
+		record.Referrer = ac.analyticsReferrer(request.Referrer)
+		record.Name = request.Name
+		record.Category = request.Category
+		record.Label = request.Label
+		record.Value = request.Value
+	}
+
+	if err := ac.record(record, clientIP(c), c.Request.UserAgent()); err != nil {
+		analyticsLog.error(c.Request.Context(), "could not record analytics event", logFields{"error": err})
+
+		abortWithError(c, http.StatusInternalServerError, "could not record event")
+
+		return
+	}
+
+	respondWithData(c, nil)
+}
+
+type AnalyticsTotals struct {
+	Pageviews int `json:"pageviews"`
+	Visitors  int `json:"visitors"`
+	Events    int `json:"events"`
+	Bots      int `json:"bots"`
+}
+
+type AnalyticsDay struct {
+	Date string `json:"date"`
+	AnalyticsTotals
+}
+
+// AnalyticsReport sums the days from From to To, visitors are counted per day as
+// visitor hashes don't carry over from one day to the next
+type AnalyticsReport struct {
+	From      string           `json:"from"`
+	To        string           `json:"to"`
+	Totals    AnalyticsTotals  `json:"totals"`
+	Days      []AnalyticsDay   `json:"days"`
+	Pages     []AnalyticsPage  `json:"pages"`
+	Referrers []AnalyticsCount `json:"referrers"`
+	Events    []AnalyticsCount `json:"events"`
+}
+
+type analyticsReportQuery struct {
+	From string `form:"from" json:"from"`
+	To   string `form:"to" json:"to"`
+}
+
+func topAnalyticsCounts(counts map[string]int) []AnalyticsCount {
+	top := make([]AnalyticsCount, 0, len(counts))
+
+	for name, count := range counts {
+		top = append(top, AnalyticsCount{Name: name, Count: count})
+	}
+
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+
+		return top[i].Name < top[j].Name
+	})
+
+	if len(top) > analyticsReportSize {
+		top = top[:analyticsReportSize]
+	}
+
+	return top
+}
+
+// report summarizes the last 30 days unless from and to pick other days
+func (ac *analyticsCollector) report(c *gin.Context) {
+	var request analyticsReportQuery
+
+	if err := c.ShouldBindQuery(&request); err != nil {
+		abortWithError(c, http.StatusBadRequest, bindingErrorMessage(err))
+
+		return
+	}
+
+	to := time.Now().UTC()
+
+	if request.To != "" {
+		parsed, err := time.Parse(analyticsDateLayout, request.To)
+
+		if err != nil {
+			abortWithError(c, http.StatusBadRequest, "to must be a date like 2006-01-02")
+
+			return
+		}
+
+		to = parsed
+	}
+
+	from := to.AddDate(0, 0, -29)
+
+	if request.From != "" {
+		parsed, err := time.Parse(analyticsDateLayout, request.From)
+
+		if err != nil {
+			abortWithError(c, http.StatusBadRequest, "from must be a date like 2006-01-02")
+
+			return
+		}
+
+		from = parsed
+	}
+
+	if from.After(to) || to.Sub(from) > time.Hour*24*366 {
+		abortWithError(c, http.StatusBadRequest, "from must be before to and at most a year apart")
+
+		return
+	}
+
+	report := AnalyticsReport{
+		From: from.Format(analyticsDateLayout),
+		To:   to.Format(analyticsDateLayout),
+		Days: []AnalyticsDay{},
+	}
+
+	pages := make(map[string]*AnalyticsPage)
+	referrers := make(map[string]int)
+	eventNames := make(map[string]int)
+
+	ac.mutex.Lock()
+
+	for date := from; !date.After(to); date = date.AddDate(0, 0, 1) {
+		summary := AnalyticsDay{Date: date.Format(analyticsDateLayout)}
+
+		if day, ok := ac.days[summary.Date]; ok {
+			rollup := day.rollup
+
+			summary.Pageviews = rollup.Pageviews
+			summary.Visitors = rollup.Visitors
+			summary.Events = rollup.Events
+			summary.Bots = rollup.Bots
+
+			for path, page := range rollup.Pages {
+				total, ok := pages[path]
+
+				if !ok {
+					total = &AnalyticsPage{Path: path}
+
+					pages[path] = total
+				}
+
+				total.Pageviews += page.Pageviews
+				total.Visitors += page.Visitors
+			}
+
+			for referrer, count := range rollup.Referrers {
+				referrers[referrer] += count
+			}
+
+			for name, count := range rollup.EventNames {
+				eventNames[name] += count
+			}
+		}
+
+		report.Totals.Pageviews += summary.Pageviews
+		report.Totals.Visitors += summary.Visitors
+		report.Totals.Events += summary.Events
+		report.Totals.Bots += summary.Bots
+
+		report.Days = append(report.Days, summary)
+	}
+
+	ac.mutex.Unlock()
+
+	report.Pages = make([]AnalyticsPage, 0, len(pages))
+
+	for _, page := range pages {
+		report.Pages = append(report.Pages, *page)
+	}
+
+	sort.Slice(report.Pages, func(i, j int) bool {
+		if report.Pages[i].Pageviews != report.Pages[j].Pageviews {
+			return report.Pages[i].Pageviews > report.Pages[j].Pageviews
+		}
+
+		return report.Pages[i].Path < report.Pages[j].Path
+	})
+
+	if len(report.Pages) > analyticsReportSize {
+		report.Pages = report.Pages[:analyticsReportSize]
+	}
+
+	report.Referrers = topAnalyticsCounts(referrers)
+	report.Events = topAnalyticsCounts(eventNames)
+
+	respondWithData(c, report)
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Scopes limit what an API key can do, each admin route API keys may call needs one
+const (
+	scopePlaylistsRefresh = "playlists:refresh"
+	scopePostsRevalidate  = "posts:revalidate"
+	scopeContactRead      = "contact:read"
+	scopeAnalyticsRead    = "analytics:read"
+	scopeLinksRead        = "links:read"
+	scopeLinksWrite       = "links:write"
+)
+
+var apiKeyScopes = []string{
+	scopePlaylistsRefresh,
+	scopePostsRevalidate,
+	scopeContactRead,
+	scopeAnalyticsRead,
+	scopeLinksRead,
+	scopeLinksWrite,
+}
+
+func validAPIKeyScope(scope string) bool {
+	for _, known := range apiKeyScopes {
+		if scope == known {
+			return true
+		}
+	}
+
+	return false
+}
+
+// API keys are "rjk_<id>_<secret>", the ID finds the key without revealing its secret
+const apiKeyPrefix = "rjk_"
+
+// apiKey is a credential for scripts, only a hash of its secret is kept
+type apiKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	SecretHash string     `json:"secret_hash"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+}
+
+func (ak *apiKey) hasScope(scope string) bool {
+	for _, granted := range ak.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+var (
+	errAPIKeyNotFound = errors.New("api key not found")
+	errAPIKeyInvalid  = errors.New("invalid or expired api key")
+)
+
+// Uses of a key are only written down once this has passed since the last recorded use
+const apiKeyUsageResolution = time.Minute
+
+// apiKeyStore keeps keys in one JSON file, reread on each use so keys created or
+// revoked by the apikey command apply to a running server. When keys were last used
+// is kept apart, written only by the server, so the two never overwrite each other.
+type apiKeyStore struct {
+	path      string
+	usagePath string
+	mutex     *sync.Mutex
+	lastUsed  map[string]time.Time
+}
+
+func newAPIKeyStore(directory string) *apiKeyStore {
+	return &apiKeyStore{
+		path:      filepath.Join(directory, "api_keys.json"),
+		usagePath: filepath.Join(directory, "api_key_usage.json"),
+		mutex:     &sync.Mutex{},
+	}
+}
+
+func (aks *apiKeyStore) loadLocked() (map[string]*apiKey, error) {
+	keys := make(map[string]*apiKey)
+
+	if err := readJSONFile(aks.path, &keys); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// update lets modify change the keys and saves them if modify succeeds
+func (aks *apiKeyStore) update(modify func(keys map[string]*apiKey) error) error {
+	aks.mutex.Lock()
+	defer aks.mutex.Unlock()
+
+	keys, err := aks.loadLocked()
+
+	if err != nil {
+		return err
+	}
+
+	if err = modify(keys); err != nil {
+		return err
+	}
+
+	return writeJSONFile(aks.path, keys)
+}
+
+func hashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// create stores a new key, returning it in full, which is the only time it is seen
+func (aks *apiKeyStore) create(name string, scopes []string, expiresAt *time.Time) (string, *apiKey, error) {
+	secret := make([]byte, 32)
+
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+
+	key := &apiKey{
+		ID:         newRequestID(),
+		Name:       name,
+		SecretHash: hashAPIKeySecret(hex.EncodeToString(secret)),
+		Scopes:     scopes,
+		CreatedAt:  time.Now().UTC(),
+		ExpiresAt:  expiresAt,
+	}
+
+	err := aks.update(func(keys map[string]*apiKey) error {
+		keys[key.ID] = key
+
+		return nil
+	})
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	return apiKeyPrefix + key.ID + "_" + hex.EncodeToString(secret), key, nil
+}
+
+func (aks *apiKeyStore) revoke(keyID string) error {
+	return aks.update(func(keys map[string]*apiKey) error {
+		if _, ok := keys[keyID]; !ok {
+			return errAPIKeyNotFound
+		}
+
+		delete(keys, keyID)
+
+		return nil
+	})
+}
+
+type apiKeyListing struct {
+	apiKey
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// list returns every key, oldest first
+func (aks *apiKeyStore) list() ([]apiKeyListing, error) {
+	aks.mutex.Lock()
+	defer aks.mutex.Unlock()
+
+	keys, err := aks.loadLocked()
+
+	if err != nil {
+		return nil, err
+	}
+
+	lastUsed := make(map[string]time.Time)
+
+	if err = readJSONFile(aks.usagePath, &lastUsed); err != nil {
+		return nil, err
+	}
+
+	listings := make([]apiKeyListing, 0, len(keys))
+
+	for _, key := range keys {
+		listing := apiKeyListing{apiKey: *key}
+
+		if usedAt, ok := lastUsed[key.ID]; ok {
+			listing.LastUsedAt = &usedAt
+		}
+
+		listings = append(listings, listing)
+	}
+
+	sort.Slice(listings, func(i, j int) bool {
+		return listings[i].CreatedAt.Before(listings[j].CreatedAt)
+	})
+
+	return listings, nil
+}
+
+// authenticate returns the key token is, recording that it was used
+func (aks *apiKeyStore) authenticate(ctx context.Context, token string, now time.Time) (*apiKey, error) {
+	tokenParts := strings.SplitN(strings.TrimPrefix(token, apiKeyPrefix), "_", 2)
+
+	if !strings.HasPrefix(token, apiKeyPrefix) || len(tokenParts) != 2 || !validRecordID(tokenParts[0]) {
+		return nil, errAPIKeyInvalid
+	}
+
+	aks.mutex.Lock()
+	defer aks.mutex.Unlock()
+
+	keys, err := aks.loadLocked()
+
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := keys[tokenParts[0]]
+
+	if !ok || subtle.ConstantTimeCompare([]byte(hashAPIKeySecret(tokenParts[1])), []byte(key.SecretHash)) != 1 {
+		return nil, errAPIKeyInvalid
+	}
+
+	if key.ExpiresAt != nil && !now.Before(*key.ExpiresAt) {
+		return nil, errAPIKeyInvalid
+	}
+
+	if aks.lastUsed == nil {
+		aks.lastUsed = make(map[string]time.Time)
+
+		if err = readJSONFile(aks.usagePath, &aks.lastUsed); err != nil {
+			return nil, err
+		}
+	}
+
+	if now.Sub(aks.lastUsed[key.ID]) >= apiKeyUsageResolution {
+		aks.lastUsed[key.ID] = now.UTC()
+
+		// Revoked keys are dropped from the usage file as it is rewritten
+		for keyID := range aks.lastUsed {
+			if _, exists := keys[keyID]; !exists {
+				delete(aks.lastUsed, keyID)
+			}
+		}
+
+		if err = writeJSONFile(aks.usagePath, aks.lastUsed); err != nil {
+			apiKeysLog.warn(ctx, "could not record api key use", logFields{"error": err})
+		}
+	}
+
+	return key, nil
+}
+
+var apiKeysLog = newLogger("apikeys")
+
+// apiKeyRoutes knows which admin routes API keys may call and with what scope
+type apiKeyRoutes struct {
+	keys   *apiKeyStore
+	scopes map[string]string
+}
+
+func newAPIKeyRoutes(keys *apiKeyStore) *apiKeyRoutes {
+	return &apiKeyRoutes{
+		keys:   keys,
+		scopes: make(map[string]string),
+	}
+}
+
+// scoped registers an admin route that API keys with scope may call as well
+func (akr *apiKeyRoutes) scoped(group *gin.RouterGroup, method, path, scope string, handlers ...gin.HandlerFunc) {
+	akr.scopes[method+" "+group.BasePath()+path] = scope
+
+	group.Handle(method, path, handlers...)
+}
+
+// authorize checks an API key against the scope of the matched route, aborting the
+// request if the key is invalid or not allowed to use the route
+func (akr *apiKeyRoutes) authorize(c *gin.Context, token string) bool {
+	key, err := akr.keys.authenticate(c.Request.Context(), token, time.Now())
+
+	if err == errAPIKeyInvalid {
+		abortWithError(c, http.StatusUnauthorized, "unauthorized")
+
+		return false
+	}
+
+	if err != nil {
+		apiKeysLog.error(c.Request.Context(), "could not check api key", logFields{"error": err})
+
+		abortWithError(c, http.StatusInternalServerError, "could not check api key")
+
+		return false
+	}
+
+	scope, ok := akr.scopes[c.Request.Method+" "+c.FullPath()]
+
+	if !ok || !key.hasScope(scope) {
+		apiKeysLog.warn(c.Request.Context(), "api key used beyond its scopes", logFields{
+			"key":  key.ID,
+			"path": c.FullPath(),
+		})
+
+		abortWithError(c, http.StatusForbidden, "api key is not allowed to use this route")
+
+		return false
+	}
+
+	c.Set(adminActorKey, "api-key:"+key.Name)
+
+	return true
+}
@@ -0,0 +1,633 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type articlesConfig struct {
+	// Higher gravity makes articles fall out of the hottest feed sooner, Hacker News uses 1.8
+	HotGravity float64 `yaml:"hot_gravity" env:"ARTICLES_HOT_GRAVITY" validate:"gt=0" reload:"true"`
+}
+
+func defaultArticlesConfig() articlesConfig {
+	return articlesConfig{
+		HotGravity: 1.8,
+	}
+}
+
+type ArticleVotes struct {
+	Up    int `json:"up"`
+	Down  int `json:"down"`
+	Score int `json:"score"`
+}
+
+// Article is a post in an article feed along with its votes
+type Article struct {
+	Slug          string       `json:"slug"`
+	Title         string       `json:"title"`
+	Excerpt       string       `json:"excerpt"`
+	FeatureImage  *string      `json:"feature_image"`
+	Featured      bool         `json:"featured"`
+	ReadingTime   int          `json:"reading_time"`
+	PublishedAt   time.Time    `json:"published_at"`
+	Tags          []PostTag    `json:"tags"`
+	PrimaryAuthor *PostAuthor  `json:"primary_author"`
+	Votes         ArticleVotes `json:"votes"`
+	HotScore      float64      `json:"hot_score"`
+	// The requesting visitor's vote, 0 when they haven't voted or sent no visitor token
+	Vote int `json:"vote"`
+}
+
+type ArticleFeed struct {
+	Articles   []Article  `json:"articles"`
+	Pagination Pagination `json:"pagination"`
+}
+
+type ArticleVoteResult struct {
+	Slug  string       `json:"slug"`
+	Vote  int          `json:"vote"`
+	Votes ArticleVotes `json:"votes"`
+}
+
+type VisitorToken struct {
+	VisitorToken string `json:"visitor_token"`
+}
+
+// articleVote is a line of the vote journal, a vote of 0 withdraws the visitor's vote
+type articleVote struct {
+	Time    time.Time `json:"time"`
+	Slug    string    `json:"slug"`
+	Visitor string    `json:"visitor"`
+	Vote    int       `json:"vote"`
+}
+
+// articleVoteStore appends every vote to a journal that is replayed on startup,
+// votes that were later changed are dropped from it when it has grown enough
+type articleVoteStore struct {
+	path    string
+	mutex   *sync.RWMutex
+	tallies map[string]ArticleVotes
+	votes   map[string]map[string]articleVote
+}
+
+var articlesLog = newLogger("articles")
+
+func loadArticleVoteStore(ctx context.Context, path string) (*articleVoteStore, error) {
+	avs := &articleVoteStore{
+		path:    path,
+		mutex:   &sync.RWMutex{},
+		tallies: make(map[string]ArticleVotes),
+		votes:   make(map[string]map[string]articleVote),
+	}
+
+	journal, err := os.Open(path)
+
+	if os.IsNotExist(err) {
+		return avs, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer journal.Close()
+
+	lines, skipped, live := 0, 0, 0
+
+	scanner := bufio.NewScanner(journal)
+
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+
+		if len(line) == 0 {
+			continue
+		}
+
+		lines++
+
+		var vote articleVote
+
+		// A line cut short by a crash is all that is lost of it
+		if err = json.Unmarshal(line, &vote); err != nil {
+			skipped++
+
+			continue
+		}
+
+		avs.applyLocked(vote)
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, visitors := range avs.votes {
+		live += len(visitors)
+	}
+
+	if skipped != 0 {
+		articlesLog.warn(ctx, "skipped unreadable votes", logFields{"skipped": skipped})
+	}
+
+	if lines > 2*live+64 {
+		if err = avs.compactLocked(); err != nil {
+			return nil, err
+		}
+
+		articlesLog.info(ctx, "compacted vote journal", logFields{
+			"lines": lines,
+			"votes": live,
+		})
+	}
+
+	return avs, nil
+}
+
+func (avs *articleVoteStore) applyLocked(vote articleVote) {
+	visitors, ok := avs.votes[vote.Slug]
+
+	if !ok {
+		visitors = make(map[string]articleVote)
+
+		avs.votes[vote.Slug] = visitors
+	}
+
+	tally := avs.tallies[vote.Slug]
+
+	switch visitors[vote.Visitor].Vote {
+	case 1:
+		tally.Up--
+	case -1:
+		tally.Down--
+	}
+
+	switch vote.Vote {
+	case 1:
+		tally.Up++
+	case -1:
+		tally.Down++
+	}
+
+	tally.Score = tally.Up - tally.Down
+
+	if vote.Vote == 0 {
+		delete(visitors, vote.Visitor)
+	} else {
+		visitors[vote.Visitor] = vote
+	}
+
+	if len(visitors) == 0 {
+		delete(avs.votes, vote.Slug)
+		delete(avs.tallies, vote.Slug)
+	} else {
+		avs.tallies[vote.Slug] = tally
+	}
+}
+
+// compactLocked rewrites the journal with only the votes that still count
+func (avs *articleVoteStore) compactLocked() error {
+	var journal bytes.Buffer
+
+	for _, visitors := range avs.votes {
+		for _, vote := range visitors {
+			line, err := json.Marshal(vote)
+
+			if err != nil {
+				return err
+			}
+
+			journal.Write(append(line, '\n'))
+		}
+	}
+
+	return writeFileAtomic(avs.path, journal.Bytes())
+}
+
+func (avs *articleVoteStore) appendLocked(vote articleVote) error {
+	line, err := json.Marshal(vote)
+
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(avs.path), 0755); err != nil {
+		return err
+	}
+
+	journal, err := os.OpenFile(avs.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = journal.Write(append(line, '\n')); err != nil {
+		journal.Close()
+
+		return err
+	}
+
+	return journal.Close()
+}
+
+// cast records the visitor's vote on the article, replacing any earlier vote of theirs
+func (avs *articleVoteStore) cast(slug, visitor string, vote int) (ArticleVotes, error) {
+	avs.mutex.Lock()
+	defer avs.mutex.Unlock()
+
+	if avs.votes[slug][visitor].Vote == vote {
+		return avs.tallies[slug], nil
+	}
+
+	record := articleVote{
+		Time:    time.Now().UTC(),
+		Slug:    slug,
+		Visitor: visitor,
+		Vote:    vote,
+	}
+
+	// The journal is written first so a vote is never counted without being kept
+	if err := avs.appendLocked(record); err != nil {
+		return ArticleVotes{}, err
+	}
+
+	avs.applyLocked(record)
+
+	return avs.tallies[slug], nil
+}
+
+// talliesFor returns the votes on each article and the visitor's own votes
+func (avs *articleVoteStore) talliesFor(slugs []string, visitor string) ([]ArticleVotes, []int) {
+	avs.mutex.RLock()
+	defer avs.mutex.RUnlock()
+
+	tallies := make([]ArticleVotes, len(slugs))
+	visitorVotes := make([]int, len(slugs))
+
+	for index, slug := range slugs {
+		tallies[index] = avs.tallies[slug]
+
+		if visitor != "" {
+			visitorVotes[index] = avs.votes[slug][visitor].Vote
+		}
+	}
+
+	return tallies, visitorVotes
+}
+
+// hotScore ranks articles the way Hacker News does, every article starts with one
+// point so unvoted articles still sink with age and disliked ones sink below them
+func hotScore(votes ArticleVotes, publishedAt time.Time, now time.Time, gravity float64) float64 {
+	ageHours := math.Max(now.Sub(publishedAt).Hours(), 0)
+
+	return float64(votes.Score+1) / math.Pow(ageHours+2, gravity)
+}
+
+// articleFeeds lists Ghost posts as articles readers can vote on, voters are
+// anonymous and identified only by a signed visitor token, which is the same for
+// every request from one browser on one network
+type articleFeeds struct {
+	config        func() articlesConfig
+	posts         *postService
+	visitorSecret []byte
+	votes         *articleVoteStore
+}
+
+type articleSecrets struct {
+	VisitorSecret string `json:"visitor_secret"`
+}
+
+func newArticleFeeds(ctx context.Context, directory string, posts *postService, config func() articlesConfig) (*articleFeeds, error) {
+	votes, err := loadArticleVoteStore(ctx, filepath.Join(directory, "votes.log"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Unlike contact form tokens, visitor tokens must survive restarts or everyone could vote again
+	var secrets articleSecrets
+
+	secretsPath := filepath.Join(directory, "secrets.json")
+
+	if err = readJSONFile(secretsPath, &secrets); err != nil {
+		return nil, err
+	}
+
+	if secrets.VisitorSecret == "" {
+		visitorSecret := make([]byte, 32)
+
+		if _, err = rand.Read(visitorSecret); err != nil {
+			return nil, err
+		}
+
+		secrets.VisitorSecret = hex.EncodeToString(visitorSecret)
+
+		if err = writeJSONFile(secretsPath, secrets); err != nil {
+			return nil, err
+		}
+	}
+
+	visitorSecret, err := hex.DecodeString(secrets.VisitorSecret)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &articleFeeds{
+		config:        config,
+		posts:         posts,
+		visitorSecret: visitorSecret,
+		votes:         votes,
+	}, nil
+}
+
+func (af *articleFeeds) registerRoutes(apiGroup *gin.RouterGroup, voteLimiter gin.HandlerFunc) {
+	apiGroup.POST("/n/article/feed/latest", af.handleFeed(false))
+	apiGroup.POST("/n/article/feed/hottest", af.handleFeed(true))
+	apiGroup.POST("/n/article/visitor", voteLimiter, af.issueVisitorToken)
+	apiGroup.POST("/n/article/vote", voteLimiter, af.handleVote)
+}
+
+func (af *articleFeeds) signVisitor(visitor string) string {
+	mac := hmac.New(sha256.New, af.visitorSecret)
+
+	mac.Write([]byte(visitor))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+var errInvalidVisitorToken = errors.New("invalid visitor token")
+
+// visitorFromToken checks the token's signature, returning the visitor it was issued to
+func (af *articleFeeds) visitorFromToken(visitorToken string) (string, error) {
+	tokenParts := strings.SplitN(visitorToken, ".", 2)
+
+	if len(tokenParts) != 2 || !validRecordID(tokenParts[0]) || !hmac.Equal([]byte(af.signVisitor(tokenParts[0])), []byte(tokenParts[1])) {
+		return "", errInvalidVisitorToken
+	}
+
+	return tokenParts[0], nil
+}
+
+// visitorFor derives the visitor from the client's address and user agent, so asking
+// for token after token still only gets one vote per browser and network
+func (af *articleFeeds) visitorFor(clientIP, userAgent string) string {
+	mac := hmac.New(sha256.New, af.visitorSecret)
+
+	mac.Write([]byte("visitor\x00" + clientIP + "\x00" + userAgent))
+
+	return hex.EncodeToString(mac.Sum(nil)[:12])
+}
+
+func (af *articleFeeds) issueVisitorToken(c *gin.Context) {
+	visitor := af.visitorFor(clientIP(c), c.Request.UserAgent())
+
+	respondWithData(c, VisitorToken{VisitorToken: visitor + "." + af.signVisitor(visitor)})
+}
+
+type articleFeedRequest struct {
+	Page         int    `json:"page" binding:"omitempty,min=1"`
+	Limit        int    `json:"limit" binding:"omitempty,min=1,max=50"`
+	Tag          string `json:"tag"`
+	VisitorToken string `json:"visitor_token"`
+}
+
+func (af *articleFeeds) handleFeed(hottest bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request articleFeedRequest
+
+		// The body is optional, an empty one asks for the first page
+		if err := c.ShouldBindJSON(&request); err != nil && err != io.EOF {
+			abortWithError(c, http.StatusBadRequest, bindingErrorMessage(err))
+
+			return
+		}
+
+		if request.Tag != "" && !validSlug(request.Tag) {
+			abortWithError(c, http.StatusBadRequest, "tag must be a slug")
+
+			return
+		}
+
+		if request.Page == 0 {
+			request.Page = 1
+		}
+
+		if request.Limit == 0 {
+			request.Limit = 15
+		}
+
+		visitor := ""
+
+		if request.VisitorToken != "" {
+			var err error
+
+			if visitor, err = af.visitorFromToken(request.VisitorToken); err != nil {
+				abortWithError(c, http.StatusBadRequest, err.Error())
+
+				return
+			}
+		}
+
+		posts, cacheStatus, err := af.posts.listAllPosts(c.Request.Context())
+
+		if err != nil {
+			abortWithError(c, http.StatusBadGateway, "articles are unavailable right now")
+
+			return
+		}
+
+		var tagged []Post
+
+		for _, post := range posts {
+			if request.Tag == "" || postHasTag(post, request.Tag) {
+				tagged = append(tagged, post)
+			}
+		}
+
+		slugs := make([]string, len(tagged))
+
+		for index, post := range tagged {
+			slugs[index] = post.Slug
+		}
+
+		tallies, visitorVotes := af.votes.talliesFor(slugs, visitor)
+
+		now := time.Now()
+		gravity := af.config().HotGravity
+
+		articles := make([]Article, len(tagged))
+
+		for index, post := range tagged {
+			articles[index] = Article{
+				Slug:          post.Slug,
+				Title:         post.Title,
+				Excerpt:       postSummary(post),
+				FeatureImage:  post.FeatureImage,
+				Featured:      post.Featured,
+				ReadingTime:   post.ReadingTime,
+				PublishedAt:   post.PublishedAt,
+				Tags:          post.Tags,
+				PrimaryAuthor: post.PrimaryAuthor,
+				Votes:         tallies[index],
+				HotScore:      hotScore(tallies[index], post.PublishedAt, now, gravity),
+				Vote:          visitorVotes[index],
+			}
+		}
+
+		// Ghost already lists posts newest first, which is the latest feed
+		if hottest {
+			sort.SliceStable(articles, func(i, j int) bool {
+				return articles[i].HotScore > articles[j].HotScore
+			})
+		}
+
+		c.Header("X-Cache", cacheStatus)
+
+		respondWithData(c, paginateArticles(articles, request.Page, request.Limit))
+	}
+}
+
+func postHasTag(post Post, tag string) bool {
+	for _, postTag := range post.Tags {
+		if postTag.Slug == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// paginateArticles cuts a page out of articles, paginated the same way Ghost paginates posts
+func paginateArticles(articles []Article, page, limit int) ArticleFeed {
+	pagination := Pagination{
+		Page:  page,
+		Limit: limit,
+		Pages: (len(articles) + limit - 1) / limit,
+		Total: len(articles),
+	}
+
+	if page < pagination.Pages {
+		next := page + 1
+
+		pagination.Next = &next
+	}
+
+	if page > 1 {
+		prev := page - 1
+
+		pagination.Prev = &prev
+	}
+
+	start := (page - 1) * limit
+
+	if start > len(articles) {
+		start = len(articles)
+	}
+
+	end := start + limit
+
+	if end > len(articles) {
+		end = len(articles)
+	}
+
+	return ArticleFeed{
+		Articles:   articles[start:end],
+		Pagination: pagination,
+	}
+}
+
+type articleVoteRequest struct {
+	Slug string `json:"slug" binding:"required"`
+	// 1 up, -1 down and 0 to withdraw a vote
+	Vote         *int   `json:"vote" binding:"required,min=-1,max=1"`
+	VisitorToken string `json:"visitor_token" binding:"required"`
+}
+
+func (af *articleFeeds) handleVote(c *gin.Context) {
+	var request articleVoteRequest
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		abortWithError(c, http.StatusBadRequest, bindingErrorMessage(err))
+
+		return
+	}
+
+	visitor, err := af.visitorFromToken(request.VisitorToken)
+
+	if err != nil {
+		abortWithError(c, http.StatusUnauthorized, err.Error())
+
+		return
+	}
+
+	if !validSlug(request.Slug) {
+		abortWithError(c, http.StatusNotFound, "article not found")
+
+		return
+	}
+
+	ctx := c.Request.Context()
+
+	// Votes are only kept for articles that exist, so the journal can't be filled with made up slugs
+	posts, _, err := af.posts.listAllPosts(ctx)
+
+	if err != nil {
+		abortWithError(c, http.StatusBadGateway, "articles are unavailable right now")
+
+		return
+	}
+
+	found := false
+
+	for _, post := range posts {
+		if post.Slug == request.Slug {
+			found = true
+
+			break
+		}
+	}
+
+	if !found {
+		abortWithError(c, http.StatusNotFound, "article not found")
+
+		return
+	}
+
+	votes, err := af.votes.cast(request.Slug, visitor, *request.Vote)
+
+	if err != nil {
+		articlesLog.error(ctx, "could not record vote", logFields{
+			"slug":  request.Slug,
+			"error": err,
+		})
+
+		abortWithError(c, http.StatusInternalServerError, "could not record vote")
+
+		return
+	}
+
+	respondWithData(c, ArticleVoteResult{
+		Slug:  request.Slug,
+		Vote:  *request.Vote,
+		Votes: votes,
+	})
+}
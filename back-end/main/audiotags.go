@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// audioTags is the subset of ID3/FLAC metadata used to describe local tracks
+type audioTags struct {
+	Title  string
+	Artist string
+	Album  string
+	Genre  string
+	// Duration in milliseconds, zero when the file does not declare it
+	Duration int64
+}
+
+var errNoAudioTags = errors.New("no supported tags found")
+
+// readAudioTags reads ID3v2, ID3v1 or FLAC Vorbis comment tags from the file at path
+func readAudioTags(path string) (audioTags, error) {
+	audioFile, err := os.Open(path)
+
+	if err != nil {
+		return audioTags{}, err
+	}
+
+	defer audioFile.Close()
+
+	magic := make([]byte, 4)
+
+	if _, err = io.ReadFull(audioFile, magic); err != nil {
+		return audioTags{}, err
+	}
+
+	if _, err = audioFile.Seek(0, io.SeekStart); err != nil {
+		return audioTags{}, err
+	}
+
+	switch {
+	case string(magic) == "fLaC":
+		return readFLACTags(audioFile)
+	case string(magic[:3]) == "ID3":
+		tags, err := readID3v2Tags(audioFile)
+
+		if err == nil && tags.Title != "" {
+			return tags, nil
+		}
+	}
+
+	return readID3v1Tags(audioFile)
+}
+
+func readID3v2Tags(reader io.Reader) (audioTags, error) {
+	header := make([]byte, 10)
+
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return audioTags{}, err
+	}
+
+	majorVersion := header[3]
+	flags := header[5]
+	tagSize := syncsafeInt(header[6:10])
+
+	if majorVersion < 2 || majorVersion > 4 {
+		return audioTags{}, errors.New("unsupported ID3v2 version " + strconv.Itoa(int(majorVersion)))
+	}
+
+	tagBytes := make([]byte, tagSize)
+
+	if _, err := io.ReadFull(reader, tagBytes); err != nil {
+		return audioTags{}, err
+	}
+
+	// Skip the extended header, v2.3 excludes the size field from its length while v2.4 includes it
+	if flags&0x40 != 0 && majorVersion >= 3 && len(tagBytes) >= 4 {
+		var extendedSize int
+
+		if majorVersion == 4 {
+			extendedSize = syncsafeInt(tagBytes[:4])
+		} else {
+			extendedSize = int(binary.BigEndian.Uint32(tagBytes[:4])) + 4
+		}
+
+		if extendedSize > len(tagBytes) {
+			return audioTags{}, errors.New("malformed ID3v2 extended header")
+		}
+
+		tagBytes = tagBytes[extendedSize:]
+	}
+
+	idLength, headerLength := 4, 10
+
+	if majorVersion == 2 {
+		idLength, headerLength = 3, 6
+	}
+
+	var tags audioTags
+
+	for len(tagBytes) >= headerLength && tagBytes[0] != 0 {
+		frameID := string(tagBytes[:idLength])
+
+		var frameSize int
+
+		switch majorVersion {
+		case 2:
+			frameSize = int(tagBytes[3])<<16 | int(tagBytes[4])<<8 | int(tagBytes[5])
+		case 3:
+			frameSize = int(binary.BigEndian.Uint32(tagBytes[4:8]))
+		default:
+			frameSize = syncsafeInt(tagBytes[4:8])
+		}
+
+		if frameSize < 0 || headerLength+frameSize > len(tagBytes) {
+			break
+		}
+
+		frameBody := tagBytes[headerLength : headerLength+frameSize]
+		tagBytes = tagBytes[headerLength+frameSize:]
+
+		switch frameID {
+		case "TIT2", "TT2":
+			tags.Title = decodeID3Text(frameBody)
+		case "TPE1", "TP1":
+			tags.Artist = decodeID3Text(frameBody)
+		case "TALB", "TAL":
+			tags.Album = decodeID3Text(frameBody)
+		case "TCON", "TCO":
+			tags.Genre = cleanID3Genre(decodeID3Text(frameBody))
+		case "TLEN", "TLE":
+			if milliseconds, err := strconv.ParseInt(decodeID3Text(frameBody), 10, 64); err == nil {
+				tags.Duration = milliseconds
+			}
+		}
+	}
+
+	if tags == (audioTags{}) {
+		return tags, errNoAudioTags
+	}
+
+	return tags, nil
+}
+
+func syncsafeInt(sizeBytes []byte) int {
+	size := 0
+
+	for _, sizeByte := range sizeBytes {
+		size = size<<7 | int(sizeByte&0x7f)
+	}
+
+	return size
+}
+
+// decodeID3Text decodes a text frame body, the first byte declares the encoding
+func decodeID3Text(frameBody []byte) string {
+	if len(frameBody) == 0 {
+		return ""
+	}
+
+	text := frameBody[1:]
+
+	var decoded string
+
+	switch frameBody[0] {
+	case 0:
+		decoded = decodeLatin1(text)
+	case 1:
+		decoded = decodeUTF16(text, true)
+	case 2:
+		decoded = decodeUTF16(text, false)
+	default:
+		decoded = string(text)
+	}
+
+	// Multiple values are null separated, only the first is kept
+	if nullIndex := strings.IndexRune(decoded, 0); nullIndex != -1 {
+		decoded = decoded[:nullIndex]
+	}
+
+	return strings.TrimSpace(decoded)
+}
+
+func decodeLatin1(text []byte) string {
+	runes := make([]rune, len(text))
+
+	for index, char := range text {
+		runes[index] = rune(char)
+	}
+
+	return string(runes)
+}
+
+func decodeUTF16(text []byte, hasBOM bool) string {
+	bigEndian := true
+
+	if hasBOM && len(text) >= 2 {
+		bigEndian = !(text[0] == 0xff && text[1] == 0xfe)
+		text = text[2:]
+	}
+
+	units := make([]uint16, 0, len(text)/2)
+
+	for index := 0; index+1 < len(text); index += 2 {
+		if bigEndian {
+			units = append(units, binary.BigEndian.Uint16(text[index:]))
+		} else {
+			units = append(units, binary.LittleEndian.Uint16(text[index:]))
+		}
+	}
+
+	return string(utf16.Decode(units))
+}
+
+// cleanID3Genre resolves genres stored as "(17)" references into the ID3v1 genre list
+func cleanID3Genre(genre string) string {
+	if strings.HasPrefix(genre, "(") {
+		if closeIndex := strings.Index(genre, ")"); closeIndex != -1 {
+			if genreIndex, err := strconv.Atoi(genre[1:closeIndex]); err == nil {
+				if remainder := strings.TrimSpace(genre[closeIndex+1:]); remainder != "" {
+					return remainder
+				}
+
+				return id3v1Genre(genreIndex)
+			}
+		}
+	}
+
+	if genreIndex, err := strconv.Atoi(genre); err == nil {
+		return id3v1Genre(genreIndex)
+	}
+
+	return genre
+}
+
+var id3v1Genres = []string{
+	"Blues", "Classic Rock", "Country", "Dance", "Disco", "Funk", "Grunge", "Hip-Hop", "Jazz", "Metal",
+	"New Age", "Oldies", "Other", "Pop", "R&B", "Rap", "Reggae", "Rock", "Techno", "Industrial",
+	"Alternative", "Ska", "Death Metal", "Pranks", "Soundtrack", "Euro-Techno", "Ambient", "Trip-Hop", "Vocal", "Jazz+Funk",
+	"Fusion", "Trance", "Classical", "Instrumental", "Acid", "House", "Game", "Sound Clip", "Gospel", "Noise",
+	"AlternRock", "Bass", "Soul", "Punk", "Space", "Meditative", "Instrumental Pop", "Instrumental Rock", "Ethnic", "Gothic",
+	"Darkwave", "Techno-Industrial", "Electronic", "Pop-Folk", "Eurodance", "Dream", "Southern Rock", "Comedy", "Cult", "Gangsta",
+	"Top 40", "Christian Rap", "Pop/Funk", "Jungle", "Native American", "Cabaret", "New Wave", "Psychadelic", "Rave", "Showtunes",
+	"Trailer", "Lo-Fi", "Tribal", "Acid Punk", "Acid Jazz", "Polka", "Retro", "Musical", "Rock & Roll", "Hard Rock",
+}
+
+func id3v1Genre(genreIndex int) string {
+	if genreIndex < 0 || genreIndex >= len(id3v1Genres) {
+		return ""
+	}
+
+	return id3v1Genres[genreIndex]
+}
+
+func readID3v1Tags(audioFile io.ReadSeeker) (audioTags, error) {
+	if _, err := audioFile.Seek(-128, io.SeekEnd); err != nil {
+		return audioTags{}, errNoAudioTags
+	}
+
+	tagBytes := make([]byte, 128)
+
+	if _, err := io.ReadFull(audioFile, tagBytes); err != nil {
+		return audioTags{}, err
+	}
+
+	if string(tagBytes[:3]) != "TAG" {
+		return audioTags{}, errNoAudioTags
+	}
+
+	field := func(start, end int) string {
+		return strings.TrimSpace(decodeLatin1(bytes.TrimRight(tagBytes[start:end], "\x00 ")))
+	}
+
+	return audioTags{
+		Title:  field(3, 33),
+		Artist: field(33, 63),
+		Album:  field(63, 93),
+		Genre:  id3v1Genre(int(tagBytes[127])),
+	}, nil
+}
+
+// readFLACTags reads the STREAMINFO and VORBIS_COMMENT metadata blocks, the rest,
+// embedded cover art especially, are skipped without being read
+func readFLACTags(reader io.ReadSeeker) (audioTags, error) {
+	magic := make([]byte, 4)
+
+	if _, err := io.ReadFull(reader, magic); err != nil {
+		return audioTags{}, err
+	}
+
+	var tags audioTags
+
+	blockHeader := make([]byte, 4)
+
+	for {
+		if _, err := io.ReadFull(reader, blockHeader); err != nil {
+			return tags, err
+		}
+
+		isLastBlock := blockHeader[0]&0x80 != 0
+		blockType := blockHeader[0] & 0x7f
+		blockLength := int(blockHeader[1])<<16 | int(blockHeader[2])<<8 | int(blockHeader[3])
+
+		var block []byte
+
+		if blockType == 0 || blockType == 4 {
+			block = make([]byte, blockLength)
+
+			if _, err := io.ReadFull(reader, block); err != nil {
+				return tags, err
+			}
+		} else if _, err := reader.Seek(int64(blockLength), io.SeekCurrent); err != nil {
+			return tags, err
+		}
+
+		switch blockType {
+		case 0:
+			if len(block) >= 18 {
+				// Sample rate is 20 bits starting at byte 10, total samples the low 36 bits of bytes 13-17
+				sampleRate := int64(block[10])<<12 | int64(block[11])<<4 | int64(block[12])>>4
+				totalSamples := int64(block[13]&0x0f)<<32 | int64(binary.BigEndian.Uint32(block[14:18]))
+
+				if sampleRate != 0 {
+					tags.Duration = totalSamples * 1000 / sampleRate
+				}
+			}
+		case 4:
+			applyVorbisComments(&tags, block)
+		}
+
+		if isLastBlock {
+			break
+		}
+	}
+
+	if tags.Title == "" && tags.Artist == "" {
+		return tags, errNoAudioTags
+	}
+
+	return tags, nil
+}
+
+func applyVorbisComments(tags *audioTags, block []byte) {
+	readUint32 := func() (int, bool) {
+		if len(block) < 4 {
+			return 0, false
+		}
+
+		value := int(binary.LittleEndian.Uint32(block[:4]))
+		block = block[4:]
+
+		return value, true
+	}
+
+	vendorLength, ok := readUint32()
+
+	if !ok || vendorLength > len(block) {
+		return
+	}
+
+	block = block[vendorLength:]
+
+	commentCount, ok := readUint32()
+
+	if !ok {
+		return
+	}
+
+	for commentIndex := 0; commentIndex < commentCount; commentIndex++ {
+		commentLength, ok := readUint32()
+
+		if !ok || commentLength > len(block) {
+			return
+		}
+
+		comment := string(block[:commentLength])
+		block = block[commentLength:]
+
+		equalsIndex := strings.Index(comment, "=")
+
+		if equalsIndex == -1 {
+			continue
+		}
+
+		value := strings.TrimSpace(comment[equalsIndex+1:])
+
+		switch strings.ToUpper(comment[:equalsIndex]) {
+		case "TITLE":
+			tags.Title = value
+		case "ARTIST":
+			tags.Artist = value
+		case "ALBUM":
+			tags.Album = value
+		case "GENRE":
+			tags.Genre = value
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// countingReadSeeker counts the bytes read through it, seeking past them isn't counted
+type countingReadSeeker struct {
+	io.ReadSeeker
+	read int
+}
+
+func (crs *countingReadSeeker) Read(p []byte) (int, error) {
+	n, err := crs.ReadSeeker.Read(p)
+	crs.read += n
+
+	return n, err
+}
+
+func flacBlock(blockType byte, isLast bool, body []byte) []byte {
+	header := []byte{blockType, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}
+
+	if isLast {
+		header[0] |= 0x80
+	}
+
+	return append(header, body...)
+}
+
+func vorbisComments(comments ...string) []byte {
+	var block bytes.Buffer
+
+	binary.Write(&block, binary.LittleEndian, uint32(len("test")))
+	block.WriteString("test")
+	binary.Write(&block, binary.LittleEndian, uint32(len(comments)))
+
+	for _, comment := range comments {
+		binary.Write(&block, binary.LittleEndian, uint32(len(comment)))
+		block.WriteString(comment)
+	}
+
+	return block.Bytes()
+}
+
+func TestReadFLACTagsSkipsPictures(t *testing.T) {
+	// 441000 samples at 44.1kHz
+	streamInfo := make([]byte, 34)
+	streamInfo[10], streamInfo[11], streamInfo[12] = 0x0a, 0xc4, 0x42
+	binary.BigEndian.PutUint32(streamInfo[14:18], 441000)
+
+	picture := make([]byte, 4<<20)
+
+	var flac bytes.Buffer
+
+	flac.WriteString("fLaC")
+	flac.Write(flacBlock(0, false, streamInfo))
+	flac.Write(flacBlock(6, false, picture))
+	flac.Write(flacBlock(1, false, make([]byte, 1024)))
+	flac.Write(flacBlock(4, true, vorbisComments("TITLE=Song", "artist=Riley", "ALBUM=Album", "not a comment")))
+
+	reader := &countingReadSeeker{ReadSeeker: bytes.NewReader(flac.Bytes())}
+
+	tags, err := readFLACTags(reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := audioTags{Title: "Song", Artist: "Riley", Album: "Album", Duration: 10000}
+
+	if tags != want {
+		t.Errorf("readFLACTags = %+v, want %+v", tags, want)
+	}
+
+	if reader.read > 1024 {
+		t.Errorf("readFLACTags read %d bytes, the picture and padding should be skipped", reader.read)
+	}
+}
+
+func TestReadFLACTagsWithoutComments(t *testing.T) {
+	var flac bytes.Buffer
+
+	flac.WriteString("fLaC")
+	flac.Write(flacBlock(0, false, make([]byte, 34)))
+	flac.Write(flacBlock(6, true, make([]byte, 1024)))
+
+	if _, err := readFLACTags(bytes.NewReader(flac.Bytes())); err != errNoAudioTags {
+		t.Errorf("readFLACTags without a VORBIS_COMMENT block = %v, want errNoAudioTags", err)
+	}
+
+	// A VORBIS_COMMENT block running past the end of the file
+	comments := flacBlock(4, true, vorbisComments("TITLE=Song"))
+
+	var truncated bytes.Buffer
+
+	truncated.WriteString("fLaC")
+	truncated.Write(comments[:len(comments)-4])
+
+	if _, err := readFLACTags(bytes.NewReader(truncated.Bytes())); err != io.ErrUnexpectedEOF {
+		t.Errorf("readFLACTags of a truncated file = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
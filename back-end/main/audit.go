@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type auditEntry struct {
+	Time      time.Time   `json:"time"`
+	Actor     string      `json:"actor"`
+	Action    string      `json:"action"`
+	Target    string      `json:"target,omitempty"`
+	Details   interface{} `json:"details,omitempty"`
+	Success   bool        `json:"success"`
+	Error     string      `json:"error,omitempty"`
+	RequestID string      `json:"request_id,omitempty"`
+	ClientIP  string      `json:"client_ip,omitempty"`
+}
+
+// auditLog appends one JSON line per administrative action, the file is never rewritten
+type auditLog struct {
+	path  string
+	mutex *sync.Mutex
+}
+
+func newAuditLog(path string) *auditLog {
+	return &auditLog{
+		path:  path,
+		mutex: &sync.Mutex{},
+	}
+}
+
+var auditLogger = newLogger("audit")
+
+func (al *auditLog) record(entry auditEntry) {
+	entry.Time = time.Now().UTC()
+
+	line, err := json.Marshal(entry)
+
+	if err == nil {
+		err = al.appendLine(line)
+	}
+
+	fields := logFields{
+		"actor":   entry.Actor,
+		"action":  entry.Action,
+		"target":  entry.Target,
+		"success": entry.Success,
+	}
+
+	if err != nil {
+		fields["error"] = err
+
+		auditLogger.error(context.Background(), "could not write audit entry", fields)
+
+		return
+	}
+
+	auditLogger.info(context.Background(), "audit entry recorded", fields)
+}
+
+func (al *auditLog) appendLine(line []byte) error {
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(al.path), 0755); err != nil {
+		return err
+	}
+
+	auditFile, err := os.OpenFile(al.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = auditFile.Write(append(line, '\n')); err != nil {
+		auditFile.Close()
+
+		return err
+	}
+
+	return auditFile.Close()
+}
+
+// recent returns up to limit of the newest entries, newest first
+func (al *auditLog) recent(limit int) ([]auditEntry, error) {
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+
+	auditFile, err := os.Open(al.path)
+
+	if os.IsNotExist(err) {
+		return []auditEntry{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer auditFile.Close()
+
+	var entries []auditEntry
+
+	scanner := bufio.NewScanner(auditFile)
+
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+
+		if len(line) == 0 {
+			continue
+		}
+
+		var entry auditEntry
+
+		if err := json.Unmarshal(line, &entry); err != nil {
+			continue
+		}
+
+		entries = append(entries, entry)
+
+		if len(entries) > limit {
+			entries = entries[1:]
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	newestFirst := make([]auditEntry, len(entries))
+
+	for index, entry := range entries {
+		newestFirst[len(entries)-1-index] = entry
+	}
+
+	return newestFirst, nil
+}
+
+// recordRequest records an action performed through the admin API, attributing it to the authenticated actor
+func (al *auditLog) recordRequest(c *gin.Context, action, target string, details interface{}, actionErr error) {
+	entry := auditEntry{
+		Actor:     c.GetString(adminActorKey),
+		Action:    action,
+		Target:    target,
+		Details:   details,
+		Success:   actionErr == nil,
+		RequestID: requestIDFromContext(c.Request.Context()),
+		ClientIP:  clientIP(c),
+	}
+
+	if actionErr != nil {
+		entry.Error = actionErr.Error()
+	}
+
+	al.record(entry)
+}
@@ -0,0 +1,600 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type authConfig struct {
+	// Sessions expire this long after logging in or being refreshed
+	SessionTTL time.Duration `yaml:"session_ttl" env:"AUTH_SESSION_TTL" validate:"mindur=1m" reload:"true"`
+	// Refreshing can't keep a session alive for longer than this after logging in
+	MaxSessionAge time.Duration `yaml:"max_session_age" env:"AUTH_MAX_SESSION_AGE" validate:"mindur=1m" reload:"true"`
+	// Used for passwords hashed from now on, existing hashes keep their own count
+	PasswordIterations int `yaml:"password_iterations" env:"AUTH_PASSWORD_ITERATIONS" validate:"min=10000" reload:"true"`
+}
+
+func defaultAuthConfig() authConfig {
+	return authConfig{
+		SessionTTL:         time.Hour * 12,
+		MaxSessionAge:      time.Hour * 24 * 30,
+		PasswordIterations: 310000,
+	}
+}
+
+const authSessionKey = "authSession"
+
+// adminAccount is someone who can log in to the admin API, accounts are managed
+// with the account command rather than through the API
+type adminAccount struct {
+	Name         string    `json:"name"`
+	PasswordHash string    `json:"password_hash"`
+	TOTPSecret   string    `json:"totp_secret,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	// Sessions from before this, such as before a password change, are no longer valid
+	SessionsValidAfter time.Time `json:"sessions_valid_after"`
+}
+
+var errAccountNotFound = errors.New("account not found")
+
+// accountStore keeps every account in one JSON file, it is reread on each use so
+// changes made by the account command apply to a running server
+type accountStore struct {
+	path  string
+	mutex *sync.Mutex
+}
+
+func newAccountStore(path string) *accountStore {
+	return &accountStore{
+		path:  path,
+		mutex: &sync.Mutex{},
+	}
+}
+
+func (as *accountStore) loadLocked() (map[string]*adminAccount, error) {
+	accounts := make(map[string]*adminAccount)
+
+	if err := readJSONFile(as.path, &accounts); err != nil {
+		return nil, err
+	}
+
+	return accounts, nil
+}
+
+func (as *accountStore) get(name string) (*adminAccount, error) {
+	as.mutex.Lock()
+	defer as.mutex.Unlock()
+
+	accounts, err := as.loadLocked()
+
+	if err != nil {
+		return nil, err
+	}
+
+	account, ok := accounts[name]
+
+	if !ok {
+		return nil, errAccountNotFound
+	}
+
+	return account, nil
+}
+
+// list returns every account sorted by name
+func (as *accountStore) list() ([]adminAccount, error) {
+	as.mutex.Lock()
+	defer as.mutex.Unlock()
+
+	accounts, err := as.loadLocked()
+
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]adminAccount, 0, len(accounts))
+
+	for _, account := range accounts {
+		list = append(list, *account)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+
+	return list, nil
+}
+
+// update lets modify change the accounts and saves them if modify succeeds
+func (as *accountStore) update(modify func(accounts map[string]*adminAccount) error) error {
+	as.mutex.Lock()
+	defer as.mutex.Unlock()
+
+	accounts, err := as.loadLocked()
+
+	if err != nil {
+		return err
+	}
+
+	if err = modify(accounts); err != nil {
+		return err
+	}
+
+	return writeJSONFile(as.path, accounts)
+}
+
+type authSession struct {
+	Account string `json:"account"`
+	// When the account logged in, refreshing a session carries this over
+	LoggedInAt time.Time `json:"logged_in_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	ClientIP   string    `json:"client_ip"`
+	UserAgent  string    `json:"user_agent"`
+}
+
+// sessionStore keeps sessions by the SHA-256 of their token, so the file alone
+// can't be used to take one over
+type sessionStore struct {
+	path     string
+	mutex    *sync.Mutex
+	sessions map[string]authSession
+}
+
+func loadSessionStore(path string) (*sessionStore, error) {
+	ss := &sessionStore{
+		path:     path,
+		mutex:    &sync.Mutex{},
+		sessions: make(map[string]authSession),
+	}
+
+	if err := readJSONFile(path, &ss.sessions); err != nil {
+		return nil, err
+	}
+
+	return ss, nil
+}
+
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// saveLocked writes the sessions that haven't expired
+func (ss *sessionStore) saveLocked(now time.Time) error {
+	for tokenHash, session := range ss.sessions {
+		if !now.Before(session.ExpiresAt) {
+			delete(ss.sessions, tokenHash)
+		}
+	}
+
+	return writeJSONFile(ss.path, ss.sessions)
+}
+
+func newSessionToken() (string, error) {
+	token := make([]byte, 32)
+
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(token), nil
+}
+
+func (ss *sessionStore) create(session authSession) (string, error) {
+	encodedToken, err := newSessionToken()
+
+	if err != nil {
+		return "", err
+	}
+
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	ss.sessions[hashSessionToken(encodedToken)] = session
+
+	return encodedToken, ss.saveLocked(time.Now())
+}
+
+func (ss *sessionStore) lookup(token string, now time.Time) (authSession, bool) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	session, ok := ss.sessions[hashSessionToken(token)]
+
+	return session, ok && now.Before(session.ExpiresAt)
+}
+
+func (ss *sessionStore) revoke(token string) error {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	delete(ss.sessions, hashSessionToken(token))
+
+	return ss.saveLocked(time.Now())
+}
+
+// rotate replaces the session's token with a new one, the old token stops working
+func (ss *sessionStore) rotate(token string, expiresAt time.Time) (string, authSession, error) {
+	newToken, err := newSessionToken()
+
+	if err != nil {
+		return "", authSession{}, err
+	}
+
+	// Held throughout, so two refreshes with the same token can't both get a session
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	now := time.Now()
+	tokenHash := hashSessionToken(token)
+	session, ok := ss.sessions[tokenHash]
+
+	if !ok || !now.Before(session.ExpiresAt) {
+		return "", authSession{}, errSessionInvalid
+	}
+
+	previous := session
+	newTokenHash := hashSessionToken(newToken)
+
+	session.ExpiresAt = expiresAt
+
+	ss.sessions[newTokenHash] = session
+	delete(ss.sessions, tokenHash)
+
+	if err = ss.saveLocked(now); err != nil {
+		delete(ss.sessions, newTokenHash)
+		ss.sessions[tokenHash] = previous
+
+		return "", authSession{}, err
+	}
+
+	return newToken, session, nil
+}
+
+var errSessionInvalid = errors.New("session expired or invalid")
+
+// authService logs admin accounts in with a password and, when they have enrolled
+// one, a TOTP code, handing out opaque session tokens for the /api/a routes
+type authService struct {
+	accounts *accountStore
+	audit    *auditLog
+	config   func() authConfig
+	sessions *sessionStore
+	// Unknown accounts are checked against this so they take as long as known ones
+	decoyHash string
+	// The last TOTP step each account logged in with, a code can't be used twice
+	totpMutex *sync.Mutex
+	totpSteps map[string]int64
+}
+
+func newAuthService(directory string, audit *auditLog, config func() authConfig) (*authService, error) {
+	sessions, err := loadSessionStore(sessionsPath(directory))
+
+	if err != nil {
+		return nil, err
+	}
+
+	decoyHash, err := hashPassword("decoy", config().PasswordIterations)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &authService{
+		accounts:  newAccountStore(accountsPath(directory)),
+		audit:     audit,
+		config:    config,
+		sessions:  sessions,
+		decoyHash: decoyHash,
+		totpMutex: &sync.Mutex{},
+		totpSteps: make(map[string]int64),
+	}, nil
+}
+
+func accountsPath(directory string) string {
+	return filepath.Join(directory, "accounts.json")
+}
+
+func sessionsPath(directory string) string {
+	return filepath.Join(directory, "sessions.json")
+}
+
+var authLog = newLogger("auth")
+
+// hasAccounts reports whether anyone could log in, the admin API is disabled otherwise
+func (as *authService) hasAccounts() bool {
+	accounts, err := as.accounts.list()
+
+	return err == nil && len(accounts) != 0
+}
+
+// authenticate returns the session and account token belongs to
+func (as *authService) authenticate(token string) (authSession, *adminAccount, error) {
+	if token == "" {
+		return authSession{}, nil, errSessionInvalid
+	}
+
+	session, ok := as.sessions.lookup(token, time.Now())
+
+	if !ok {
+		return authSession{}, nil, errSessionInvalid
+	}
+
+	account, err := as.accounts.get(session.Account)
+
+	if err == errAccountNotFound || (err == nil && session.LoggedInAt.Before(account.SessionsValidAfter)) {
+		as.sessions.revoke(token)
+
+		return authSession{}, nil, errSessionInvalid
+	}
+
+	if err != nil {
+		return authSession{}, nil, err
+	}
+
+	return session, account, nil
+}
+
+// authToken reads the session token from the auth_token query parameter the front
+// end uses, or from the Authorization header with or without a Bearer prefix
+func authToken(c *gin.Context) string {
+	if token := c.Query("auth_token"); token != "" {
+		return token
+	}
+
+	return strings.TrimSpace(strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer "))
+}
+
+// sessionAuthMiddleware only lets through requests with a valid session, others are
+// told to log out so the front end drops its token
+func (as *authService) sessionAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, account, err := as.authenticate(authToken(c))
+
+		if err == errSessionInvalid {
+			abortWithLogout(c, err.Error())
+
+			return
+		}
+
+		if err != nil {
+			authLog.error(c.Request.Context(), "could not check session", logFields{"error": err})
+
+			abortWithError(c, http.StatusInternalServerError, "could not check session")
+
+			return
+		}
+
+		c.Set(authSessionKey, session)
+		c.Set(adminActorKey, "account:"+account.Name)
+
+		c.Next()
+	}
+}
+
+func (as *authService) registerRoutes(apiGroup *gin.RouterGroup, loginLimiter gin.HandlerFunc) {
+	apiGroup.POST("/n/auth/login", loginLimiter, as.login)
+
+	authGroup := apiGroup.Group("/a", as.sessionAuthMiddleware())
+
+	authGroup.POST("/auth/status", as.status)
+	authGroup.POST("/auth/refresh", as.refresh)
+	authGroup.POST("/auth/logout", as.logout)
+}
+
+// sessionExpiry is when a session refreshed now expires
+func (as *authService) sessionExpiry(loggedInAt, now time.Time) time.Time {
+	config := as.config()
+
+	expiresAt := now.Add(config.SessionTTL)
+
+	if latest := loggedInAt.Add(config.MaxSessionAge); expiresAt.After(latest) {
+		return latest
+	}
+
+	return expiresAt
+}
+
+type AuthSession struct {
+	AuthToken string    `json:"auth_token"`
+	Account   string    `json:"account"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type loginRequest struct {
+	Username string `json:"username" binding:"required,max=64"`
+	Password string `json:"password" binding:"required,max=1024"`
+	// Required once the account has enrolled a TOTP authenticator
+	TOTPCode string `json:"totp_code" binding:"omitempty,len=6,numeric"`
+}
+
+func (as *authService) login(c *gin.Context) {
+	var request loginRequest
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		abortWithError(c, http.StatusBadRequest, bindingErrorMessage(err))
+
+		return
+	}
+
+	ctx := c.Request.Context()
+
+	c.Set(adminActorKey, request.Username)
+
+	account, err := as.accounts.get(request.Username)
+
+	passwordHash := as.decoyHash
+
+	if err == nil {
+		passwordHash = account.PasswordHash
+	} else if err != errAccountNotFound {
+		authLog.error(ctx, "could not load account", logFields{"error": err})
+
+		abortWithError(c, http.StatusInternalServerError, "could not log in")
+
+		return
+	}
+
+	validPassword, err := verifyPassword(request.Password, passwordHash)
+
+	if err != nil {
+		authLog.error(ctx, "stored password hash is invalid", logFields{"account": request.Username})
+	}
+
+	if account == nil || !validPassword {
+		as.audit.recordRequest(c, "auth.login", request.Username, nil, errors.New("invalid username or password"))
+
+		abortWithError(c, http.StatusUnauthorized, "invalid username or password")
+
+		return
+	}
+
+	now := time.Now()
+
+	// Failing the second factor gets the same answer as the first, so a correct
+	// password isn't given away
+	if account.TOTPSecret != "" {
+		if request.TOTPCode == "" {
+			as.audit.recordRequest(c, "auth.login", request.Username, nil, errors.New("totp code required"))
+
+			abortWithError(c, http.StatusUnauthorized, "invalid username or password")
+
+			return
+		}
+
+		if !as.useTOTPCode(account, request.TOTPCode, now) {
+			as.audit.recordRequest(c, "auth.login", request.Username, nil, errors.New("invalid totp code"))
+
+			abortWithError(c, http.StatusUnauthorized, "invalid username or password")
+
+			return
+		}
+	}
+
+	session := authSession{
+		Account:    account.Name,
+		LoggedInAt: now,
+		ExpiresAt:  as.sessionExpiry(now, now),
+		ClientIP:   clientIP(c),
+		UserAgent:  c.Request.UserAgent(),
+	}
+
+	token, err := as.sessions.create(session)
+
+	as.audit.recordRequest(c, "auth.login", request.Username, nil, err)
+
+	if err != nil {
+		authLog.error(ctx, "could not create session", logFields{"error": err})
+
+		abortWithError(c, http.StatusInternalServerError, "could not log in")
+
+		return
+	}
+
+	respondWithData(c, AuthSession{
+		AuthToken: token,
+		Account:   account.Name,
+		ExpiresAt: session.ExpiresAt,
+	})
+}
+
+// useTOTPCode checks the code, refusing one that was already used to log in
+func (as *authService) useTOTPCode(account *adminAccount, code string, now time.Time) bool {
+	step, ok := verifyTOTP(account.TOTPSecret, code, now)
+
+	if !ok {
+		return false
+	}
+
+	as.totpMutex.Lock()
+	defer as.totpMutex.Unlock()
+
+	if lastStep, used := as.totpSteps[account.Name]; used && step <= lastStep {
+		return false
+	}
+
+	as.totpSteps[account.Name] = step
+
+	return true
+}
+
+type AuthStatus struct {
+	Account     string    `json:"account"`
+	TOTPEnabled bool      `json:"totp_enabled"`
+	LoggedInAt  time.Time `json:"logged_in_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+func (as *authService) status(c *gin.Context) {
+	session := c.MustGet(authSessionKey).(authSession)
+
+	account, err := as.accounts.get(session.Account)
+
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, "could not load account")
+
+		return
+	}
+
+	respondWithData(c, AuthStatus{
+		Account:     account.Name,
+		TOTPEnabled: account.TOTPSecret != "",
+		LoggedInAt:  session.LoggedInAt,
+		ExpiresAt:   session.ExpiresAt,
+	})
+}
+
+// refresh swaps the session's token for a new one that expires later
+func (as *authService) refresh(c *gin.Context) {
+	session := c.MustGet(authSessionKey).(authSession)
+
+	token, session, err := as.sessions.rotate(authToken(c), as.sessionExpiry(session.LoggedInAt, time.Now()))
+
+	if err == errSessionInvalid {
+		abortWithLogout(c, err.Error())
+
+		return
+	}
+
+	if err != nil {
+		authLog.error(c.Request.Context(), "could not refresh session", logFields{"error": err})
+
+		abortWithError(c, http.StatusInternalServerError, "could not refresh session")
+
+		return
+	}
+
+	respondWithData(c, AuthSession{
+		AuthToken: token,
+		Account:   session.Account,
+		ExpiresAt: session.ExpiresAt,
+	})
+}
+
+func (as *authService) logout(c *gin.Context) {
+	err := as.sessions.revoke(authToken(c))
+
+	as.audit.recordRequest(c, "auth.logout", "", nil, err)
+
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, "could not log out")
+
+		return
+	}
+
+	c.JSON(http.StatusOK, apiResponse{
+		Err:    false,
+		Data:   struct{}{},
+		Logout: true,
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const clientIPKey = "clientIP"
+
+func parseTrustedProxies(cidrs []string) ([]*net.IPNet, error) {
+	var trustedProxies []*net.IPNet
+
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+
+		_, network, err := net.ParseCIDR(cidr)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %s", cidr, err)
+		}
+
+		trustedProxies = append(trustedProxies, network)
+	}
+
+	return trustedProxies, nil
+}
+
+func isTrustedProxy(ip net.IP, trustedProxies []*net.IPNet) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resolveClientIP only believes X-Forwarded-For when the connection comes from a trusted proxy,
+// walking the header from the nearest hop back until the first address that is not a trusted proxy
+func resolveClientIP(remoteAddr, forwardedFor string, trustedProxies []*net.IPNet) string {
+	remoteHost, _, err := net.SplitHostPort(strings.TrimSpace(remoteAddr))
+
+	if err != nil {
+		remoteHost = strings.TrimSpace(remoteAddr)
+	}
+
+	remoteIP := net.ParseIP(remoteHost)
+
+	if remoteIP == nil || !isTrustedProxy(remoteIP, trustedProxies) || forwardedFor == "" {
+		return remoteHost
+	}
+
+	hops := strings.Split(forwardedFor, ",")
+	clientIP := remoteHost
+
+	for hopIndex := len(hops) - 1; hopIndex >= 0; hopIndex-- {
+		hopIP := parseForwardedHop(hops[hopIndex])
+
+		if hopIP == nil {
+			break
+		}
+
+		clientIP = hopIP.String()
+
+		if !isTrustedProxy(hopIP, trustedProxies) {
+			break
+		}
+	}
+
+	return clientIP
+}
+
+// parseForwardedHop reads an address from X-Forwarded-For, some proxies add the port,
+// which puts IPv6 addresses in brackets
+func parseForwardedHop(hop string) net.IP {
+	hop = strings.TrimSpace(hop)
+
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]"))
+}
+
+// clientIPMiddleware resolves the caller's address once so that rate limiting and
+// logging agree on who the client is
+func clientIPMiddleware(trustedProxies []*net.IPNet) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(clientIPKey, resolveClientIP(c.Request.RemoteAddr, c.GetHeader("X-Forwarded-For"), trustedProxies))
+
+		c.Next()
+	}
+}
+
+func clientIP(c *gin.Context) string {
+	if ip := c.GetString(clientIPKey); ip != "" {
+		return ip
+	}
+
+	return c.ClientIP()
+}
@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestResolveClientIP(t *testing.T) {
+	trustedProxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "fd00::/8"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor string
+		want         string
+	}{
+		{"no header", "203.0.113.7:5000", "", "203.0.113.7"},
+		{"untrusted remote with a spoofed header", "203.0.113.7:5000", "198.51.100.1", "203.0.113.7"},
+		{"untrusted remote with a spoofed trusted hop", "203.0.113.7:5000", "10.0.0.1", "203.0.113.7"},
+		{"trusted remote", "10.0.0.2:5000", "198.51.100.1", "198.51.100.1"},
+		{"client's own header is ignored", "10.0.0.2:5000", "1.2.3.4, 198.51.100.1", "198.51.100.1"},
+		{"chain of trusted proxies", "10.0.0.2:5000", "198.51.100.1, 10.0.0.4, 10.0.0.3", "198.51.100.1"},
+		{"all trusted", "10.0.0.2:5000", "10.0.0.5, 10.0.0.4", "10.0.0.5"},
+		{"garbage hop", "10.0.0.2:5000", "garbage", "10.0.0.2"},
+		{"garbage before a trusted hop", "10.0.0.2:5000", "198.51.100.1, <script>, 10.0.0.3", "10.0.0.3"},
+		{"garbage beyond the client", "10.0.0.2:5000", "garbage, 198.51.100.1", "198.51.100.1"},
+		{"empty hops", "10.0.0.2:5000", ",,", "10.0.0.2"},
+		{"hop with a port", "10.0.0.2:5000", "198.51.100.1:4711", "198.51.100.1"},
+		{"IPv6 remote with a port", "[2001:db8::1]:443", "198.51.100.1", "2001:db8::1"},
+		{"trusted IPv6 remote with a port", "[fd00::1]:443", "2001:db8::2", "2001:db8::2"},
+		{"IPv6 hop with a port", "[fd00::1]:443", "[2001:db8::2]:4711", "2001:db8::2"},
+		{"IPv6 hop in brackets", "[fd00::1]:443", "[2001:db8::2]", "2001:db8::2"},
+		{"remote without a port", "10.0.0.2", "198.51.100.1", "198.51.100.1"},
+		{"unparseable remote", "somewhere", "198.51.100.1", "somewhere"},
+	}
+
+	for _, testCase := range cases {
+		if got := resolveClientIP(testCase.remoteAddr, testCase.forwardedFor, trustedProxies); got != testCase.want {
+			t.Errorf("%s: resolveClientIP(%q, %q) = %q, want %q", testCase.name, testCase.remoteAddr, testCase.forwardedFor, got, testCase.want)
+		}
+	}
+}
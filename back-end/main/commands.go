@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const commandsUsage = `
+Commands, run instead of the server:
+  account list
+  account add [-totp] <name>       the password is read from stdin
+  account passwd <name>            the password is read from stdin
+  account totp [-disable] <name>   enrols a new authenticator, printing its otpauth:// URI
+  account remove <name>
+  apikey list
+  apikey create -scopes <scope,...> [-expires <duration>] <name>
+                                   prints the key, it can't be shown again
+  apikey revoke <id>
+`
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command]\n\nFlags:\n", filepath.Base(os.Args[0]))
+
+	flag.PrintDefaults()
+
+	fmt.Fprint(flag.CommandLine.Output(), commandsUsage)
+}
+
+// runCommand runs a maintenance command given after the flags, returning the exit code
+func runCommand(config *appConfig, args []string) int {
+	var err error
+
+	switch args[0] {
+	case "account":
+		err = runAccountCommand(config, args[1:])
+	case "apikey":
+		err = runAPIKeyCommand(config, args[1:])
+	default:
+		err = fmt.Errorf("unknown command %q", args[0])
+	}
+
+	if err == flag.ErrHelp {
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+
+		return 1
+	}
+
+	return 0
+}
+
+const minPasswordLength = 12
+
+// readPassword reads the first line of stdin, so passwords can be piped in
+// without ending up in the shell's history
+func readPassword(input io.Reader) (string, error) {
+	line, err := bufio.NewReader(input).ReadString('\n')
+
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	password := strings.TrimRight(line, "\r\n")
+
+	if len(password) < minPasswordLength {
+		return "", fmt.Errorf("passwords must be at least %d characters", minPasswordLength)
+	}
+
+	return password, nil
+}
+
+var errAccountCommandUsage = errors.New("usage: account list|add|passwd|totp|remove")
+
+func runAccountCommand(config *appConfig, args []string) error {
+	if len(args) == 0 {
+		return errAccountCommandUsage
+	}
+
+	accounts := newAccountStore(accountsPath(filepath.Join(config.DataDir, "auth")))
+
+	commandFlags := flag.NewFlagSet("account "+args[0], flag.ContinueOnError)
+
+	withTOTP := commandFlags.Bool("totp", false, "enrol a TOTP authenticator for the account")
+	disableTOTP := commandFlags.Bool("disable", false, "remove the account's TOTP authenticator")
+
+	if err := commandFlags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	if args[0] == "list" {
+		list, err := accounts.list()
+
+		if err != nil {
+			return err
+		}
+
+		for _, account := range list {
+			fmt.Printf("%s\tcreated %s\ttotp %t\n", account.Name, account.CreatedAt.Format(time.RFC3339), account.TOTPSecret != "")
+		}
+
+		return nil
+	}
+
+	if commandFlags.NArg() != 1 {
+		return errAccountCommandUsage
+	}
+
+	name := commandFlags.Arg(0)
+
+	if !validSlug(name) || len(name) > 64 {
+		return errors.New("account names must be lowercase letters, digits and dashes")
+	}
+
+	now := time.Now().UTC()
+
+	switch args[0] {
+	case "add", "passwd":
+		password, err := readPassword(os.Stdin)
+
+		if err != nil {
+			return err
+		}
+
+		passwordHash, err := hashPassword(password, config.Auth.PasswordIterations)
+
+		if err != nil {
+			return err
+		}
+
+		totpSecret := ""
+
+		if args[0] == "add" && *withTOTP {
+			if totpSecret, err = newTOTPSecret(); err != nil {
+				return err
+			}
+		}
+
+		err = accounts.update(func(list map[string]*adminAccount) error {
+			account, exists := list[name]
+
+			if args[0] == "add" {
+				if exists {
+					return fmt.Errorf("account %q already exists", name)
+				}
+
+				list[name] = &adminAccount{
+					Name:         name,
+					PasswordHash: passwordHash,
+					TOTPSecret:   totpSecret,
+					CreatedAt:    now,
+				}
+
+				return nil
+			}
+
+			if !exists {
+				return errAccountNotFound
+			}
+
+			// Changing the password logs the account out everywhere
+			account.PasswordHash = passwordHash
+			account.SessionsValidAfter = now
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		if totpSecret != "" {
+			fmt.Println(totpURI(config.Site.Title, name, totpSecret))
+		}
+
+		return nil
+	case "totp":
+		totpSecret := ""
+
+		if !*disableTOTP {
+			var err error
+
+			if totpSecret, err = newTOTPSecret(); err != nil {
+				return err
+			}
+		}
+
+		err := accounts.update(func(list map[string]*adminAccount) error {
+			account, exists := list[name]
+
+			if !exists {
+				return errAccountNotFound
+			}
+
+			account.TOTPSecret = totpSecret
+			account.SessionsValidAfter = now
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		if totpSecret != "" {
+			fmt.Println(totpURI(config.Site.Title, name, totpSecret))
+		}
+
+		return nil
+	case "remove":
+		return accounts.update(func(list map[string]*adminAccount) error {
+			if _, exists := list[name]; !exists {
+				return errAccountNotFound
+			}
+
+			delete(list, name)
+
+			return nil
+		})
+	}
+
+	return errAccountCommandUsage
+}
+
+var errAPIKeyCommandUsage = errors.New("usage: apikey list|create|revoke")
+
+func runAPIKeyCommand(config *appConfig, args []string) error {
+	if len(args) == 0 {
+		return errAPIKeyCommandUsage
+	}
+
+	keys := newAPIKeyStore(filepath.Join(config.DataDir, "auth"))
+
+	commandFlags := flag.NewFlagSet("apikey "+args[0], flag.ContinueOnError)
+
+	scopes := commandFlags.String("scopes", "", "comma separated scopes, one of "+strings.Join(apiKeyScopes, ", "))
+	expires := commandFlags.Duration("expires", 0, "how long until the key expires, it never does when 0")
+
+	if err := commandFlags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	switch {
+	case args[0] == "list" && commandFlags.NArg() == 0:
+		listings, err := keys.list()
+
+		if err != nil {
+			return err
+		}
+
+		for _, listing := range listings {
+			expiresAt, lastUsedAt := "never", "never"
+
+			if listing.ExpiresAt != nil {
+				expiresAt = listing.ExpiresAt.Format(time.RFC3339)
+			}
+
+			if listing.LastUsedAt != nil {
+				lastUsedAt = listing.LastUsedAt.Format(time.RFC3339)
+			}
+
+			fmt.Printf("%s\t%s\t%s\texpires %s\tlast used %s\n", listing.ID, listing.Name, strings.Join(listing.Scopes, ","), expiresAt, lastUsedAt)
+		}
+
+		return nil
+	case args[0] == "create" && commandFlags.NArg() == 1:
+		var keyScopes []string
+
+		for _, scope := range strings.Split(*scopes, ",") {
+			if scope = strings.TrimSpace(scope); scope == "" {
+				continue
+			}
+
+			if !validAPIKeyScope(scope) {
+				return fmt.Errorf("unknown scope %q, scopes are %s", scope, strings.Join(apiKeyScopes, ", "))
+			}
+
+			keyScopes = append(keyScopes, scope)
+		}
+
+		if len(keyScopes) == 0 {
+			return errors.New("api keys need at least one scope")
+		}
+
+		var expiresAt *time.Time
+
+		if *expires < 0 {
+			return errors.New("expires can't be negative")
+		}
+
+		if *expires != 0 {
+			expiry := time.Now().Add(*expires).UTC()
+
+			expiresAt = &expiry
+		}
+
+		token, key, err := keys.create(commandFlags.Arg(0), keyScopes, expiresAt)
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(os.Stderr, "created api key %s\n", key.ID)
+		fmt.Println(token)
+
+		return nil
+	case args[0] == "revoke" && commandFlags.NArg() == 1:
+		return keys.revoke(commandFlags.Arg(0))
+	}
+
+	return errAPIKeyCommandUsage
+}
@@ -0,0 +1,888 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type commentsConfig struct {
+	// Comments scoring at least this are held as likely spam, nobody is notified about them
+	SpamThreshold float64 `yaml:"spam_threshold" env:"COMMENTS_SPAM_THRESHOLD" validate:"gt=0,lte=1" reload:"true"`
+	// How deep replies can be nested, 1 allows no replies
+	MaxDepth int `yaml:"max_depth" env:"COMMENTS_MAX_DEPTH" validate:"min=1,max=10" reload:"true"`
+	// Addresses emailed about every comment that isn't likely spam
+	NotifyTo []string `yaml:"notify_to" env:"COMMENTS_NOTIFY_TO" validate:"dive,email" reload:"true"`
+	// Posted the same comments as JSON, signed with webhook_secret in X-Comment-Signature if set
+	WebhookURL     string        `yaml:"webhook_url" env:"COMMENTS_WEBHOOK_URL" validate:"omitempty,url" reload:"true"`
+	WebhookSecret  string        `yaml:"webhook_secret" env:"COMMENTS_WEBHOOK_SECRET" reload:"true" secret:"true"`
+	WebhookTimeout time.Duration `yaml:"webhook_timeout" env:"COMMENTS_WEBHOOK_TIMEOUT" validate:"mindur=1s"`
+}
+
+func defaultCommentsConfig() commentsConfig {
+	return commentsConfig{
+		SpamThreshold:  0.7,
+		MaxDepth:       3,
+		WebhookTimeout: time.Second * 10,
+	}
+}
+
+const (
+	commentPending  = "pending"
+	commentApproved = "approved"
+	commentRejected = "rejected"
+)
+
+type comment struct {
+	ID        string    `json:"id"`
+	PostSlug  string    `json:"post_slug"`
+	ParentID  string    `json:"parent_id,omitempty"`
+	Depth     int       `json:"depth"`
+	CreatedAt time.Time `json:"created_at"`
+	Author    string    `json:"author"`
+	Email     string    `json:"email"`
+	// The markdown as written, HTML is rendered from it when the comment is received
+	Body        string     `json:"body"`
+	HTML        string     `json:"html"`
+	Status      string     `json:"status"`
+	ModeratedAt *time.Time `json:"moderated_at"`
+	ModeratedBy string     `json:"moderated_by,omitempty"`
+	ClientIP    string     `json:"client_ip"`
+	UserAgent   string     `json:"user_agent"`
+	RequestID   string     `json:"request_id"`
+	Spam        bool       `json:"spam"`
+	SpamScore   float64    `json:"spam_score"`
+	SpamReasons []string   `json:"spam_reasons"`
+	// The label the spam model was trained with for this comment, if any
+	TrainedAs string `json:"trained_as,omitempty"`
+}
+
+func (cm *comment) scoredText() string {
+	return cm.Author + "\n" + cm.Body
+}
+
+// Comment is an approved comment as shown under a post, with its approved replies
+type Comment struct {
+	ID        string    `json:"id"`
+	ParentID  string    `json:"parent_id,omitempty"`
+	Author    string    `json:"author"`
+	HTML      string    `json:"html"`
+	CreatedAt time.Time `json:"created_at"`
+	Replies   []Comment `json:"replies"`
+}
+
+type CommentThread struct {
+	Count    int       `json:"count"`
+	Comments []Comment `json:"comments"`
+}
+
+// commentBan keeps an email address or client IP from commenting
+type commentBan struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"`
+	Value     string    `json:"value"`
+	CommentID string    `json:"comment_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	CreatedBy string    `json:"created_by"`
+}
+
+const (
+	commentBanEmail = "email"
+	commentBanIP    = "ip"
+)
+
+var (
+	errCommentNotFound    = errors.New("comment not found")
+	errCommentBanNotFound = errors.New("ban not found")
+)
+
+// commentStore keeps each post's comments in a JSON file named after its slug, they
+// are all held in memory as the moderation queue spans every post
+type commentStore struct {
+	bans      []*commentBan
+	bansPath  string
+	byID      map[string]*comment
+	byPost    map[string][]*comment
+	directory string
+	mutex     *sync.Mutex
+}
+
+func newCommentStore(directory string) (*commentStore, error) {
+	cs := &commentStore{
+		bansPath:  filepath.Join(directory, "bans.json"),
+		byID:      make(map[string]*comment),
+		byPost:    make(map[string][]*comment),
+		directory: filepath.Join(directory, "posts"),
+		mutex:     &sync.Mutex{},
+	}
+
+	if err := readJSONFile(cs.bansPath, &cs.bans); err != nil {
+		return nil, err
+	}
+
+	fileInfos, err := ioutil.ReadDir(cs.directory)
+
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, fileInfo := range fileInfos {
+		slug := strings.TrimSuffix(fileInfo.Name(), ".json")
+
+		if fileInfo.IsDir() || !validSlug(slug) {
+			continue
+		}
+
+		var comments []*comment
+
+		if err = readJSONFile(filepath.Join(cs.directory, fileInfo.Name()), &comments); err != nil {
+			return nil, err
+		}
+
+		cs.byPost[slug] = comments
+
+		for _, postComment := range comments {
+			cs.byID[postComment.ID] = postComment
+		}
+	}
+
+	return cs, nil
+}
+
+func (cs *commentStore) savePostLocked(slug string) error {
+	return writeJSONFile(filepath.Join(cs.directory, slug+".json"), cs.byPost[slug])
+}
+
+func (cs *commentStore) add(newComment *comment) error {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	cs.byPost[newComment.PostSlug] = append(cs.byPost[newComment.PostSlug], newComment)
+
+	if err := cs.savePostLocked(newComment.PostSlug); err != nil {
+		cs.byPost[newComment.PostSlug] = cs.byPost[newComment.PostSlug][:len(cs.byPost[newComment.PostSlug])-1]
+
+		return err
+	}
+
+	cs.byID[newComment.ID] = newComment
+
+	return nil
+}
+
+func (cs *commentStore) get(commentID string) (comment, error) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	found, ok := cs.byID[commentID]
+
+	if !ok {
+		return comment{}, errCommentNotFound
+	}
+
+	return *found, nil
+}
+
+// writePostLocked saves a post's comments as they will be once changes are made
+func (cs *commentStore) writePostLocked(slug string, changes map[*comment]comment) error {
+	comments := make([]comment, len(cs.byPost[slug]))
+
+	for index, stored := range cs.byPost[slug] {
+		comments[index] = *stored
+
+		if changed, ok := changes[stored]; ok {
+			comments[index] = changed
+		}
+	}
+
+	return writeJSONFile(filepath.Join(cs.directory, slug+".json"), comments)
+}
+
+// update lets modify change each comment selected and saves the posts they belong
+// to, the comments only change once every post is saved
+func (cs *commentStore) update(selected func(*comment) bool, modify func(*comment) error) ([]comment, error) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	var (
+		updated []comment
+		changes = make(map[*comment]comment)
+		posts   = make(map[string]bool)
+	)
+
+	for _, stored := range cs.byID {
+		if !selected(stored) {
+			continue
+		}
+
+		changed := *stored
+
+		if err := modify(&changed); err != nil {
+			return nil, err
+		}
+
+		changes[stored] = changed
+		posts[stored.PostSlug] = true
+		updated = append(updated, changed)
+	}
+
+	var saved []string
+
+	for slug := range posts {
+		if err := cs.writePostLocked(slug, changes); err != nil {
+			// Posts already saved are put back to match the unchanged comments
+			for _, savedSlug := range saved {
+				if restoreErr := cs.savePostLocked(savedSlug); restoreErr != nil {
+					commentsLog.error(context.Background(), "could not restore comments after a failed save", logFields{
+						"post":  savedSlug,
+						"error": restoreErr,
+					})
+				}
+			}
+
+			return nil, err
+		}
+
+		saved = append(saved, slug)
+	}
+
+	for stored, changed := range changes {
+		*stored = changed
+	}
+
+	return updated, nil
+}
+
+// list returns the comments with status, every comment if status is empty, newest first
+func (cs *commentStore) list(status string) []comment {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	listed := []comment{}
+
+	for _, stored := range cs.byID {
+		if status == "" || stored.Status == status {
+			listed = append(listed, *stored)
+		}
+	}
+
+	sort.Slice(listed, func(i, j int) bool {
+		return listed[i].CreatedAt.After(listed[j].CreatedAt)
+	})
+
+	return listed
+}
+
+// thread returns a post's approved comments with their replies nested, oldest first.
+// Replies to comments that aren't approved are left out along with them.
+func (cs *commentStore) thread(slug string) CommentThread {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	replies := make(map[string][]*comment)
+
+	for _, postComment := range cs.byPost[slug] {
+		if postComment.Status == commentApproved {
+			replies[postComment.ParentID] = append(replies[postComment.ParentID], postComment)
+		}
+	}
+
+	thread := CommentThread{}
+
+	var nest func(parentID string) []Comment
+
+	nest = func(parentID string) []Comment {
+		nested := []Comment{}
+
+		for _, reply := range replies[parentID] {
+			thread.Count++
+
+			nested = append(nested, Comment{
+				ID:        reply.ID,
+				ParentID:  reply.ParentID,
+				Author:    reply.Author,
+				HTML:      reply.HTML,
+				CreatedAt: reply.CreatedAt,
+				Replies:   nest(reply.ID),
+			})
+		}
+
+		return nested
+	}
+
+	thread.Comments = nest("")
+
+	return thread
+}
+
+func (cs *commentStore) banned(email, clientIP string) bool {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	for _, ban := range cs.bans {
+		if (ban.Kind == commentBanEmail && strings.EqualFold(ban.Value, email)) || (ban.Kind == commentBanIP && ban.Value == clientIP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// addBans bans each kind and value not already banned
+func (cs *commentStore) addBans(bans []*commentBan) error {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	existing := cs.bans
+
+	for _, ban := range bans {
+		duplicate := false
+
+		for _, current := range cs.bans {
+			if current.Kind == ban.Kind && strings.EqualFold(current.Value, ban.Value) {
+				duplicate = true
+			}
+		}
+
+		if !duplicate && ban.Value != "" {
+			cs.bans = append(cs.bans, ban)
+		}
+	}
+
+	if err := writeJSONFile(cs.bansPath, cs.bans); err != nil {
+		cs.bans = existing
+
+		return err
+	}
+
+	return nil
+}
+
+func (cs *commentStore) listBans() []commentBan {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	listed := make([]commentBan, 0, len(cs.bans))
+
+	for _, ban := range cs.bans {
+		listed = append(listed, *ban)
+	}
+
+	return listed
+}
+
+func (cs *commentStore) removeBan(banID string) error {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	for index, ban := range cs.bans {
+		if ban.ID != banID {
+			continue
+		}
+
+		remaining := append(append([]*commentBan{}, cs.bans[:index]...), cs.bans[index+1:]...)
+
+		if err := writeJSONFile(cs.bansPath, remaining); err != nil {
+			return err
+		}
+
+		cs.bans = remaining
+
+		return nil
+	}
+
+	return errCommentBanNotFound
+}
+
+// commentsAPI takes comments on posts, holding them for moderation. Only approved
+// comments are ever served publicly.
+type commentsAPI struct {
+	audit      *auditLog
+	config     func() commentsConfig
+	httpClient *http.Client
+	outbox     *outbox
+	pending    *sync.WaitGroup
+	posts      *postService
+	spam       *spamScorer
+	store      *commentStore
+}
+
+func newCommentsAPI(directory string, posts *postService, audit *auditLog, outbox *outbox, config func() commentsConfig) (*commentsAPI, error) {
+	spam, err := newSpamScorer(filepath.Join(directory, "spam_model.json"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := newCommentStore(directory)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &commentsAPI{
+		audit:  audit,
+		config: config,
+		httpClient: &http.Client{
+			Timeout: config().WebhookTimeout,
+		},
+		outbox:  outbox,
+		pending: &sync.WaitGroup{},
+		posts:   posts,
+		spam:    spam,
+		store:   store,
+	}, nil
+}
+
+var commentsLog = newLogger("comments")
+
+func (ca *commentsAPI) registerRoutes(apiGroup *gin.RouterGroup, submitLimiter gin.HandlerFunc) {
+	apiGroup.GET("/posts/:slug/comments", ca.listThread)
+	apiGroup.POST("/posts/:slug/comments", submitLimiter, ca.submit)
+}
+
+func (ca *commentsAPI) registerAdminRoutes(adminGroup *gin.RouterGroup) {
+	adminGroup.GET("/comments", ca.listComments)
+	adminGroup.POST("/comments/:commentID/approve", ca.approve)
+	adminGroup.POST("/comments/:commentID/reject", ca.reject)
+	adminGroup.POST("/comments/:commentID/ban", ca.ban)
+	adminGroup.GET("/comment-bans", ca.listBans)
+	adminGroup.DELETE("/comment-bans/:banID", ca.removeBan)
+}
+
+func (ca *commentsAPI) listThread(c *gin.Context) {
+	slug := c.Param("slug")
+
+	if !validSlug(slug) {
+		abortWithError(c, http.StatusNotFound, "post not found")
+
+		return
+	}
+
+	respondWithData(c, ca.store.thread(slug))
+}
+
+type commentRequest struct {
+	ParentID string `json:"parent_id"`
+	Author   string `json:"author" binding:"required,max=80"`
+	// Never shown, only used to reach the author and to ban them
+	Email string `json:"email" binding:"required,email,max=254"`
+	Body  string `json:"body" binding:"required,min=2,max=5000"`
+	// Hidden from people by the form, anything filled in here came from a bot
+	Website string `json:"website"`
+}
+
+type commentSubmission struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+func (ca *commentsAPI) submit(c *gin.Context) {
+	var request commentRequest
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		abortWithError(c, http.StatusBadRequest, bindingErrorMessage(err))
+
+		return
+	}
+
+	ctx := c.Request.Context()
+	config := ca.config()
+	slug := c.Param("slug")
+
+	if !validSlug(slug) {
+		abortWithError(c, http.StatusNotFound, "post not found")
+
+		return
+	}
+
+	newComment := &comment{
+		ID:        newRequestID(),
+		PostSlug:  slug,
+		CreatedAt: time.Now().UTC(),
+		Author:    strings.Join(strings.Fields(request.Author), " "),
+		Email:     strings.TrimSpace(request.Email),
+		Body:      strings.TrimSpace(request.Body),
+		Status:    commentPending,
+		ClientIP:  clientIP(c),
+		UserAgent: c.Request.UserAgent(),
+		RequestID: requestIDFromContext(ctx),
+	}
+
+	// Bots and banned commenters get the same response as everyone else so they don't adapt
+	if request.Website != "" || ca.store.banned(newComment.Email, newComment.ClientIP) {
+		commentsLog.info(ctx, "discarded comment", logFields{
+			"client_ip": newComment.ClientIP,
+			"honeypot":  request.Website != "",
+		})
+
+		respondWithData(c, commentSubmission{ID: newComment.ID, Status: commentPending})
+
+		return
+	}
+
+	if _, _, err := ca.posts.getPost(ctx, slug); err == errGhostNotFound {
+		abortWithError(c, http.StatusNotFound, "post not found")
+
+		return
+	} else if err != nil {
+		abortWithError(c, http.StatusBadGateway, "comments are unavailable right now")
+
+		return
+	}
+
+	if request.ParentID != "" {
+		parent, err := ca.store.get(request.ParentID)
+
+		if err != nil || parent.PostSlug != slug || parent.Status != commentApproved {
+			abortWithError(c, http.StatusBadRequest, "the comment being replied to doesn't exist")
+
+			return
+		}
+
+		if parent.Depth+1 >= config.MaxDepth {
+			abortWithError(c, http.StatusBadRequest, "replies can't be nested any deeper")
+
+			return
+		}
+
+		newComment.ParentID = parent.ID
+		newComment.Depth = parent.Depth + 1
+	}
+
+	newComment.HTML = renderMarkdown(newComment.Body)
+
+	verdict := ca.spam.score(newComment.scoredText())
+
+	newComment.SpamScore = verdict.Score
+	newComment.SpamReasons = verdict.Reasons
+	newComment.Spam = verdict.Score >= config.SpamThreshold
+
+	if err := ca.store.add(newComment); err != nil {
+		commentsLog.error(ctx, "could not store comment", logFields{"error": err})
+
+		abortWithError(c, http.StatusInternalServerError, "could not post your comment, try again later")
+
+		return
+	}
+
+	commentsLog.info(ctx, "comment received", logFields{
+		"comment_id": newComment.ID,
+		"post":       slug,
+		"spam":       newComment.Spam,
+		"spam_score": newComment.SpamScore,
+	})
+
+	if !newComment.Spam {
+		ca.notify(ctx, config, newComment)
+	}
+
+	respondWithData(c, commentSubmission{ID: newComment.ID, Status: newComment.Status})
+}
+
+type commentWebhook struct {
+	Event   string  `json:"event"`
+	Comment comment `json:"comment"`
+}
+
+// notify tells moderators about a new comment by email and webhook, whichever are set up.
+// The comment is already stored, so failures are only logged.
+func (ca *commentsAPI) notify(ctx context.Context, config commentsConfig, newComment *comment) {
+	if len(config.NotifyTo) != 0 {
+		replyTo := &mail.Address{Name: newComment.Author, Address: newComment.Email}
+
+		if _, err := ca.outbox.enqueue(ctx, "comment_notification", config.NotifyTo, replyTo, newComment); err != nil {
+			commentsLog.error(ctx, "could not queue comment notification", logFields{
+				"comment_id": newComment.ID,
+				"error":      err,
+			})
+		}
+	}
+
+	if config.WebhookURL == "" {
+		return
+	}
+
+	body, err := json.Marshal(commentWebhook{Event: "comment.created", Comment: *newComment})
+
+	if err != nil {
+		commentsLog.error(ctx, "could not encode comment webhook", logFields{"error": err})
+
+		return
+	}
+
+	ca.pending.Add(1)
+
+	// Sent after responding
+	webhookCtx := detachedContext(ctx)
+
+	go func() {
+		defer ca.pending.Done()
+
+		if err := ca.sendWebhook(webhookCtx, config, body); err != nil {
+			commentsLog.warn(webhookCtx, "comment webhook failed", logFields{
+				"comment_id": newComment.ID,
+				"error":      err,
+			})
+		}
+	}()
+}
+
+func (ca *commentsAPI) sendWebhook(ctx context.Context, config commentsConfig, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, config.WebhookURL, bytes.NewReader(body))
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if config.WebhookSecret != "" {
+		mac := hmac.New(sha256.New, []byte(config.WebhookSecret))
+
+		mac.Write(body)
+
+		req.Header.Set("X-Comment-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := ca.httpClient.Do(req.WithContext(ctx))
+
+	if err != nil {
+		return redactURLError(err)
+	}
+
+	defer resp.Body.Close()
+
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("comment webhook responded with %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// close waits for webhooks still being sent
+func (ca *commentsAPI) close(ctx context.Context) error {
+	done := make(chan struct{})
+
+	go func() {
+		ca.pending.Wait()
+
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		commentsLog.warn(ctx, "timed out waiting for comment webhooks to finish", nil)
+	}
+
+	return nil
+}
+
+// listComments returns the moderation queue, status picks another state or "all"
+func (ca *commentsAPI) listComments(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+
+	if err != nil || limit < 1 || limit > 1000 {
+		abortWithError(c, http.StatusBadRequest, "limit must be between 1 and 1000")
+
+		return
+	}
+
+	status := c.DefaultQuery("status", commentPending)
+
+	switch status {
+	case commentPending, commentApproved, commentRejected:
+	case "all":
+		status = ""
+	default:
+		abortWithError(c, http.StatusBadRequest, "status must be pending, approved, rejected or all")
+
+		return
+	}
+
+	comments := ca.store.list(status)
+
+	if len(comments) > limit {
+		comments = comments[:limit]
+	}
+
+	respondWithData(c, comments)
+}
+
+// moderate sets a comment's status, training the spam model with the decision
+// when spam is true or false. The comment is saved before the model is trained, a
+// failed save then can't leave the model having counted it.
+func (ca *commentsAPI) moderate(c *gin.Context, commentID, status string, spam *bool) ([]comment, error) {
+	actor := c.GetString(adminActorKey)
+	now := time.Now().UTC()
+
+	var previousLabel string
+
+	moderated, err := ca.store.update(func(stored *comment) bool {
+		return stored.ID == commentID
+	}, func(moderated *comment) error {
+		previousLabel = moderated.TrainedAs
+
+		if spam != nil {
+			moderated.Spam = *spam
+			moderated.TrainedAs = contactLabelHam
+
+			if *spam {
+				moderated.TrainedAs = contactLabelSpam
+			}
+		}
+
+		moderated.Status = status
+		moderated.ModeratedAt = &now
+		moderated.ModeratedBy = actor
+
+		return nil
+	})
+
+	if err != nil || len(moderated) == 0 || spam == nil || moderated[0].TrainedAs == previousLabel {
+		return moderated, err
+	}
+
+	return moderated, ca.spam.train(moderated[0].scoredText(), *spam, previousLabel)
+}
+
+func (ca *commentsAPI) respondModerated(c *gin.Context, action string, moderated []comment, err error) {
+	commentID := c.Param("commentID")
+
+	if err == nil && len(moderated) == 0 {
+		abortWithError(c, http.StatusNotFound, errCommentNotFound.Error())
+
+		return
+	}
+
+	ca.audit.recordRequest(c, action, commentID, nil, err)
+
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, "could not moderate comment")
+
+		return
+	}
+
+	respondWithData(c, moderated[0])
+}
+
+// approve publishes a comment, which also teaches the spam model it isn't spam
+func (ca *commentsAPI) approve(c *gin.Context) {
+	notSpam := false
+
+	moderated, err := ca.moderate(c, c.Param("commentID"), commentApproved, &notSpam)
+
+	ca.respondModerated(c, "comments.approve", moderated, err)
+}
+
+type rejectCommentRequest struct {
+	// Trains the spam model with the comment when set
+	Spam *bool `json:"spam"`
+}
+
+func (ca *commentsAPI) reject(c *gin.Context) {
+	var request rejectCommentRequest
+
+	if err := c.ShouldBindJSON(&request); err != nil && err != io.EOF {
+		abortWithError(c, http.StatusBadRequest, bindingErrorMessage(err))
+
+		return
+	}
+
+	moderated, err := ca.moderate(c, c.Param("commentID"), commentRejected, request.Spam)
+
+	ca.respondModerated(c, "comments.reject", moderated, err)
+}
+
+// ban rejects a comment as spam and bans its author's email address and IP, their
+// other comments still waiting for moderation are rejected too
+func (ca *commentsAPI) ban(c *gin.Context) {
+	commentID := c.Param("commentID")
+
+	banned, err := ca.store.get(commentID)
+
+	if err != nil {
+		abortWithError(c, http.StatusNotFound, err.Error())
+
+		return
+	}
+
+	actor := c.GetString(adminActorKey)
+	now := time.Now().UTC()
+
+	err = ca.store.addBans([]*commentBan{
+		{ID: newRequestID(), Kind: commentBanEmail, Value: banned.Email, CommentID: commentID, CreatedAt: now, CreatedBy: actor},
+		{ID: newRequestID(), Kind: commentBanIP, Value: banned.ClientIP, CommentID: commentID, CreatedAt: now, CreatedBy: actor},
+	})
+
+	if err == nil {
+		spam := true
+
+		if _, err = ca.moderate(c, commentID, commentRejected, &spam); err == nil {
+			_, err = ca.store.update(func(stored *comment) bool {
+				return stored.Status == commentPending && (strings.EqualFold(stored.Email, banned.Email) || stored.ClientIP == banned.ClientIP)
+			}, func(moderated *comment) error {
+				moderated.Status = commentRejected
+				moderated.ModeratedAt = &now
+				moderated.ModeratedBy = actor
+
+				return nil
+			})
+		}
+	}
+
+	ca.audit.recordRequest(c, "comments.ban", commentID, gin.H{"email": banned.Email, "client_ip": banned.ClientIP}, err)
+
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, "could not ban commenter")
+
+		return
+	}
+
+	respondWithData(c, ca.store.listBans())
+}
+
+func (ca *commentsAPI) listBans(c *gin.Context) {
+	respondWithData(c, ca.store.listBans())
+}
+
+func (ca *commentsAPI) removeBan(c *gin.Context) {
+	err := ca.store.removeBan(c.Param("banID"))
+
+	if err == errCommentBanNotFound {
+		abortWithError(c, http.StatusNotFound, err.Error())
+
+		return
+	}
+
+	ca.audit.recordRequest(c, "comments.unban", c.Param("banID"), nil, err)
+
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, "could not remove ban")
+
+		return
+	}
+
+	respondWithData(c, nil)
+}
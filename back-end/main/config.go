@@ -0,0 +1,476 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"gopkg.in/yaml.v2"
+)
+
+// Fields tagged reload:"true" are applied on SIGHUP, changes to any other field
+// only take effect after a restart. Fields tagged secret:"true" are redacted
+// whenever the configuration is printed.
+
+type logConfig struct {
+	// A default level optionally followed by per-component overrides, e.g. "info,soundcloud=debug"
+	Level string `yaml:"level" env:"LOG_LEVEL" validate:"loglevels" reload:"true"`
+}
+
+type playlistConfig struct {
+	Title            string        `yaml:"title" env:"PLAYLIST_TITLE" validate:"required" reload:"true"`
+	Sources          []string      `yaml:"sources" env:"PLAYLIST_SOURCES" validate:"min=1,dive,oneof=soundcloud local"`
+	LocalDir         string        `yaml:"local_dir" env:"LOCAL_PLAYLIST_DIR"`
+	RefreshInterval  time.Duration `yaml:"refresh_interval" env:"PLAYLIST_REFRESH_INTERVAL" validate:"mindur=10s" reload:"true"`
+	ErrorBackoff     time.Duration `yaml:"error_backoff" env:"PLAYLIST_ERROR_BACKOFF" validate:"mindur=1s" reload:"true"`
+	SnapshotInterval time.Duration `yaml:"snapshot_interval" env:"PLAYLIST_SNAPSHOT_INTERVAL" validate:"mindur=1s"`
+}
+
+type adminConfig struct {
+	// The admin API answers 503 while no token is configured and no account exists
+	Token string `yaml:"token" env:"ADMIN_TOKEN" validate:"omitempty,min=16" secret:"true" reload:"true"`
+}
+
+type siteConfig struct {
+	// The public origin of the Next.js site, links in sitemaps and feeds are built on it
+	BaseURL     string `yaml:"base_url" env:"SITE_BASE_URL" validate:"required,url"`
+	Title       string `yaml:"title" env:"SITE_TITLE" validate:"required" reload:"true"`
+	Description string `yaml:"description" env:"SITE_DESCRIPTION" reload:"true"`
+}
+
+// absoluteURL turns a site path into a public URL
+func (sc siteConfig) absoluteURL(path string) string {
+	return strings.TrimRight(sc.BaseURL, "/") + path
+}
+
+type appConfig struct {
+	Server     serverConfig     `yaml:"server"`
+	Log        logConfig        `yaml:"log"`
+	DataDir    string           `yaml:"data_dir" env:"DATA_DIR" validate:"required"`
+	Site       siteConfig       `yaml:"site"`
+	Playlist   playlistConfig   `yaml:"playlist"`
+	RateLimit  rateLimitConfig  `yaml:"rate_limit"`
+	Admin      adminConfig      `yaml:"admin"`
+	Auth       authConfig       `yaml:"auth"`
+	Contact    contactConfig    `yaml:"contact"`
+	Email      emailConfig      `yaml:"email"`
+	Ghost      ghostConfig      `yaml:"ghost"`
+	Revalidate revalidateConfig `yaml:"revalidate"`
+	Sitemap    sitemapConfig    `yaml:"sitemap"`
+	Feed       feedConfig       `yaml:"feed"`
+	Search     searchConfig     `yaml:"search"`
+	Enrich     enrichConfig     `yaml:"enrich"`
+	Articles   articlesConfig   `yaml:"articles"`
+	Analytics  analyticsConfig  `yaml:"analytics"`
+	Comments   commentsConfig   `yaml:"comments"`
+	Newsletter newsletterConfig `yaml:"newsletter"`
+	OG         ogConfig         `yaml:"og"`
+}
+
+func defaultAppConfig() appConfig {
+	return appConfig{
+		Server: defaultServerConfig(),
+		Log: logConfig{
+			Level: "info",
+		},
+		DataDir: "data",
+		Site: siteConfig{
+			BaseURL:     "https://therileyjohnson.com",
+			Title:       "RJ's Site",
+			Description: "Posts from RJ's Site",
+		},
+		Playlist: playlistConfig{
+			Title:            "NormieAppropriateGymMusic",
+			Sources:          []string{"soundcloud", "local"},
+			LocalDir:         "playlists",
+			RefreshInterval:  time.Minute,
+			ErrorBackoff:     time.Second * 30,
+			SnapshotInterval: time.Minute * 10,
+		},
+		RateLimit:  defaultRateLimitConfig(),
+		Auth:       defaultAuthConfig(),
+		Contact:    defaultContactConfig(),
+		Email:      defaultEmailConfig(),
+		Ghost:      defaultGhostConfig(),
+		Revalidate: defaultRevalidateConfig(),
+		Sitemap:    defaultSitemapConfig(),
+		Feed:       defaultFeedConfig(),
+		Search:     defaultSearchConfig(),
+		Enrich:     defaultEnrichConfig(),
+		Articles:   defaultArticlesConfig(),
+		Analytics:  defaultAnalyticsConfig(),
+		Comments:   defaultCommentsConfig(),
+		Newsletter: defaultNewsletterConfig(),
+		OG:         defaultOGConfig(),
+	}
+}
+
+// configFile is where the configuration is read from, a missing file is only an
+// error when the path was given explicitly
+type configFile struct {
+	path     string
+	required bool
+}
+
+// loadConfig layers the config file and then the environment over the defaults
+func loadConfig(file configFile) (*appConfig, error) {
+	config := defaultAppConfig()
+
+	configBytes, err := ioutil.ReadFile(file.path)
+
+	switch {
+	case err == nil:
+		// UnmarshalStrict rejects keys already present in a map, so rate limit
+		// groups from the file replace the defaults, which are merged back in later
+		config.RateLimit.Groups = nil
+
+		if err = yaml.UnmarshalStrict(configBytes, &config); err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %s", file.path, err)
+		}
+
+		if config.RateLimit.Groups == nil {
+			config.RateLimit.Groups = defaultRateLimitConfig().Groups
+		}
+	case os.IsNotExist(err) && !file.required:
+	default:
+		return nil, err
+	}
+
+	if err = applyEnvOverrides(&config); err != nil {
+		return nil, err
+	}
+
+	if err = validateConfig(&config); err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// walkConfigFields calls fn for every non-struct field, path is the dotted yaml path
+func walkConfigFields(value reflect.Value, path string, index []int, fn func(path string, index []int, field reflect.StructField, fieldValue reflect.Value)) {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		fieldPath := configFieldName(field)
+		fieldIndex := append(append([]int{}, index...), i)
+
+		if path != "" {
+			fieldPath = path + "." + fieldPath
+		}
+
+		if field.Type.Kind() == reflect.Struct {
+			walkConfigFields(value.Field(i), fieldPath, fieldIndex, fn)
+
+			continue
+		}
+
+		fn(fieldPath, fieldIndex, field, value.Field(i))
+	}
+}
+
+func configFieldName(field reflect.StructField) string {
+	name := strings.SplitN(field.Tag.Get("yaml"), ",", 2)[0]
+
+	if name == "" {
+		return field.Name
+	}
+
+	return name
+}
+
+// applyEnvOverrides sets every field with an env tag whose variable is set, lists
+// are comma separated and maps are comma separated key=value pairs
+func applyEnvOverrides(config *appConfig) error {
+	var envErrors []string
+
+	walkConfigFields(reflect.ValueOf(config).Elem(), "", nil, func(path string, index []int, field reflect.StructField, fieldValue reflect.Value) {
+		envName := field.Tag.Get("env")
+
+		if envName == "" {
+			return
+		}
+
+		envValue, ok := os.LookupEnv(envName)
+
+		if !ok {
+			return
+		}
+
+		if err := setConfigValue(fieldValue, envValue); err != nil {
+			envErrors = append(envErrors, fmt.Sprintf("%s: %s", envName, err))
+		}
+	})
+
+	if len(envErrors) != 0 {
+		return errors.New("invalid environment:\n  " + strings.Join(envErrors, "\n  "))
+	}
+
+	return nil
+}
+
+func setConfigValue(fieldValue reflect.Value, rawValue string) error {
+	if fieldValue.Type() == reflect.TypeOf(time.Duration(0)) {
+		duration, err := time.ParseDuration(strings.TrimSpace(rawValue))
+
+		if err != nil {
+			return err
+		}
+
+		fieldValue.SetInt(int64(duration))
+
+		return nil
+	}
+
+	switch fieldValue.Kind() {
+	case reflect.String:
+		fieldValue.SetString(rawValue)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(strings.TrimSpace(rawValue))
+
+		if err != nil {
+			return err
+		}
+
+		fieldValue.SetBool(parsed)
+	case reflect.Int, reflect.Int64:
+		parsed, err := strconv.ParseInt(strings.TrimSpace(rawValue), 10, 64)
+
+		if err != nil {
+			return err
+		}
+
+		fieldValue.SetInt(parsed)
+	case reflect.Float64:
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(rawValue), 64)
+
+		if err != nil {
+			return err
+		}
+
+		fieldValue.SetFloat(parsed)
+	case reflect.Slice:
+		values := reflect.MakeSlice(fieldValue.Type(), 0, 0)
+
+		for _, part := range strings.Split(rawValue, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				values = reflect.Append(values, reflect.ValueOf(part))
+			}
+		}
+
+		fieldValue.Set(values)
+	case reflect.Map:
+		values := reflect.MakeMap(fieldValue.Type())
+
+		for _, part := range strings.Split(rawValue, ",") {
+			if part = strings.TrimSpace(part); part == "" {
+				continue
+			}
+
+			keyValue := strings.SplitN(part, "=", 2)
+
+			if len(keyValue) != 2 {
+				return fmt.Errorf("expected key=value, got %q", part)
+			}
+
+			values.SetMapIndex(reflect.ValueOf(strings.TrimSpace(keyValue[0])), reflect.ValueOf(strings.TrimSpace(keyValue[1])))
+		}
+
+		fieldValue.Set(values)
+	default:
+		return fmt.Errorf("unsupported config field type %s", fieldValue.Type())
+	}
+
+	return nil
+}
+
+var configValidator = newConfigValidator()
+
+func newConfigValidator() *validator.Validate {
+	configValidate := validator.New()
+
+	configValidate.RegisterTagNameFunc(configFieldName)
+
+	configValidate.RegisterValidation("mindur", func(fl validator.FieldLevel) bool {
+		minimum, err := time.ParseDuration(fl.Param())
+
+		return err == nil && time.Duration(fl.Field().Int()) >= minimum
+	})
+
+	configValidate.RegisterValidation("loglevels", func(fl validator.FieldLevel) bool {
+		_, _, err := parseLogLevelSpec(fl.Field().String())
+
+		return err == nil
+	})
+
+	configValidate.RegisterValidation("ratelimit", func(fl validator.FieldLevel) bool {
+		_, err := parseRateLimit(fl.Field().String())
+
+		return err == nil
+	})
+
+	return configValidate
+}
+
+// validateConfig checks the config against its validate tags, reporting every
+// problem at once as "path: problem" lines
+func validateConfig(config *appConfig) error {
+	err := configValidator.Struct(config)
+
+	if err == nil {
+		return nil
+	}
+
+	validationErrors, ok := err.(validator.ValidationErrors)
+
+	if !ok {
+		return err
+	}
+
+	problems := make([]string, 0, len(validationErrors))
+
+	for _, fieldError := range validationErrors {
+		// Drop the leading struct name, leaving the yaml path of the field
+		path := fieldError.Namespace()
+
+		if dotIndex := strings.Index(path, "."); dotIndex != -1 {
+			path = path[dotIndex+1:]
+		}
+
+		problems = append(problems, path+": "+describeFieldError(fieldError))
+	}
+
+	return errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+}
+
+// redactedConfigYAML renders the config with every secret field that is set replaced
+func redactedConfigYAML(config *appConfig) ([]byte, error) {
+	redacted := *config
+
+	walkConfigFields(reflect.ValueOf(&redacted).Elem(), "", nil, func(path string, index []int, field reflect.StructField, fieldValue reflect.Value) {
+		if field.Tag.Get("secret") == "true" && fieldValue.Kind() == reflect.String && fieldValue.String() != "" {
+			fieldValue.SetString("REDACTED")
+		}
+	})
+
+	return yaml.Marshal(&redacted)
+}
+
+// mergeReloadableFields copies the reloadable fields of next over current, reporting
+// which reloadable fields changed and which other fields changed but were ignored
+func mergeReloadableFields(current, next *appConfig) (*appConfig, []string, []string) {
+	merged := *current
+	nextValue := reflect.ValueOf(next).Elem()
+
+	var applied, ignored []string
+
+	walkConfigFields(reflect.ValueOf(&merged).Elem(), "", nil, func(path string, index []int, field reflect.StructField, fieldValue reflect.Value) {
+		nextFieldValue := nextValue.FieldByIndex(index)
+
+		if reflect.DeepEqual(fieldValue.Interface(), nextFieldValue.Interface()) {
+			return
+		}
+
+		if field.Tag.Get("reload") != "true" {
+			ignored = append(ignored, path)
+
+			return
+		}
+
+		fieldValue.Set(nextFieldValue)
+
+		applied = append(applied, path)
+	})
+
+	sort.Strings(applied)
+	sort.Strings(ignored)
+
+	return &merged, applied, ignored
+}
+
+var configLog = newLogger("config")
+
+// liveConfig holds the running configuration, which is replaced as a whole on reload
+type liveConfig struct {
+	file   configFile
+	mutex  *sync.Mutex
+	config atomic.Value
+}
+
+func newLiveConfig(file configFile, config *appConfig) *liveConfig {
+	lc := &liveConfig{
+		file:  file,
+		mutex: &sync.Mutex{},
+	}
+
+	lc.config.Store(config)
+
+	return lc
+}
+
+func (lc *liveConfig) current() *appConfig {
+	return lc.config.Load().(*appConfig)
+}
+
+// configApplier puts the reloadable fields of a freshly reloaded config into effect
+type configApplier func(ctx context.Context, previous, next *appConfig)
+
+// reload rereads the config, an invalid config is rejected leaving the running one untouched
+func (lc *liveConfig) reload(ctx context.Context, apply configApplier) error {
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+
+	loaded, err := loadConfig(lc.file)
+
+	if err != nil {
+		return err
+	}
+
+	previous := lc.current()
+
+	next, applied, ignored := mergeReloadableFields(previous, loaded)
+
+	if len(ignored) != 0 {
+		configLog.warn(ctx, "changed settings need a restart to take effect", logFields{"fields": ignored})
+	}
+
+	if len(applied) == 0 {
+		configLog.info(ctx, "config reloaded without changes", nil)
+
+		return nil
+	}
+
+	lc.config.Store(next)
+
+	apply(ctx, previous, next)
+
+	configLog.info(ctx, "config reloaded", logFields{"fields": applied})
+
+	return nil
+}
+
+// reloadOnSIGHUP reloads the config whenever a SIGHUP is received
+func (lc *liveConfig) reloadOnSIGHUP(apply configApplier) {
+	signals := make(chan os.Signal, 1)
+
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		ctx := contextWithRequestID(context.Background(), "reload-"+newRequestID())
+
+		if err := lc.reload(ctx, apply); err != nil {
+			configLog.error(ctx, "config reload failed, keeping the running config", logFields{"error": err})
+		}
+	}
+}
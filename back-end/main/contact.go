@@ -0,0 +1,518 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type contactConfig struct {
+	// Forms submitted sooner than this after being loaded are assumed to come from bots
+	MinSubmitTime time.Duration `yaml:"min_submit_time" env:"CONTACT_MIN_SUBMIT_TIME" reload:"true"`
+	MaxFormAge    time.Duration `yaml:"max_form_age" env:"CONTACT_MAX_FORM_AGE" validate:"mindur=1m" reload:"true"`
+	SpamThreshold float64       `yaml:"spam_threshold" env:"CONTACT_SPAM_THRESHOLD" validate:"gt=0,lte=1" reload:"true"`
+	// Addresses emailed about every message that isn't spam
+	NotifyTo []string `yaml:"notify_to" env:"CONTACT_NOTIFY_TO" validate:"dive,email" reload:"true"`
+}
+
+func defaultContactConfig() contactConfig {
+	return contactConfig{
+		MinSubmitTime: time.Second * 3,
+		MaxFormAge:    time.Hour * 24,
+		SpamThreshold: 0.7,
+	}
+}
+
+const (
+	contactLabelSpam = "spam"
+	contactLabelHam  = "ham"
+)
+
+type contactMessage struct {
+	ID          string     `json:"id"`
+	ReceivedAt  time.Time  `json:"received_at"`
+	ReadAt      *time.Time `json:"read_at"`
+	Name        string     `json:"name"`
+	Email       string     `json:"email"`
+	Subject     string     `json:"subject"`
+	Message     string     `json:"message"`
+	ClientIP    string     `json:"client_ip"`
+	UserAgent   string     `json:"user_agent"`
+	RequestID   string     `json:"request_id"`
+	Spam        bool       `json:"spam"`
+	SpamScore   float64    `json:"spam_score"`
+	SpamReasons []string   `json:"spam_reasons"`
+	// The label the spam model was trained with for this message, if any
+	TrainedAs string `json:"trained_as,omitempty"`
+}
+
+func (cm *contactMessage) scoredText() string {
+	return cm.Subject + "\n" + cm.Message
+}
+
+var errContactMessageNotFound = errors.New("message not found")
+
+// contactStore keeps each message as its own JSON file
+type contactStore struct {
+	directory string
+	mutex     *sync.Mutex
+}
+
+func newContactStore(directory string) *contactStore {
+	return &contactStore{
+		directory: directory,
+		mutex:     &sync.Mutex{},
+	}
+}
+
+func (cs *contactStore) messagePath(messageID string) string {
+	return filepath.Join(cs.directory, messageID+".json")
+}
+
+func (cs *contactStore) save(message *contactMessage) error {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	return writeJSONFile(cs.messagePath(message.ID), message)
+}
+
+func (cs *contactStore) load(messageID string) (*contactMessage, error) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	return cs.loadLocked(messageID)
+}
+
+func (cs *contactStore) loadLocked(messageID string) (*contactMessage, error) {
+	if !validRecordID(messageID) || !fileExists(cs.messagePath(messageID)) {
+		return nil, errContactMessageNotFound
+	}
+
+	var message contactMessage
+
+	if err := readJSONFile(cs.messagePath(messageID), &message); err != nil {
+		return nil, err
+	}
+
+	return &message, nil
+}
+
+// update loads a message, lets modify change it and saves it if modify succeeds
+func (cs *contactStore) update(messageID string, modify func(*contactMessage) error) (*contactMessage, error) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	message, err := cs.loadLocked(messageID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = modify(message); err != nil {
+		return nil, err
+	}
+
+	return message, writeJSONFile(cs.messagePath(messageID), message)
+}
+
+func (cs *contactStore) delete(messageID string) error {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	if !validRecordID(messageID) {
+		return errContactMessageNotFound
+	}
+
+	err := os.Remove(cs.messagePath(messageID))
+
+	if os.IsNotExist(err) {
+		return errContactMessageNotFound
+	}
+
+	return err
+}
+
+// list returns every stored message, newest first
+func (cs *contactStore) list() ([]contactMessage, error) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	fileInfos, err := ioutil.ReadDir(cs.directory)
+
+	if os.IsNotExist(err) {
+		return []contactMessage{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]contactMessage, 0, len(fileInfos))
+
+	for _, fileInfo := range fileInfos {
+		messageID := strings.TrimSuffix(fileInfo.Name(), ".json")
+
+		if fileInfo.IsDir() || !validRecordID(messageID) {
+			continue
+		}
+
+		message, err := cs.loadLocked(messageID)
+
+		if err != nil {
+			return nil, err
+		}
+
+		messages = append(messages, *message)
+	}
+
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].ReceivedAt.After(messages[j].ReceivedAt)
+	})
+
+	return messages, nil
+}
+
+// contactAPI accepts messages from the contact form, bots are filtered out by a
+// honeypot field, a signed form token that must not be submitted too quickly and
+// spam scoring, spam is kept so it can be reviewed and used to train the scorer
+type contactAPI struct {
+	audit      *auditLog
+	config     func() contactConfig
+	formSecret []byte
+	outbox     *outbox
+	spam       *spamScorer
+	store      *contactStore
+}
+
+func newContactAPI(directory string, audit *auditLog, outbox *outbox, config func() contactConfig) (*contactAPI, error) {
+	spam, err := newSpamScorer(filepath.Join(directory, "spam_model.json"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Form tokens only need to outlive a page load, so they are invalidated by a restart
+	formSecret := make([]byte, 32)
+
+	if _, err = rand.Read(formSecret); err != nil {
+		return nil, err
+	}
+
+	return &contactAPI{
+		audit:      audit,
+		config:     config,
+		formSecret: formSecret,
+		outbox:     outbox,
+		spam:       spam,
+		store:      newContactStore(filepath.Join(directory, "messages")),
+	}, nil
+}
+
+var contactLog = newLogger("contact")
+
+func (ca *contactAPI) registerRoutes(apiGroup *gin.RouterGroup, submitLimiter gin.HandlerFunc) {
+	apiGroup.GET("/contact/form", ca.issueForm)
+	apiGroup.POST("/contact", submitLimiter, ca.submit)
+}
+
+func (ca *contactAPI) registerAdminRoutes(adminGroup *gin.RouterGroup, keys *apiKeyRoutes) {
+	keys.scoped(adminGroup, http.MethodGet, "/contact", scopeContactRead, ca.listMessages)
+	keys.scoped(adminGroup, http.MethodGet, "/contact/:messageID", scopeContactRead, ca.readMessage)
+	adminGroup.DELETE("/contact/:messageID", ca.deleteMessage)
+	adminGroup.PUT("/contact/:messageID/classification", ca.classifyMessage)
+}
+
+func (ca *contactAPI) signFormIssuedAt(issuedAt string) string {
+	mac := hmac.New(sha256.New, ca.formSecret)
+
+	mac.Write([]byte(issuedAt))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// formTokenAge checks the form token's signature, returning how long ago it was issued
+func (ca *contactAPI) formTokenAge(formToken string, now time.Time) (time.Duration, bool) {
+	tokenParts := strings.SplitN(formToken, ".", 2)
+
+	if len(tokenParts) != 2 || !hmac.Equal([]byte(ca.signFormIssuedAt(tokenParts[0])), []byte(tokenParts[1])) {
+		return 0, false
+	}
+
+	issuedAtMillis, err := strconv.ParseInt(tokenParts[0], 10, 64)
+
+	if err != nil {
+		return 0, false
+	}
+
+	return now.Sub(time.Unix(0, issuedAtMillis*int64(time.Millisecond))), true
+}
+
+type contactForm struct {
+	FormToken string `json:"form_token"`
+	// Submitting sooner than this is rejected, the form should stay disabled until then
+	MinSubmitSeconds float64 `json:"min_submit_seconds"`
+}
+
+// issueForm hands out a token to be submitted with the form, recording when it was loaded
+func (ca *contactAPI) issueForm(c *gin.Context) {
+	issuedAt := strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+
+	respondWithData(c, contactForm{
+		FormToken:        issuedAt + "." + ca.signFormIssuedAt(issuedAt),
+		MinSubmitSeconds: ca.config().MinSubmitTime.Seconds(),
+	})
+}
+
+type contactRequest struct {
+	Name      string `json:"name" binding:"required,max=100"`
+	Email     string `json:"email" binding:"required,email,max=254"`
+	Subject   string `json:"subject" binding:"max=200"`
+	Message   string `json:"message" binding:"required,min=10,max=5000"`
+	FormToken string `json:"form_token" binding:"required"`
+	// Hidden from people by the form, anything filled in here came from a bot
+	Website string `json:"website"`
+}
+
+func (ca *contactAPI) submit(c *gin.Context) {
+	var request contactRequest
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		abortWithError(c, http.StatusBadRequest, bindingErrorMessage(err))
+
+		return
+	}
+
+	ctx := c.Request.Context()
+	config := ca.config()
+
+	formAge, ok := ca.formTokenAge(request.FormToken, time.Now())
+
+	if !ok || formAge > config.MaxFormAge {
+		abortWithError(c, http.StatusBadRequest, "the form has expired, reload the page and try again")
+
+		return
+	}
+
+	if formAge < config.MinSubmitTime {
+		contactLog.info(ctx, "rejected contact form submitted too quickly", logFields{
+			"client_ip": clientIP(c),
+			"form_age":  formAge.String(),
+		})
+
+		abortWithError(c, http.StatusBadRequest, "the form was submitted too quickly, wait a moment and try again")
+
+		return
+	}
+
+	// Bots get the same response as everyone else so they don't learn to avoid the honeypot
+	if request.Website != "" {
+		contactLog.info(ctx, "discarded contact form with filled honeypot", logFields{"client_ip": clientIP(c)})
+
+		respondWithData(c, nil)
+
+		return
+	}
+
+	message := &contactMessage{
+		ID:         newRequestID(),
+		ReceivedAt: time.Now().UTC(),
+		Name:       strings.Join(strings.Fields(request.Name), " "),
+		Email:      strings.TrimSpace(request.Email),
+		Subject:    strings.Join(strings.Fields(request.Subject), " "),
+		Message:    strings.TrimSpace(request.Message),
+		ClientIP:   clientIP(c),
+		UserAgent:  c.Request.UserAgent(),
+		RequestID:  requestIDFromContext(ctx),
+	}
+
+	verdict := ca.spam.score(message.scoredText())
+
+	message.SpamScore = verdict.Score
+	message.SpamReasons = verdict.Reasons
+	message.Spam = verdict.Score >= config.SpamThreshold
+
+	if err := ca.store.save(message); err != nil {
+		contactLog.error(ctx, "could not store contact message", logFields{"error": err})
+
+		abortWithError(c, http.StatusInternalServerError, "could not send your message, try again later")
+
+		return
+	}
+
+	contactLog.info(ctx, "contact message received", logFields{
+		"message_id": message.ID,
+		"spam":       message.Spam,
+		"spam_score": message.SpamScore,
+	})
+
+	if notifyTo := config.NotifyTo; !message.Spam && len(notifyTo) != 0 {
+		replyTo := &mail.Address{Name: message.Name, Address: message.Email}
+
+		// The message is already stored, so a failure here is only worth logging
+		if _, err := ca.outbox.enqueue(ctx, "contact_notification", notifyTo, replyTo, message); err != nil {
+			contactLog.error(ctx, "could not queue contact notification", logFields{
+				"message_id": message.ID,
+				"error":      err,
+			})
+		}
+	}
+
+	respondWithData(c, nil)
+}
+
+func (ca *contactAPI) listMessages(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+
+	if err != nil || limit < 1 || limit > 1000 {
+		abortWithError(c, http.StatusBadRequest, "limit must be between 1 and 1000")
+
+		return
+	}
+
+	spamFilter := c.Query("spam")
+
+	if spamFilter != "" && spamFilter != "true" && spamFilter != "false" {
+		abortWithError(c, http.StatusBadRequest, "spam must be true or false")
+
+		return
+	}
+
+	messages, err := ca.store.list()
+
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, "could not list messages")
+
+		return
+	}
+
+	filtered := make([]contactMessage, 0, len(messages))
+
+	for _, message := range messages {
+		if spamFilter != "" && strconv.FormatBool(message.Spam) != spamFilter {
+			continue
+		}
+
+		filtered = append(filtered, message)
+
+		if len(filtered) == limit {
+			break
+		}
+	}
+
+	respondWithData(c, filtered)
+}
+
+// readMessage returns a message, marking it as read the first time
+func (ca *contactAPI) readMessage(c *gin.Context) {
+	message, err := ca.store.update(c.Param("messageID"), func(message *contactMessage) error {
+		if message.ReadAt == nil {
+			readAt := time.Now().UTC()
+
+			message.ReadAt = &readAt
+		}
+
+		return nil
+	})
+
+	if err == errContactMessageNotFound {
+		abortWithError(c, http.StatusNotFound, err.Error())
+
+		return
+	}
+
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, "could not read message")
+
+		return
+	}
+
+	respondWithData(c, message)
+}
+
+func (ca *contactAPI) deleteMessage(c *gin.Context) {
+	err := ca.store.delete(c.Param("messageID"))
+
+	if err == errContactMessageNotFound {
+		abortWithError(c, http.StatusNotFound, err.Error())
+
+		return
+	}
+
+	ca.audit.recordRequest(c, "contact.delete", c.Param("messageID"), nil, err)
+
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, "could not delete message")
+
+		return
+	}
+
+	respondWithData(c, nil)
+}
+
+type classifyMessageRequest struct {
+	Spam *bool `json:"spam" binding:"required"`
+}
+
+// classifyMessage corrects whether a message is spam, training the spam model with it
+func (ca *contactAPI) classifyMessage(c *gin.Context) {
+	var request classifyMessageRequest
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		abortWithError(c, http.StatusBadRequest, bindingErrorMessage(err))
+
+		return
+	}
+
+	label := contactLabelHam
+
+	if *request.Spam {
+		label = contactLabelSpam
+	}
+
+	var previousLabel string
+
+	message, err := ca.store.update(c.Param("messageID"), func(message *contactMessage) error {
+		previousLabel = message.TrainedAs
+
+		message.Spam = *request.Spam
+		message.TrainedAs = label
+
+		return nil
+	})
+
+	if err == errContactMessageNotFound {
+		abortWithError(c, http.StatusNotFound, err.Error())
+
+		return
+	}
+
+	// The label is saved before training, a failure then leaves the model a message
+	// short rather than counting it twice when the classification is retried
+	if err == nil && previousLabel != label {
+		err = ca.spam.train(message.scoredText(), *request.Spam, previousLabel)
+	}
+
+	ca.audit.recordRequest(c, "contact.classify", c.Param("messageID"), gin.H{"spam": *request.Spam}, err)
+
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, "could not classify message")
+
+		return
+	}
+
+	respondWithData(c, message)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	passwordHashScheme = "pbkdf2-sha256"
+	passwordSaltLength = 16
+	passwordKeyLength  = 32
+
+	totpPeriod = 30
+	totpDigits = 6
+)
+
+// pbkdf2SHA256 derives a key as described in RFC 8018, x/crypto isn't vendored
+func pbkdf2SHA256(password, salt []byte, iterations, keyLength int) []byte {
+	prf := hmac.New(sha256.New, password)
+
+	blockCount := (keyLength + prf.Size() - 1) / prf.Size()
+	blockIndex := make([]byte, 4)
+
+	var (
+		derived []byte
+		u       []byte
+	)
+
+	for block := 1; block <= blockCount; block++ {
+		prf.Reset()
+		prf.Write(salt)
+
+		binary.BigEndian.PutUint32(blockIndex, uint32(block))
+
+		prf.Write(blockIndex)
+
+		u = prf.Sum(u[:0])
+
+		t := make([]byte, len(u))
+
+		copy(t, u)
+
+		for iteration := 1; iteration < iterations; iteration++ {
+			prf.Reset()
+			prf.Write(u)
+
+			u = prf.Sum(u[:0])
+
+			for index := range t {
+				t[index] ^= u[index]
+			}
+		}
+
+		derived = append(derived, t...)
+	}
+
+	return derived[:keyLength]
+}
+
+// hashPassword returns "pbkdf2-sha256$<iterations>$<salt>$<key>", the iterations are
+// kept with the hash so they can be raised without invalidating existing passwords
+func hashPassword(password string, iterations int) (string, error) {
+	salt := make([]byte, passwordSaltLength)
+
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := pbkdf2SHA256([]byte(password), salt, iterations, passwordKeyLength)
+
+	return strings.Join([]string{
+		passwordHashScheme,
+		strconv.Itoa(iterations),
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	}, "$"), nil
+}
+
+var errInvalidPasswordHash = errors.New("invalid password hash")
+
+func verifyPassword(password, passwordHash string) (bool, error) {
+	hashParts := strings.Split(passwordHash, "$")
+
+	if len(hashParts) != 4 || hashParts[0] != passwordHashScheme {
+		return false, errInvalidPasswordHash
+	}
+
+	iterations, err := strconv.Atoi(hashParts[1])
+
+	if err != nil || iterations < 1 {
+		return false, errInvalidPasswordHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(hashParts[2])
+
+	if err != nil {
+		return false, errInvalidPasswordHash
+	}
+
+	expectedKey, err := base64.RawStdEncoding.DecodeString(hashParts[3])
+
+	if err != nil || len(expectedKey) == 0 {
+		return false, errInvalidPasswordHash
+	}
+
+	key := pbkdf2SHA256([]byte(password), salt, iterations, len(expectedKey))
+
+	return subtle.ConstantTimeCompare(key, expectedKey) == 1, nil
+}
+
+// newTOTPSecret returns a base32 secret as authenticator apps expect it
+func newTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret), nil
+}
+
+// totpURI is the otpauth:// link authenticator apps enrol from, usually shown as a QR code
+func totpURI(issuer, account, secret string) string {
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {strconv.Itoa(totpDigits)},
+		"period":    {strconv.Itoa(totpPeriod)},
+	}
+
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+account) + "?" + query.Encode()
+}
+
+// hotpCode is the RFC 4226 code for counter
+func hotpCode(secret []byte, counter int64) string {
+	mac := hmac.New(sha1.New, secret)
+	message := make([]byte, 8)
+
+	binary.BigEndian.PutUint64(message, uint64(counter))
+
+	mac.Write(message)
+
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// verifyTOTP checks code against the RFC 6238 codes for the step before, at and after
+// now to allow for clock drift, returning the step it matched
+func verifyTOTP(secret, code string, now time.Time) (int64, bool) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	step := now.Unix() / totpPeriod
+
+	for drift := int64(-1); drift <= 1; drift++ {
+		if subtle.ConstantTimeCompare([]byte(hotpCode(key, step+drift)), []byte(code)) == 1 {
+			return step + drift, true
+		}
+	}
+
+	return 0, false
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+// TestPBKDF2SHA256 uses the RFC 6070 inputs with their widely published HMAC-SHA256
+// results, RFC 6070 itself only covers SHA-1, and the PBKDF2-HMAC-SHA256 vector
+// from RFC 7914 section 11
+func TestPBKDF2SHA256(t *testing.T) {
+	vectors := []struct {
+		password   string
+		salt       string
+		iterations int
+		keyLength  int
+		want       string
+	}{
+		{"password", "salt", 1, 32, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{"password", "salt", 2, 32, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{"password", "salt", 4096, 32, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+		{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096, 40, "348c89dbcbd32b2f32d814b8116e84cf2b17347ebc1800181c4e2a1fb8dd53e1c635518c7dac47e9"},
+		{"pass\x00word", "sa\x00lt", 4096, 16, "89b69d0516f829893c696226650a8687"},
+		{"passwd", "salt", 1, 64, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+	}
+
+	for _, vector := range vectors {
+		got := hex.EncodeToString(pbkdf2SHA256([]byte(vector.password), []byte(vector.salt), vector.iterations, vector.keyLength))
+
+		if got != vector.want {
+			t.Errorf("pbkdf2SHA256(%q, %q, %d, %d) = %s, want %s", vector.password, vector.salt, vector.iterations, vector.keyLength, got, vector.want)
+		}
+	}
+}
+
+// rfc6238Secret is the SHA-1 seed from RFC 6238 appendix B, "12345678901234567890", in base32
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// TestVerifyTOTP checks the SHA-1 codes from RFC 6238 appendix B, which are 8 digits
+// long, so only their last 6 digits are expected
+func TestVerifyTOTP(t *testing.T) {
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+
+	for _, vector := range vectors {
+		now := time.Unix(vector.unix, 0)
+		code := vector.code[len(vector.code)-totpDigits:]
+
+		step, ok := verifyTOTP(rfc6238Secret, code, now)
+
+		if !ok || step != vector.unix/totpPeriod {
+			t.Errorf("verifyTOTP(%s) at %d = %d, %v, want step %d", code, vector.unix, step, ok, vector.unix/totpPeriod)
+		}
+
+		// One step of clock drift either way is allowed, two isn't
+		for _, drift := range []int64{-1, 1} {
+			if _, ok := verifyTOTP(rfc6238Secret, code, now.Add(time.Duration(drift*totpPeriod)*time.Second)); !ok {
+				t.Errorf("verifyTOTP(%s) at %d should allow a step of drift by %d", code, vector.unix, drift)
+			}
+		}
+
+		for _, drift := range []int64{-2, 2} {
+			// Times before 1970 round to step 0 as well, so there's no step two before it
+			if vector.unix+drift*totpPeriod < 0 {
+				continue
+			}
+
+			if _, ok := verifyTOTP(rfc6238Secret, code, now.Add(time.Duration(drift*totpPeriod)*time.Second)); ok {
+				t.Errorf("verifyTOTP(%s) at %d accepted a code %d steps away", code, vector.unix, drift)
+			}
+		}
+	}
+
+	if _, ok := verifyTOTP(rfc6238Secret, "2870820", time.Unix(59, 0)); ok {
+		t.Error("verifyTOTP accepted a code with the wrong number of digits")
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+type smtpConfig struct {
+	Addr     string `yaml:"addr" env:"SMTP_ADDR" validate:"omitempty,hostname_port"`
+	Username string `yaml:"username" env:"SMTP_USERNAME"`
+	Password string `yaml:"password" env:"SMTP_PASSWORD" secret:"true"`
+	// Bounds the whole conversation with the server, connections are upgraded
+	// with STARTTLS whenever the server offers it
+	Timeout time.Duration `yaml:"timeout" env:"SMTP_TIMEOUT" validate:"mindur=1s"`
+}
+
+type emailConfig struct {
+	// "smtp" delivers mail, "file" writes each message to an .eml file in file_dir instead
+	Sender string `yaml:"sender" env:"EMAIL_SENDER" validate:"oneof=file smtp"`
+	From   string `yaml:"from" env:"EMAIL_FROM" validate:"required,email"`
+	// Defaults to the mail directory in data_dir
+	FileDir         string        `yaml:"file_dir" env:"EMAIL_FILE_DIR"`
+	SMTP            smtpConfig    `yaml:"smtp"`
+	MaxAttempts     int           `yaml:"max_attempts" env:"EMAIL_MAX_ATTEMPTS" validate:"min=1" reload:"true"`
+	RetryBackoff    time.Duration `yaml:"retry_backoff" env:"EMAIL_RETRY_BACKOFF" validate:"mindur=1s" reload:"true"`
+	MaxRetryBackoff time.Duration `yaml:"max_retry_backoff" env:"EMAIL_MAX_RETRY_BACKOFF" validate:"mindur=1s" reload:"true"`
+	PollInterval    time.Duration `yaml:"poll_interval" env:"EMAIL_POLL_INTERVAL" validate:"mindur=1s"`
+}
+
+func defaultEmailConfig() emailConfig {
+	return emailConfig{
+		Sender: "file",
+		From:   "no-reply@therileyjohnson.com",
+		SMTP: smtpConfig{
+			Timeout: time.Second * 30,
+		},
+		MaxAttempts:     8,
+		RetryBackoff:    time.Second * 30,
+		MaxRetryBackoff: time.Hour,
+		PollInterval:    time.Second * 10,
+	}
+}
+
+type emailTemplate struct {
+	subject *texttemplate.Template
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+func mustParseEmailTemplate(name, subject, text, html string) *emailTemplate {
+	return &emailTemplate{
+		subject: texttemplate.Must(texttemplate.New(name + ".subject").Parse(subject)),
+		text:    texttemplate.Must(texttemplate.New(name + ".txt").Parse(text)),
+		html:    htmltemplate.Must(htmltemplate.New(name + ".html").Parse(html)),
+	}
+}
+
+type renderedEmail struct {
+	Subject  string
+	TextBody string
+	HTMLBody string
+}
+
+func renderEmailTemplate(templateName string, data interface{}) (renderedEmail, error) {
+	template, ok := emailTemplates[templateName]
+
+	if !ok {
+		return renderedEmail{}, fmt.Errorf("unknown email template %q", templateName)
+	}
+
+	var subject, text, html bytes.Buffer
+
+	if err := template.subject.Execute(&subject, data); err != nil {
+		return renderedEmail{}, err
+	}
+
+	if err := template.text.Execute(&text, data); err != nil {
+		return renderedEmail{}, err
+	}
+
+	if err := template.html.Execute(&html, data); err != nil {
+		return renderedEmail{}, err
+	}
+
+	return renderedEmail{
+		// Subjects are a single header line whatever the data contained
+		Subject:  strings.Join(strings.Fields(subject.String()), " "),
+		TextBody: text.String(),
+		HTMLBody: html.String(),
+	}, nil
+}
+
+// buildMIMEMessage renders an email as a multipart/alternative message with plain text and HTML parts
+func buildMIMEMessage(email *outboxEmail) ([]byte, error) {
+	var message bytes.Buffer
+
+	bodyWriter := multipart.NewWriter(&message)
+
+	headers := []string{
+		"From: " + (&mail.Address{Address: email.From}).String(),
+		"To: " + strings.Join(email.To, ", "),
+	}
+
+	if email.ReplyTo != "" {
+		headers = append(headers, "Reply-To: "+email.ReplyTo)
+	}
+
+	// One click unsubscribing as described in RFC 8058
+	if email.ListUnsubscribe != "" {
+		headers = append(headers,
+			"List-Unsubscribe: <"+email.ListUnsubscribe+">",
+			"List-Unsubscribe-Post: List-Unsubscribe=One-Click",
+		)
+	}
+
+	messageIDDomain := "localhost"
+
+	if atIndex := strings.LastIndex(email.From, "@"); atIndex != -1 {
+		messageIDDomain = email.From[atIndex+1:]
+	}
+
+	headers = append(headers,
+		"Subject: "+mime.QEncoding.Encode("utf-8", email.Subject),
+		"Date: "+email.CreatedAt.Format(time.RFC1123Z),
+		"Message-ID: <"+email.ID+"@"+messageIDDomain+">",
+		"MIME-Version: 1.0",
+		`Content-Type: multipart/alternative; boundary="`+bodyWriter.Boundary()+`"`,
+	)
+
+	message.WriteString(strings.Join(headers, "\r\n") + "\r\n\r\n")
+
+	parts := []struct {
+		contentType string
+		body        string
+	}{
+		{"text/plain; charset=utf-8", email.TextBody},
+		{"text/html; charset=utf-8", email.HTMLBody},
+	}
+
+	for _, part := range parts {
+		partWriter, err := bodyWriter.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		quotedWriter := quotedprintable.NewWriter(partWriter)
+
+		if _, err = quotedWriter.Write([]byte(part.body)); err != nil {
+			return nil, err
+		}
+
+		if err = quotedWriter.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := bodyWriter.Close(); err != nil {
+		return nil, err
+	}
+
+	return message.Bytes(), nil
+}
+
+// mailSender delivers a built message, the email is passed along for its envelope
+type mailSender interface {
+	send(ctx context.Context, email *outboxEmail, message []byte) error
+}
+
+func newMailSender(config emailConfig, dataDirectory string) (mailSender, error) {
+	switch config.Sender {
+	case "smtp":
+		if config.SMTP.Addr == "" {
+			return nil, errors.New("email.smtp.addr is required when email.sender is smtp")
+		}
+
+		return &smtpSender{config: config.SMTP}, nil
+	case "file":
+		directory := config.FileDir
+
+		if directory == "" {
+			directory = filepath.Join(dataDirectory, "mail")
+		}
+
+		return &fileSender{directory: directory}, nil
+	default:
+		return nil, fmt.Errorf("unknown email sender %q", config.Sender)
+	}
+}
+
+// fileSender stands in for a mail server in development, each message is written
+// to an .eml file which mail clients can open
+type fileSender struct {
+	directory string
+}
+
+func (fs *fileSender) send(ctx context.Context, email *outboxEmail, message []byte) error {
+	fileName := fmt.Sprintf("%d-%s.eml", email.CreatedAt.UnixNano(), email.ID)
+
+	return writeFileAtomic(filepath.Join(fs.directory, fileName), message)
+}
+
+type smtpSender struct {
+	config smtpConfig
+}
+
+func (ss *smtpSender) send(ctx context.Context, email *outboxEmail, message []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, ss.config.Timeout)
+	defer cancel()
+
+	dialer := &net.Dialer{}
+
+	conn, err := dialer.DialContext(ctx, "tcp", ss.config.Addr)
+
+	if err != nil {
+		return err
+	}
+
+	deadline, _ := ctx.Deadline()
+
+	conn.SetDeadline(deadline)
+
+	host, _, _ := net.SplitHostPort(ss.config.Addr)
+
+	client, err := smtp.NewClient(conn, host)
+
+	if err != nil {
+		conn.Close()
+
+		return err
+	}
+
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err = client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+
+	if ss.config.Username != "" {
+		// PlainAuth refuses to send credentials over unencrypted connections to anything but localhost
+		if err = client.Auth(smtp.PlainAuth("", ss.config.Username, ss.config.Password, host)); err != nil {
+			return err
+		}
+	}
+
+	if err = client.Mail(email.From); err != nil {
+		return err
+	}
+
+	for _, recipient := range email.To {
+		address, err := mail.ParseAddress(recipient)
+
+		if err != nil {
+			return err
+		}
+
+		if err = client.Rcpt(address.Address); err != nil {
+			return err
+		}
+	}
+
+	dataWriter, err := client.Data()
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = dataWriter.Write(message); err != nil {
+		return err
+	}
+
+	if err = dataWriter.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
@@ -0,0 +1,121 @@
+package main
+
+// Built in email templates, each has a text/template subject and plain text body
+// and an html/template HTML body, all rendered with the same data
+
+const contactNotificationSubject = `New message from {{.Name}}{{if .Subject}}: {{.Subject}}{{end}}`
+
+const contactNotificationText = `{{.Name}} <{{.Email}}> sent a message through the contact form.
+{{if .Subject}}
+Subject: {{.Subject}}
+{{end}}
+{{.Message}}
+
+--
+Received {{.ReceivedAt.Format "Mon, 02 Jan 2006 15:04 MST"}} from {{.ClientIP}}, spam score {{printf "%.2f" .SpamScore}}
+Message ID {{.ID}}, reply to this email to answer {{.Name}}
+`
+
+const contactNotificationHTML = `<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif; line-height: 1.4;">
+  <p><strong>{{.Name}}</strong> &lt;<a href="mailto:{{.Email}}">{{.Email}}</a>&gt; sent a message through the contact form.</p>
+  {{if .Subject}}<p><strong>Subject:</strong> {{.Subject}}</p>{{end}}
+  <blockquote style="border-left: 3px solid #ccc; margin: 0; padding-left: 12px; white-space: pre-wrap;">{{.Message}}</blockquote>
+  <p style="color: #777; font-size: 12px;">
+    Received {{.ReceivedAt.Format "Mon, 02 Jan 2006 15:04 MST"}} from {{.ClientIP}}, spam score {{printf "%.2f" .SpamScore}}<br>
+    Message ID {{.ID}}, reply to this email to answer {{.Name}}
+  </p>
+</body>
+</html>
+`
+
+const commentNotificationSubject = `New comment from {{.Author}} on {{.PostSlug}}`
+
+const commentNotificationText = `{{.Author}} <{{.Email}}> commented on {{.PostSlug}}{{if .ParentID}} in reply to comment {{.ParentID}}{{end}}, it is waiting for moderation.
+
+{{.Body}}
+
+--
+Received {{.CreatedAt.Format "Mon, 02 Jan 2006 15:04 MST"}} from {{.ClientIP}}, spam score {{printf "%.2f" .SpamScore}}
+Comment ID {{.ID}}, approve or reject it through the admin API
+`
+
+const commentNotificationHTML = `<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif; line-height: 1.4;">
+  <p><strong>{{.Author}}</strong> &lt;<a href="mailto:{{.Email}}">{{.Email}}</a>&gt; commented on <strong>{{.PostSlug}}</strong>{{if .ParentID}} in reply to comment {{.ParentID}}{{end}}, it is waiting for moderation.</p>
+  <blockquote style="border-left: 3px solid #ccc; margin: 0; padding-left: 12px; white-space: pre-wrap;">{{.Body}}</blockquote>
+  <p style="color: #777; font-size: 12px;">
+    Received {{.CreatedAt.Format "Mon, 02 Jan 2006 15:04 MST"}} from {{.ClientIP}}, spam score {{printf "%.2f" .SpamScore}}<br>
+    Comment ID {{.ID}}, approve or reject it through the admin API
+  </p>
+</body>
+</html>
+`
+
+const newsletterConfirmationSubject = `Confirm your subscription to {{.SiteTitle}}`
+
+const newsletterConfirmationText = `Someone, hopefully you, asked to get emails from {{.SiteTitle}} when there are new posts or songs.
+
+Confirm your subscription by opening this link:
+{{.ConfirmURL}}
+
+The link expires {{.ExpiresAt.Format "Mon, 02 Jan 2006 15:04 MST"}}. If you didn't ask for this, ignore this email and you won't hear from us again.
+`
+
+const newsletterConfirmationHTML = `<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif; line-height: 1.4;">
+  <p>Someone, hopefully you, asked to get emails from {{.SiteTitle}} when there are new posts or songs.</p>
+  <p><a href="{{.ConfirmURL}}">Confirm your subscription</a></p>
+  <p style="color: #777; font-size: 12px;">
+    The link expires {{.ExpiresAt.Format "Mon, 02 Jan 2006 15:04 MST"}}. If you didn't ask for this, ignore this email and you won't hear from us again.
+  </p>
+</body>
+</html>
+`
+
+const newsletterDigestSubject = `New on {{.SiteTitle}}{{if .Posts}}: {{(index .Posts 0).Title}}{{end}}`
+
+const newsletterDigestText = `Here's what is new on {{.SiteTitle}} since {{.Since.Format "Mon, 02 Jan 2006"}}.
+{{if .Posts}}
+Posts
+
+{{range .Posts}}{{.Title}}
+{{.URL}}
+{{if .Excerpt}}{{.Excerpt}}
+{{end}}
+{{end}}{{end}}{{if .Tracks}}
+Added to the playlist
+
+{{range .Tracks}}{{.Title}} by {{.Artist}}{{if .URL}}
+{{.URL}}{{end}}
+{{end}}{{end}}
+--
+Unsubscribe: {{.UnsubscribeURL}}
+`
+
+const newsletterDigestHTML = `<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif; line-height: 1.4;">
+  <p>Here's what is new on <a href="{{.SiteURL}}">{{.SiteTitle}}</a> since {{.Since.Format "Mon, 02 Jan 2006"}}.</p>
+  {{if .Posts}}<h2>Posts</h2>
+  {{range .Posts}}<p><a href="{{.URL}}"><strong>{{.Title}}</strong></a>{{if .Excerpt}}<br>{{.Excerpt}}{{end}}</p>
+  {{end}}{{end}}{{if .Tracks}}<h2>Added to the playlist</h2>
+  <ul>
+  {{range .Tracks}}<li>{{if .URL}}<a href="{{.URL}}">{{.Title}}</a>{{else}}{{.Title}}{{end}} by {{.Artist}}</li>
+  {{end}}</ul>{{end}}
+  <p style="color: #777; font-size: 12px;">
+    You're getting this because you subscribed on {{.SiteTitle}}, <a href="{{.UnsubscribeURL}}">unsubscribe</a>
+  </p>
+</body>
+</html>
+`
+
+var emailTemplates = map[string]*emailTemplate{
+	"contact_notification":    mustParseEmailTemplate("contact_notification", contactNotificationSubject, contactNotificationText, contactNotificationHTML),
+	"comment_notification":    mustParseEmailTemplate("comment_notification", commentNotificationSubject, commentNotificationText, commentNotificationHTML),
+	"newsletter_confirmation": mustParseEmailTemplate("newsletter_confirmation", newsletterConfirmationSubject, newsletterConfirmationText, newsletterConfirmationHTML),
+	"newsletter_digest":       mustParseEmailTemplate("newsletter_digest", newsletterDigestSubject, newsletterDigestText, newsletterDigestHTML),
+}
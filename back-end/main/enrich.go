@@ -0,0 +1,527 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	_ "image/gif"  // registers GIF for image.DecodeConfig
+	_ "image/jpeg" // registers JPEG for image.DecodeConfig
+	_ "image/png"  // registers PNG for image.DecodeConfig
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/groupcache/lru"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+type enrichConfig struct {
+	WordsPerMinute int `yaml:"words_per_minute" env:"ENRICH_WORDS_PER_MINUTE" validate:"min=50" reload:"true"`
+	// Images from Ghost or the site missing a width or height are downloaded to
+	// measure them, so the page doesn't shift as they lazy-load
+	ProbeImageSizes bool `yaml:"probe_image_sizes" env:"ENRICH_PROBE_IMAGE_SIZES" reload:"true"`
+	// How long measuring a post's images may take altogether, the post is fetched
+	// for a visitor so images not measured by then are left as they are
+	ImageProbeTimeout time.Duration `yaml:"image_probe_timeout" env:"ENRICH_IMAGE_PROBE_TIMEOUT" validate:"mindur=100ms" reload:"true"`
+}
+
+func defaultEnrichConfig() enrichConfig {
+	return enrichConfig{
+		WordsPerMinute:    265,
+		ProbeImageSizes:   true,
+		ImageProbeTimeout: time.Second * 2,
+	}
+}
+
+// PostHeading is an entry in a post's table of contents, headings nest under the
+// closest heading before them with a lower level
+type PostHeading struct {
+	ID       string        `json:"id"`
+	Text     string        `json:"text"`
+	Level    int           `json:"level"`
+	Children []PostHeading `json:"children"`
+}
+
+// EnrichedPost is a post whose HTML has heading anchors and lazy-loading images
+type EnrichedPost struct {
+	Post
+	WordCount       int           `json:"word_count"`
+	CodeLanguages   []string      `json:"code_languages"`
+	TableOfContents []PostHeading `json:"table_of_contents"`
+}
+
+const (
+	// Large images are still only read as far as their header
+	imageProbeMaxBytes = 8 << 20
+
+	imageSizeCacheSize = 1024
+
+	// Images that couldn't be measured are tried again after this
+	imageProbeFailureTTL = time.Minute * 10
+
+	imageProbeConcurrency = 4
+)
+
+type imageSize struct {
+	width  int
+	height int
+	err    error
+	// When a failure stops being remembered
+	retryAt time.Time
+}
+
+// postEnricher rewrites post HTML, measured image sizes are remembered across posts
+type postEnricher struct {
+	config func() enrichConfig
+	// Origins images may be downloaded from to measure them
+	imageOrigins func() []string
+	httpClient   *http.Client
+	imageSizes   *lru.Cache
+	mutex        *sync.Mutex
+}
+
+func newPostEnricher(imageOrigins func() []string, config func() enrichConfig) *postEnricher {
+	return &postEnricher{
+		config:       config,
+		imageOrigins: imageOrigins,
+		httpClient:   &http.Client{},
+		imageSizes:   lru.New(imageSizeCacheSize),
+		mutex:        &sync.Mutex{},
+	}
+}
+
+var enrichLog = newLogger("enrich")
+
+func htmlAttribute(node *html.Node, key string) (string, bool) {
+	for _, attribute := range node.Attr {
+		if attribute.Key == key {
+			return attribute.Val, true
+		}
+	}
+
+	return "", false
+}
+
+func setHTMLAttribute(node *html.Node, key string, value string) {
+	for index := range node.Attr {
+		if node.Attr[index].Key == key {
+			node.Attr[index].Val = value
+
+			return
+		}
+	}
+
+	node.Attr = append(node.Attr, html.Attribute{Key: key, Val: value})
+}
+
+func htmlNodeText(node *html.Node) string {
+	var text strings.Builder
+
+	var walk func(node *html.Node)
+
+	walk = func(node *html.Node) {
+		if node.Type == html.TextNode {
+			text.WriteString(node.Data)
+		}
+
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+
+	walk(node)
+
+	return strings.Join(strings.Fields(text.String()), " ")
+}
+
+// headingID turns heading text into an anchor, "What's New?" becomes "whats-new"
+func headingID(text string) string {
+	var id strings.Builder
+
+	pendingDash := false
+
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case isSearchWordRune(r):
+			if pendingDash && id.Len() != 0 {
+				id.WriteByte('-')
+			}
+
+			id.WriteRune(r)
+
+			pendingDash = false
+		case r == '\'' || r == '’':
+		default:
+			pendingDash = true
+		}
+	}
+
+	if id.Len() == 0 {
+		return "section"
+	}
+
+	return id.String()
+}
+
+var headingLevels = map[atom.Atom]int{
+	atom.H1: 1,
+	atom.H2: 2,
+	atom.H3: 3,
+	atom.H4: 4,
+	atom.H5: 5,
+	atom.H6: 6,
+}
+
+// nestHeadings builds the table of contents from headings in document order
+func nestHeadings(headings []PostHeading) []PostHeading {
+	var nest func(index int, level int) ([]PostHeading, int)
+
+	nest = func(index int, level int) ([]PostHeading, int) {
+		entries := []PostHeading{}
+
+		for index < len(headings) && headings[index].Level > level {
+			entry := headings[index]
+
+			entry.Children, index = nest(index+1, entry.Level)
+			entries = append(entries, entry)
+		}
+
+		return entries, index
+	}
+
+	entries, _ := nest(0, 0)
+
+	return entries
+}
+
+// readingTime follows Medium, words at the configured pace plus 12 seconds for the
+// first image, one less for each after it down to 3
+func readingTime(words int, images int, wordsPerMinute int) int {
+	seconds := float64(words) / float64(wordsPerMinute) * 60
+
+	for index := 0; index < images; index++ {
+		seconds += math.Max(12-float64(index), 3)
+	}
+
+	return int(math.Max(1, math.Ceil(seconds/60)))
+}
+
+// enrich parses the post's HTML to anchor its headings, build its table of contents,
+// count its words and make its images lazy-load without shifting the page
+func (pe *postEnricher) enrich(ctx context.Context, post *Post) (*EnrichedPost, error) {
+	config := pe.config()
+
+	body := &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body}
+
+	nodes, err := html.ParseFragment(strings.NewReader(post.HTML), body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	enriched := &EnrichedPost{
+		Post:          *post,
+		CodeLanguages: []string{},
+	}
+
+	var (
+		headings []PostHeading
+		images   []*html.Node
+		text     strings.Builder
+	)
+
+	usedIDs := make(map[string]bool)
+	seenLanguages := make(map[string]bool)
+
+	// IDs already in the HTML are kept, generated ones must not collide with them
+	var collectIDs func(node *html.Node)
+
+	collectIDs = func(node *html.Node) {
+		if id, ok := htmlAttribute(node, "id"); ok {
+			usedIDs[id] = true
+		}
+
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			collectIDs(child)
+		}
+	}
+
+	for _, node := range nodes {
+		collectIDs(node)
+	}
+
+	var walk func(node *html.Node)
+
+	walk = func(node *html.Node) {
+		switch node.Type {
+		case html.TextNode:
+			text.WriteString(node.Data)
+			text.WriteByte(' ')
+		case html.ElementNode:
+			if level, ok := headingLevels[node.DataAtom]; ok {
+				headingText := htmlNodeText(node)
+				id, hasID := htmlAttribute(node, "id")
+
+				if !hasID || id == "" {
+					baseID := headingID(headingText)
+
+					id = baseID
+
+					for suffix := 2; usedIDs[id]; suffix++ {
+						id = baseID + "-" + strconv.Itoa(suffix)
+					}
+
+					usedIDs[id] = true
+
+					setHTMLAttribute(node, "id", id)
+				}
+
+				headings = append(headings, PostHeading{ID: id, Text: headingText, Level: level})
+			}
+
+			switch node.DataAtom {
+			case atom.Script, atom.Style:
+				return
+			case atom.Img:
+				images = append(images, node)
+			case atom.Code:
+				class, _ := htmlAttribute(node, "class")
+
+				for _, className := range strings.Fields(class) {
+					language := strings.TrimPrefix(strings.TrimPrefix(className, "language-"), "lang-")
+
+					if language != className && language != "" && !seenLanguages[language] {
+						seenLanguages[language] = true
+						enriched.CodeLanguages = append(enriched.CodeLanguages, language)
+					}
+				}
+			}
+		}
+
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+
+	for _, node := range nodes {
+		walk(node)
+	}
+
+	var probed []string
+
+	if config.ProbeImageSizes {
+		for _, img := range images {
+			_, hasWidth := htmlAttribute(img, "width")
+			_, hasHeight := htmlAttribute(img, "height")
+			src, _ := htmlAttribute(img, "src")
+
+			if !(hasWidth && hasHeight) && pe.measurable(src) {
+				probed = append(probed, src)
+			}
+		}
+	}
+
+	sizes := pe.measureImages(ctx, probed, config.ImageProbeTimeout)
+
+	for index, img := range images {
+		// The first image is usually above the fold, lazy-loading it would only delay it
+		if index != 0 {
+			setHTMLAttribute(img, "loading", "lazy")
+		}
+
+		setHTMLAttribute(img, "decoding", "async")
+
+		width, hasWidth := htmlAttribute(img, "width")
+		height, hasHeight := htmlAttribute(img, "height")
+		src, _ := htmlAttribute(img, "src")
+
+		size, measured := sizes[src]
+
+		if (hasWidth && hasHeight) || !measured || size.width == 0 || size.height == 0 {
+			continue
+		}
+
+		// A lone dimension is kept and the other scaled to match the image's aspect ratio
+		if givenWidth, err := strconv.Atoi(width); hasWidth && err == nil {
+			setHTMLAttribute(img, "height", strconv.Itoa(givenWidth*size.height/size.width))
+		} else if givenHeight, err := strconv.Atoi(height); hasHeight && err == nil {
+			setHTMLAttribute(img, "width", strconv.Itoa(givenHeight*size.width/size.height))
+		} else if !hasWidth && !hasHeight {
+			setHTMLAttribute(img, "width", strconv.Itoa(size.width))
+			setHTMLAttribute(img, "height", strconv.Itoa(size.height))
+		}
+	}
+
+	var rendered strings.Builder
+
+	for _, node := range nodes {
+		if err = html.Render(&rendered, node); err != nil {
+			return nil, err
+		}
+	}
+
+	enriched.HTML = rendered.String()
+	enriched.WordCount = len(strings.Fields(text.String()))
+	enriched.ReadingTime = readingTime(enriched.WordCount, len(images), config.WordsPerMinute)
+	enriched.TableOfContents = nestHeadings(headings)
+
+	return enriched, nil
+}
+
+// measurable is whether src is on an origin images may be downloaded from, post
+// HTML can point anywhere and only Ghost and the site are trusted to be fetched
+func (pe *postEnricher) measurable(src string) bool {
+	return onImageOrigin(src, pe.imageOrigins())
+}
+
+// onImageOrigin is whether src is on one of origins, an origin such as
+// "https://*.example.com" covers every subdomain of example.com
+func onImageOrigin(src string, origins []string) bool {
+	srcURL, err := url.Parse(src)
+
+	if err != nil || (srcURL.Scheme != "http" && srcURL.Scheme != "https") {
+		return false
+	}
+
+	for _, origin := range origins {
+		originURL, err := url.Parse(origin)
+
+		if err != nil || srcURL.Scheme != originURL.Scheme {
+			continue
+		}
+
+		if strings.HasPrefix(originURL.Host, "*.") {
+			if strings.HasSuffix(strings.ToLower(srcURL.Host), strings.ToLower(originURL.Host[1:])) {
+				return true
+			}
+		} else if strings.EqualFold(srcURL.Host, originURL.Host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// measureImages measures images concurrently from their headers, giving up on those
+// not measured within timeout. Only the images measured are returned.
+func (pe *postEnricher) measureImages(ctx context.Context, srcs []string, timeout time.Duration) map[string]imageSize {
+	sizes := make(map[string]imageSize)
+
+	if len(srcs) == 0 {
+		return sizes
+	}
+
+	probeCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var (
+		mutex   = &sync.Mutex{}
+		pending = &sync.WaitGroup{}
+		slots   = make(chan struct{}, imageProbeConcurrency)
+		started = make(map[string]bool)
+	)
+
+	for _, src := range srcs {
+		if started[src] {
+			continue
+		}
+
+		started[src] = true
+
+		pending.Add(1)
+
+		go func(src string) {
+			defer pending.Done()
+
+			select {
+			case slots <- struct{}{}:
+			case <-probeCtx.Done():
+				return
+			}
+
+			defer func() { <-slots }()
+
+			size := pe.imageSize(probeCtx, src)
+
+			if size.err == nil {
+				mutex.Lock()
+				sizes[src] = size
+				mutex.Unlock()
+			}
+		}(src)
+	}
+
+	pending.Wait()
+
+	return sizes
+}
+
+// imageSize measures an image from its header, failures are remembered for a while
+// as well so a broken image isn't downloaded for every post render
+func (pe *postEnricher) imageSize(ctx context.Context, src string) imageSize {
+	pe.mutex.Lock()
+
+	cached, ok := pe.imageSizes.Get(src)
+
+	pe.mutex.Unlock()
+
+	if ok && (cached.(imageSize).err == nil || time.Now().Before(cached.(imageSize).retryAt)) {
+		return cached.(imageSize)
+	}
+
+	size := pe.probeImage(ctx, src)
+
+	// Running out of time isn't the image's fault, it's tried again next time
+	if size.err != nil && ctx.Err() != nil {
+		return size
+	}
+
+	if size.err != nil {
+		size.retryAt = time.Now().Add(imageProbeFailureTTL)
+
+		enrichLog.warn(ctx, "could not measure image", logFields{
+			"src":   redactURL(src),
+			"error": size.err,
+		})
+	}
+
+	pe.mutex.Lock()
+	pe.imageSizes.Add(src, size)
+	pe.mutex.Unlock()
+
+	return size
+}
+
+func (pe *postEnricher) probeImage(ctx context.Context, src string) imageSize {
+	req, err := http.NewRequest(http.MethodGet, src, nil)
+
+	if err != nil {
+		return imageSize{err: err}
+	}
+
+	resp, err := pe.httpClient.Do(req.WithContext(ctx))
+
+	if err != nil {
+		return imageSize{err: redactURLError(err)}
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return imageSize{err: fmt.Errorf("image responded with %d", resp.StatusCode)}
+	}
+
+	imageConfig, _, err := image.DecodeConfig(io.LimitReader(resp.Body, imageProbeMaxBytes))
+
+	if err != nil {
+		return imageSize{err: err}
+	}
+
+	return imageSize{width: imageConfig.Width, height: imageConfig.Height}
+}
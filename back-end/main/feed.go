@@ -0,0 +1,433 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type feedConfig struct {
+	MaxItems int `yaml:"max_items" env:"FEED_MAX_ITEMS" validate:"min=1,max=100" reload:"true"`
+	// Whether entries carry the full post or only its excerpt, ?content= overrides it
+	Content string `yaml:"content" env:"FEED_CONTENT" validate:"oneof=full excerpt" reload:"true"`
+}
+
+func defaultFeedConfig() feedConfig {
+	return feedConfig{
+		MaxItems: 20,
+		Content:  "full",
+	}
+}
+
+const (
+	feedFormatRSS  = "feed.rss"
+	feedFormatAtom = "feed.atom"
+)
+
+type rssGUID struct {
+	IsPermaLink string `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssItem struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	GUID        rssGUID  `xml:"guid"`
+	PubDate     string   `xml:"pubDate"`
+	Creators    []string `xml:"dc:creator"`
+	Categories  []string `xml:"category"`
+	Description string   `xml:"description"`
+	Content     string   `xml:"content:encoded,omitempty"`
+}
+
+type rssAtomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type rssChannel struct {
+	Title         string      `xml:"title"`
+	Link          string      `xml:"link"`
+	Description   string      `xml:"description"`
+	SelfLink      rssAtomLink `xml:"atom:link"`
+	LastBuildDate string      `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem   `xml:"item"`
+}
+
+type rssFeed struct {
+	XMLName          xml.Name   `xml:"rss"`
+	Version          string     `xml:"version,attr"`
+	AtomNamespace    string     `xml:"xmlns:atom,attr"`
+	ContentNamespace string     `xml:"xmlns:content,attr"`
+	DCNamespace      string     `xml:"xmlns:dc,attr"`
+	Channel          rssChannel `xml:"channel"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomText struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomCategory struct {
+	Term  string `xml:"term,attr"`
+	Label string `xml:"label,attr,omitempty"`
+}
+
+type atomEntry struct {
+	ID         string         `xml:"id"`
+	Title      string         `xml:"title"`
+	Links      []atomLink     `xml:"link"`
+	Published  string         `xml:"published"`
+	Updated    string         `xml:"updated"`
+	Authors    []atomPerson   `xml:"author"`
+	Categories []atomCategory `xml:"category"`
+	Summary    *atomText      `xml:"summary,omitempty"`
+	Content    *atomText      `xml:"content,omitempty"`
+}
+
+type atomFeed struct {
+	XMLName  xml.Name    `xml:"feed"`
+	Xmlns    string      `xml:"xmlns,attr"`
+	ID       string      `xml:"id"`
+	Title    string      `xml:"title"`
+	Subtitle string      `xml:"subtitle,omitempty"`
+	Updated  string      `xml:"updated"`
+	Links    []atomLink  `xml:"link"`
+	Entries  []atomEntry `xml:"entry"`
+}
+
+// postFeeds serves RSS and Atom feeds of the latest posts, linking to the Next.js
+// pages rather than Ghost's own
+type postFeeds struct {
+	config func() feedConfig
+	ghost  func() ghostConfig
+	posts  *postService
+	site   func() siteConfig
+}
+
+func newPostFeeds(posts *postService, site func() siteConfig, ghost func() ghostConfig, config func() feedConfig) *postFeeds {
+	return &postFeeds{
+		config: config,
+		ghost:  ghost,
+		posts:  posts,
+		site:   site,
+	}
+}
+
+// orPost serves the feeds from the /posts/:slug route, gin can't route them beside
+// it and slugs never contain dots
+func (pf *postFeeds) orPost(handlePost gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Param("slug") {
+		case feedFormatRSS, feedFormatAtom:
+			pf.handleFeed(c)
+		default:
+			handlePost(c)
+		}
+	}
+}
+
+var ghostLinkPattern = regexp.MustCompile(`href="([^"]*)"`)
+
+// rewriteGhostLinks points links to posts on Ghost's site at the Next.js pages,
+// ghostRoot is the URL Ghost serves posts under
+func rewriteGhostLinks(html string, ghostRoot string, site siteConfig) string {
+	if ghostRoot == "" {
+		return html
+	}
+
+	return ghostLinkPattern.ReplaceAllStringFunc(html, func(attribute string) string {
+		link := ghostLinkPattern.FindStringSubmatch(attribute)[1]
+
+		if !strings.HasPrefix(link, ghostRoot) {
+			return attribute
+		}
+
+		slug := strings.TrimSuffix(strings.TrimPrefix(link, ghostRoot), "/")
+		fragment := ""
+
+		if index := strings.Index(slug, "#"); index != -1 {
+			slug, fragment = strings.TrimSuffix(slug[:index], "/"), slug[index:]
+		}
+
+		if !validSlug(slug) {
+			return attribute
+		}
+
+		return `href="` + site.absoluteURL("/posts/"+slug) + fragment + `"`
+	})
+}
+
+// ghostPostRoot works out where Ghost serves posts from its URL for one of them
+func ghostPostRoot(post Post) string {
+	if !strings.HasSuffix(post.URL, "/"+post.Slug+"/") {
+		return ""
+	}
+
+	return strings.TrimSuffix(post.URL, post.Slug+"/")
+}
+
+func postSummary(post Post) string {
+	if post.CustomExcerpt != nil && *post.CustomExcerpt != "" {
+		return *post.CustomExcerpt
+	}
+
+	return post.Excerpt
+}
+
+func (pf *postFeeds) buildRSS(posts []Post, tag string, selfURL string, fullContent bool, updated time.Time) interface{} {
+	site := pf.site()
+
+	feed := rssFeed{
+		Version:          "2.0",
+		AtomNamespace:    "http://www.w3.org/2005/Atom",
+		ContentNamespace: "http://purl.org/rss/1.0/modules/content/",
+		DCNamespace:      "http://purl.org/dc/elements/1.1/",
+		Channel: rssChannel{
+			Title:       feedTitle(site, posts, tag),
+			Link:        site.absoluteURL("/posts"),
+			Description: site.Description,
+			SelfLink: rssAtomLink{
+				Href: selfURL,
+				Rel:  "self",
+				Type: "application/rss+xml",
+			},
+			Items: make([]rssItem, 0, len(posts)),
+		},
+	}
+
+	if !updated.IsZero() {
+		feed.Channel.LastBuildDate = updated.UTC().Format(time.RFC1123Z)
+	}
+
+	for _, post := range posts {
+		item := rssItem{
+			Title:       post.Title,
+			Link:        site.absoluteURL("/posts/" + post.Slug),
+			GUID:        rssGUID{IsPermaLink: "false", Value: post.UUID},
+			PubDate:     post.PublishedAt.UTC().Format(time.RFC1123Z),
+			Description: postSummary(post),
+		}
+
+		for _, author := range post.Authors {
+			item.Creators = append(item.Creators, author.Name)
+		}
+
+		for _, postTag := range post.Tags {
+			item.Categories = append(item.Categories, postTag.Name)
+		}
+
+		if fullContent {
+			item.Content = rewriteGhostLinks(post.HTML, ghostPostRoot(post), site)
+		}
+
+		feed.Channel.Items = append(feed.Channel.Items, item)
+	}
+
+	return feed
+}
+
+func (pf *postFeeds) buildAtom(posts []Post, tag string, selfURL string, fullContent bool, updated time.Time) interface{} {
+	site := pf.site()
+
+	if updated.IsZero() {
+		updated = time.Now()
+	}
+
+	feed := atomFeed{
+		Xmlns:    "http://www.w3.org/2005/Atom",
+		ID:       selfURL,
+		Title:    feedTitle(site, posts, tag),
+		Subtitle: site.Description,
+		Updated:  updated.UTC().Format(time.RFC3339),
+		Links: []atomLink{
+			{Href: selfURL, Rel: "self", Type: "application/atom+xml"},
+			{Href: site.absoluteURL("/posts"), Rel: "alternate", Type: "text/html"},
+		},
+		Entries: make([]atomEntry, 0, len(posts)),
+	}
+
+	for _, post := range posts {
+		entry := atomEntry{
+			ID:        "urn:uuid:" + post.UUID,
+			Title:     post.Title,
+			Links:     []atomLink{{Href: site.absoluteURL("/posts/" + post.Slug), Rel: "alternate", Type: "text/html"}},
+			Published: post.PublishedAt.UTC().Format(time.RFC3339),
+			Updated:   post.UpdatedAt.UTC().Format(time.RFC3339),
+			Summary:   &atomText{Type: "text", Value: postSummary(post)},
+		}
+
+		for _, author := range post.Authors {
+			entry.Authors = append(entry.Authors, atomPerson{Name: author.Name})
+		}
+
+		for _, postTag := range post.Tags {
+			entry.Categories = append(entry.Categories, atomCategory{Term: postTag.Slug, Label: postTag.Name})
+		}
+
+		if fullContent {
+			entry.Content = &atomText{Type: "html", Value: rewriteGhostLinks(post.HTML, ghostPostRoot(post), site)}
+		}
+
+		feed.Entries = append(feed.Entries, entry)
+	}
+
+	return feed
+}
+
+// feedTitle names tag feeds after the tag, Ghost is only asked for its slug
+func feedTitle(site siteConfig, posts []Post, tag string) string {
+	if tag == "" {
+		return site.Title
+	}
+
+	for _, post := range posts {
+		for _, postTag := range post.Tags {
+			if postTag.Slug == tag {
+				return site.Title + " - " + postTag.Name
+			}
+		}
+	}
+
+	return site.Title + " - " + tag
+}
+
+type feedQuery struct {
+	Tag     string `form:"tag" json:"tag"`
+	Content string `form:"content" json:"content" binding:"omitempty,oneof=full excerpt"`
+}
+
+func (pf *postFeeds) handleFeed(c *gin.Context) {
+	var request feedQuery
+
+	if err := c.ShouldBindQuery(&request); err != nil {
+		abortWithError(c, http.StatusBadRequest, bindingErrorMessage(err))
+
+		return
+	}
+
+	if request.Tag != "" && !validSlug(request.Tag) {
+		abortWithError(c, http.StatusBadRequest, "tag must be a slug")
+
+		return
+	}
+
+	config := pf.config()
+
+	if request.Content == "" {
+		request.Content = config.Content
+	}
+
+	page, cacheStatus, err := pf.posts.listPosts(c.Request.Context(), ghostPostsQuery{
+		Page:  1,
+		Limit: config.MaxItems,
+		Tag:   request.Tag,
+	})
+
+	if err != nil {
+		abortWithError(c, http.StatusBadGateway, "posts are unavailable right now")
+
+		return
+	}
+
+	var updated time.Time
+
+	for _, post := range page.Posts {
+		if post.UpdatedAt.After(updated) {
+			updated = post.UpdatedAt
+		}
+	}
+
+	format := c.Param("slug")
+	selfQuery := url.Values{}
+
+	if request.Tag != "" {
+		selfQuery.Set("tag", request.Tag)
+	}
+
+	selfURL := pf.site().absoluteURL("/api/posts/" + format)
+
+	if len(selfQuery) != 0 {
+		selfURL += "?" + selfQuery.Encode()
+	}
+
+	fullContent := request.Content == "full"
+
+	var (
+		feed        interface{}
+		contentType string
+	)
+
+	if format == feedFormatAtom {
+		feed = pf.buildAtom(page.Posts, request.Tag, selfURL, fullContent, updated)
+		contentType = "application/atom+xml; charset=utf-8"
+	} else {
+		feed = pf.buildRSS(page.Posts, request.Tag, selfURL, fullContent, updated)
+		contentType = "application/rss+xml; charset=utf-8"
+	}
+
+	body, err := marshalXMLDocument(feed)
+
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, "could not build feed")
+
+		return
+	}
+
+	digest := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(digest[:16]) + `"`
+
+	c.Header("X-Cache", cacheStatus)
+	c.Header("Cache-Control", "public, max-age="+strconv.Itoa(int(pf.ghost().CacheTTL.Seconds())))
+	c.Header("ETag", etag)
+
+	if !updated.IsZero() {
+		c.Header("Last-Modified", updated.UTC().Format(http.TimeFormat))
+	}
+
+	if feedNotModified(c.Request, etag, updated) {
+		c.Status(http.StatusNotModified)
+
+		return
+	}
+
+	c.Data(http.StatusOK, contentType, body)
+}
+
+// feedNotModified follows RFC 7232, If-None-Match takes precedence over If-Modified-Since
+func feedNotModified(req *http.Request, etag string, updated time.Time) bool {
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+
+			if candidate == etag || candidate == "*" {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	ifModifiedSince, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+
+	return err == nil && !updated.IsZero() && !updated.Truncate(time.Second).After(ifModifiedSince)
+}
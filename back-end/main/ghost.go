@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ghostConfig struct {
+	// Where Ghost is served from, the Content API lives under /ghost/api/v3/content
+	URL string `yaml:"url" env:"GHOST_URL" validate:"required,url"`
+	Key string `yaml:"key" env:"GHOST_KEY" secret:"true"`
+	// Shared with Ghost's webhooks to sign deliveries, /api/hooks/ghost is disabled when empty
+	WebhookSecret string `yaml:"webhook_secret" env:"GHOST_WEBHOOK_SECRET" secret:"true" reload:"true"`
+	// Responses younger than this are served from the cache, older ones are refetched
+	// but still served when Ghost can't be reached
+	CacheTTL  time.Duration `yaml:"cache_ttl" env:"GHOST_CACHE_TTL" validate:"mindur=1s" reload:"true"`
+	CacheSize int           `yaml:"cache_size" env:"GHOST_CACHE_SIZE" validate:"min=1"`
+	Timeout   time.Duration `yaml:"timeout" env:"GHOST_TIMEOUT" validate:"mindur=1s"`
+}
+
+func defaultGhostConfig() ghostConfig {
+	return ghostConfig{
+		URL:       "http://ghost:2368/cms",
+		CacheTTL:  time.Minute,
+		CacheSize: 256,
+		Timeout:   time.Second * 10,
+	}
+}
+
+// Post is a published blog post as served by /api/posts
+type Post struct {
+	ID              string       `json:"id"`
+	UUID            string       `json:"uuid"`
+	Title           string       `json:"title"`
+	Slug            string       `json:"slug"`
+	HTML            string       `json:"html"`
+	Excerpt         string       `json:"excerpt"`
+	CustomExcerpt   *string      `json:"custom_excerpt"`
+	FeatureImage    *string      `json:"feature_image"`
+	Featured        bool         `json:"featured"`
+	URL             string       `json:"url"`
+	CanonicalURL    *string      `json:"canonical_url"`
+	MetaTitle       *string      `json:"meta_title"`
+	MetaDescription *string      `json:"meta_description"`
+	ReadingTime     int          `json:"reading_time"`
+	CreatedAt       time.Time    `json:"created_at"`
+	UpdatedAt       time.Time    `json:"updated_at"`
+	PublishedAt     time.Time    `json:"published_at"`
+	Tags            []PostTag    `json:"tags"`
+	Authors         []PostAuthor `json:"authors"`
+	PrimaryTag      *PostTag     `json:"primary_tag"`
+	PrimaryAuthor   *PostAuthor  `json:"primary_author"`
+}
+
+type PostTag struct {
+	ID          string  `json:"id"`
+	Name        string  `json:"name"`
+	Slug        string  `json:"slug"`
+	Description *string `json:"description"`
+	Visibility  string  `json:"visibility"`
+}
+
+type PostAuthor struct {
+	ID           string  `json:"id"`
+	Name         string  `json:"name"`
+	Slug         string  `json:"slug"`
+	ProfileImage *string `json:"profile_image"`
+	Bio          *string `json:"bio"`
+	Website      *string `json:"website"`
+}
+
+type Pagination struct {
+	Page  int  `json:"page"`
+	Limit int  `json:"limit"`
+	Pages int  `json:"pages"`
+	Total int  `json:"total"`
+	Next  *int `json:"next"`
+	Prev  *int `json:"prev"`
+}
+
+type PostsPage struct {
+	Posts      []Post     `json:"posts"`
+	Pagination Pagination `json:"pagination"`
+}
+
+var errGhostNotFound = errors.New("not found in ghost")
+
+// Background jobs that failed to reach Ghost try again after this rather than waiting out their interval
+const ghostRetryDelay = time.Minute
+
+// ghostPostsQuery selects a page of posts, tag and author are slugs
+type ghostPostsQuery struct {
+	Page   int
+	Limit  int
+	Tag    string
+	Author string
+}
+
+// ghostClient talks to the Ghost Content API v3
+type ghostClient struct {
+	baseURL    string
+	key        string
+	httpClient *http.Client
+}
+
+func newGhostClient(config ghostConfig) *ghostClient {
+	return &ghostClient{
+		baseURL: strings.TrimRight(config.URL, "/"),
+		key:     config.Key,
+		httpClient: &http.Client{
+			Timeout: config.Timeout,
+		},
+	}
+}
+
+var ghostLog = newLogger("ghost")
+
+type ghostErrorResponse struct {
+	Errors []struct {
+		Message string `json:"message"`
+		Type    string `json:"type"`
+	} `json:"errors"`
+}
+
+func (gc *ghostClient) get(ctx context.Context, path string, query url.Values, response interface{}) error {
+	query.Set("key", gc.key)
+
+	requestURL := gc.baseURL + "/ghost/api/v3/content" + path + "?" + query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, requestURL, nil)
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", "application/json")
+
+	start := time.Now()
+
+	resp, err := gc.httpClient.Do(req.WithContext(ctx))
+
+	if err != nil {
+		err = redactURLError(err)
+
+		ghostLog.warn(ctx, "ghost request failed", logFields{
+			"url":   redactURL(requestURL),
+			"error": err,
+		})
+
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	ghostLog.debug(ctx, "ghost request completed", logFields{
+		"url":         redactURL(requestURL),
+		"status":      resp.StatusCode,
+		"duration_ms": float64(time.Since(start)) / float64(time.Millisecond),
+	})
+
+	if resp.StatusCode == http.StatusNotFound {
+		io.Copy(ioutil.Discard, resp.Body)
+
+		return errGhostNotFound
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var errorResponse ghostErrorResponse
+
+		if json.NewDecoder(resp.Body).Decode(&errorResponse) == nil && len(errorResponse.Errors) != 0 {
+			return fmt.Errorf("ghost responded with %d: %s", resp.StatusCode, errorResponse.Errors[0].Message)
+		}
+
+		return fmt.Errorf("ghost responded with %d", resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+type ghostPostsResponse struct {
+	Posts []Post `json:"posts"`
+	Meta  struct {
+		Pagination Pagination `json:"pagination"`
+	} `json:"meta"`
+}
+
+func (gc *ghostClient) browsePosts(ctx context.Context, postsQuery ghostPostsQuery) (*PostsPage, error) {
+	query := url.Values{
+		"include": {"tags,authors"},
+		"formats": {"html"},
+		"page":    {strconv.Itoa(postsQuery.Page)},
+		"limit":   {strconv.Itoa(postsQuery.Limit)},
+		"order":   {"published_at desc"},
+	}
+
+	var filters []string
+
+	// Slugs are checked by the caller, so they can't smuggle extra NQL into the filter
+	if postsQuery.Tag != "" {
+		filters = append(filters, "tag:"+postsQuery.Tag)
+	}
+
+	if postsQuery.Author != "" {
+		filters = append(filters, "author:"+postsQuery.Author)
+	}
+
+	if len(filters) != 0 {
+		query.Set("filter", strings.Join(filters, "+"))
+	}
+
+	var response ghostPostsResponse
+
+	if err := gc.get(ctx, "/posts/", query, &response); err != nil {
+		return nil, err
+	}
+
+	if response.Posts == nil {
+		response.Posts = []Post{}
+	}
+
+	return &PostsPage{
+		Posts:      response.Posts,
+		Pagination: response.Meta.Pagination,
+	}, nil
+}
+
+func (gc *ghostClient) readPost(ctx context.Context, slug string) (*Post, error) {
+	query := url.Values{
+		"include": {"tags,authors"},
+		"formats": {"html"},
+	}
+
+	var response ghostPostsResponse
+
+	if err := gc.get(ctx, "/posts/slug/"+url.PathEscape(slug)+"/", query, &response); err != nil {
+		return nil, err
+	}
+
+	if len(response.Posts) == 0 {
+		return nil, errGhostNotFound
+	}
+
+	return &response.Posts[0], nil
+}
+
+// allPostSummaries lists every published post with only the fields needed to link to it
+func (gc *ghostClient) allPostSummaries(ctx context.Context) ([]Post, error) {
+	query := url.Values{
+		"fields": {"slug,title,feature_image,updated_at,published_at"},
+		"limit":  {"all"},
+		"order":  {"published_at desc"},
+	}
+
+	var response ghostPostsResponse
+
+	if err := gc.get(ctx, "/posts/", query, &response); err != nil {
+		return nil, err
+	}
+
+	if response.Posts == nil {
+		response.Posts = []Post{}
+	}
+
+	return response.Posts, nil
+}
+
+// allPostListings lists every published post with its tags and authors but without its HTML
+func (gc *ghostClient) allPostListings(ctx context.Context) ([]Post, error) {
+	query := url.Values{
+		"fields":  {"id,uuid,title,slug,excerpt,custom_excerpt,feature_image,featured,url,reading_time,created_at,updated_at,published_at"},
+		"include": {"tags,authors"},
+		"limit":   {"all"},
+		"order":   {"published_at desc"},
+	}
+
+	var response ghostPostsResponse
+
+	if err := gc.get(ctx, "/posts/", query, &response); err != nil {
+		return nil, err
+	}
+
+	if response.Posts == nil {
+		response.Posts = []Post{}
+	}
+
+	return response.Posts, nil
+}
+
+// allPosts lists every published post with its HTML, for indexing
+func (gc *ghostClient) allPosts(ctx context.Context) ([]Post, error) {
+	query := url.Values{
+		"include": {"tags,authors"},
+		"formats": {"html"},
+		"limit":   {"all"},
+		"order":   {"published_at desc"},
+	}
+
+	var response ghostPostsResponse
+
+	if err := gc.get(ctx, "/posts/", query, &response); err != nil {
+		return nil, err
+	}
+
+	if response.Posts == nil {
+		response.Posts = []Post{}
+	}
+
+	return response.Posts, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGhost serves posts the way Ghost's Content API does, or a 503 while it is down
+type fakeGhost struct {
+	server   *httptest.Server
+	down     bool
+	mutex    *sync.Mutex
+	posts    []Post
+	requests int
+}
+
+func newFakeGhost(posts ...Post) *fakeGhost {
+	fg := &fakeGhost{
+		mutex: &sync.Mutex{},
+		posts: posts,
+	}
+
+	fg.server = httptest.NewServer(http.HandlerFunc(fg.serveHTTP))
+
+	return fg
+}
+
+func (fg *fakeGhost) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	fg.mutex.Lock()
+	defer fg.mutex.Unlock()
+
+	fg.requests++
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if fg.down {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"errors": []map[string]string{{"message": "Ghost is down", "type": "InternalServerError"}},
+		})
+
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/ghost/api/v3/content")
+
+	var response ghostPostsResponse
+
+	switch {
+	case path == "/posts/":
+		response.Posts = fg.posts
+	case strings.HasPrefix(path, "/posts/slug/"):
+		slug := strings.TrimSuffix(strings.TrimPrefix(path, "/posts/slug/"), "/")
+
+		for _, post := range fg.posts {
+			if post.Slug == slug {
+				response.Posts = []Post{post}
+			}
+		}
+
+		if len(response.Posts) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"errors": []map[string]string{{"message": "Resource not found", "type": "NotFoundError"}},
+			})
+
+			return
+		}
+	default:
+		http.NotFound(w, r)
+
+		return
+	}
+
+	response.Meta.Pagination = Pagination{Page: 1, Limit: len(response.Posts), Pages: 1, Total: len(response.Posts)}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+func (fg *fakeGhost) setPosts(posts ...Post) {
+	fg.mutex.Lock()
+	defer fg.mutex.Unlock()
+
+	fg.posts = posts
+}
+
+func (fg *fakeGhost) setDown(down bool) {
+	fg.mutex.Lock()
+	defer fg.mutex.Unlock()
+
+	fg.down = down
+}
+
+func (fg *fakeGhost) requestCount() int {
+	fg.mutex.Lock()
+	defer fg.mutex.Unlock()
+
+	return fg.requests
+}
+
+func (fg *fakeGhost) close() {
+	fg.server.Close()
+}
+
+func (fg *fakeGhost) config() ghostConfig {
+	config := defaultGhostConfig()
+	config.URL = fg.server.URL
+	config.Key = "content-key"
+	config.Timeout = time.Second * 5
+
+	return config
+}
+
+// postService returns a post service in front of the fake Ghost
+func (fg *fakeGhost) postService() *postService {
+	config := fg.config()
+
+	return newPostService(
+		newGhostClient(config),
+		newPostEnricher(func() []string { return []string{fg.server.URL} }, defaultEnrichConfig),
+		config.CacheSize,
+		func() ghostConfig { return config },
+	)
+}
+
+func TestGhostClientReadPost(t *testing.T) {
+	ghost := newFakeGhost(Post{ID: "1", Slug: "hello", Title: "Hello"})
+	defer ghost.close()
+
+	client := newGhostClient(ghost.config())
+	ctx := context.Background()
+
+	if post, err := client.readPost(ctx, "hello"); err != nil || post.Title != "Hello" {
+		t.Errorf("readPost(hello) = %v, %v, want the post", post, err)
+	}
+
+	if _, err := client.readPost(ctx, "missing"); err != errGhostNotFound {
+		t.Errorf("readPost(missing) = %v, want errGhostNotFound", err)
+	}
+
+	ghost.setDown(true)
+
+	_, err := client.readPost(ctx, "hello")
+
+	if err == nil || !strings.Contains(err.Error(), "503: Ghost is down") {
+		t.Errorf("readPost while Ghost is down = %v, want Ghost's error", err)
+	}
+}
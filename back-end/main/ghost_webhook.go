@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ghostEventPublished       = "post.published"
+	ghostEventPublishedEdited = "post.published.edited"
+	ghostEventUnpublished     = "post.unpublished"
+	ghostEventDeleted         = "post.deleted"
+
+	// Signatures older than this are rejected so captured deliveries can't be replayed
+	ghostWebhookMaxAge = time.Minute * 5
+
+	ghostWebhookMaxBody = 4 << 20
+)
+
+type ghostWebhookPost struct {
+	Slug   string `json:"slug"`
+	Status string `json:"status"`
+}
+
+// ghostWebhookPayload is what Ghost sends for post events, previous only holds the
+// attributes that changed and current is empty once a post is deleted
+type ghostWebhookPayload struct {
+	Post struct {
+		Current  ghostWebhookPost `json:"current"`
+		Previous ghostWebhookPost `json:"previous"`
+	} `json:"post"`
+}
+
+// event works out which post event was sent, Ghost doesn't include it in the payload
+// so webhooks may name it with ?event=, otherwise it is inferred from the status change
+func (gwp ghostWebhookPayload) event() string {
+	current, previous := gwp.Post.Current, gwp.Post.Previous
+
+	switch {
+	case current.Slug == "" && previous.Slug != "":
+		return ghostEventDeleted
+	case current.Status == "published" && previous.Status != "" && previous.Status != "published":
+		return ghostEventPublished
+	case current.Status != "published" && previous.Status == "published":
+		return ghostEventUnpublished
+	case current.Status == "published":
+		return ghostEventPublishedEdited
+	}
+
+	return ""
+}
+
+// slugs returns the slugs whose pages are affected, both when a post's slug changed
+func (gwp ghostWebhookPayload) slugs() []string {
+	var slugs []string
+
+	for _, slug := range []string{gwp.Post.Current.Slug, gwp.Post.Previous.Slug} {
+		if validSlug(slug) && (len(slugs) == 0 || slugs[0] != slug) {
+			slugs = append(slugs, slug)
+		}
+	}
+
+	return slugs
+}
+
+// ghostWebhooks keeps the posts cache, the sitemap, the search index and the
+// statically rendered blog pages in step with Ghost
+type ghostWebhooks struct {
+	audit       *auditLog
+	config      func() ghostConfig
+	posts       *postService
+	revalidator *revalidator
+	search      *postSearch
+	sitemap     *sitemap
+}
+
+func newGhostWebhooks(posts *postService, revalidator *revalidator, sitemap *sitemap, search *postSearch, audit *auditLog, config func() ghostConfig) *ghostWebhooks {
+	return &ghostWebhooks{
+		audit:       audit,
+		config:      config,
+		posts:       posts,
+		revalidator: revalidator,
+		search:      search,
+		sitemap:     sitemap,
+	}
+}
+
+var ghostWebhookLog = newLogger("ghost-webhook")
+
+func (gw *ghostWebhooks) registerRoutes(apiGroup *gin.RouterGroup) {
+	apiGroup.POST("/hooks/ghost", gw.handleWebhook)
+}
+
+// verifyGhostSignature checks an X-Ghost-Signature header, "sha256=<hex>, t=<unix millis>",
+// where the HMAC covers the body followed by the timestamp
+func verifyGhostSignature(secret string, header string, body []byte, now time.Time) bool {
+	var signature, timestamp string
+
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+
+		if strings.HasPrefix(part, "sha256=") {
+			signature = strings.TrimPrefix(part, "sha256=")
+		} else if strings.HasPrefix(part, "t=") {
+			timestamp = strings.TrimPrefix(part, "t=")
+		}
+	}
+
+	sentAtMillis, err := strconv.ParseInt(timestamp, 10, 64)
+
+	if signature == "" || err != nil {
+		return false
+	}
+
+	age := now.Sub(time.Unix(0, sentAtMillis*int64(time.Millisecond)))
+
+	if age > ghostWebhookMaxAge || age < -ghostWebhookMaxAge {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+
+	mac.Write(body)
+	mac.Write([]byte(timestamp))
+
+	return hmac.Equal([]byte(hex.EncodeToString(mac.Sum(nil))), []byte(strings.ToLower(signature)))
+}
+
+func (gw *ghostWebhooks) registerAdminRoutes(adminGroup *gin.RouterGroup, keys *apiKeyRoutes) {
+	keys.scoped(adminGroup, http.MethodPost, "/posts/revalidate", scopePostsRevalidate, gw.handleRevalidate)
+}
+
+type ghostWebhookResult struct {
+	Event string   `json:"event,omitempty"`
+	Paths []string `json:"paths"`
+}
+
+func (gw *ghostWebhooks) handleWebhook(c *gin.Context) {
+	secret := gw.config().WebhookSecret
+
+	if secret == "" {
+		abortWithError(c, http.StatusServiceUnavailable, "webhooks are disabled")
+
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, ghostWebhookMaxBody))
+
+	if err != nil {
+		abortWithError(c, http.StatusRequestEntityTooLarge, "payload is too large")
+
+		return
+	}
+
+	if !verifyGhostSignature(secret, c.GetHeader("X-Ghost-Signature"), body, time.Now()) {
+		ghostWebhookLog.warn(c.Request.Context(), "rejected webhook with a bad signature", nil)
+
+		abortWithError(c, http.StatusUnauthorized, "invalid signature")
+
+		return
+	}
+
+	var payload ghostWebhookPayload
+
+	if err = json.Unmarshal(body, &payload); err != nil {
+		abortWithError(c, http.StatusBadRequest, "invalid payload")
+
+		return
+	}
+
+	event := c.Query("event")
+
+	if event == "" {
+		event = payload.event()
+	}
+
+	switch event {
+	case ghostEventPublished, ghostEventPublishedEdited, ghostEventUnpublished, ghostEventDeleted:
+	case "":
+		// Edits to drafts don't change anything that is served
+		respondWithData(c, ghostWebhookResult{Paths: []string{}})
+
+		return
+	default:
+		abortWithError(c, http.StatusBadRequest, "unsupported event")
+
+		return
+	}
+
+	// Every cached listing may include the post, so there is no narrower invalidation
+	gw.posts.invalidate()
+	gw.sitemap.regenerateSoon()
+
+	if event == ghostEventPublished || event == ghostEventPublishedEdited {
+		// A renamed post is replaced by its ID, so only the current slug is fetched
+		if validSlug(payload.Post.Current.Slug) {
+			gw.search.queueUpdate(c.Request.Context(), payload.Post.Current.Slug, false)
+		}
+	} else {
+		for _, slug := range payload.slugs() {
+			gw.search.queueUpdate(c.Request.Context(), slug, true)
+		}
+	}
+
+	paths := []string{"/posts"}
+
+	for _, slug := range payload.slugs() {
+		paths = append(paths, "/posts/"+slug)
+	}
+
+	ghostWebhookLog.info(c.Request.Context(), "handling ghost webhook", logFields{
+		"event": event,
+		"paths": paths,
+	})
+
+	gw.revalidator.revalidate(c.Request.Context(), paths)
+
+	respondWithData(c, ghostWebhookResult{
+		Event: event,
+		Paths: paths,
+	})
+}
+
+type revalidatePostsRequest struct {
+	// Posts that changed, every post is refreshed when empty
+	Slugs []string `json:"slugs" binding:"max=100,dive,required,max=191"`
+}
+
+// handleRevalidate refreshes posts the same way a webhook would, for deploys and
+// changes Ghost doesn't send webhooks for
+func (gw *ghostWebhooks) handleRevalidate(c *gin.Context) {
+	var request revalidatePostsRequest
+
+	if err := c.ShouldBindJSON(&request); err != nil && err != io.EOF {
+		abortWithError(c, http.StatusBadRequest, bindingErrorMessage(err))
+
+		return
+	}
+
+	for _, slug := range request.Slugs {
+		if !validSlug(slug) {
+			abortWithError(c, http.StatusBadRequest, "slugs must be slugs")
+
+			return
+		}
+	}
+
+	gw.posts.invalidate()
+	gw.sitemap.regenerateSoon()
+
+	paths := []string{"/", "/posts"}
+
+	if len(request.Slugs) == 0 {
+		gw.search.rebuildSoon()
+	}
+
+	for _, slug := range request.Slugs {
+		gw.search.queueUpdate(c.Request.Context(), slug, false)
+
+		paths = append(paths, "/posts/"+slug)
+	}
+
+	gw.revalidator.revalidate(c.Request.Context(), paths)
+
+	gw.audit.recordRequest(c, "posts.revalidate", "", gin.H{"paths": paths}, nil)
+
+	respondWithData(c, ghostWebhookResult{Paths: paths})
+}
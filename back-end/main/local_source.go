@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var localAudioExtensions = map[string]bool{
+	".flac": true,
+	".m4a":  true,
+	".mp3":  true,
+	".ogg":  true,
+	".opus": true,
+	".wav":  true,
+}
+
+// localPlaylistManifest describes a playlist by hand, tracks either point at a
+// file relative to the manifest or an external URL
+type localPlaylistManifest struct {
+	Title       string                       `json:"title"`
+	Description *string                      `json:"description"`
+	ArtworkURL  *string                      `json:"artwork_url"`
+	Tracks      []localPlaylistManifestTrack `json:"tracks"`
+}
+
+type localPlaylistManifestTrack struct {
+	File         string  `json:"file"`
+	URL          string  `json:"url"`
+	Title        string  `json:"title"`
+	Artist       string  `json:"artist"`
+	Album        *string `json:"album"`
+	Genre        *string `json:"genre"`
+	Duration     int64   `json:"duration"`
+	ArtworkURL   *string `json:"artwork_url"`
+	PermalinkURL *string `json:"permalink_url"`
+}
+
+// localPlaylistSource serves playlists from a directory, a playlist named "x" is read from
+// x.json, x.m3u or x.m3u8 if present, otherwise from the audio files in the x directory
+type localPlaylistSource struct {
+	directory string
+	mutex     *sync.Mutex
+	files     map[string]string
+}
+
+func newLocalPlaylistSource(directory string) *localPlaylistSource {
+	return &localPlaylistSource{
+		directory: directory,
+		mutex:     &sync.Mutex{},
+		files:     make(map[string]string),
+	}
+}
+
+func (lps *localPlaylistSource) Name() string {
+	return "local"
+}
+
+func (lps *localPlaylistSource) FetchPlaylist(ctx context.Context, playlistName string) (*Playlist, error) {
+	if lps.directory == "" {
+		return nil, errors.New("no local playlist directory configured")
+	}
+
+	if playlistName != filepath.Base(playlistName) || strings.HasPrefix(playlistName, ".") {
+		return nil, fmt.Errorf("invalid local playlist name %q", playlistName)
+	}
+
+	basePath := filepath.Join(lps.directory, playlistName)
+	files := make(map[string]string)
+
+	var (
+		playlist *Playlist
+		err      error
+	)
+
+	switch {
+	case fileExists(basePath + ".json"):
+		playlist, err = lps.readJSONManifest(basePath+".json", files)
+	case fileExists(basePath + ".m3u8"):
+		playlist, err = lps.readM3U(basePath+".m3u8", files)
+	case fileExists(basePath + ".m3u"):
+		playlist, err = lps.readM3U(basePath+".m3u", files)
+	default:
+		playlist, err = lps.readDirectory(basePath, files)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if playlist.Title == "" {
+		playlist.Title = playlistName
+	}
+
+	playlist.Source = lps.Name()
+	playlist.ID = playlistName
+	playlist.TrackCount = len(playlist.Tracks)
+
+	for _, track := range playlist.Tracks {
+		playlist.Duration += track.Duration
+	}
+
+	lps.mutex.Lock()
+	lps.files = files
+	lps.mutex.Unlock()
+
+	return playlist, nil
+}
+
+// filePath resolves the track ID of a locally served file to its path on disk
+func (lps *localPlaylistSource) filePath(trackID string) (string, bool) {
+	lps.mutex.Lock()
+	defer lps.mutex.Unlock()
+
+	path, ok := lps.files[trackID]
+
+	return path, ok
+}
+
+func (lps *localPlaylistSource) readDirectory(directory string, files map[string]string) (*Playlist, error) {
+	fileInfos, err := ioutil.ReadDir(directory)
+
+	if err != nil {
+		return nil, err
+	}
+
+	playlist := &Playlist{}
+
+	for _, fileInfo := range fileInfos {
+		if fileInfo.IsDir() || !localAudioExtensions[strings.ToLower(filepath.Ext(fileInfo.Name()))] {
+			continue
+		}
+
+		playlist.Tracks = append(playlist.Tracks, lps.localFileTrack(filepath.Join(directory, fileInfo.Name()), files))
+	}
+
+	if len(playlist.Tracks) == 0 {
+		return nil, fmt.Errorf("no audio files in %s", directory)
+	}
+
+	sort.SliceStable(playlist.Tracks, func(i, j int) bool {
+		return strings.ToLower(playlist.Tracks[i].Title) < strings.ToLower(playlist.Tracks[j].Title)
+	})
+
+	return playlist, nil
+}
+
+func (lps *localPlaylistSource) readJSONManifest(manifestPath string, files map[string]string) (*Playlist, error) {
+	manifestBytes, err := ioutil.ReadFile(manifestPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest localPlaylistManifest
+
+	if err = json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid playlist manifest %s: %s", manifestPath, err)
+	}
+
+	playlist := &Playlist{
+		Title:       manifest.Title,
+		Description: manifest.Description,
+		ArtworkURL:  manifest.ArtworkURL,
+	}
+
+	for manifestIndex, manifestTrack := range manifest.Tracks {
+		var track PlaylistTrack
+
+		switch {
+		case manifestTrack.File != "":
+			track = lps.localFileTrack(filepath.Join(filepath.Dir(manifestPath), filepath.Clean("/"+manifestTrack.File)), files)
+		case manifestTrack.URL != "":
+			streamURL := manifestTrack.URL
+
+			track = PlaylistTrack{
+				ID:        localTrackID(streamURL),
+				StreamURL: &streamURL,
+			}
+		default:
+			return nil, fmt.Errorf("track %d in %s has neither a file nor a url", manifestIndex, manifestPath)
+		}
+
+		if manifestTrack.Title != "" {
+			track.Title = manifestTrack.Title
+		}
+
+		if manifestTrack.Artist != "" {
+			track.Artist = manifestTrack.Artist
+		}
+
+		if manifestTrack.Album != nil {
+			track.Album = manifestTrack.Album
+		}
+
+		if manifestTrack.Genre != nil {
+			track.Genre = manifestTrack.Genre
+		}
+
+		if manifestTrack.Duration != 0 {
+			track.Duration = manifestTrack.Duration
+		}
+
+		track.ArtworkURL = manifestTrack.ArtworkURL
+		track.PermalinkURL = manifestTrack.PermalinkURL
+
+		playlist.Tracks = append(playlist.Tracks, track)
+	}
+
+	return playlist, nil
+}
+
+// readM3U reads extended M3U playlists, #EXTINF lines supply the duration and "artist - title"
+func (lps *localPlaylistSource) readM3U(playlistPath string, files map[string]string) (*Playlist, error) {
+	playlistFile, err := os.Open(playlistPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer playlistFile.Close()
+
+	playlist := &Playlist{}
+
+	var (
+		extinfDuration int64
+		extinfArtist   string
+		extinfTitle    string
+	)
+
+	scanner := bufio.NewScanner(playlistFile)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "#PLAYLIST:"):
+			playlist.Title = strings.TrimSpace(strings.TrimPrefix(line, "#PLAYLIST:"))
+		case strings.HasPrefix(line, "#EXTINF:"):
+			info := strings.TrimPrefix(line, "#EXTINF:")
+			commaIndex := strings.Index(info, ",")
+
+			if commaIndex == -1 {
+				continue
+			}
+
+			// Attributes such as tvg-id may follow the duration, separated by spaces
+			durationField := strings.Fields(info[:commaIndex])
+
+			if len(durationField) != 0 {
+				if seconds, err := strconv.ParseFloat(durationField[0], 64); err == nil && seconds > 0 {
+					extinfDuration = int64(seconds * 1000)
+				}
+			}
+
+			extinfArtist, extinfTitle = splitArtistTitle(strings.TrimSpace(info[commaIndex+1:]))
+		case strings.HasPrefix(line, "#"):
+			continue
+		default:
+			var track PlaylistTrack
+
+			if strings.Contains(line, "://") {
+				streamURL := line
+
+				track = PlaylistTrack{
+					ID:        localTrackID(streamURL),
+					StreamURL: &streamURL,
+				}
+			} else if trackPath := filepath.FromSlash(line); filepath.IsAbs(trackPath) {
+				// Absolute paths are only streamed from within the playlist directory
+				track = lps.localFileTrack(filepath.Clean(trackPath), files)
+			} else {
+				// Relative paths can't climb out of the playlist's directory
+				track = lps.localFileTrack(filepath.Join(filepath.Dir(playlistPath), filepath.Clean("/"+trackPath)), files)
+			}
+
+			if extinfTitle != "" {
+				track.Title = extinfTitle
+			}
+
+			if extinfArtist != "" {
+				track.Artist = extinfArtist
+			}
+
+			if extinfDuration != 0 {
+				track.Duration = extinfDuration
+			}
+
+			if track.Title == "" {
+				track.Title = line
+			}
+
+			playlist.Tracks = append(playlist.Tracks, track)
+
+			extinfDuration, extinfArtist, extinfTitle = 0, "", ""
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return playlist, nil
+}
+
+// localFileTrack describes an audio file from its tags, falling back to an
+// "artist - title" file name, and registers it to be streamed by track ID. Only
+// audio files within the playlist directory are registered, or even opened, since
+// a playlist may point anywhere.
+func (lps *localPlaylistSource) localFileTrack(path string, files map[string]string) PlaylistTrack {
+	relativePath, withinDirectory := localRelativePath(lps.directory, path)
+
+	if !withinDirectory {
+		relativePath = path
+	}
+
+	trackID := localTrackID(filepath.ToSlash(relativePath))
+	streamURL := "/api/songs/local/" + trackID
+
+	track := PlaylistTrack{
+		ID:        trackID,
+		StreamURL: &streamURL,
+	}
+
+	if withinDirectory && localAudioExtensions[strings.ToLower(filepath.Ext(path))] && fileExists(path) {
+		files[trackID] = path
+	} else {
+		track.StreamURL = nil
+		track.Artist, track.Title = splitArtistTitle(strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)))
+
+		return track
+	}
+
+	tags, err := readAudioTags(path)
+
+	if err != nil {
+		track.Artist, track.Title = splitArtistTitle(strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)))
+
+		return track
+	}
+
+	track.Title = tags.Title
+	track.Artist = tags.Artist
+	track.Duration = tags.Duration
+
+	if tags.Album != "" {
+		track.Album = &tags.Album
+	}
+
+	if tags.Genre != "" {
+		track.Genre = &tags.Genre
+	}
+
+	if track.Title == "" {
+		_, track.Title = splitArtistTitle(strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)))
+	}
+
+	return track
+}
+
+func splitArtistTitle(name string) (string, string) {
+	if separatorIndex := strings.Index(name, " - "); separatorIndex != -1 {
+		return strings.TrimSpace(name[:separatorIndex]), strings.TrimSpace(name[separatorIndex+3:])
+	}
+
+	return "", name
+}
+
+// localRelativePath makes path relative to directory, reporting whether it lies within it
+func localRelativePath(directory, path string) (string, bool) {
+	absoluteDirectory, err := filepath.Abs(directory)
+
+	if err != nil {
+		return "", false
+	}
+
+	absolutePath, err := filepath.Abs(path)
+
+	if err != nil {
+		return "", false
+	}
+
+	relativePath, err := filepath.Rel(absoluteDirectory, absolutePath)
+
+	if err != nil || relativePath == ".." || strings.HasPrefix(relativePath, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+
+	return relativePath, true
+}
+
+func localTrackID(location string) string {
+	locationHash := sha1.Sum([]byte(location))
+
+	return hex.EncodeToString(locationHash[:8])
+}
+
+func fileExists(path string) bool {
+	fileInfo, err := os.Stat(path)
+
+	return err == nil && !fileInfo.IsDir()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, path, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLocalM3UOnlyServesAudioWithinDirectory(t *testing.T) {
+	root, err := ioutil.TempDir("", "local-source")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(root)
+
+	directory := filepath.Join(root, "playlists")
+	outside := filepath.Join(root, "outside")
+
+	writeTestFile(t, filepath.Join(directory, "mix", "Riley - Relative.mp3"), "audio")
+	writeTestFile(t, filepath.Join(directory, "Riley - Absolute.mp3"), "audio")
+	writeTestFile(t, filepath.Join(directory, "config.yaml"), "secret: hunter2")
+	writeTestFile(t, filepath.Join(outside, "Riley - Outside.mp3"), "audio")
+	writeTestFile(t, filepath.Join(outside, "passwd"), "root:x:0:0")
+
+	playlist := []string{
+		"#EXTM3U",
+		"mix/Riley - Relative.mp3",
+		filepath.Join(directory, "Riley - Absolute.mp3"),
+		filepath.Join(directory, "config.yaml"),
+		"config.yaml",
+		filepath.Join(outside, "Riley - Outside.mp3"),
+		filepath.Join(outside, "passwd"),
+		"../outside/Riley - Outside.mp3",
+		filepath.Join(directory, "..", "outside", "Riley - Outside.mp3"),
+	}
+
+	writeTestFile(t, filepath.Join(directory, "mix.m3u"), strings.Join(playlist, "\n"))
+
+	source := newLocalPlaylistSource(directory)
+
+	fetched, err := source.FetchPlaylist(context.Background(), "mix")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fetched.Tracks) != len(playlist)-1 {
+		t.Fatalf("the playlist has %d tracks, want %d", len(fetched.Tracks), len(playlist)-1)
+	}
+
+	served := map[string]string{
+		"Relative": filepath.Join(directory, "mix", "Riley - Relative.mp3"),
+		"Absolute": filepath.Join(directory, "Riley - Absolute.mp3"),
+	}
+
+	for index, track := range fetched.Tracks {
+		line := playlist[index+1]
+		path, registered := source.filePath(track.ID)
+
+		if want, ok := served[track.Title]; ok {
+			if !registered || path != want || track.StreamURL == nil {
+				t.Errorf("%q should be served from %s, got %q %v", line, want, path, registered)
+			}
+
+			continue
+		}
+
+		if registered || track.StreamURL != nil {
+			t.Errorf("%q shouldn't be served, it's registered as %q", line, path)
+		}
+	}
+}
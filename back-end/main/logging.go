@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = map[logLevel]string{
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+}
+
+func (ll logLevel) String() string {
+	return logLevelNames[ll]
+}
+
+func parseLogLevel(levelName string) (logLevel, error) {
+	for level, name := range logLevelNames {
+		if strings.EqualFold(levelName, name) {
+			return level, nil
+		}
+	}
+
+	return levelInfo, fmt.Errorf("unknown log level %q", levelName)
+}
+
+type logFields map[string]interface{}
+
+// logOutput serializes writes of JSON lines from every logger and holds the
+// per-component levels, a component without its own level uses the default level
+type logOutput struct {
+	mutex           *sync.Mutex
+	writer          io.Writer
+	defaultLevel    logLevel
+	componentLevels map[string]logLevel
+}
+
+var logs = &logOutput{
+	mutex:           &sync.Mutex{},
+	writer:          os.Stdout,
+	defaultLevel:    levelInfo,
+	componentLevels: map[string]logLevel{},
+}
+
+// parseLogLevelSpec parses a level specification such as "info,soundcloud=debug,http=warn"
+func parseLogLevelSpec(levelSpec string) (logLevel, map[string]logLevel, error) {
+	defaultLevel := levelInfo
+	componentLevels := map[string]logLevel{}
+
+	for _, part := range strings.Split(levelSpec, ",") {
+		part = strings.TrimSpace(part)
+
+		if part == "" {
+			continue
+		}
+
+		equalsIndex := strings.Index(part, "=")
+
+		if equalsIndex == -1 {
+			level, err := parseLogLevel(part)
+
+			if err != nil {
+				return 0, nil, err
+			}
+
+			defaultLevel = level
+
+			continue
+		}
+
+		level, err := parseLogLevel(part[equalsIndex+1:])
+
+		if err != nil {
+			return 0, nil, err
+		}
+
+		componentLevels[strings.TrimSpace(part[:equalsIndex])] = level
+	}
+
+	return defaultLevel, componentLevels, nil
+}
+
+func (lo *logOutput) configure(levelSpec string) error {
+	defaultLevel, componentLevels, err := parseLogLevelSpec(levelSpec)
+
+	if err != nil {
+		return err
+	}
+
+	lo.mutex.Lock()
+	defer lo.mutex.Unlock()
+
+	lo.defaultLevel = defaultLevel
+	lo.componentLevels = componentLevels
+
+	return nil
+}
+
+func (lo *logOutput) enabled(component string, level logLevel) bool {
+	lo.mutex.Lock()
+	defer lo.mutex.Unlock()
+
+	componentLevel, ok := lo.componentLevels[component]
+
+	if !ok {
+		componentLevel = lo.defaultLevel
+	}
+
+	return level >= componentLevel
+}
+
+func (lo *logOutput) write(line []byte) {
+	lo.mutex.Lock()
+	defer lo.mutex.Unlock()
+
+	lo.writer.Write(line)
+}
+
+type logger struct {
+	component string
+	output    *logOutput
+}
+
+func newLogger(component string) *logger {
+	return &logger{
+		component: component,
+		output:    logs,
+	}
+}
+
+func (l *logger) log(ctx context.Context, level logLevel, msg string, fields logFields) {
+	if !l.output.enabled(l.component, level) {
+		return
+	}
+
+	entry := make(map[string]interface{}, len(fields)+5)
+
+	for key, value := range fields {
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+
+		entry[key] = value
+	}
+
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level.String()
+	entry["component"] = l.component
+	entry["msg"] = msg
+
+	if requestID := requestIDFromContext(ctx); requestID != "" {
+		entry["request_id"] = requestID
+	}
+
+	line, err := json.Marshal(entry)
+
+	if err != nil {
+		line, _ = json.Marshal(map[string]interface{}{
+			"time":      entry["time"],
+			"level":     levelError.String(),
+			"component": l.component,
+			"msg":       "could not encode log entry: " + err.Error(),
+		})
+	}
+
+	l.output.write(append(line, '\n'))
+}
+
+func (l *logger) debug(ctx context.Context, msg string, fields logFields) {
+	l.log(ctx, levelDebug, msg, fields)
+}
+
+func (l *logger) info(ctx context.Context, msg string, fields logFields) {
+	l.log(ctx, levelInfo, msg, fields)
+}
+
+func (l *logger) warn(ctx context.Context, msg string, fields logFields) {
+	l.log(ctx, levelWarn, msg, fields)
+}
+
+func (l *logger) error(ctx context.Context, msg string, fields logFields) {
+	l.log(ctx, levelError, msg, fields)
+}
+
+// stdLogger adapts the logger for APIs that expect a *log.Logger, such as http.Server.ErrorLog
+func (l *logger) stdLogger(level logLevel) *log.Logger {
+	return log.New(&stdLogWriter{logger: l, level: level}, "", 0)
+}
+
+type stdLogWriter struct {
+	logger *logger
+	level  logLevel
+}
+
+func (slw *stdLogWriter) Write(p []byte) (int, error) {
+	slw.logger.log(context.Background(), slw.level, string(bytes.TrimSpace(p)), nil)
+
+	return len(p), nil
+}
+
+type requestIDKey struct{}
+
+func contextWithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+
+	return requestID
+}
+
+// detachedContext is for work that outlives the request that started it, or that other
+// requests share, so it mustn't be cancelled with the request. Only the request ID is
+// carried over, which keeps the work's logs traceable to the request.
+func detachedContext(ctx context.Context) context.Context {
+	return contextWithRequestID(context.Background(), requestIDFromContext(ctx))
+}
+
+func newRequestID() string {
+	idBytes := make([]byte, 12)
+
+	if _, err := rand.Read(idBytes); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+
+	return hex.EncodeToString(idBytes)
+}
+
+// validRequestID guards against clients smuggling arbitrary content into the logs
+func validRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > 128 {
+		return false
+	}
+
+	for _, char := range requestID {
+		isAlphanumeric := (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') || (char >= '0' && char <= '9')
+
+		if !isAlphanumeric && !strings.ContainsRune("-_.:", char) {
+			return false
+		}
+	}
+
+	return true
+}
+
+var sensitiveQueryParameters = []string{"client_id", "auth_token", "token", "key", "secret", "password"}
+
+// redactURL replaces the values of sensitive query parameters so URLs can be logged safely
+func redactURL(rawURL string) string {
+	parsedURL, err := url.Parse(rawURL)
+
+	if err != nil {
+		return "unparseable-url"
+	}
+
+	urlQuery := parsedURL.Query()
+	redacted := false
+
+	for _, parameter := range sensitiveQueryParameters {
+		if _, ok := urlQuery[parameter]; ok {
+			urlQuery.Set(parameter, "REDACTED")
+
+			redacted = true
+		}
+	}
+
+	if redacted {
+		parsedURL.RawQuery = urlQuery.Encode()
+	}
+
+	return parsedURL.String()
+}
+
+// redactURLError redacts the URL net/http includes in request errors, which would
+// otherwise leak credentials into logs and error messages
+func redactURLError(err error) error {
+	if urlErr, ok := err.(*url.Error); ok {
+		return &url.Error{
+			Op:  urlErr.Op,
+			URL: redactURL(urlErr.URL),
+			Err: urlErr.Err,
+		}
+	}
+
+	return err
+}
+
+const requestIDHeader = "X-Request-ID"
+
+// requestIDMiddleware accepts a well formed X-Request-ID from the caller or generates one,
+// echoing it on the response and attaching it to the request context
+func requestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader(requestIDHeader)
+
+		if !validRequestID(requestID) {
+			requestID = newRequestID()
+		}
+
+		c.Request = c.Request.WithContext(contextWithRequestID(c.Request.Context(), requestID))
+
+		c.Header(requestIDHeader, requestID)
+
+		c.Next()
+	}
+}
+
+func accessLogMiddleware(accessLogger *logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		c.Next()
+
+		status := c.Writer.Status()
+		fields := logFields{
+			"method":      c.Request.Method,
+			"path":        redactURL(c.Request.URL.RequestURI()),
+			"status":      status,
+			"duration_ms": float64(time.Since(start)) / float64(time.Millisecond),
+			"client_ip":   clientIP(c),
+			"bytes":       c.Writer.Size(),
+		}
+
+		if len(c.Errors) != 0 {
+			fields["errors"] = c.Errors.String()
+		}
+
+		switch {
+		case status >= http.StatusInternalServerError:
+			accessLogger.error(c.Request.Context(), "request completed", fields)
+		case status >= http.StatusBadRequest:
+			accessLogger.warn(c.Request.Context(), "request completed", fields)
+		default:
+			accessLogger.info(c.Request.Context(), "request completed", fields)
+		}
+	}
+}
+
+func recoveryMiddleware(recoveryLogger *logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				recoveryLogger.error(c.Request.Context(), "recovered from panic", logFields{
+					"panic": fmt.Sprint(recovered),
+					"stack": string(debug.Stack()),
+				})
+
+				abortWithError(c, http.StatusInternalServerError, "internal server error")
+			}
+		}()
+
+		c.Next()
+	}
+}
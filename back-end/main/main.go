@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
@@ -256,60 +260,67 @@ type SoundCloudToken struct {
 	token       string
 }
 
-func newSoundCloudToken() (*SoundCloudToken, error) {
-	clientID, err := getSoundCloudClientID()
-
-	if err != nil {
-		return nil, err
-	}
-
+// The client ID is scraped lazily on first use so that other playlist sources
+// can still serve while SoundCloud is unreachable
+func newSoundCloudToken() *SoundCloudToken {
 	return &SoundCloudToken{
-		lastUpdated: time.Now(),
-		mutex:       &sync.Mutex{},
-		token:       clientID,
-	}, nil
+		mutex: &sync.Mutex{},
+	}
 }
 
-type SoundCloudPlaylistHandler struct {
-	lastupdate   time.Time
-	mutex        *sync.Mutex
-	token        *SoundCloudToken
-	playlist     *SoundCloudPlaylist
-	playlistName string
-}
+func (sct *SoundCloudToken) getNewClientID(ctx context.Context) (string, error) {
+	clientID, err := getSoundCloudClientID(ctx)
 
-func (sct *SoundCloudToken) getNewClientID() string {
-	clientID, err := getSoundCloudClientID()
+	sct.mutex.Lock()
+	defer sct.mutex.Unlock()
 
 	if err != nil {
-		return sct.token
+		if sct.token == "" {
+			return "", err
+		}
+
+		soundCloudLog.warn(ctx, "could not refresh client ID, reusing previous one", logFields{"error": err})
+
+		return sct.token, nil
 	}
 
-	return clientID
+	sct.lastUpdated = time.Now()
+	sct.token = clientID
+
+	return clientID, nil
 }
 
-func newSoundCloudPlaylistHandler(playlistName string) (*SoundCloudPlaylistHandler, error) {
-	soundcloudToken, err := newSoundCloudToken()
+// rotateClientID scrapes a fresh client ID, unlike getNewClientID failures are reported
+func (sct *SoundCloudToken) rotateClientID(ctx context.Context) (string, error) {
+	clientID, err := getSoundCloudClientID(ctx)
 
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	scph := &SoundCloudPlaylistHandler{
-		lastupdate:   time.Now(),
-		mutex:        &sync.Mutex{},
-		token:        soundcloudToken,
-		playlist:     nil,
-		playlistName: playlistName,
-	}
+	sct.setClientID(clientID)
 
-	return scph, scph.refreshUploadData()
+	return clientID, nil
 }
 
-func getUploadData(clientIDHandler *SoundCloudToken, workoutPlaylistTitle string) (*SoundCloudPlaylist, error) {
-	clientID := clientIDHandler.getNewClientID()
+// setClientID overrides the client ID, it is kept until a newer one is scraped
+func (sct *SoundCloudToken) setClientID(clientID string) {
+	sct.mutex.Lock()
+	defer sct.mutex.Unlock()
+
+	sct.lastUpdated = time.Now()
+	sct.token = clientID
+}
+
+func getUploadData(ctx context.Context, clientIDHandler *SoundCloudToken, workoutPlaylistTitle string) (*SoundCloudPlaylist, error) {
+	clientID, err := clientIDHandler.getNewClientID(ctx)
+
+	if err != nil {
+		return nil, err
+	}
 
 	userPlaylistResponse, err := getSoundCloudResponse(
+		ctx,
 		http.MethodGet,
 		"https://api-v2.soundcloud.com/users/371817032/playlists_without_albums?representation=mini&limit=10&offset=0&linked_partitioning=1&app_locale=en",
 		clientID,
@@ -345,6 +356,7 @@ func getUploadData(clientIDHandler *SoundCloudToken, workoutPlaylistTitle string
 	}
 
 	playlistInfoResponse, err := getSoundCloudResponse(
+		ctx,
 		http.MethodGet,
 		fmt.Sprintf(
 			"https://api-v2.soundcloud.com/playlists/%d?representation=full&limit=10&offset=0&app_locale=en",
@@ -412,10 +424,10 @@ func getUploadData(clientIDHandler *SoundCloudToken, workoutPlaylistTitle string
 
 			tracksRequest.Header.Set("referer", "https://soundcloud.com/")
 
-			trackResponse, err := http.DefaultClient.Do(tracksRequest)
+			trackResponse, err := doSoundCloudRequest(ctx, tracksRequest)
 
 			if err != nil {
-				panic(err)
+				return nil, err
 			}
 
 			responseBytes, err := ioutil.ReadAll(trackResponse.Body)
@@ -425,7 +437,7 @@ func getUploadData(clientIDHandler *SoundCloudToken, workoutPlaylistTitle string
 			// trackResponse.Body = ioutil.NopCloser(bytes.NewBuffer(responseBytes))
 
 			if err != nil {
-				panic(err)
+				return nil, err
 			}
 
 			var reqTracks []TrackElement
@@ -449,57 +461,21 @@ func getUploadData(clientIDHandler *SoundCloudToken, workoutPlaylistTitle string
 	return &soundCloudPlaylist, nil
 }
 
-// Meant to be ran concurrently after/before time has been reset to now
-func (scph *SoundCloudPlaylistHandler) refreshUploadDataWithUpdateTime(previousUpdateTime time.Time) error {
-	err := scph.refreshUploadData()
-
-	scph.mutex.Lock()
-	defer scph.mutex.Unlock()
-
-	if err != nil {
-		// Set the update time on err to 30 seconds to prevent too many consecutive
-		// requests to SC for the playlist, there will be about 30 seconds before another request is made
-		scph.lastupdate = previousUpdateTime.Add(time.Second * 30)
-	}
-
-	return err
-}
-
-func (scph *SoundCloudPlaylistHandler) refreshUploadData() error {
-	playlist, err := getUploadData(scph.token, scph.playlistName)
-
-	scph.mutex.Lock()
-	defer scph.mutex.Unlock()
-
-	if err == nil {
-		scph.playlist = playlist
-	}
-
-	return err
-}
+var ClientIDRegex = regexp.MustCompile(`client_id=([\d\w]{20,})`)
 
-// Manage how often data is updated, keeping it up to date
-func (scph *SoundCloudPlaylistHandler) getUploadData() *SoundCloudPlaylist {
-	scph.mutex.Lock()
+var (
+	soundCloudLog = newLogger("soundcloud")
+	playlistLog   = newLogger("playlist")
+)
 
-	if time.Now().Sub(scph.lastupdate) > time.Minute {
-		go scph.refreshUploadDataWithUpdateTime(scph.lastupdate)
+func getSoundCloudClientID(ctx context.Context) (string, error) {
+	homepageRequest, err := http.NewRequest(http.MethodGet, "https://soundcloud.com/riley-johnson-734562913/sets/lovethemgunsounds", nil)
 
-		// Prevent new updates from happening for at least another minute while we're fetching new results
-		scph.lastupdate = time.Now()
+	if err != nil {
+		return "", err
 	}
 
-	soundcloudPlaylist := scph.playlist
-
-	scph.mutex.Unlock()
-
-	return soundcloudPlaylist
-}
-
-var ClientIDRegex = regexp.MustCompile(`client_id=([\d\w]{20,})`)
-
-func getSoundCloudClientID() (string, error) {
-	homepageResponse, err := http.Get("https://soundcloud.com/riley-johnson-734562913/sets/lovethemgunsounds")
+	homepageResponse, err := doSoundCloudRequest(ctx, homepageRequest)
 
 	if err != nil {
 		return "", err
@@ -534,7 +510,7 @@ func getSoundCloudClientID() (string, error) {
 
 		scriptRequest.Header.Set("referer", "https://soundcloud.com/")
 
-		scriptResponse, err := http.DefaultClient.Do(scriptRequest)
+		scriptResponse, err := doSoundCloudRequest(ctx, scriptRequest)
 
 		if err != nil {
 			continue
@@ -556,7 +532,7 @@ func getSoundCloudClientID() (string, error) {
 	return "", errors.New("could not find client ID")
 }
 
-func getSoundCloudResponse(method, url, clientID string, body io.Reader) (*http.Response, error) {
+func getSoundCloudResponse(ctx context.Context, method, url, clientID string, body io.Reader) (*http.Response, error) {
 	soundCloudRequest, err := http.NewRequest(method, url, body)
 
 	if err != nil {
@@ -571,31 +547,371 @@ func getSoundCloudResponse(method, url, clientID string, body io.Reader) (*http.
 
 	soundCloudRequest.Header.Set("referer", "https://soundcloud.com/")
 
-	return http.DefaultClient.Do(soundCloudRequest)
+	return doSoundCloudRequest(ctx, soundCloudRequest)
+}
+
+// doSoundCloudRequest performs the request bound to ctx, logging it under the caller's request ID
+func doSoundCloudRequest(ctx context.Context, soundCloudRequest *http.Request) (*http.Response, error) {
+	start := time.Now()
+
+	response, err := http.DefaultClient.Do(soundCloudRequest.WithContext(ctx))
+
+	fields := logFields{
+		"method":      soundCloudRequest.Method,
+		"url":         redactURL(soundCloudRequest.URL.String()),
+		"duration_ms": float64(time.Since(start)) / float64(time.Millisecond),
+	}
+
+	if err != nil {
+		err = redactURLError(err)
+
+		fields["error"] = err
+
+		soundCloudLog.warn(ctx, "soundcloud request failed", fields)
+
+		return nil, err
+	}
+
+	fields["status"] = response.StatusCode
+
+	soundCloudLog.debug(ctx, "soundcloud request completed", fields)
+
+	return response, nil
 }
 
 func main() {
-	router := gin.Default()
+	defaultConfigPath, configPathFromEnv := os.LookupEnv("CONFIG_FILE")
+
+	if !configPathFromEnv {
+		defaultConfigPath = "config.yaml"
+	}
+
+	configPath := flag.String("config", defaultConfigPath, "YAML config file, defaults to $CONFIG_FILE, environment variables override its values")
+	printConfig := flag.Bool("print-config", false, "print the effective config with secrets redacted and exit")
+
+	flag.Usage = usage
+
+	flag.Parse()
+
+	serverLog := newLogger("server")
+
+	file := configFile{
+		path:     *configPath,
+		required: configPathFromEnv || *configPath != defaultConfigPath,
+	}
+
+	config, err := loadConfig(file)
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+
+		os.Exit(2)
+	}
+
+	if flag.NArg() != 0 {
+		os.Exit(runCommand(config, flag.Args()))
+	}
+
+	if *printConfig {
+		configYAML, err := redactedConfigYAML(config)
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+
+			os.Exit(1)
+		}
+
+		os.Stdout.Write(configYAML)
+
+		return
+	}
+
+	settings := newLiveConfig(file, config)
+
+	// Already validated, so this cannot fail
+	logs.configure(config.Log.Level)
+
+	log.SetFlags(0)
+	log.SetOutput(&stdLogWriter{logger: newLogger("stdlib"), level: levelInfo})
+
+	gin.DefaultWriter = &stdLogWriter{logger: newLogger("gin"), level: levelDebug}
+	gin.DefaultErrorWriter = &stdLogWriter{logger: newLogger("gin"), level: levelError}
+
+	trustedProxies, err := parseTrustedProxies(config.Server.TrustedProxies)
+
+	if err != nil {
+		serverLog.error(context.Background(), "invalid trusted proxies", logFields{"error": err})
+
+		os.Exit(2)
+	}
+
+	limiters, err := newRateLimiters(config.RateLimit)
+
+	if err != nil {
+		serverLog.error(context.Background(), "invalid rate limits", logFields{"error": err})
+
+		os.Exit(2)
+	}
+
+	useJSONFieldNames()
+
+	router := gin.New()
+
+	router.ForwardedByClientIP = false
+
+	router.Use(
+		requestIDMiddleware(),
+		clientIPMiddleware(trustedProxies),
+		accessLogMiddleware(newLogger("http")),
+		recoveryMiddleware(serverLog),
+	)
+
+	const playlistKey = "songs"
+
+	startupCtx := contextWithRequestID(context.Background(), "startup-"+newRequestID())
+
+	sources, err := newPlaylistSources(config.Playlist.Sources, config.Playlist.LocalDir)
+
+	if err != nil {
+		serverLog.error(context.Background(), "invalid playlist sources", logFields{"error": err})
+
+		os.Exit(2)
+	}
 
-	apiGroup := router.Group("/api")
+	snapshots := newPlaylistSnapshotStore(filepath.Join(config.DataDir, "snapshots", playlistKey))
 
-	soundcloudPlaylistHandler, err := newSoundCloudPlaylistHandler("NormieAppropriateGymMusic")
+	playlistHandler, err := newPlaylistHandler(startupCtx, config.Playlist.Title, sources.ordered, snapshots)
 
 	for err != nil {
-		log.Println(err)
+		serverLog.error(startupCtx, "could not load initial playlist, retrying", logFields{"error": err})
 
 		time.Sleep(time.Second * 15)
 
-		soundcloudPlaylistHandler, err = newSoundCloudPlaylistHandler("NormieAppropriateGymMusic")
+		playlistHandler, err = newPlaylistHandler(startupCtx, config.Playlist.Title, sources.ordered, snapshots)
+	}
+
+	playlistHandler.setRefreshTiming(config.Playlist.RefreshInterval, config.Playlist.ErrorBackoff)
+
+	go playlistHandler.runSnapshotFlusher(config.Playlist.SnapshotInterval)
+
+	if config.Ghost.Key == "" {
+		serverLog.warn(startupCtx, "no ghost content key configured, posts will be unavailable", nil)
+	}
+
+	ghost := newGhostClient(config.Ghost)
+
+	enricher := newPostEnricher(func() []string {
+		current := settings.current()
+
+		return []string{current.Ghost.URL, current.Site.BaseURL}
+	}, func() enrichConfig {
+		return settings.current().Enrich
+	})
+
+	posts := newPostService(ghost, enricher, config.Ghost.CacheSize, func() ghostConfig {
+		return settings.current().Ghost
+	})
+
+	site := func() siteConfig {
+		return settings.current().Site
+	}
+
+	feeds := newPostFeeds(posts, site, func() ghostConfig {
+		return settings.current().Ghost
+	}, func() feedConfig {
+		return settings.current().Feed
+	})
+
+	pages := newRevalidator(config.Revalidate.Timeout, func() revalidateConfig {
+		return settings.current().Revalidate
+	})
+
+	siteMap := newSitemap(ghost, site, func() sitemapConfig {
+		return settings.current().Sitemap
+	})
+
+	go siteMap.run(config.Sitemap.RegenerateInterval)
+
+	search := newPostSearch(ghost)
+
+	go search.run(config.Search.ReindexInterval)
+
+	articles, err := newArticleFeeds(startupCtx, filepath.Join(config.DataDir, "articles"), posts, func() articlesConfig {
+		return settings.current().Articles
+	})
+
+	if err != nil {
+		serverLog.error(startupCtx, "could not set up article feeds", logFields{"error": err})
+
+		os.Exit(1)
+	}
+
+	analytics, err := newAnalyticsCollector(startupCtx, filepath.Join(config.DataDir, "analytics"), site, func() analyticsConfig {
+		return settings.current().Analytics
+	})
+
+	if err != nil {
+		serverLog.error(startupCtx, "could not set up analytics", logFields{"error": err})
+
+		os.Exit(1)
+	}
+
+	go analytics.run(time.Hour)
+
+	audit := newAuditLog(filepath.Join(config.DataDir, "audit.log"))
+
+	ghostHooks := newGhostWebhooks(posts, pages, siteMap, search, audit, func() ghostConfig {
+		return settings.current().Ghost
+	})
+
+	mailer, err := newMailSender(config.Email, config.DataDir)
+
+	if err != nil {
+		serverLog.error(startupCtx, "invalid email config", logFields{"error": err})
+
+		os.Exit(2)
+	}
+
+	if config.Email.Sender == "file" {
+		serverLog.warn(startupCtx, "emails are written to files instead of being delivered", nil)
+	}
+
+	emails := newOutbox(filepath.Join(config.DataDir, "outbox"), mailer, audit, func() emailConfig {
+		return settings.current().Email
+	})
+
+	go emails.run()
+
+	contact, err := newContactAPI(filepath.Join(config.DataDir, "contact"), audit, emails, func() contactConfig {
+		return settings.current().Contact
+	})
+
+	if err != nil {
+		serverLog.error(startupCtx, "could not set up the contact API", logFields{"error": err})
+
+		os.Exit(1)
+	}
+
+	comments, err := newCommentsAPI(filepath.Join(config.DataDir, "comments"), posts, audit, emails, func() commentsConfig {
+		return settings.current().Comments
+	})
+
+	if err != nil {
+		serverLog.error(startupCtx, "could not set up comments", logFields{"error": err})
+
+		os.Exit(1)
 	}
 
-	apiGroup.GET("/songs", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{
-			"err":  false,
-			"data": soundcloudPlaylistHandler.getUploadData(),
-			"msg":  "",
-		})
+	previews := newOGImages(filepath.Join(config.DataDir, "og"), posts, playlistHandler, playlistKey, func() []string {
+		current := settings.current()
+
+		return []string{current.Ghost.URL, current.Site.BaseURL, soundCloudImageOrigin}
+	}, site, func() ogConfig {
+		return settings.current().OG
 	})
 
-	router.Run(":80")
+	subscriptions, err := newNewsletter(filepath.Join(config.DataDir, "newsletter"), posts, playlistHandler, emails, audit, site, func() newsletterConfig {
+		return settings.current().Newsletter
+	})
+
+	if err != nil {
+		serverLog.error(startupCtx, "could not set up the newsletter", logFields{"error": err})
+
+		os.Exit(1)
+	}
+
+	go subscriptions.run(time.Hour)
+
+	links, err := newShortLinks(filepath.Join(config.DataDir, "links"), audit, site)
+
+	if err != nil {
+		serverLog.error(startupCtx, "could not set up short links", logFields{"error": err})
+
+		os.Exit(1)
+	}
+
+	go links.run(time.Minute)
+
+	admin := &adminAPI{
+		audit:      audit,
+		playlists:  map[string]*PlaylistHandler{playlistKey: playlistHandler},
+		soundCloud: sources.soundCloud,
+	}
+
+	adminToken := func() string {
+		return settings.current().Admin.Token
+	}
+
+	auth, err := newAuthService(filepath.Join(config.DataDir, "auth"), audit, func() authConfig {
+		return settings.current().Auth
+	})
+
+	if err != nil {
+		serverLog.error(startupCtx, "could not set up authentication", logFields{"error": err})
+
+		os.Exit(1)
+	}
+
+	apiKeys := newAPIKeyRoutes(newAPIKeyStore(filepath.Join(config.DataDir, "auth")))
+
+	registerAllRoutes(router, limiters, adminToken, apiServices{
+		playlist:      playlistHandler,
+		localTracks:   sources.local,
+		posts:         posts,
+		feeds:         feeds,
+		siteMap:       siteMap,
+		search:        search,
+		articles:      articles,
+		analytics:     analytics,
+		ghostHooks:    ghostHooks,
+		emails:        emails,
+		contact:       contact,
+		comments:      comments,
+		previews:      previews,
+		subscriptions: subscriptions,
+		links:         links,
+		admin:         admin,
+		auth:          auth,
+		apiKeys:       apiKeys,
+		docs:          newAPIDocs(site, apiKeys),
+	})
+
+	if config.Admin.Token == "" && !auth.hasAccounts() {
+		serverLog.warn(startupCtx, "no admin token or accounts configured, the admin API is disabled", nil)
+	}
+
+	go settings.reloadOnSIGHUP(func(ctx context.Context, previous, next *appConfig) {
+		if err := logs.configure(next.Log.Level); err != nil {
+			configLog.error(ctx, "could not apply log levels", logFields{"error": err})
+		}
+
+		playlistHandler.setRefreshTiming(next.Playlist.RefreshInterval, next.Playlist.ErrorBackoff)
+
+		if err := limiters.update(next.RateLimit.Groups); err != nil {
+			configLog.error(ctx, "could not apply rate limits", logFields{"error": err})
+		}
+
+		if next.Playlist.Title != previous.Playlist.Title {
+			if _, err := playlistHandler.setPlaylistName(ctx, next.Playlist.Title); err != nil {
+				configLog.error(ctx, "could not switch to the configured playlist", logFields{
+					"playlist": next.Playlist.Title,
+					"error":    err,
+				})
+			}
+		}
+	})
+
+	server := newHTTPServer(config.Server, router)
+
+	server.ErrorLog = serverLog.stdLogger(levelWarn)
+
+	serverLog.info(startupCtx, "listening", logFields{"addr": config.Server.Addr})
+
+	err = runServer(server, config.Server.ShutdownTimeout, playlistHandler.close, emails.close, pages.close, siteMap.close, search.close, analytics.close, links.close, comments.close, subscriptions.close)
+
+	if err != nil {
+		serverLog.error(context.Background(), "server stopped with error", logFields{"error": err})
+
+		os.Exit(1)
+	}
 }
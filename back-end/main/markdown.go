@@ -0,0 +1,318 @@
+package main
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A small markdown renderer for comments. It covers paragraphs, line breaks,
+// blockquotes, lists, fenced code, inline code, emphasis and links, nothing that
+// needs raw HTML. All text is escaped as it is written and only http, https and
+// mailto links are kept, so the output is safe to insert into a page as is.
+
+var markdownListItemPattern = regexp.MustCompile(`^(?:([-*+])|(\d{1,9})[.)])\s+`)
+
+const markdownLinkRel = `rel="nofollow ugc noopener"`
+
+func renderMarkdown(source string) string {
+	source = strings.Replace(source, "\r\n", "\n", -1)
+
+	var output strings.Builder
+
+	renderMarkdownBlocks(&output, strings.Split(source, "\n"))
+
+	return strings.TrimSuffix(output.String(), "\n")
+}
+
+func markdownBlockStart(line string) bool {
+	trimmed := strings.TrimSpace(line)
+
+	return trimmed == "" || strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, ">") || markdownListItemPattern.MatchString(trimmed)
+}
+
+func renderMarkdownBlocks(output *strings.Builder, lines []string) {
+	for index := 0; index < len(lines); {
+		trimmed := strings.TrimSpace(lines[index])
+
+		switch {
+		case trimmed == "":
+			index++
+		case strings.HasPrefix(trimmed, "```"):
+			index++
+
+			var code []string
+
+			for ; index < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[index]), "```"); index++ {
+				code = append(code, lines[index])
+			}
+
+			// Skips the closing fence, an unclosed block runs to the end
+			index++
+
+			output.WriteString("<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>\n")
+		case strings.HasPrefix(trimmed, ">"):
+			var quoted []string
+
+			for ; index < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[index]), ">"); index++ {
+				line := strings.TrimPrefix(strings.TrimSpace(lines[index]), ">")
+
+				quoted = append(quoted, strings.TrimPrefix(line, " "))
+			}
+
+			output.WriteString("<blockquote>\n")
+
+			renderMarkdownBlocks(output, quoted)
+
+			output.WriteString("</blockquote>\n")
+		case markdownListItemPattern.MatchString(trimmed):
+			ordered := markdownListItemPattern.FindStringSubmatch(trimmed)[2] != ""
+			tag := "ul"
+
+			if ordered {
+				tag = "ol"
+			}
+
+			output.WriteString("<" + tag + ">\n")
+
+			for ; index < len(lines); index++ {
+				item := markdownListItemPattern.FindStringSubmatch(strings.TrimSpace(lines[index]))
+
+				if item == nil || (item[2] != "") != ordered {
+					break
+				}
+
+				output.WriteString("<li>" + renderMarkdownInline(strings.TrimSpace(lines[index])[len(item[0]):], false) + "</li>\n")
+			}
+
+			output.WriteString("</" + tag + ">\n")
+		default:
+			var paragraph []string
+
+			for ; index < len(lines) && (len(paragraph) == 0 || !markdownBlockStart(lines[index])); index++ {
+				paragraph = append(paragraph, renderMarkdownInline(strings.TrimSpace(lines[index]), false))
+			}
+
+			output.WriteString("<p>" + strings.Join(paragraph, "<br>\n") + "</p>\n")
+		}
+	}
+}
+
+// markdownLinkURL returns the link target if it is one that can be followed safely
+func markdownLinkURL(target string) (string, bool) {
+	parsed, err := url.Parse(target)
+
+	if err != nil {
+		return "", false
+	}
+
+	switch parsed.Scheme {
+	case "http", "https":
+		if parsed.Host == "" {
+			return "", false
+		}
+	case "mailto":
+	default:
+		return "", false
+	}
+
+	return parsed.String(), true
+}
+
+func markdownLink(target, text string) string {
+	return `<a href="` + html.EscapeString(target) + `" ` + markdownLinkRel + `>` + text + `</a>`
+}
+
+// markdownCodeSpan measures the code span text starts with, returning the length of
+// its opening run of backticks and of the whole span, which is zero when no run of the
+// same length closes it
+func markdownCodeSpan(text string) (int, int) {
+	fence := len(text) - len(strings.TrimLeft(text, "`"))
+
+	for index := fence; index < len(text); {
+		next := strings.IndexByte(text[index:], '`')
+
+		if next == -1 {
+			break
+		}
+
+		index += next
+
+		run := len(text[index:]) - len(strings.TrimLeft(text[index:], "`"))
+
+		if run == fence {
+			return fence, index + run
+		}
+
+		index += run
+	}
+
+	return fence, 0
+}
+
+// markdownCloser finds where a run of width delimiters, "*" or "_", closes emphasis
+// in text, which starts after the opener. Code spans are skipped and the last of a
+// run of delimiters are taken, so "***x***" closes its strong and its emphasis. An
+// odd run is needed to close a single delimiter, a pair belongs to strong emphasis.
+func markdownCloser(text string, delimiter byte, width int) int {
+	for index := 0; index < len(text); {
+		if text[index] == '`' {
+			fence, end := markdownCodeSpan(text[index:])
+
+			if end == 0 {
+				end = fence
+			}
+
+			index += end
+
+			continue
+		}
+
+		if text[index] != delimiter {
+			index++
+
+			continue
+		}
+
+		run := len(text[index:]) - len(strings.TrimLeft(text[index:], string(delimiter)))
+
+		if run >= width && (width == 2 || run%2 == 1) {
+			return index + run - width
+		}
+
+		index += run
+	}
+
+	return -1
+}
+
+// markdownLinkTargetEnd finds the parenthesis closing a link target, any within the
+// target have to be balanced
+func markdownLinkTargetEnd(text string) int {
+	depth := 0
+
+	for index := 0; index < len(text); index++ {
+		switch text[index] {
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				return index
+			}
+
+			depth--
+		}
+	}
+
+	return -1
+}
+
+// renderMarkdownInline renders a line's inline markup, links can't be nested in links
+func renderMarkdownInline(text string, inLink bool) string {
+	var (
+		output strings.Builder
+		plain  strings.Builder
+	)
+
+	flush := func() {
+		output.WriteString(html.EscapeString(plain.String()))
+		plain.Reset()
+	}
+
+	for index := 0; index < len(text); {
+		rest := text[index:]
+
+		previous, _ := utf8.DecodeLastRuneInString(text[:index])
+		afterWord := index != 0 && (unicode.IsLetter(previous) || unicode.IsDigit(previous))
+
+		switch {
+		case rest[0] == '`':
+			fence, end := markdownCodeSpan(rest)
+
+			// An unclosed fence is text, all of it, so none of its backticks open a span
+			if end == 0 {
+				plain.WriteString(rest[:fence])
+
+				index += fence
+
+				continue
+			}
+
+			flush()
+			output.WriteString("<code>" + html.EscapeString(rest[fence:end-fence]) + "</code>")
+
+			index += end
+
+			continue
+		case strings.HasPrefix(rest, "**"):
+			if end := markdownCloser(rest[2:], '*', 2); end > 0 {
+				flush()
+				output.WriteString("<strong>" + renderMarkdownInline(rest[2:end+2], inLink) + "</strong>")
+
+				index += end + 4
+
+				continue
+			}
+		case (rest[0] == '*' || rest[0] == '_') && !afterWord:
+			if end := markdownCloser(rest[1:], rest[0], 1); end > 0 && rest[1] != ' ' {
+				flush()
+				output.WriteString("<em>" + renderMarkdownInline(rest[1:end+1], inLink) + "</em>")
+
+				index += end + 2
+
+				continue
+			}
+		case rest[0] == '[' && !inLink:
+			textEnd := strings.Index(rest, "](")
+
+			if textEnd > 1 {
+				if targetEnd := markdownLinkTargetEnd(rest[textEnd+2:]); targetEnd > 0 {
+					if target, ok := markdownLinkURL(rest[textEnd+2 : textEnd+2+targetEnd]); ok {
+						flush()
+						output.WriteString(markdownLink(target, renderMarkdownInline(rest[1:textEnd], true)))
+
+						index += textEnd + 3 + targetEnd
+
+						continue
+					}
+				}
+			}
+		case !inLink && !afterWord && (strings.HasPrefix(rest, "http://") || strings.HasPrefix(rest, "https://")):
+			end := strings.IndexFunc(rest, unicode.IsSpace)
+
+			if end == -1 {
+				end = len(rest)
+			}
+
+			// Punctuation ending a sentence isn't part of the link, nor is a closing
+			// parenthesis without an opening one, as when the link is in parentheses
+			end = len(strings.TrimRight(rest[:end], ".,;:!?'\""))
+
+			for strings.HasSuffix(rest[:end], ")") && strings.Count(rest[:end], "(") < strings.Count(rest[:end], ")") {
+				end = len(strings.TrimRight(rest[:end-1], ".,;:!?'\""))
+			}
+
+			if target, ok := markdownLinkURL(rest[:end]); ok {
+				flush()
+				output.WriteString(markdownLink(target, html.EscapeString(rest[:end])))
+
+				index += end
+
+				continue
+			}
+		}
+
+		r, size := utf8.DecodeRuneInString(rest)
+
+		plain.WriteRune(r)
+
+		index += size
+	}
+
+	flush()
+
+	return output.String()
+}
@@ -0,0 +1,79 @@
+package main
+
+import "testing"
+
+func TestRenderMarkdown(t *testing.T) {
+	const rel = ` rel="nofollow ugc noopener"`
+
+	cases := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		// Raw HTML is always text
+		{"script", "<script>alert(1)</script>", "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>"},
+		{"html in emphasis", "*<b>x</b>*", "<p><em>&lt;b&gt;x&lt;/b&gt;</em></p>"},
+		{"html in strong", "**<img src=x onerror=alert(1)>**", "<p><strong>&lt;img src=x onerror=alert(1)&gt;</strong></p>"},
+		{"html in link text", "[<i>x</i>](https://a.com)", `<p><a href="https://a.com"` + rel + `>&lt;i&gt;x&lt;/i&gt;</a></p>`},
+		{"html in code", "`<b>`", "<p><code>&lt;b&gt;</code></p>"},
+		{"html in fence", "```\n<script>\n```", "<pre><code>&lt;script&gt;</code></pre>"},
+		{"entities", "&amp; &lt;", "<p>&amp;amp; &amp;lt;</p>"},
+
+		// Only http, https and mailto links are kept
+		{"javascript link", "[x](javascript:alert(1))", "<p>[x](javascript:alert(1))</p>"},
+		{"javascript link in capitals", "[x](JavaScript:alert(1))", "<p>[x](JavaScript:alert(1))</p>"},
+		{"javascript link with a tab", "[x](java\tscript:alert(1))", "<p>[x](java\tscript:alert(1))</p>"},
+		{"data link", "[x](data:text/html,<script>)", "<p>[x](data:text/html,&lt;script&gt;)</p>"},
+		{"scheme relative link", "[x](//evil.com)", "<p>[x](//evil.com)</p>"},
+		{"relative link", "[x](/path)", "<p>[x](/path)</p>"},
+		{"scheme-less link", "[x](evil.com)", "<p>[x](evil.com)</p>"},
+		{"hostless link", "[x](http:evil.com)", "<p>[x](http:evil.com)</p>"},
+		{"mailto link", "[x](mailto:a@b.c)", `<p><a href="mailto:a@b.c"` + rel + `>x</a></p>`},
+		{"javascript autolink", "javascript:alert(1)", "<p>javascript:alert(1)</p>"},
+		{"hostless autolink", "http://", "<p>http://</p>"},
+
+		// Quotes and angle brackets can't leave the href
+		{"double quotes in link", `[x](https://a.com/"onmouseover="x)`, `<p><a href="https://a.com/%22onmouseover=%22x"` + rel + `>x</a></p>`},
+		{"single quote in link", "[x](https://a.com/'x)", `<p><a href="https://a.com/&#39;x"` + rel + `>x</a></p>`},
+		{"double quotes in autolink", `https://a.com/"onmouseover="x`, `<p><a href="https://a.com/%22onmouseover=%22x"` + rel + `>https://a.com/&#34;onmouseover=&#34;x</a></p>`},
+		{"html in autolink", "https://a.com/<b>", `<p><a href="https://a.com/%3Cb%3E"` + rel + `>https://a.com/&lt;b&gt;</a></p>`},
+
+		// Parentheses
+		{"parentheses in link", "[x](https://a.com/(b))", `<p><a href="https://a.com/(b)"` + rel + `>x</a></p>`},
+		{"parentheses in autolink", "https://en.wikipedia.org/wiki/A_(b)", `<p><a href="https://en.wikipedia.org/wiki/A_(b)"` + rel + `>https://en.wikipedia.org/wiki/A_(b)</a></p>`},
+		{"autolink in parentheses", "(see https://a.com/x)", `<p>(see <a href="https://a.com/x"` + rel + `>https://a.com/x</a>)</p>`},
+		{"autolink ending a sentence", "https://a.com.", `<p><a href="https://a.com"` + rel + `>https://a.com</a>.</p>`},
+
+		// Nesting
+		{"emphasis in strong", "**a *b* c**", "<p><strong>a <em>b</em> c</strong></p>"},
+		{"strong emphasis", "***x***", "<p><strong><em>x</em></strong></p>"},
+		{"strong in emphasis", "*a **b** c*", "<p><em>a <strong>b</strong> c</em></p>"},
+		{"crossed emphasis", "*a **b* c**", "<p><em>a **b</em> c**</p>"},
+		{"delimiters in code", "**a `**` b**", "<p><strong>a <code>**</code> b</strong></p>"},
+		{"emphasis in code", "`a *b* c`", "<p><code>a *b* c</code></p>"},
+		{"double backticks", "``a ` b``", "<p><code>a ` b</code></p>"},
+		{"link in link", "[[x](https://a.com)](https://b.com)", `<p><a href="https://a.com"` + rel + `>[x</a>](<a href="https://b.com"` + rel + `>https://b.com</a>)</p>`},
+		{"emphasis crossing a link", "[a **b](https://x.com) c**", `<p><a href="https://x.com"` + rel + `>a **b</a> c**</p>`},
+		{"underscores in words", "snake_case_word", "<p>snake_case_word</p>"},
+
+		// Unclosed markup is text
+		{"unclosed strong", "**unclosed", "<p>**unclosed</p>"},
+		{"unclosed underscore", "_unclosed", "<p>_unclosed</p>"},
+		{"unclosed backtick", "`unclosed", "<p>`unclosed</p>"},
+		{"empty code", "``", "<p>``</p>"},
+		{"unmatched backtick runs", "a `` b ` c", "<p>a `` b ` c</p>"},
+		{"unclosed fence", "```\ncode <b>\nmore", "<pre><code>code &lt;b&gt;\nmore</code></pre>"},
+		{"unclosed fence in a quote", "> quote *x*\n> ```\n> code", "<blockquote>\n<p>quote <em>x</em></p>\n<pre><code>code</code></pre>\n</blockquote>"},
+
+		// Blocks
+		{"fence", "```go\nx\n```\nafter", "<pre><code>x</code></pre>\n<p>after</p>"},
+		{"lists", "- a\n- b\n1. c", "<ul>\n<li>a</li>\n<li>b</li>\n</ul>\n<ol>\n<li>c</li>\n</ol>"},
+		{"line breaks", "a\r\nb\n\nc", "<p>a<br>\nb</p>\n<p>c</p>"},
+	}
+
+	for _, testCase := range cases {
+		if got := renderMarkdown(testCase.source); got != testCase.want {
+			t.Errorf("%s: renderMarkdown(%q) =\n%q\nwant\n%q", testCase.name, testCase.source, got, testCase.want)
+		}
+	}
+}
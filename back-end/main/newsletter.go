@@ -0,0 +1,751 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type newsletterConfig struct {
+	// Digests go out this long after the last one, if anything new was published
+	DigestInterval time.Duration `yaml:"digest_interval" env:"NEWSLETTER_DIGEST_INTERVAL" validate:"mindur=1h" reload:"true"`
+	// Unconfirmed subscriptions are forgotten after this, along with their confirmation links
+	ConfirmationTTL time.Duration `yaml:"confirmation_ttl" env:"NEWSLETTER_CONFIRMATION_TTL" validate:"mindur=1h" reload:"true"`
+}
+
+func defaultNewsletterConfig() newsletterConfig {
+	return newsletterConfig{
+		DigestInterval:  time.Hour * 24 * 7,
+		ConfirmationTTL: time.Hour * 72,
+	}
+}
+
+const (
+	subscriberPending   = "pending"
+	subscriberConfirmed = "confirmed"
+
+	newsletterConfirmPurpose     = "confirm"
+	newsletterUnsubscribePurpose = "unsubscribe"
+
+	// Asking to subscribe again sooner than this doesn't send another confirmation
+	newsletterResendDelay = time.Minute * 10
+)
+
+var errNewsletterSubscriberNotFound = errors.New("subscriber not found")
+
+type subscriber struct {
+	Email              string     `json:"email"`
+	Status             string     `json:"status"`
+	SubscribedAt       time.Time  `json:"subscribed_at"`
+	ConfirmedAt        *time.Time `json:"confirmed_at"`
+	ConfirmationSentAt time.Time  `json:"confirmation_sent_at"`
+	ClientIP           string     `json:"client_ip"`
+}
+
+// newsletterState is what the last digest covered
+type newsletterState struct {
+	LastDigestAt time.Time `json:"last_digest_at"`
+	TrackIDs     []string  `json:"track_ids"`
+}
+
+type newsletterSecrets struct {
+	TokenSecret string `json:"token_secret"`
+}
+
+type newsletterPost struct {
+	Title       string
+	URL         string
+	Excerpt     string
+	PublishedAt time.Time
+}
+
+type newsletterTrack struct {
+	Title  string
+	Artist string
+	URL    string
+}
+
+type newsletterDigest struct {
+	SiteTitle      string
+	SiteURL        string
+	Since          time.Time
+	Posts          []newsletterPost
+	Tracks         []newsletterTrack
+	UnsubscribeURL string
+}
+
+type newsletterConfirmation struct {
+	SiteTitle  string
+	ConfirmURL string
+	ExpiresAt  time.Time
+}
+
+// newsletter takes subscriptions with double opt-in and emails subscribers a digest
+// of new posts and playlist tracks. Confirmation and unsubscribe links carry a
+// signed token, so no state is needed to check them.
+type newsletter struct {
+	audit           *auditLog
+	config          func() newsletterConfig
+	digestMutex     *sync.Mutex
+	done            chan struct{}
+	mutex           *sync.Mutex
+	outbox          *outbox
+	playlists       *PlaylistHandler
+	posts           *postService
+	site            func() siteConfig
+	state           newsletterState
+	statePath       string
+	stop            chan struct{}
+	stopOnce        *sync.Once
+	subscribers     map[string]*subscriber
+	subscribersPath string
+	tokenSecret     []byte
+}
+
+var newsletterLog = newLogger("newsletter")
+
+func newNewsletter(directory string, posts *postService, playlists *PlaylistHandler, outbox *outbox, audit *auditLog, site func() siteConfig, config func() newsletterConfig) (*newsletter, error) {
+	nl := &newsletter{
+		audit:           audit,
+		config:          config,
+		digestMutex:     &sync.Mutex{},
+		done:            make(chan struct{}),
+		mutex:           &sync.Mutex{},
+		outbox:          outbox,
+		playlists:       playlists,
+		posts:           posts,
+		site:            site,
+		statePath:       filepath.Join(directory, "state.json"),
+		stop:            make(chan struct{}),
+		stopOnce:        &sync.Once{},
+		subscribers:     make(map[string]*subscriber),
+		subscribersPath: filepath.Join(directory, "subscribers.json"),
+	}
+
+	if err := readJSONFile(nl.subscribersPath, &nl.subscribers); err != nil {
+		return nil, err
+	}
+
+	if err := readJSONFile(nl.statePath, &nl.state); err != nil {
+		return nil, err
+	}
+
+	// Tokens in emails already sent must keep working after a restart
+	var secrets newsletterSecrets
+
+	secretsPath := filepath.Join(directory, "secrets.json")
+
+	if err := readJSONFile(secretsPath, &secrets); err != nil {
+		return nil, err
+	}
+
+	if secrets.TokenSecret == "" {
+		tokenSecret := make([]byte, 32)
+
+		if _, err := rand.Read(tokenSecret); err != nil {
+			return nil, err
+		}
+
+		secrets.TokenSecret = hex.EncodeToString(tokenSecret)
+
+		if err := writeJSONFile(secretsPath, secrets); err != nil {
+			return nil, err
+		}
+	}
+
+	tokenSecret, err := hex.DecodeString(secrets.TokenSecret)
+
+	if err != nil {
+		return nil, err
+	}
+
+	nl.tokenSecret = tokenSecret
+
+	return nl, nil
+}
+
+// subscriberKey ignores case, which almost every mail server does
+func subscriberKey(email string) string {
+	return strings.ToLower(email)
+}
+
+func (nl *newsletter) signToken(payload string) string {
+	mac := hmac.New(sha256.New, nl.tokenSecret)
+
+	mac.Write([]byte(payload))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// token is "<payload>.<signature>", the payload naming what it is for, when it was
+// issued and the address
+func (nl *newsletter) token(purpose, email string, issuedAt time.Time) string {
+	payload := purpose + ":" + strconv.FormatInt(issuedAt.Unix(), 10) + ":" + email
+
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + nl.signToken(payload)
+}
+
+// verifyToken returns the address a token for purpose was issued to and when
+func (nl *newsletter) verifyToken(purpose, token string) (string, time.Time, bool) {
+	tokenParts := strings.SplitN(token, ".", 2)
+
+	if len(tokenParts) != 2 {
+		return "", time.Time{}, false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(tokenParts[0])
+
+	if err != nil || !hmac.Equal([]byte(nl.signToken(string(payload))), []byte(tokenParts[1])) {
+		return "", time.Time{}, false
+	}
+
+	payloadParts := strings.SplitN(string(payload), ":", 3)
+
+	if len(payloadParts) != 3 || payloadParts[0] != purpose {
+		return "", time.Time{}, false
+	}
+
+	issuedAt, err := strconv.ParseInt(payloadParts[1], 10, 64)
+
+	if err != nil {
+		return "", time.Time{}, false
+	}
+
+	return payloadParts[2], time.Unix(issuedAt, 0), true
+}
+
+func (nl *newsletter) confirmURL(email string, now time.Time) string {
+	return nl.site().absoluteURL("/api/subscribe/confirm?token=" + url.QueryEscape(nl.token(newsletterConfirmPurpose, email, now)))
+}
+
+func (nl *newsletter) unsubscribeURL(email string) string {
+	// Unsubscribe links never expire, so they are all issued at the same time
+	return nl.site().absoluteURL("/api/unsubscribe?token=" + url.QueryEscape(nl.token(newsletterUnsubscribePurpose, email, time.Unix(0, 0))))
+}
+
+// updateSubscribers lets modify change the subscribers and saves them, modify must
+// leave them untouched when it fails
+func (nl *newsletter) updateSubscribers(modify func(subscribers map[string]*subscriber) error) error {
+	nl.mutex.Lock()
+	defer nl.mutex.Unlock()
+
+	if err := modify(nl.subscribers); err != nil {
+		return err
+	}
+
+	if err := writeJSONFile(nl.subscribersPath, nl.subscribers); err != nil {
+		subscribers := make(map[string]*subscriber)
+
+		if readErr := readJSONFile(nl.subscribersPath, &subscribers); readErr == nil {
+			nl.subscribers = subscribers
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// listSubscribers returns the subscribers, oldest first
+func (nl *newsletter) listSubscribers() []subscriber {
+	nl.mutex.Lock()
+	defer nl.mutex.Unlock()
+
+	listed := make([]subscriber, 0, len(nl.subscribers))
+
+	for _, current := range nl.subscribers {
+		listed = append(listed, *current)
+	}
+
+	sort.Slice(listed, func(i, j int) bool {
+		return listed[i].SubscribedAt.Before(listed[j].SubscribedAt)
+	})
+
+	return listed
+}
+
+func (nl *newsletter) registerRoutes(apiGroup *gin.RouterGroup, subscribeLimiter gin.HandlerFunc) {
+	apiGroup.POST("/subscribe", subscribeLimiter, nl.subscribe)
+	apiGroup.GET("/subscribe/confirm", nl.confirmPage)
+	apiGroup.POST("/subscribe/confirm", nl.confirm)
+	apiGroup.GET("/unsubscribe", nl.unsubscribePage)
+	// Posted by the unsubscribe page and by mail clients when the List-Unsubscribe
+	// button is used
+	apiGroup.POST("/unsubscribe", nl.unsubscribe)
+}
+
+func (nl *newsletter) registerAdminRoutes(adminGroup *gin.RouterGroup) {
+	adminGroup.GET("/newsletter/subscribers", nl.listSubscribersHandler)
+	adminGroup.POST("/newsletter/digest", nl.sendDigestHandler)
+}
+
+type subscribeRequest struct {
+	Email string `json:"email" binding:"required,email,max=254"`
+	// Hidden from people by the form, anything filled in here came from a bot
+	Website string `json:"website"`
+}
+
+// subscribe sends a confirmation link, the response is the same whether or not the
+// address is already subscribed so it can't be used to find out who is
+func (nl *newsletter) subscribe(c *gin.Context) {
+	var request subscribeRequest
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		abortWithError(c, http.StatusBadRequest, bindingErrorMessage(err))
+
+		return
+	}
+
+	ctx := c.Request.Context()
+
+	if request.Website != "" {
+		newsletterLog.info(ctx, "discarded subscription with filled honeypot", logFields{"client_ip": clientIP(c)})
+
+		respondWithData(c, nil)
+
+		return
+	}
+
+	email := strings.TrimSpace(request.Email)
+	now := time.Now().UTC()
+	sendConfirmation := false
+
+	err := nl.updateSubscribers(func(subscribers map[string]*subscriber) error {
+		current, exists := subscribers[subscriberKey(email)]
+
+		if exists && (current.Status == subscriberConfirmed || now.Sub(current.ConfirmationSentAt) < newsletterResendDelay) {
+			return nil
+		}
+
+		if !exists {
+			current = &subscriber{
+				Email:        email,
+				Status:       subscriberPending,
+				SubscribedAt: now,
+			}
+
+			subscribers[subscriberKey(email)] = current
+		}
+
+		current.ConfirmationSentAt = now
+		current.ClientIP = clientIP(c)
+
+		sendConfirmation = true
+
+		return nil
+	})
+
+	if err != nil {
+		newsletterLog.error(ctx, "could not store subscriber", logFields{"error": err})
+
+		abortWithError(c, http.StatusInternalServerError, "could not subscribe you, try again later")
+
+		return
+	}
+
+	if sendConfirmation {
+		confirmation := newsletterConfirmation{
+			SiteTitle:  nl.site().Title,
+			ConfirmURL: nl.confirmURL(email, now),
+			ExpiresAt:  now.Add(nl.config().ConfirmationTTL),
+		}
+
+		if _, err = nl.outbox.enqueue(ctx, "newsletter_confirmation", []string{email}, nil, confirmation); err != nil {
+			newsletterLog.error(ctx, "could not queue subscription confirmation", logFields{"error": err})
+
+			abortWithError(c, http.StatusInternalServerError, "could not subscribe you, try again later")
+
+			return
+		}
+	}
+
+	respondWithData(c, nil)
+}
+
+var newsletterPage = template.Must(template.New("newsletter").Parse(`<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <meta name="robots" content="noindex">
+  <title>{{.Heading}} | {{.SiteTitle}}</title>
+</head>
+<body style="font-family: sans-serif; line-height: 1.4; max-width: 600px; margin: 48px auto; padding: 0 16px;">
+  <h1>{{.Heading}}</h1>
+  <p>{{.Message}}</p>
+  {{- if .Action}}
+  <form method="post" action="{{.Action}}"><button type="submit">{{.Button}}</button></form>
+  {{- end}}
+  <p><a href="{{.SiteURL}}">Back to {{.SiteTitle}}</a></p>
+</body>
+</html>
+`))
+
+// servePage answers links followed from emails, which are opened in a browser
+func (nl *newsletter) servePage(c *gin.Context, status int, heading, message string) {
+	nl.serveFormPage(c, status, heading, message, "")
+}
+
+// serveFormPage asks before acting on a link, mail scanners follow links in emails
+// but don't submit forms. The form posts back to the same URL.
+func (nl *newsletter) serveFormPage(c *gin.Context, status int, heading, message, button string) {
+	site := nl.site()
+
+	var page bytes.Buffer
+
+	data := gin.H{
+		"Heading":   heading,
+		"Message":   message,
+		"SiteTitle": site.Title,
+		"SiteURL":   site.absoluteURL("/"),
+	}
+
+	if button != "" {
+		data["Action"] = c.Request.URL.RequestURI()
+		data["Button"] = button
+	}
+
+	err := newsletterPage.Execute(&page, data)
+
+	if err != nil {
+		c.String(http.StatusInternalServerError, "could not render page")
+
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Data(status, "text/html; charset=utf-8", page.Bytes())
+}
+
+// confirmPage is where confirmation links lead, it only asks to confirm since
+// links are followed by mail scanners too
+func (nl *newsletter) confirmPage(c *gin.Context) {
+	email, issuedAt, ok := nl.verifyToken(newsletterConfirmPurpose, c.Query("token"))
+
+	if !ok || time.Since(issuedAt) > nl.config().ConfirmationTTL {
+		nl.servePage(c, http.StatusBadRequest, "Link expired", "This confirmation link is invalid or has expired, subscribe again to get a new one.")
+
+		return
+	}
+
+	nl.serveFormPage(c, http.StatusOK, "Confirm subscription", "Get emails from "+nl.site().Title+" at "+email+" when there are new posts or songs?", "Confirm subscription")
+}
+
+// confirm is posted by the confirmation page
+func (nl *newsletter) confirm(c *gin.Context) {
+	email, issuedAt, ok := nl.verifyToken(newsletterConfirmPurpose, c.Query("token"))
+
+	if !ok || time.Since(issuedAt) > nl.config().ConfirmationTTL {
+		nl.servePage(c, http.StatusBadRequest, "Link expired", "This confirmation link is invalid or has expired, subscribe again to get a new one.")
+
+		return
+	}
+
+	now := time.Now().UTC()
+
+	err := nl.updateSubscribers(func(subscribers map[string]*subscriber) error {
+		current, exists := subscribers[subscriberKey(email)]
+
+		if !exists {
+			return errNewsletterSubscriberNotFound
+		}
+
+		if current.Status != subscriberConfirmed {
+			current.Status = subscriberConfirmed
+			current.ConfirmedAt = &now
+		}
+
+		return nil
+	})
+
+	if err == errNewsletterSubscriberNotFound {
+		nl.servePage(c, http.StatusBadRequest, "Link expired", "This confirmation link has expired, subscribe again to get a new one.")
+
+		return
+	}
+
+	if err != nil {
+		newsletterLog.error(c.Request.Context(), "could not confirm subscriber", logFields{"error": err})
+
+		nl.servePage(c, http.StatusInternalServerError, "Something went wrong", "Your subscription couldn't be confirmed, try the link again later.")
+
+		return
+	}
+
+	nl.servePage(c, http.StatusOK, "You're subscribed", "You'll get an email when there are new posts or songs.")
+}
+
+// unsubscribePage is where unsubscribe links lead, it only asks to confirm since
+// links are followed by mail scanners too
+func (nl *newsletter) unsubscribePage(c *gin.Context) {
+	email, _, ok := nl.verifyToken(newsletterUnsubscribePurpose, c.Query("token"))
+
+	if !ok {
+		nl.servePage(c, http.StatusBadRequest, "Invalid link", "This unsubscribe link is invalid.")
+
+		return
+	}
+
+	nl.serveFormPage(c, http.StatusOK, "Unsubscribe", "Stop emails from "+nl.site().Title+" to "+email+"?", "Unsubscribe")
+}
+
+// unsubscribe forgets the address entirely, the unsubscribe page gets a page back
+// while one click unsubscribes from mail clients, as in RFC 8058, get a plain response
+func (nl *newsletter) unsubscribe(c *gin.Context) {
+	email, _, ok := nl.verifyToken(newsletterUnsubscribePurpose, c.Query("token"))
+
+	oneClick := c.PostForm("List-Unsubscribe") == "One-Click"
+
+	if !ok {
+		if oneClick {
+			abortWithError(c, http.StatusBadRequest, "invalid unsubscribe link")
+		} else {
+			nl.servePage(c, http.StatusBadRequest, "Invalid link", "This unsubscribe link is invalid.")
+		}
+
+		return
+	}
+
+	err := nl.updateSubscribers(func(subscribers map[string]*subscriber) error {
+		delete(subscribers, subscriberKey(email))
+
+		return nil
+	})
+
+	if err != nil {
+		newsletterLog.error(c.Request.Context(), "could not unsubscribe", logFields{"error": err})
+
+		if oneClick {
+			abortWithError(c, http.StatusInternalServerError, "could not unsubscribe, try again later")
+		} else {
+			nl.servePage(c, http.StatusInternalServerError, "Something went wrong", "You couldn't be unsubscribed, try the link again later.")
+		}
+
+		return
+	}
+
+	if oneClick {
+		respondWithData(c, nil)
+
+		return
+	}
+
+	nl.servePage(c, http.StatusOK, "You're unsubscribed", "You won't get any more emails from "+nl.site().Title+".")
+}
+
+// pruneUnconfirmed forgets subscriptions that were never confirmed
+func (nl *newsletter) pruneUnconfirmed(now time.Time) error {
+	ttl := nl.config().ConfirmationTTL
+
+	return nl.updateSubscribers(func(subscribers map[string]*subscriber) error {
+		for key, current := range subscribers {
+			if current.Status == subscriberPending && now.Sub(current.ConfirmationSentAt) > ttl {
+				delete(subscribers, key)
+			}
+		}
+
+		return nil
+	})
+}
+
+// sendDigest emails confirmed subscribers the posts published and tracks added since
+// the last digest, once the digest interval has passed unless force is set. The first
+// run only records what there is, so subscribers aren't sent the whole back catalogue.
+func (nl *newsletter) sendDigest(ctx context.Context, now time.Time, force bool) (int, error) {
+	nl.digestMutex.Lock()
+	defer nl.digestMutex.Unlock()
+
+	state := nl.state
+
+	if !force && !state.LastDigestAt.IsZero() && now.Sub(state.LastDigestAt) < nl.config().DigestInterval {
+		return 0, nil
+	}
+
+	allPosts, _, err := nl.posts.listAllPosts(ctx)
+
+	if err != nil {
+		return 0, err
+	}
+
+	site := nl.site()
+
+	digest := newsletterDigest{
+		SiteTitle: site.Title,
+		SiteURL:   site.absoluteURL("/"),
+		Since:     state.LastDigestAt,
+	}
+
+	for _, post := range allPosts {
+		if post.PublishedAt.After(state.LastDigestAt) && !post.PublishedAt.After(now) {
+			digest.Posts = append(digest.Posts, newsletterPost{
+				Title:       post.Title,
+				URL:         site.absoluteURL("/posts/" + post.Slug),
+				Excerpt:     post.Excerpt,
+				PublishedAt: post.PublishedAt,
+			})
+		}
+	}
+
+	trackIDs := state.TrackIDs
+
+	if playlist := nl.playlists.getUploadData(ctx); playlist != nil {
+		previousTracks := make(map[string]bool)
+
+		for _, trackID := range state.TrackIDs {
+			previousTracks[trackID] = true
+		}
+
+		trackIDs = make([]string, 0, len(playlist.Tracks))
+
+		for _, track := range playlist.Tracks {
+			trackIDs = append(trackIDs, track.ID)
+
+			if previousTracks[track.ID] {
+				continue
+			}
+
+			newTrack := newsletterTrack{Title: track.Title, Artist: track.Artist}
+
+			if track.PermalinkURL != nil {
+				newTrack.URL = *track.PermalinkURL
+			}
+
+			digest.Tracks = append(digest.Tracks, newTrack)
+		}
+	}
+
+	sent, failed := 0, 0
+
+	if state.LastDigestAt.IsZero() {
+		newsletterLog.info(ctx, "recorded newsletter baseline, the next digest lists what is new after it", nil)
+	} else if len(digest.Posts) != 0 || len(digest.Tracks) != 0 {
+		for _, current := range nl.listSubscribers() {
+			if current.Status != subscriberConfirmed {
+				continue
+			}
+
+			digest.UnsubscribeURL = nl.unsubscribeURL(current.Email)
+
+			email, err := nl.outbox.render(ctx, "newsletter_digest", []string{current.Email}, nil, digest)
+
+			if err == nil {
+				email.ListUnsubscribe = digest.UnsubscribeURL
+
+				err = nl.outbox.queue(ctx, email)
+			}
+
+			// Everyone else still gets theirs
+			if err != nil {
+				newsletterLog.error(ctx, "could not queue digest", logFields{"error": err})
+
+				failed++
+
+				continue
+			}
+
+			sent++
+		}
+
+		newsletterLog.info(ctx, "queued newsletter digest", logFields{
+			"posts":       len(digest.Posts),
+			"tracks":      len(digest.Tracks),
+			"subscribers": sent,
+		})
+	}
+
+	// Nobody got this digest, the next run tries again with everything in it
+	if sent == 0 && failed != 0 {
+		return 0, fmt.Errorf("could not queue the digest for any of %d subscribers", failed)
+	}
+
+	state = newsletterState{LastDigestAt: now, TrackIDs: trackIDs}
+
+	if err = writeJSONFile(nl.statePath, state); err != nil {
+		return sent, err
+	}
+
+	nl.state = state
+
+	return sent, nil
+}
+
+// run checks for a due digest every interval until the newsletter is closed
+func (nl *newsletter) run(interval time.Duration) {
+	defer close(nl.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		ctx := contextWithRequestID(context.Background(), "newsletter-"+newRequestID())
+		now := time.Now().UTC()
+
+		if err := nl.pruneUnconfirmed(now); err != nil {
+			newsletterLog.error(ctx, "could not prune unconfirmed subscribers", logFields{"error": err})
+		}
+
+		if _, err := nl.sendDigest(ctx, now, false); err != nil {
+			newsletterLog.error(ctx, "could not send newsletter digest", logFields{"error": err})
+		}
+
+		select {
+		case <-ticker.C:
+		case <-nl.stop:
+			return
+		}
+	}
+}
+
+func (nl *newsletter) close(ctx context.Context) error {
+	nl.stopOnce.Do(func() {
+		close(nl.stop)
+	})
+
+	select {
+	case <-nl.done:
+	case <-ctx.Done():
+		newsletterLog.warn(ctx, "timed out waiting for the newsletter to stop", nil)
+	}
+
+	return nil
+}
+
+func (nl *newsletter) listSubscribersHandler(c *gin.Context) {
+	respondWithData(c, nl.listSubscribers())
+}
+
+type newsletterDigestResult struct {
+	Subscribers int `json:"subscribers"`
+}
+
+// sendDigestHandler sends a digest of what is new now rather than waiting for the interval
+func (nl *newsletter) sendDigestHandler(c *gin.Context) {
+	sent, err := nl.sendDigest(c.Request.Context(), time.Now().UTC(), true)
+
+	nl.audit.recordRequest(c, "newsletter.digest", "", gin.H{"subscribers": sent}, err)
+
+	if err != nil {
+		abortWithError(c, http.StatusBadGateway, "could not send the digest")
+
+		return
+	}
+
+	respondWithData(c, newsletterDigestResult{Subscribers: sent})
+}
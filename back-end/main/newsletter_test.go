@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type newsletterFixture struct {
+	directory  string
+	ghost      *fakeGhost
+	mailDir    string
+	newsletter *newsletter
+	outbox     *outbox
+	playlists  *PlaylistHandler
+}
+
+// newNewsletterFixture wires a newsletter to a fake Ghost, a pinned playlist and an
+// outbox which writes to the file sink, outboxDir is relative to the fixture's directory
+func newNewsletterFixture(t *testing.T, outboxDir string, posts ...Post) *newsletterFixture {
+	directory, err := ioutil.TempDir("", "newsletter")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fixture := &newsletterFixture{
+		directory: directory,
+		ghost:     newFakeGhost(posts...),
+		mailDir:   filepath.Join(directory, "mail"),
+		playlists: &PlaylistHandler{
+			mutex:     &sync.Mutex{},
+			pinned:    true,
+			refreshes: &sync.WaitGroup{},
+			playlist:  &Playlist{Title: "Uploads", Tracks: []PlaylistTrack{{ID: "track-1", Title: "Old Track", Artist: "Riley"}}},
+		},
+	}
+
+	sender, err := newMailSender(emailConfig{Sender: "file", FileDir: fixture.mailDir}, directory)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	audit := newAuditLog(filepath.Join(directory, "audit.log"))
+
+	fixture.outbox = newOutbox(filepath.Join(directory, outboxDir), sender, audit, defaultEmailConfig)
+
+	site := func() siteConfig {
+		return siteConfig{BaseURL: "https://example.com", Title: "Example"}
+	}
+
+	fixture.newsletter, err = newNewsletter(filepath.Join(directory, "newsletter"), fixture.ghost.postService(), fixture.playlists, fixture.outbox, audit, site, defaultNewsletterConfig)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fixture.newsletter.updateSubscribers(func(subscribers map[string]*subscriber) error {
+		confirmedAt := time.Now().UTC()
+
+		subscribers[subscriberKey("reader@example.com")] = &subscriber{Email: "reader@example.com", Status: subscriberConfirmed, ConfirmedAt: &confirmedAt}
+		subscribers[subscriberKey("pending@example.com")] = &subscriber{Email: "pending@example.com", Status: subscriberPending}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fixture
+}
+
+func (nf *newsletterFixture) close() {
+	nf.ghost.close()
+	os.RemoveAll(nf.directory)
+}
+
+// publish adds a post and a track after the baseline, the post cache is invalidated
+// as Ghost's webhook would
+func (nf *newsletterFixture) publish(posts []Post, publishedAt time.Time) {
+	nf.ghost.setPosts(append(posts, Post{ID: "2", Slug: "new-post", Title: "New Post", Excerpt: "Something new", PublishedAt: publishedAt})...)
+	nf.newsletter.posts.invalidate()
+
+	nf.playlists.mutex.Lock()
+	nf.playlists.playlist.Tracks = append(nf.playlists.playlist.Tracks, PlaylistTrack{ID: "track-2", Title: "New Track", Artist: "Riley"})
+	nf.playlists.mutex.Unlock()
+}
+
+func TestNewsletterDigestWritesToFileSink(t *testing.T) {
+	baseline := time.Date(2020, time.March, 1, 12, 0, 0, 0, time.UTC)
+	oldPosts := []Post{{ID: "1", Slug: "old-post", Title: "Old Post", PublishedAt: baseline.Add(-time.Hour)}}
+
+	fixture := newNewsletterFixture(t, "outbox", oldPosts...)
+	defer fixture.close()
+
+	ctx := context.Background()
+
+	if sent, err := fixture.newsletter.sendDigest(ctx, baseline, false); err != nil || sent != 0 {
+		t.Fatalf("the first digest should only record a baseline, sent %d: %v", sent, err)
+	}
+
+	fixture.publish(oldPosts, baseline.Add(time.Hour))
+
+	now := baseline.Add(defaultNewsletterConfig().DigestInterval)
+
+	sent, err := fixture.newsletter.sendDigest(ctx, now, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sent != 1 {
+		t.Fatalf("the digest should go to the one confirmed subscriber, sent %d", sent)
+	}
+
+	if !fixture.newsletter.state.LastDigestAt.Equal(now) {
+		t.Errorf("the last digest time is %v, want %v", fixture.newsletter.state.LastDigestAt, now)
+	}
+
+	fixture.outbox.deliverDue()
+
+	files, err := filepath.Glob(filepath.Join(fixture.mailDir, "*.eml"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 1 {
+		t.Fatalf("the file sink has %d messages, want 1", len(files))
+	}
+
+	data, err := ioutil.ReadFile(files[0])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := string(data)
+
+	for _, want := range []string{"To: <reader@example.com>", "List-Unsubscribe: <https://example.com/api/unsubscribe?token=", "New Post", "New Track"} {
+		if !strings.Contains(message, want) {
+			t.Errorf("the digest is missing %q", want)
+		}
+	}
+
+	for _, unwanted := range []string{"Old Post", "Old Track"} {
+		if strings.Contains(message, unwanted) {
+			t.Errorf("the digest lists %q from before the last one", unwanted)
+		}
+	}
+
+	// Nothing new since, so nobody gets another digest
+	later := now.Add(defaultNewsletterConfig().DigestInterval)
+
+	if sent, err := fixture.newsletter.sendDigest(ctx, later, false); err != nil || sent != 0 {
+		t.Errorf("a digest without anything new was sent to %d subscribers: %v", sent, err)
+	}
+}
+
+func TestNewsletterDigestKeepsLastDigestTimeWhenNothingQueued(t *testing.T) {
+	baseline := time.Date(2020, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	// A file where the outbox's directory should be makes every enqueue fail
+	fixture := newNewsletterFixture(t, "outbox-file")
+	defer fixture.close()
+
+	if err := ioutil.WriteFile(filepath.Join(fixture.directory, "outbox-file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	if _, err := fixture.newsletter.sendDigest(ctx, baseline, false); err != nil {
+		t.Fatal(err)
+	}
+
+	fixture.publish(nil, baseline.Add(time.Hour))
+
+	now := baseline.Add(defaultNewsletterConfig().DigestInterval)
+
+	if _, err := fixture.newsletter.sendDigest(ctx, now, false); err == nil {
+		t.Fatal("a digest that couldn't be queued for anyone should be an error")
+	}
+
+	if !fixture.newsletter.state.LastDigestAt.Equal(baseline) {
+		t.Errorf("the last digest time moved to %v, want it kept at %v", fixture.newsletter.state.LastDigestAt, baseline)
+	}
+}
+
+func TestNewsletterConfirmationNeedsPost(t *testing.T) {
+	fixture := newNewsletterFixture(t, "outbox")
+	defer fixture.close()
+
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+
+	fixture.newsletter.registerRoutes(router.Group("/api"), func(c *gin.Context) { c.Next() })
+
+	confirmURL, err := url.Parse(fixture.newsletter.confirmURL("pending@example.com", time.Now()))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status := func() string {
+		for _, listed := range fixture.newsletter.listSubscribers() {
+			if listed.Email == "pending@example.com" {
+				return listed.Status
+			}
+		}
+
+		return ""
+	}
+
+	request := func(method string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+
+		router.ServeHTTP(recorder, httptest.NewRequest(method, confirmURL.RequestURI(), nil))
+
+		return recorder
+	}
+
+	// Following the link, as mail scanners do, only shows the form
+	page := request(http.MethodGet)
+
+	if page.Code != http.StatusOK || !strings.Contains(page.Body.String(), `<form method="post"`) {
+		t.Fatalf("GET %s = %d without a form", confirmURL.Path, page.Code)
+	}
+
+	if current := status(); current != subscriberPending {
+		t.Fatalf("following the confirmation link made the subscriber %s", current)
+	}
+
+	if confirmed := request(http.MethodPost); confirmed.Code != http.StatusOK {
+		t.Fatalf("POST %s = %d, want 200", confirmURL.Path, confirmed.Code)
+	}
+
+	if current := status(); current != subscriberConfirmed {
+		t.Errorf("posting the confirmation form left the subscriber %s", current)
+	}
+}
@@ -0,0 +1,613 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ogConfig struct {
+	// Feature images and artwork are downloaded for at most this long, cards are
+	// drawn without them when it runs out
+	ImageTimeout    time.Duration `yaml:"image_timeout" env:"OG_IMAGE_TIMEOUT" validate:"mindur=100ms"`
+	BackgroundColor string        `yaml:"background_color" env:"OG_BACKGROUND_COLOR" validate:"hexcolor" reload:"true"`
+	TextColor       string        `yaml:"text_color" env:"OG_TEXT_COLOR" validate:"hexcolor" reload:"true"`
+	AccentColor     string        `yaml:"accent_color" env:"OG_ACCENT_COLOR" validate:"hexcolor" reload:"true"`
+}
+
+func defaultOGConfig() ogConfig {
+	return ogConfig{
+		ImageTimeout:    time.Second * 5,
+		BackgroundColor: "#111827",
+		TextColor:       "#f9fafb",
+		AccentColor:     "#f59e0b",
+	}
+}
+
+const (
+	ogWidth   = 1200
+	ogHeight  = 630
+	ogPadding = 72
+	ogBarSize = 16
+
+	// The square image on the right of the card
+	ogArtworkSize = 420
+
+	ogKindPost     = "post"
+	ogKindPlaylist = "playlist"
+
+	// Bumped whenever the layout changes, so images cached on disk are redrawn
+	ogRenderVersion = 1
+
+	ogImageMaxBytes = 10 << 20
+	// Decoded as RGBA this is 48MB, far more than the artwork drawn needs
+	ogImageMaxPixels = 4000 * 3000
+)
+
+var errOGNotFound = errors.New("nothing to draw a preview image for")
+
+// ogCard is everything drawn on a preview image, its hash names the cached file
+type ogCard struct {
+	Version  int      `json:"version"`
+	Label    string   `json:"label"`
+	Title    string   `json:"title"`
+	Details  string   `json:"details"`
+	ImageURL string   `json:"image_url"`
+	Site     string   `json:"site"`
+	Colors   []string `json:"colors"`
+}
+
+type ogRender struct {
+	done     chan struct{}
+	image    []byte
+	complete bool
+	err      error
+}
+
+// ogImages draws Open Graph preview images for posts and the playlist. Rendered
+// images are kept on disk under a hash of what was drawn, so a changed post or
+// playlist gets a new image and the old one is removed.
+type ogImages struct {
+	config     func() ogConfig
+	directory  string
+	httpClient *http.Client
+	// Origins feature images and artwork may be downloaded from
+	imageOrigins func() []string
+	inFlight     map[string]*ogRender
+	mutex        *sync.Mutex
+	playlist     *PlaylistHandler
+	playlistKey  string
+	posts        *postService
+	site         func() siteConfig
+}
+
+var ogLog = newLogger("og")
+
+func newOGImages(directory string, posts *postService, playlist *PlaylistHandler, playlistKey string, imageOrigins func() []string, site func() siteConfig, config func() ogConfig) *ogImages {
+	og := &ogImages{
+		config:       config,
+		directory:    directory,
+		imageOrigins: imageOrigins,
+		inFlight:     make(map[string]*ogRender),
+		mutex:        &sync.Mutex{},
+		playlist:     playlist,
+		playlistKey:  playlistKey,
+		posts:        posts,
+		site:         site,
+	}
+
+	og.httpClient = &http.Client{
+		Timeout: config().ImageTimeout,
+		// A redirect mustn't lead off the allowed origins either
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+
+			if !onImageOrigin(req.URL.String(), og.imageOrigins()) {
+				return errors.New("image redirected off the allowed origins")
+			}
+
+			return nil
+		},
+	}
+
+	return og
+}
+
+func (og *ogImages) registerRoutes(apiGroup *gin.RouterGroup, limiter gin.HandlerFunc) {
+	// gin can't match "<id>.png" as a parameter, so the extension is checked in serve
+	apiGroup.GET("/og/:kind/:file", limiter, og.serve)
+}
+
+// card gathers what to draw for id, errOGNotFound means there is nothing by that id
+func (og *ogImages) card(ctx context.Context, kind, id string) (*ogCard, error) {
+	site := og.site()
+
+	card := &ogCard{
+		Version: ogRenderVersion,
+		Site:    site.Title,
+	}
+
+	config := og.config()
+
+	card.Colors = []string{config.BackgroundColor, config.TextColor, config.AccentColor}
+
+	switch kind {
+	case ogKindPost:
+		if !validSlug(id) {
+			return nil, errOGNotFound
+		}
+
+		post, _, err := og.posts.getPost(ctx, id)
+
+		if err != nil {
+			if err == errGhostNotFound {
+				err = errOGNotFound
+			}
+
+			return nil, err
+		}
+
+		card.Label = "POST"
+		card.Title = post.Title
+		card.Details = post.PublishedAt.Format("January 2, 2006")
+
+		if post.ReadingTime > 0 {
+			card.Details += fmt.Sprintf(" - %d min read", post.ReadingTime)
+		}
+
+		if post.FeatureImage != nil {
+			card.ImageURL = *post.FeatureImage
+		}
+	case ogKindPlaylist:
+		if id != og.playlistKey {
+			return nil, errOGNotFound
+		}
+
+		playlist := og.playlist.getUploadData(ctx)
+
+		if playlist == nil {
+			return nil, errors.New("the playlist hasn't been loaded yet")
+		}
+
+		card.Label = "PLAYLIST"
+		card.Title = playlist.Title
+		card.Details = strconv.Itoa(len(playlist.Tracks)) + " tracks"
+
+		if len(playlist.Tracks) == 1 {
+			card.Details = "1 track"
+		}
+
+		if playlist.ArtworkURL != nil {
+			card.ImageURL = *playlist.ArtworkURL
+		} else {
+			// Falls back to the first track with artwork
+			for _, track := range playlist.Tracks {
+				if track.ArtworkURL != nil {
+					card.ImageURL = *track.ArtworkURL
+
+					break
+				}
+			}
+		}
+	default:
+		return nil, errOGNotFound
+	}
+
+	if strings.HasPrefix(card.ImageURL, "/") {
+		card.ImageURL = site.absoluteURL(card.ImageURL)
+	}
+
+	return card, nil
+}
+
+func (og *ogImages) cachePath(kind, id string, card *ogCard) (string, error) {
+	cardJSON, err := json.Marshal(card)
+
+	if err != nil {
+		return "", err
+	}
+
+	digest := sha256.Sum256(cardJSON)
+
+	return filepath.Join(og.directory, kind, id+"-"+hex.EncodeToString(digest[:8])+".png"), nil
+}
+
+// removeCached deletes the cached images for id other than keep
+func (og *ogImages) removeCached(ctx context.Context, kind, id, keep string) {
+	entries, err := ioutil.ReadDir(filepath.Join(og.directory, kind))
+
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".png")
+
+		// Names are "<id>-<hash>", ids can contain dashes themselves
+		if hashIndex := strings.LastIndex(name, "-"); hashIndex == -1 || name[:hashIndex] != id {
+			continue
+		}
+
+		path := filepath.Join(og.directory, kind, entry.Name())
+
+		if path == keep {
+			continue
+		}
+
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			ogLog.warn(ctx, "could not remove outdated preview image", logFields{"path": path, "error": err})
+		}
+	}
+}
+
+// image returns the PNG for id and its version, drawing it when there is no cached
+// copy. The version is empty for images drawn without their artwork.
+func (og *ogImages) image(ctx context.Context, kind, id string) ([]byte, string, error) {
+	card, err := og.card(ctx, kind, id)
+
+	if err == errOGNotFound {
+		og.removeCached(ctx, kind, id, "")
+	}
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	path, err := og.cachePath(kind, id, card)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	if cached, err := ioutil.ReadFile(path); err == nil {
+		return cached, ogImageVersion(path), nil
+	}
+
+	og.mutex.Lock()
+
+	render, rendering := og.inFlight[path]
+
+	if !rendering {
+		render = &ogRender{done: make(chan struct{})}
+
+		og.inFlight[path] = render
+	}
+
+	og.mutex.Unlock()
+
+	if rendering {
+		<-render.done
+
+		return render.image, render.version(path), render.err
+	}
+
+	// Other requests may be waiting on this render
+	renderCtx := detachedContext(ctx)
+
+	render.image, render.complete, render.err = og.render(renderCtx, card)
+
+	// Images drawn without their artwork are served but not kept, the download is
+	// retried next time
+	if render.err == nil && render.complete {
+		if err := writeFileAtomic(path, render.image); err != nil {
+			ogLog.error(renderCtx, "could not cache preview image", logFields{"path": path, "error": err})
+		} else {
+			og.removeCached(renderCtx, kind, id, path)
+		}
+	}
+
+	og.mutex.Lock()
+	delete(og.inFlight, path)
+	og.mutex.Unlock()
+
+	close(render.done)
+
+	return render.image, render.version(path), render.err
+}
+
+// ogImageVersion is the hash in the name of a cached image
+func ogImageVersion(path string) string {
+	name := strings.TrimSuffix(filepath.Base(path), ".png")
+
+	return name[strings.LastIndex(name, "-")+1:]
+}
+
+func (render *ogRender) version(path string) string {
+	if !render.complete {
+		return ""
+	}
+
+	return ogImageVersion(path)
+}
+
+// fetchImage downloads and decodes a feature image or artwork
+func (og *ogImages) fetchImage(ctx context.Context, src string) (image.Image, error) {
+	if !onImageOrigin(src, og.imageOrigins()) {
+		return nil, errors.New("image isn't on an allowed origin")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, src, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := og.httpClient.Do(req.WithContext(ctx))
+
+	if err != nil {
+		return nil, redactURLError(err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("image responded with %d", resp.StatusCode)
+	}
+
+	imageBytes, err := ioutil.ReadAll(io.LimitReader(resp.Body, ogImageMaxBytes))
+
+	if err != nil {
+		return nil, err
+	}
+
+	// A small file can still decode to an enormous image
+	imageConfig, _, err := image.DecodeConfig(bytes.NewReader(imageBytes))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if imageConfig.Width*imageConfig.Height > ogImageMaxPixels {
+		return nil, fmt.Errorf("image is too large at %dx%d", imageConfig.Width, imageConfig.Height)
+	}
+
+	decoded, _, err := image.Decode(bytes.NewReader(imageBytes))
+
+	return decoded, err
+}
+
+// parseHexColor reads "#rgb" or "#rrggbb", which config validation guarantees
+func parseHexColor(hexColor string) color.RGBA {
+	hexColor = strings.TrimPrefix(hexColor, "#")
+
+	if len(hexColor) == 3 {
+		hexColor = string([]byte{hexColor[0], hexColor[0], hexColor[1], hexColor[1], hexColor[2], hexColor[2]})
+	}
+
+	rgb, _ := hex.DecodeString(hexColor)
+
+	if len(rgb) != 3 {
+		return color.RGBA{A: 0xff}
+	}
+
+	return color.RGBA{R: rgb[0], G: rgb[1], B: rgb[2], A: 0xff}
+}
+
+// blendColors mixes amount of from into to
+func blendColors(from, to color.RGBA, amount float64) color.RGBA {
+	mix := func(a, b uint8) uint8 {
+		return uint8(float64(a)*amount + float64(b)*(1-amount) + 0.5)
+	}
+
+	return color.RGBA{R: mix(from.R, to.R), G: mix(from.G, to.G), B: mix(from.B, to.B), A: 0xff}
+}
+
+// drawCover scales src to fill bounds, cropping whichever sides overflow. Each
+// pixel averages a grid of samples so large images don't alias when shrunk.
+func drawCover(dst *image.RGBA, bounds image.Rectangle, src image.Image) {
+	srcBounds := src.Bounds()
+	srcWidth, srcHeight := float64(srcBounds.Dx()), float64(srcBounds.Dy())
+
+	if srcWidth == 0 || srcHeight == 0 {
+		return
+	}
+
+	scale := srcWidth / float64(bounds.Dx())
+
+	if heightScale := srcHeight / float64(bounds.Dy()); heightScale < scale {
+		scale = heightScale
+	}
+
+	offsetX := float64(srcBounds.Min.X) + (srcWidth-scale*float64(bounds.Dx()))/2
+	offsetY := float64(srcBounds.Min.Y) + (srcHeight-scale*float64(bounds.Dy()))/2
+
+	samples := int(scale + 0.999)
+
+	if samples < 1 {
+		samples = 1
+	} else if samples > 4 {
+		samples = 4
+	}
+
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			var r, g, b uint32
+
+			for sampleY := 0; sampleY < samples; sampleY++ {
+				for sampleX := 0; sampleX < samples; sampleX++ {
+					srcX := int(offsetX + (float64(x)+(float64(sampleX)+0.5)/float64(samples))*scale)
+					srcY := int(offsetY + (float64(y)+(float64(sampleY)+0.5)/float64(samples))*scale)
+
+					sampleR, sampleG, sampleB, _ := src.At(srcX, srcY).RGBA()
+
+					r += sampleR
+					g += sampleG
+					b += sampleB
+				}
+			}
+
+			count := uint32(samples * samples)
+
+			dst.SetRGBA(bounds.Min.X+x, bounds.Min.Y+y, color.RGBA{
+				R: uint8(r / count >> 8),
+				G: uint8(g / count >> 8),
+				B: uint8(b / count >> 8),
+				A: 0xff,
+			})
+		}
+	}
+}
+
+// render draws the card as a PNG: a label, the title wrapped as large as fits,
+// details and the site title on the left, and the image on the right. complete is
+// false when the image couldn't be downloaded and was left out. Images off the
+// allowed origins are left out for good, without being downloaded.
+func (og *ogImages) render(ctx context.Context, card *ogCard) ([]byte, bool, error) {
+	var artwork image.Image
+
+	fetchable := card.ImageURL != "" && onImageOrigin(card.ImageURL, og.imageOrigins())
+
+	if card.ImageURL != "" && !fetchable {
+		ogLog.debug(ctx, "drawing preview image without an image off the allowed origins", logFields{
+			"src": redactURL(card.ImageURL),
+		})
+	}
+
+	if fetchable {
+		fetched, err := og.fetchImage(ctx, card.ImageURL)
+
+		if err != nil {
+			ogLog.warn(ctx, "drawing preview image without its image", logFields{
+				"src":   redactURL(card.ImageURL),
+				"error": err,
+			})
+		}
+
+		artwork = fetched
+	}
+
+	background := parseHexColor(card.Colors[0])
+	text := parseHexColor(card.Colors[1])
+	accent := parseHexColor(card.Colors[2])
+	muted := blendColors(text, background, 0.6)
+
+	canvas := image.NewRGBA(image.Rect(0, 0, ogWidth, ogHeight))
+
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(background), image.Point{}, draw.Src)
+	draw.Draw(canvas, image.Rect(0, 0, ogBarSize, ogHeight), image.NewUniform(accent), image.Point{}, draw.Src)
+
+	textLeft := ogBarSize + ogPadding
+	textRight := ogWidth - ogPadding
+
+	if artwork != nil {
+		artworkBounds := image.Rect(ogWidth-ogPadding-ogArtworkSize, (ogHeight-ogArtworkSize)/2, ogWidth-ogPadding, (ogHeight+ogArtworkSize)/2)
+
+		drawCover(canvas, artworkBounds, artwork)
+
+		textRight = artworkBounds.Min.X - ogPadding/2
+	}
+
+	drawBitmapText(canvas, textLeft, ogPadding, 3, card.Label, accent)
+
+	// The largest scale the whole title fits at, or the smallest with it cut short
+	titleTop, titleBottom := ogPadding+60, ogHeight-ogPadding-120
+	title := bitmapFontText(card.Title)
+
+	var (
+		titleLines []string
+		titleScale int
+	)
+
+	for titleScale = 10; titleScale >= 4; titleScale-- {
+		lineHeight := (bitmapFontHeight + 3) * titleScale
+		lineWidth := (textRight - textLeft + titleScale) / (bitmapFontAdvance * titleScale)
+
+		lines, fits := wrapBitmapText(title, lineWidth, (titleBottom-titleTop)/lineHeight)
+
+		titleLines = lines
+
+		if fits || titleScale == 4 {
+			break
+		}
+	}
+
+	for index, line := range titleLines {
+		drawBitmapText(canvas, textLeft, titleTop+index*(bitmapFontHeight+3)*titleScale, titleScale, line, text)
+	}
+
+	detailsLines, _ := wrapBitmapText(bitmapFontText(card.Details), (textRight-textLeft+3)/(bitmapFontAdvance*3), 1)
+
+	if len(detailsLines) != 0 {
+		drawBitmapText(canvas, textLeft, ogHeight-ogPadding-84, 3, detailsLines[0], muted)
+	}
+
+	siteLines, _ := wrapBitmapText(bitmapFontText(card.Site), (textRight-textLeft+4)/(bitmapFontAdvance*4), 1)
+
+	if len(siteLines) != 0 {
+		drawBitmapText(canvas, textLeft, ogHeight-ogPadding-bitmapFontHeight*4, 4, siteLines[0], accent)
+	}
+
+	var encoded bytes.Buffer
+
+	if err := png.Encode(&encoded, canvas); err != nil {
+		return nil, false, err
+	}
+
+	return encoded.Bytes(), !fetchable || artwork != nil, nil
+}
+
+func (og *ogImages) serve(c *gin.Context) {
+	ctx := c.Request.Context()
+	kind := c.Param("kind")
+	file := c.Param("file")
+
+	if !strings.HasSuffix(file, ".png") {
+		c.String(http.StatusNotFound, "image not found")
+
+		return
+	}
+
+	pngBytes, version, err := og.image(ctx, kind, strings.TrimSuffix(file, ".png"))
+
+	switch {
+	case err == errOGNotFound:
+		c.String(http.StatusNotFound, "image not found")
+
+		return
+	case err != nil:
+		ogLog.error(ctx, "could not draw preview image", logFields{"kind": kind, "error": err})
+
+		c.String(http.StatusBadGateway, "could not draw image")
+
+		return
+	}
+
+	if version == "" {
+		// Drawn without its artwork, it should be fetched again soon
+		c.Header("Cache-Control", "public, max-age=300")
+	} else {
+		etag := `"` + version + `"`
+
+		c.Header("Cache-Control", "public, max-age=3600")
+		c.Header("ETag", etag)
+
+		if feedNotModified(c.Request, etag, time.Time{}) {
+			c.Status(http.StatusNotModified)
+
+			return
+		}
+	}
+
+	c.Data(http.StatusOK, "image/png", pngBytes)
+}
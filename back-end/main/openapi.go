@@ -0,0 +1,850 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiOperation documents a route, what is documented is matched to the router's
+// routes by "<method> <path>" so routes only exist in the description once registered
+type apiOperation struct {
+	Summary string
+	Tag     string
+	// Given to ShouldBindJSON
+	Request interface{}
+	// Requests without a body are accepted too
+	OptionalRequest bool
+	// Given to ShouldBindQuery, fields with form tags are the query parameters
+	Query interface{}
+	// Given to respondWithData, nil for routes responding without data
+	Response interface{}
+	// Set for routes answering with something other than the JSON envelope
+	ContentType string
+	// Set for routes answering with a redirect
+	Redirect bool
+}
+
+// Query parameters read without ShouldBindQuery, described the same way
+
+type limitQuery struct {
+	Limit int `form:"limit" binding:"omitempty,min=1,max=1000"`
+}
+
+type contactListQuery struct {
+	Limit int    `form:"limit" binding:"omitempty,min=1,max=1000"`
+	Spam  string `form:"spam" binding:"omitempty,oneof=true false"`
+}
+
+type commentListQuery struct {
+	Status string `form:"status" binding:"omitempty,oneof=pending approved rejected all"`
+	Limit  int    `form:"limit" binding:"omitempty,min=1,max=1000"`
+}
+
+type ghostWebhookQuery struct {
+	Event string `form:"event" binding:"omitempty,oneof=post.published post.published.edited post.unpublished post.deleted"`
+}
+
+type newsletterTokenQuery struct {
+	Token string `form:"token" binding:"required"`
+}
+
+type qrCodeQuery struct {
+	Scale int `form:"scale" binding:"omitempty,min=1,max=20"`
+}
+
+var apiOperations = map[string]apiOperation{
+	"GET /api/songs":                {Tag: "playlist", Summary: "The playlist and its tracks, null until it has first loaded", Response: (*Playlist)(nil)},
+	"GET /api/songs/local/:trackID": {Tag: "playlist", Summary: "Audio file of a track from the local playlist source", ContentType: "audio/*"},
+
+	"GET /api/posts":               {Tag: "posts", Summary: "A page of posts", Query: listPostsQuery{}, Response: PostsPage{}},
+	"GET /api/posts/:slug":         {Tag: "posts", Summary: "A post with heading anchors and a table of contents, the slugs feed.rss and feed.atom serve the feeds instead", Response: EnrichedPost{}},
+	"GET /api/posts/:slug/related": {Tag: "posts", Summary: "Posts most similar to a post", Query: relatedQuery{}, Response: []RelatedPost{}},
+	"GET /api/search":              {Tag: "posts", Summary: "Full text search of posts", Query: searchQuery{}, Response: SearchResults{}},
+	"GET /api/search/suggest":      {Tag: "posts", Summary: "Search terms starting with the query", Query: searchQuery{}, Response: []string{}},
+	"GET /robots.txt":              {Tag: "site", Summary: "Crawler rules pointing at the sitemap", ContentType: "text/plain"},
+	"GET /sitemap.xml":             {Tag: "site", Summary: "Sitemap, or a sitemap index when there are too many URLs for one", ContentType: "application/xml"},
+	"GET /sitemaps/:page":          {Tag: "site", Summary: "One sitemap of a sitemap index", ContentType: "application/xml"},
+
+	"POST /api/n/article/feed/latest":  {Tag: "articles", Summary: "Newest articles with their votes", Request: articleFeedRequest{}, OptionalRequest: true, Response: ArticleFeed{}},
+	"POST /api/n/article/feed/hottest": {Tag: "articles", Summary: "Articles ranked by votes decaying with age", Request: articleFeedRequest{}, OptionalRequest: true, Response: ArticleFeed{}},
+	"POST /api/n/article/visitor":      {Tag: "articles", Summary: "A signed token identifying a visitor for voting, the same for every request from one browser and address", Response: VisitorToken{}},
+	"POST /api/n/article/vote":         {Tag: "articles", Summary: "Vote on an article or withdraw a vote", Request: articleVoteRequest{}, Response: ArticleVoteResult{}},
+
+	"POST /api/analytics/event": {Tag: "analytics", Summary: "Record a page view or event, visitors sending Do Not Track aren't counted", Request: analyticsEventRequest{}},
+	"GET /api/admin/analytics":  {Tag: "analytics", Summary: "Daily totals, top pages, referrers and events between two dates", Query: analyticsReportQuery{}, Response: AnalyticsReport{}},
+
+	"POST /api/hooks/ghost":            {Tag: "posts", Summary: "Ghost post webhook signed with X-Ghost-Signature, refreshes caches and revalidates pages", Query: ghostWebhookQuery{}, Request: ghostWebhookPayload{}, Response: ghostWebhookResult{}},
+	"POST /api/admin/posts/revalidate": {Tag: "posts", Summary: "Refresh posts as if Ghost had sent a webhook for them, every post without slugs", Request: revalidatePostsRequest{}, OptionalRequest: true, Response: ghostWebhookResult{}},
+
+	"GET /api/contact/form":                            {Tag: "contact", Summary: "A token to submit the contact form with", Response: contactForm{}},
+	"POST /api/contact":                                {Tag: "contact", Summary: "Send a message through the contact form", Request: contactRequest{}},
+	"GET /api/admin/contact":                           {Tag: "contact", Summary: "Received messages, newest first", Query: contactListQuery{}, Response: []contactMessage{}},
+	"GET /api/admin/contact/:messageID":                {Tag: "contact", Summary: "A message, marking it read", Response: contactMessage{}},
+	"DELETE /api/admin/contact/:messageID":             {Tag: "contact", Summary: "Delete a message"},
+	"PUT /api/admin/contact/:messageID/classification": {Tag: "contact", Summary: "Correct whether a message is spam, training the spam model", Request: classifyMessageRequest{}, Response: contactMessage{}},
+
+	"GET /api/posts/:slug/comments":               {Tag: "comments", Summary: "Approved comments on a post, replies nested under their parents", Response: CommentThread{}},
+	"POST /api/posts/:slug/comments":              {Tag: "comments", Summary: "Comment on a post, comments wait for moderation", Request: commentRequest{}, Response: commentSubmission{}},
+	"GET /api/admin/comments":                     {Tag: "comments", Summary: "Comments by moderation status, pending by default", Query: commentListQuery{}, Response: []comment{}},
+	"POST /api/admin/comments/:commentID/approve": {Tag: "comments", Summary: "Approve a comment, training the spam model with it as ham", Response: comment{}},
+	"POST /api/admin/comments/:commentID/reject":  {Tag: "comments", Summary: "Reject a comment, optionally as spam", Request: rejectCommentRequest{}, OptionalRequest: true, Response: comment{}},
+	"POST /api/admin/comments/:commentID/ban":     {Tag: "comments", Summary: "Ban a commenter's email and IP address, rejecting their pending comments", Response: []commentBan{}},
+	"GET /api/admin/comment-bans":                 {Tag: "comments", Summary: "Banned emails and IP addresses", Response: []commentBan{}},
+	"DELETE /api/admin/comment-bans/:banID":       {Tag: "comments", Summary: "Lift a ban"},
+
+	"GET /api/og/:kind/:file": {Tag: "site", Summary: "1200x630 Open Graph preview image, post/<slug>.png or playlist/songs.png", ContentType: "image/png"},
+
+	"POST /api/subscribe":                   {Tag: "newsletter", Summary: "Subscribe to the newsletter, a confirmation link is emailed to new subscribers", Request: subscribeRequest{}},
+	"GET /api/subscribe/confirm":            {Tag: "newsletter", Summary: "Page asking to confirm a subscription, where the emailed link leads", Query: newsletterTokenQuery{}, ContentType: "text/html"},
+	"POST /api/subscribe/confirm":           {Tag: "newsletter", Summary: "Confirm a subscription, posted by the confirmation page", Query: newsletterTokenQuery{}, ContentType: "text/html"},
+	"GET /api/unsubscribe":                  {Tag: "newsletter", Summary: "Page asking to confirm unsubscribing, where links in digests lead", Query: newsletterTokenQuery{}, ContentType: "text/html"},
+	"POST /api/unsubscribe":                 {Tag: "newsletter", Summary: "Unsubscribe, a List-Unsubscribe=One-Click body from mail clients as described in RFC 8058 gets the JSON envelope, the unsubscribe page's form gets a page", Query: newsletterTokenQuery{}},
+	"GET /api/admin/newsletter/subscribers": {Tag: "newsletter", Summary: "Pending and confirmed subscribers, oldest first", Response: []subscriber{}},
+	"POST /api/admin/newsletter/digest":     {Tag: "newsletter", Summary: "Send a digest of what is new now instead of waiting", Response: newsletterDigestResult{}},
+
+	"GET /go/:slug":                 {Tag: "links", Summary: "Follow a short link", Redirect: true},
+	"GET /go/:slug/qr.png":          {Tag: "links", Summary: "QR code of a short link", Query: qrCodeQuery{}, ContentType: "image/png"},
+	"GET /api/admin/links":          {Tag: "links", Summary: "Short links with their click counts", Response: []ShortLink{}},
+	"POST /api/admin/links":         {Tag: "links", Summary: "Create a short link", Request: createShortLinkRequest{}, Response: ShortLink{}},
+	"GET /api/admin/links/:slug":    {Tag: "links", Summary: "A short link with its click counts", Response: ShortLink{}},
+	"PUT /api/admin/links/:slug":    {Tag: "links", Summary: "Change where a short link goes", Request: shortLinkRequest{}, Response: ShortLink{}},
+	"DELETE /api/admin/links/:slug": {Tag: "links", Summary: "Delete a short link"},
+
+	"POST /api/n/auth/login":   {Tag: "auth", Summary: "Log in to an admin account", Request: loginRequest{}, Response: AuthSession{}},
+	"POST /api/a/auth/status":  {Tag: "auth", Summary: "The logged in account", Response: AuthStatus{}},
+	"POST /api/a/auth/refresh": {Tag: "auth", Summary: "Swap the session token for a new one", Response: AuthSession{}},
+	"POST /api/a/auth/logout":  {Tag: "auth", Summary: "End the session, logout is set in the response"},
+
+	"GET /api/admin/playlists":                                       {Tag: "admin", Summary: "Status of each playlist by name", Response: map[string]playlistStatus{}},
+	"POST /api/admin/playlists/:name/refresh":                        {Tag: "admin", Summary: "Reload a playlist from its sources", Response: playlistStatus{}},
+	"PUT /api/admin/playlists/:name/title":                           {Tag: "admin", Summary: "Switch which playlist is tracked", Request: setPlaylistTitleRequest{}, Response: playlistStatus{}},
+	"GET /api/admin/playlists/:name/snapshots":                       {Tag: "admin", Summary: "Saved snapshots of a playlist, newest first", Response: []playlistSnapshotInfo{}},
+	"POST /api/admin/playlists/:name/snapshots/:snapshotID/rollback": {Tag: "admin", Summary: "Serve a snapshot and stop refreshing until the next refresh", Response: playlistStatus{}},
+	"POST /api/admin/soundcloud/client-id":                           {Tag: "admin", Summary: "Replace the SoundCloud client ID, scraping a new one when none is given", Request: rotateClientIDRequest{}},
+	"GET /api/admin/audit":                                           {Tag: "admin", Summary: "Recent admin actions, newest first", Query: limitQuery{}, Response: []auditEntry{}},
+	"GET /api/admin/outbox":                                          {Tag: "admin", Summary: "Emails waiting to be sent", Response: []outboxEmail{}},
+	"GET /api/admin/outbox/dead":                                     {Tag: "admin", Summary: "Emails that couldn't be sent", Response: []outboxEmail{}},
+	"POST /api/admin/outbox/dead/:emailID/retry":                     {Tag: "admin", Summary: "Queue a dead email again"},
+	"DELETE /api/admin/outbox/dead/:emailID":                         {Tag: "admin", Summary: "Delete a dead email"},
+
+	"GET /api/openapi.json": {Tag: "site", Summary: "This description of the API", ContentType: "application/json"},
+	"GET /api/docs":         {Tag: "site", Summary: "API reference page", ContentType: "text/html"},
+}
+
+// apiDocs serves an OpenAPI 3 description of the API, built once every route has
+// been registered, and a reference page reading it
+type apiDocs struct {
+	keys *apiKeyRoutes
+	site func() siteConfig
+	spec []byte
+}
+
+var docsLog = newLogger("docs")
+
+func newAPIDocs(site func() siteConfig, keys *apiKeyRoutes) *apiDocs {
+	return &apiDocs{
+		keys: keys,
+		site: site,
+	}
+}
+
+func (ad *apiDocs) registerRoutes(apiGroup *gin.RouterGroup) {
+	apiGroup.GET("/openapi.json", ad.serveSpec)
+	apiGroup.GET("/docs", ad.serveReference)
+}
+
+// openAPISchemas turns Go types into schemas the way encoding/json would encode
+// them, named structs become components referenced by name
+type openAPISchemas struct {
+	components map[string]interface{}
+}
+
+var (
+	timeType        = reflect.TypeOf(time.Time{})
+	durationType    = reflect.TypeOf(time.Duration(0))
+	rawMessageType  = reflect.TypeOf(json.RawMessage{})
+	bindingSkipKeys = map[string]bool{"required": true, "omitempty": true}
+)
+
+func openAPIRef(name string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+// schema describes t, request types take required fields from their binding tags
+// rather than from omitempty. A named type is described by whichever use of it
+// comes first, none of them are both sent and received.
+func (oas *openAPISchemas) schema(t reflect.Type, request bool) map[string]interface{} {
+	switch t {
+	case timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case durationType:
+		return map[string]interface{}{"type": "integer", "description": "nanoseconds"}
+	case rawMessageType:
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		element := oas.schema(t.Elem(), request)
+
+		if _, isRef := element["$ref"]; isRef {
+			return map[string]interface{}{"allOf": []interface{}{element}, "nullable": true}
+		}
+
+		element["nullable"] = true
+
+		return element
+	case reflect.Struct:
+		if t.Name() == "" {
+			return oas.objectSchema(t, request)
+		}
+
+		if _, ok := oas.components[t.Name()]; !ok {
+			// Claims the name first, types can refer to themselves
+			oas.components[t.Name()] = nil
+			oas.components[t.Name()] = oas.objectSchema(t, request)
+		}
+
+		return openAPIRef(t.Name())
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+
+		return map[string]interface{}{"type": "array", "items": oas.schema(t.Elem(), request)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": oas.schema(t.Elem(), request)}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	}
+
+	// Interfaces can hold anything
+	return map[string]interface{}{}
+}
+
+func (oas *openAPISchemas) objectSchema(t reflect.Type, request bool) map[string]interface{} {
+	properties := make(map[string]interface{})
+	required := []string{}
+
+	oas.addFields(t, request, properties, &required)
+
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+
+	if len(required) != 0 {
+		sort.Strings(required)
+
+		schema["required"] = required
+	}
+
+	return schema
+}
+
+// addFields adds the JSON fields of t, including those of embedded structs
+func (oas *openAPISchemas) addFields(t reflect.Type, request bool, properties map[string]interface{}, required *[]string) {
+	for index := 0; index < t.NumField(); index++ {
+		field := t.Field(index)
+		tag := field.Tag.Get("json")
+
+		if tag == "-" {
+			continue
+		}
+
+		tagParts := strings.Split(tag, ",")
+		name := tagParts[0]
+
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+
+			if embedded.Kind() == reflect.Struct {
+				oas.addFields(embedded, request, properties, required)
+
+				continue
+			}
+		}
+
+		if field.PkgPath != "" {
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+
+		fieldSchema := oas.schema(field.Type, request)
+		binding := field.Tag.Get("binding")
+
+		if request {
+			applyBindingRules(fieldSchema, binding)
+		}
+
+		omitEmpty := false
+
+		for _, option := range tagParts[1:] {
+			omitEmpty = omitEmpty || option == "omitempty"
+		}
+
+		if (request && bindingRequired(binding)) || (!request && !omitEmpty) {
+			*required = append(*required, name)
+		}
+
+		properties[name] = fieldSchema
+	}
+}
+
+func bindingRequired(binding string) bool {
+	for _, rule := range strings.Split(binding, ",") {
+		if rule == "dive" {
+			return false
+		}
+
+		if rule == "required" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// applyBindingRules describes the validator rules on a field, rules after dive
+// apply to elements and aren't described
+func applyBindingRules(schema map[string]interface{}, binding string) {
+	if binding == "" {
+		return
+	}
+
+	if _, isRef := schema["$ref"]; isRef {
+		return
+	}
+
+	for _, rule := range strings.Split(binding, ",") {
+		if rule == "dive" {
+			return
+		}
+
+		if bindingSkipKeys[rule] {
+			continue
+		}
+
+		ruleParts := strings.SplitN(rule, "=", 2)
+		value := ""
+
+		if len(ruleParts) == 2 {
+			value = ruleParts[1]
+		}
+
+		var limit interface{} = value
+
+		if number, err := json.Number(value).Int64(); err == nil {
+			limit = number
+		}
+
+		switch ruleParts[0] {
+		case "min", "max", "len":
+			bounds := map[string]map[string]string{
+				"string": {"min": "minLength", "max": "maxLength"},
+				"array":  {"min": "minItems", "max": "maxItems"},
+				"":       {"min": "minimum", "max": "maximum"},
+			}
+
+			kind, _ := schema["type"].(string)
+
+			if kind != "string" && kind != "array" {
+				kind = ""
+			}
+
+			if ruleParts[0] == "len" {
+				schema[bounds[kind]["min"]] = limit
+				schema[bounds[kind]["max"]] = limit
+			} else {
+				schema[bounds[kind][ruleParts[0]]] = limit
+			}
+		case "oneof":
+			enum := []interface{}{}
+
+			for _, option := range strings.Fields(value) {
+				enum = append(enum, option)
+			}
+
+			schema["enum"] = enum
+		case "email":
+			schema["format"] = "email"
+		case "url":
+			schema["format"] = "uri"
+		case "numeric":
+			schema["pattern"] = "^[0-9]+$"
+		case "startswith":
+			schema["pattern"] = "^" + strings.Replace(value, "/", "\\/", -1)
+		}
+	}
+}
+
+// openAPIPath turns gin's ":param" segments into "{param}", returning the names
+func openAPIPath(ginPath string) (string, []string) {
+	var names []string
+
+	segments := strings.Split(ginPath, "/")
+
+	for index, segment := range segments {
+		if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+			names = append(names, segment[1:])
+			segments[index] = "{" + segment[1:] + "}"
+		}
+	}
+
+	return strings.Join(segments, "/"), names
+}
+
+func (oas *openAPISchemas) queryParameters(query interface{}) []interface{} {
+	var parameters []interface{}
+
+	queryType := reflect.TypeOf(query)
+
+	for index := 0; index < queryType.NumField(); index++ {
+		field := queryType.Field(index)
+		name := field.Tag.Get("form")
+
+		if name == "" || name == "-" {
+			continue
+		}
+
+		schema := oas.schema(field.Type, true)
+		binding := field.Tag.Get("binding")
+
+		applyBindingRules(schema, binding)
+
+		parameters = append(parameters, map[string]interface{}{
+			"name":     name,
+			"in":       "query",
+			"required": bindingRequired(binding),
+			"schema":   schema,
+		})
+	}
+
+	return parameters
+}
+
+// operation describes one route, undocumented routes are still listed so the
+// description never leaves a route out
+func (ad *apiDocs) operation(schemas *openAPISchemas, route gin.RouteInfo) map[string]interface{} {
+	documented, ok := apiOperations[route.Method+" "+route.Path]
+
+	if !ok {
+		documented = apiOperation{Summary: "Undocumented", Response: new(interface{})}
+	}
+
+	operation := map[string]interface{}{
+		"summary":     documented.Summary,
+		"operationId": route.Method + " " + route.Path,
+	}
+
+	if documented.Tag != "" {
+		operation["tags"] = []string{documented.Tag}
+	}
+
+	_, pathParameters := openAPIPath(route.Path)
+
+	parameters := []interface{}{}
+
+	for _, name := range pathParameters {
+		parameters = append(parameters, map[string]interface{}{
+			"name":     name,
+			"in":       "path",
+			"required": true,
+			"schema":   map[string]interface{}{"type": "string"},
+		})
+	}
+
+	if documented.Query != nil {
+		parameters = append(parameters, schemas.queryParameters(documented.Query)...)
+	}
+
+	if len(parameters) != 0 {
+		operation["parameters"] = parameters
+	}
+
+	if documented.Request != nil {
+		operation["requestBody"] = map[string]interface{}{
+			"required": !documented.OptionalRequest,
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{
+					"schema": schemas.schema(reflect.TypeOf(documented.Request), true),
+				},
+			},
+		}
+	}
+
+	responses := map[string]interface{}{
+		"default": map[string]interface{}{"$ref": "#/components/responses/Error"},
+	}
+
+	switch {
+	case documented.Redirect:
+		redirect := map[string]interface{}{
+			"description": "Redirects to the link's URL",
+			"headers": map[string]interface{}{
+				"Location": map[string]interface{}{"schema": map[string]interface{}{"type": "string", "format": "uri"}},
+			},
+		}
+
+		responses["301"] = redirect
+		responses["302"] = redirect
+	case documented.ContentType != "":
+		schema := map[string]interface{}{"type": "string"}
+
+		if !strings.HasPrefix(documented.ContentType, "text/") && !strings.HasSuffix(documented.ContentType, "json") && !strings.HasSuffix(documented.ContentType, "xml") {
+			schema["format"] = "binary"
+		}
+
+		responses["200"] = map[string]interface{}{
+			"description": "OK",
+			"content": map[string]interface{}{
+				documented.ContentType: map[string]interface{}{"schema": schema},
+			},
+		}
+	default:
+		data := map[string]interface{}{"nullable": true, "description": "Always null"}
+
+		if documented.Response != nil {
+			data = schemas.schema(reflect.TypeOf(documented.Response), false)
+		}
+
+		responses["200"] = map[string]interface{}{
+			"description": "OK",
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{
+					"schema": map[string]interface{}{
+						"allOf": []interface{}{
+							openAPIRef("Envelope"),
+							map[string]interface{}{
+								"type":       "object",
+								"properties": map[string]interface{}{"data": data},
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	operation["responses"] = responses
+
+	switch {
+	case strings.HasPrefix(route.Path, "/api/admin/"):
+		operation["security"] = []interface{}{
+			map[string]interface{}{"bearerAuth": []string{}},
+			map[string]interface{}{"authTokenQuery": []string{}},
+		}
+
+		if scope, ok := ad.keys.scopes[route.Method+" "+route.Path]; ok {
+			operation["description"] = "API keys with the " + scope + " scope may call this as well as admins."
+		} else {
+			operation["description"] = "Only for admins, API keys can't call this."
+		}
+	case strings.HasPrefix(route.Path, "/api/a/"):
+		operation["security"] = []interface{}{
+			map[string]interface{}{"bearerAuth": []string{}},
+			map[string]interface{}{"authTokenQuery": []string{}},
+		}
+		operation["description"] = "Needs an account's session token."
+	}
+
+	return operation
+}
+
+// build describes routes, the router's routes once all are registered
+func (ad *apiDocs) build(routes gin.RoutesInfo) {
+	schemas := &openAPISchemas{components: make(map[string]interface{})}
+
+	schemas.components["Envelope"] = map[string]interface{}{
+		"type":     "object",
+		"required": []string{"err", "data", "msg"},
+		"properties": map[string]interface{}{
+			"err":  map[string]interface{}{"type": "boolean", "description": "Set when the request failed"},
+			"data": map[string]interface{}{"nullable": true, "description": "The response, null when the request failed"},
+			"msg":  map[string]interface{}{"type": "string", "description": "Why the request failed"},
+			"logout": map[string]interface{}{
+				"type":        "boolean",
+				"description": "Tells the front end to drop its auth token",
+			},
+		},
+	}
+
+	paths := make(map[string]map[string]interface{})
+
+	for _, route := range routes {
+		path, _ := openAPIPath(route.Path)
+
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+
+		paths[path][strings.ToLower(route.Method)] = ad.operation(schemas, route)
+	}
+
+	site := ad.site()
+
+	spec := map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       site.Title + " API",
+			"description": "Responses under /api are JSON envelopes unless noted otherwise, failed requests set err and explain why in msg.",
+			"version":     "1",
+		},
+		"servers": []interface{}{
+			map[string]interface{}{"url": site.absoluteURL("/")},
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas.components,
+			"responses": map[string]interface{}{
+				"Error": map[string]interface{}{
+					"description": "Failed request, or a plain text error for routes outside /api",
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{"schema": openAPIRef("Envelope")},
+					},
+				},
+			},
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "The admin token, a session token or an API key in Authorization, the Bearer prefix is optional",
+				},
+				"authTokenQuery": map[string]interface{}{
+					"type": "apiKey",
+					"in":   "query",
+					"name": "auth_token",
+				},
+			},
+		},
+	}
+
+	specJSON, err := json.Marshal(spec)
+
+	if err != nil {
+		docsLog.error(context.Background(), "could not build the API description", logFields{"error": err})
+
+		return
+	}
+
+	ad.spec = specJSON
+}
+
+func (ad *apiDocs) serveSpec(c *gin.Context) {
+	if ad.spec == nil {
+		abortWithError(c, http.StatusServiceUnavailable, "the API description isn't available")
+
+		return
+	}
+
+	c.Header("Access-Control-Allow-Origin", "*")
+	c.Data(http.StatusOK, "application/json; charset=utf-8", ad.spec)
+}
+
+func (ad *apiDocs) serveReference(c *gin.Context) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(apiReferencePage))
+}
+
+// apiReferencePage lists the operations in openapi.json, it is served from here so
+// no third party scripts are needed
+const apiReferencePage = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <meta name="robots" content="noindex">
+  <title>API reference</title>
+  <style>
+    body { font-family: sans-serif; line-height: 1.4; max-width: 960px; margin: 32px auto; padding: 0 16px; color: #111827; }
+    h2 { border-bottom: 1px solid #e5e7eb; padding-bottom: 4px; margin-top: 40px; text-transform: capitalize; }
+    details { border: 1px solid #e5e7eb; border-radius: 4px; margin: 8px 0; padding: 8px 12px; }
+    summary { cursor: pointer; }
+    code, pre { font-family: monospace; font-size: 13px; }
+    pre { background: #f3f4f6; padding: 8px; overflow-x: auto; }
+    .method { display: inline-block; min-width: 64px; font-weight: bold; }
+    .get { color: #2563eb; } .post { color: #16a34a; } .put { color: #d97706; } .delete { color: #dc2626; }
+    .muted { color: #6b7280; }
+  </style>
+</head>
+<body>
+  <h1 id="title">API reference</h1>
+  <p class="muted">Generated from <a href="openapi.json">openapi.json</a>.</p>
+  <div id="operations">Loading...</div>
+  <script>
+    function resolve(spec, schema) {
+      if (schema && schema.$ref) {
+        return spec.components.schemas[schema.$ref.split("/").pop()];
+      }
+
+      return schema;
+    }
+
+    // Writes a schema out as a TypeScript-like type, named types are expanded once
+    function describe(spec, schema, indent, seen) {
+      if (!schema) {
+        return "any";
+      }
+
+      var nullable = schema.nullable ? " | null" : "";
+
+      if (schema.$ref) {
+        var name = schema.$ref.split("/").pop();
+
+        if (seen.indexOf(name) !== -1) {
+          return name;
+        }
+
+        return name + " " + describe(spec, resolve(spec, schema), indent, seen.concat([name]));
+      }
+
+      if (schema.allOf) {
+        var merged = { type: "object", properties: {}, required: [] };
+
+        schema.allOf.forEach(function (part) {
+          var resolved = resolve(spec, part);
+
+          Object.assign(merged.properties, resolved.properties || {});
+          merged.required = merged.required.concat(resolved.required || []);
+        });
+
+        if (schema.allOf.length === 1) {
+          return describe(spec, schema.allOf[0], indent, seen) + nullable;
+        }
+
+        return describe(spec, merged, indent, seen) + nullable;
+      }
+
+      if (schema.type === "array") {
+        return "Array<" + describe(spec, schema.items, indent, seen) + ">" + nullable;
+      }
+
+      if (schema.type === "object" && schema.properties) {
+        var inner = indent + "  ";
+        var lines = Object.keys(schema.properties).map(function (key) {
+          var optional = (schema.required || []).indexOf(key) === -1 ? "?" : "";
+
+          return inner + key + optional + ": " + describe(spec, schema.properties[key], inner, seen);
+        });
+
+        return "{\n" + lines.join("\n") + "\n" + indent + "}" + nullable;
+      }
+
+      if (schema.type === "object") {
+        return "Record<string, " + describe(spec, schema.additionalProperties, indent, seen) + ">" + nullable;
+      }
+
+      var type = schema.type || "any";
+
+      if (schema.enum) {
+        type = schema.enum.map(function (value) { return JSON.stringify(value); }).join(" | ");
+      } else if (schema.format) {
+        type += " (" + schema.format + ")";
+      }
+
+      return type + nullable;
+    }
+
+    function element(tag, className, text) {
+      var created = document.createElement(tag);
+
+      if (className) {
+        created.className = className;
+      }
+
+      if (text !== undefined) {
+        created.textContent = text;
+      }
+
+      return created;
+    }
+
+    fetch("openapi.json").then(function (response) {
+      return response.json();
+    }).then(function (spec) {
+      var byTag = {};
+
+      document.getElementById("title").textContent = spec.info.title;
+
+      Object.keys(spec.paths).sort().forEach(function (path) {
+        Object.keys(spec.paths[path]).forEach(function (method) {
+          var operation = spec.paths[path][method];
+          var tag = (operation.tags || ["other"])[0];
+
+          (byTag[tag] = byTag[tag] || []).push({ path: path, method: method, operation: operation });
+        });
+      });
+
+      var container = document.getElementById("operations");
+
+      container.textContent = "";
+
+      Object.keys(byTag).sort().forEach(function (tag) {
+        container.appendChild(element("h2", "", tag));
+
+        byTag[tag].forEach(function (entry) {
+          var operation = entry.operation;
+          var details = element("details");
+          var summary = element("summary");
+
+          summary.appendChild(element("span", "method " + entry.method, entry.method.toUpperCase()));
+          summary.appendChild(element("code", "", entry.path));
+          summary.appendChild(element("span", "muted", " " + operation.summary));
+          details.appendChild(summary);
+
+          if (operation.description) {
+            details.appendChild(element("p", "", operation.description));
+          }
+
+          (operation.parameters || []).forEach(function (parameter) {
+            details.appendChild(element("p", "", parameter.in + " " + parameter.name + (parameter.required ? "" : "?") + ": " + describe(spec, parameter.schema, "", [])));
+          });
+
+          if (operation.requestBody) {
+            details.appendChild(element("p", "", "Request body" + (operation.requestBody.required ? "" : ", optional")));
+            details.appendChild(element("pre", "", describe(spec, operation.requestBody.content["application/json"].schema, "", [])));
+          }
+
+          Object.keys(operation.responses).filter(function (status) {
+            return status !== "default";
+          }).forEach(function (status) {
+            var response = operation.responses[status];
+
+            Object.keys(response.content || {}).forEach(function (contentType) {
+              details.appendChild(element("p", "", status + " " + contentType));
+              details.appendChild(element("pre", "", describe(spec, response.content[contentType].schema, "", [])));
+            });
+
+            if (!response.content) {
+              details.appendChild(element("p", "", status + " " + response.description));
+            }
+          });
+
+          container.appendChild(details);
+        });
+      });
+    }).catch(function (err) {
+      document.getElementById("operations").textContent = "Could not load openapi.json: " + err;
+    });
+  </script>
+</body>
+</html>
+`
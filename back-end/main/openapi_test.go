@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestOpenAPICoversRoutes fails when a route is registered without being
+// documented, or when a documented route no longer exists
+func TestOpenAPICoversRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	limiters, err := newRateLimiters(defaultRateLimitConfig())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	apiKeys := newAPIKeyRoutes(nil)
+	docs := newAPIDocs(func() siteConfig { return defaultAppConfig().Site }, apiKeys)
+
+	registerAllRoutes(router, limiters, func() string { return "" }, apiServices{
+		localTracks: &localPlaylistSource{},
+		apiKeys:     apiKeys,
+		docs:        docs,
+	})
+
+	var spec struct {
+		Paths map[string]map[string]struct {
+			Summary string `json:"summary"`
+		} `json:"paths"`
+	}
+
+	if err := json.Unmarshal(docs.spec, &spec); err != nil {
+		t.Fatalf("the API description isn't valid JSON: %v", err)
+	}
+
+	registered := make(map[string]bool)
+
+	for _, route := range router.Routes() {
+		registered[route.Method+" "+route.Path] = true
+
+		path, _ := openAPIPath(route.Path)
+		operation, ok := spec.Paths[path][strings.ToLower(route.Method)]
+
+		if !ok {
+			t.Errorf("%s %s is missing from the API description", route.Method, path)
+
+			continue
+		}
+
+		if _, ok := apiOperations[route.Method+" "+route.Path]; !ok || operation.Summary == "" {
+			t.Errorf("%s %s isn't documented in apiOperations", route.Method, route.Path)
+		}
+	}
+
+	for key := range apiOperations {
+		if !registered[key] {
+			t.Errorf("%s is documented in apiOperations but isn't a route", key)
+		}
+	}
+}
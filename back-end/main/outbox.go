@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// outboxEmail is a rendered email waiting to be sent, or in the dead letters once
+// every attempt to send it has failed
+type outboxEmail struct {
+	ID            string     `json:"id"`
+	Template      string     `json:"template"`
+	RequestID     string     `json:"request_id,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	From          string     `json:"from"`
+	To            []string   `json:"to"`
+	ReplyTo       string     `json:"reply_to,omitempty"`
+	Subject       string     `json:"subject"`
+	TextBody      string     `json:"text_body"`
+	HTMLBody      string     `json:"html_body"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	LastError     string     `json:"last_error,omitempty"`
+	FailedAt      *time.Time `json:"failed_at,omitempty"`
+	// Mail clients show an unsubscribe button for it, posting to it unsubscribes
+	ListUnsubscribe string `json:"list_unsubscribe,omitempty"`
+}
+
+var errOutboxEmailNotFound = errors.New("email not found")
+
+// outbox persists emails before sending them so they survive restarts, failed
+// sends are retried with exponential backoff until max_attempts is reached, at
+// which point the email is moved to the dead letters for an admin to retry or delete
+type outbox struct {
+	audit     *auditLog
+	closed    bool
+	config    func() emailConfig
+	directory string
+	done      chan struct{}
+	mutex     *sync.Mutex
+	sender    mailSender
+	stop      chan struct{}
+	wake      chan struct{}
+}
+
+func newOutbox(directory string, sender mailSender, audit *auditLog, config func() emailConfig) *outbox {
+	return &outbox{
+		audit:     audit,
+		config:    config,
+		directory: directory,
+		done:      make(chan struct{}),
+		mutex:     &sync.Mutex{},
+		sender:    sender,
+		stop:      make(chan struct{}),
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+var outboxLog = newLogger("outbox")
+
+func (ob *outbox) pendingPath(emailID string) string {
+	return filepath.Join(ob.directory, "pending", emailID+".json")
+}
+
+func (ob *outbox) deadPath(emailID string) string {
+	return filepath.Join(ob.directory, "dead", emailID+".json")
+}
+
+// enqueue renders the template and queues the email, replyTo is optional
+func (ob *outbox) enqueue(ctx context.Context, templateName string, to []string, replyTo *mail.Address, data interface{}) (*outboxEmail, error) {
+	email, err := ob.render(ctx, templateName, to, replyTo, data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return email, ob.queue(ctx, email)
+}
+
+// render builds an email from the template for queue, so it can be changed before it is queued
+func (ob *outbox) render(ctx context.Context, templateName string, to []string, replyTo *mail.Address, data interface{}) (*outboxEmail, error) {
+	rendered, err := renderEmailTemplate(templateName, data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(to) == 0 {
+		return nil, errors.New("an email needs at least one recipient")
+	}
+
+	email := &outboxEmail{
+		ID:        newRequestID(),
+		Template:  templateName,
+		RequestID: requestIDFromContext(ctx),
+		CreatedAt: time.Now().UTC(),
+		From:      ob.config().From,
+		Subject:   rendered.Subject,
+		TextBody:  rendered.TextBody,
+		HTMLBody:  rendered.HTMLBody,
+	}
+
+	email.NextAttemptAt = email.CreatedAt
+
+	for _, recipient := range to {
+		address, err := mail.ParseAddress(recipient)
+
+		if err != nil {
+			return nil, err
+		}
+
+		email.To = append(email.To, address.String())
+	}
+
+	if replyTo != nil {
+		email.ReplyTo = replyTo.String()
+	}
+
+	return email, nil
+}
+
+func (ob *outbox) queue(ctx context.Context, email *outboxEmail) error {
+	ob.mutex.Lock()
+	err := writeJSONFile(ob.pendingPath(email.ID), email)
+	ob.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	outboxLog.info(ctx, "email queued", logFields{
+		"email_id": email.ID,
+		"template": email.Template,
+	})
+
+	ob.wakeWorker()
+
+	return nil
+}
+
+func (ob *outbox) wakeWorker() {
+	select {
+	case ob.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run sends due emails until the outbox is closed
+func (ob *outbox) run() {
+	defer close(ob.done)
+
+	ticker := time.NewTicker(ob.config().PollInterval)
+	defer ticker.Stop()
+
+	for {
+		ob.deliverDue()
+
+		select {
+		case <-ticker.C:
+		case <-ob.wake:
+		case <-ob.stop:
+			return
+		}
+	}
+}
+
+func (ob *outbox) deliverDue() {
+	emails, err := ob.list("pending")
+
+	if err != nil {
+		outboxLog.error(context.Background(), "could not read the outbox", logFields{"error": err})
+
+		return
+	}
+
+	for index := range emails {
+		select {
+		case <-ob.stop:
+			return
+		default:
+		}
+
+		if emails[index].NextAttemptAt.After(time.Now()) {
+			continue
+		}
+
+		ob.deliver(&emails[index])
+	}
+}
+
+// retryBackoff doubles the configured backoff with every failed attempt, up to the maximum
+func retryBackoff(config emailConfig, attempts int) time.Duration {
+	backoff := float64(config.RetryBackoff) * math.Pow(2, float64(attempts-1))
+
+	if backoff > float64(config.MaxRetryBackoff) {
+		return config.MaxRetryBackoff
+	}
+
+	return time.Duration(backoff)
+}
+
+func (ob *outbox) deliver(email *outboxEmail) {
+	ctx := contextWithRequestID(context.Background(), email.RequestID)
+
+	message, err := buildMIMEMessage(email)
+
+	if err == nil {
+		err = ob.sender.send(ctx, email, message)
+	}
+
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	fields := logFields{
+		"email_id": email.ID,
+		"template": email.Template,
+	}
+
+	if err == nil {
+		if err = os.Remove(ob.pendingPath(email.ID)); err != nil {
+			outboxLog.error(ctx, "could not remove sent email from the outbox", logFields{"email_id": email.ID, "error": err})
+		}
+
+		outboxLog.info(ctx, "email sent", fields)
+
+		return
+	}
+
+	config := ob.config()
+	now := time.Now().UTC()
+
+	email.Attempts++
+	email.LastError = err.Error()
+
+	fields["attempts"] = email.Attempts
+	fields["error"] = err
+
+	if email.Attempts >= config.MaxAttempts {
+		email.FailedAt = &now
+
+		if err = writeJSONFile(ob.deadPath(email.ID), email); err == nil {
+			err = os.Remove(ob.pendingPath(email.ID))
+		}
+
+		if err != nil {
+			outboxLog.error(ctx, "could not move email to the dead letters", logFields{"email_id": email.ID, "error": err})
+		}
+
+		outboxLog.error(ctx, "giving up on email, moved to the dead letters", fields)
+
+		return
+	}
+
+	email.NextAttemptAt = now.Add(retryBackoff(config, email.Attempts))
+
+	if err = writeJSONFile(ob.pendingPath(email.ID), email); err != nil {
+		outboxLog.error(ctx, "could not update email in the outbox", logFields{"email_id": email.ID, "error": err})
+	}
+
+	fields["next_attempt_at"] = email.NextAttemptAt
+
+	outboxLog.warn(ctx, "could not send email, will retry", fields)
+}
+
+// list returns the emails in the pending or dead directory, oldest first
+func (ob *outbox) list(state string) ([]outboxEmail, error) {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	directory := filepath.Join(ob.directory, state)
+
+	fileInfos, err := ioutil.ReadDir(directory)
+
+	if os.IsNotExist(err) {
+		return []outboxEmail{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	emails := make([]outboxEmail, 0, len(fileInfos))
+
+	for _, fileInfo := range fileInfos {
+		emailID := strings.TrimSuffix(fileInfo.Name(), ".json")
+
+		if fileInfo.IsDir() || !validRecordID(emailID) {
+			continue
+		}
+
+		var email outboxEmail
+
+		if err = readJSONFile(filepath.Join(directory, fileInfo.Name()), &email); err != nil {
+			return nil, err
+		}
+
+		emails = append(emails, email)
+	}
+
+	sort.Slice(emails, func(i, j int) bool {
+		return emails[i].CreatedAt.Before(emails[j].CreatedAt)
+	})
+
+	return emails, nil
+}
+
+// retryDead moves a dead letter back into the outbox with its attempts reset
+func (ob *outbox) retryDead(emailID string) error {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	if !validRecordID(emailID) || !fileExists(ob.deadPath(emailID)) {
+		return errOutboxEmailNotFound
+	}
+
+	var email outboxEmail
+
+	if err := readJSONFile(ob.deadPath(emailID), &email); err != nil {
+		return err
+	}
+
+	email.Attempts = 0
+	email.FailedAt = nil
+	email.NextAttemptAt = time.Now().UTC()
+
+	if err := writeJSONFile(ob.pendingPath(emailID), email); err != nil {
+		return err
+	}
+
+	if err := os.Remove(ob.deadPath(emailID)); err != nil {
+		return err
+	}
+
+	ob.wakeWorker()
+
+	return nil
+}
+
+func (ob *outbox) deleteDead(emailID string) error {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	if !validRecordID(emailID) {
+		return errOutboxEmailNotFound
+	}
+
+	err := os.Remove(ob.deadPath(emailID))
+
+	if os.IsNotExist(err) {
+		return errOutboxEmailNotFound
+	}
+
+	return err
+}
+
+// close stops the worker, waiting for an email being sent to finish
+func (ob *outbox) close(ctx context.Context) error {
+	ob.mutex.Lock()
+
+	if ob.closed {
+		ob.mutex.Unlock()
+
+		return nil
+	}
+
+	ob.closed = true
+
+	close(ob.stop)
+
+	ob.mutex.Unlock()
+
+	select {
+	case <-ob.done:
+	case <-ctx.Done():
+		outboxLog.warn(ctx, "timed out waiting for the outbox to stop", nil)
+	}
+
+	return nil
+}
+
+func (ob *outbox) registerAdminRoutes(adminGroup *gin.RouterGroup) {
+	adminGroup.GET("/outbox", ob.listEmails("pending"))
+	adminGroup.GET("/outbox/dead", ob.listEmails("dead"))
+	adminGroup.POST("/outbox/dead/:emailID/retry", ob.retryDeadEmail)
+	adminGroup.DELETE("/outbox/dead/:emailID", ob.deleteDeadEmail)
+}
+
+func (ob *outbox) listEmails(state string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		emails, err := ob.list(state)
+
+		if err != nil {
+			abortWithError(c, http.StatusInternalServerError, "could not read the outbox")
+
+			return
+		}
+
+		respondWithData(c, emails)
+	}
+}
+
+func (ob *outbox) retryDeadEmail(c *gin.Context) {
+	err := ob.retryDead(c.Param("emailID"))
+
+	if err == errOutboxEmailNotFound {
+		abortWithError(c, http.StatusNotFound, err.Error())
+
+		return
+	}
+
+	ob.audit.recordRequest(c, "outbox.retry", c.Param("emailID"), nil, err)
+
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, "could not requeue email")
+
+		return
+	}
+
+	respondWithData(c, nil)
+}
+
+func (ob *outbox) deleteDeadEmail(c *gin.Context) {
+	err := ob.deleteDead(c.Param("emailID"))
+
+	if err == errOutboxEmailNotFound {
+		abortWithError(c, http.StatusNotFound, err.Error())
+
+		return
+	}
+
+	ob.audit.recordRequest(c, "outbox.delete", c.Param("emailID"), nil, err)
+
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, "could not delete email")
+
+		return
+	}
+
+	respondWithData(c, nil)
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PlaylistHandler keeps the tracked playlist fresh, asking each source in order
+// until one of them can provide it
+type PlaylistHandler struct {
+	closed          bool
+	errorBackoff    time.Duration
+	lastupdate      time.Time
+	mutex           *sync.Mutex
+	pinned          bool
+	refreshInterval time.Duration
+	refreshes       *sync.WaitGroup
+	snapshots       *playlistSnapshotStore
+	sources         []PlaylistSource
+	stopFlusher     chan struct{}
+	playlist        *Playlist
+	playlistName    string
+}
+
+func newPlaylistHandler(ctx context.Context, playlistName string, sources []PlaylistSource, snapshots *playlistSnapshotStore) (*PlaylistHandler, error) {
+	if len(sources) == 0 {
+		return nil, errors.New("no playlist sources configured")
+	}
+
+	ph := &PlaylistHandler{
+		errorBackoff:    time.Second * 30,
+		lastupdate:      time.Now(),
+		mutex:           &sync.Mutex{},
+		refreshInterval: time.Minute,
+		refreshes:       &sync.WaitGroup{},
+		snapshots:       snapshots,
+		sources:         sources,
+		stopFlusher:     make(chan struct{}),
+		playlist:        nil,
+		playlistName:    playlistName,
+	}
+
+	return ph, ph.refreshUploadData(ctx)
+}
+
+// fetchPlaylist falls through the sources in order, returning the first playlist found
+func (ph *PlaylistHandler) fetchPlaylist(ctx context.Context, playlistName string) (*Playlist, error) {
+	var sourceErrors []string
+
+	for _, source := range ph.sources {
+		playlist, err := source.FetchPlaylist(ctx, playlistName)
+
+		if err == nil {
+			return playlist, nil
+		}
+
+		playlistLog.warn(ctx, "playlist source failed", logFields{
+			"playlist": playlistName,
+			"source":   source.Name(),
+			"error":    err,
+		})
+
+		sourceErrors = append(sourceErrors, source.Name()+": "+err.Error())
+	}
+
+	return nil, errors.New("all playlist sources failed: " + strings.Join(sourceErrors, "; "))
+}
+
+// Meant to be ran concurrently after/before time has been reset to now
+func (ph *PlaylistHandler) refreshUploadDataWithUpdateTime(ctx context.Context, previousUpdateTime time.Time) error {
+	err := ph.refreshUploadData(ctx)
+
+	ph.mutex.Lock()
+	defer ph.mutex.Unlock()
+
+	if err != nil {
+		// Push the update time forward by the backoff to prevent too many consecutive
+		// requests for the playlist, another request is made once the backoff has passed
+		ph.lastupdate = previousUpdateTime.Add(ph.errorBackoff)
+	}
+
+	return err
+}
+
+func (ph *PlaylistHandler) refreshUploadData(ctx context.Context) error {
+	start := time.Now()
+
+	playlistName := ph.currentPlaylistName()
+
+	playlist, err := ph.fetchPlaylist(ctx, playlistName)
+
+	if err != nil {
+		playlistLog.warn(ctx, "playlist refresh failed", logFields{
+			"playlist":    playlistName,
+			"duration_ms": float64(time.Since(start)) / float64(time.Millisecond),
+			"error":       err,
+		})
+	} else {
+		playlistLog.info(ctx, "playlist refreshed", logFields{
+			"playlist":    playlistName,
+			"source":      playlist.Source,
+			"duration_ms": float64(time.Since(start)) / float64(time.Millisecond),
+			"tracks":      len(playlist.Tracks),
+		})
+	}
+
+	ph.mutex.Lock()
+	defer ph.mutex.Unlock()
+
+	// The title may have been changed while this refresh was in flight
+	if err == nil && playlistName == ph.playlistName {
+		ph.playlist = playlist
+		ph.pinned = false
+
+		ph.snapshots.record(playlist)
+	}
+
+	return err
+}
+
+// setRefreshTiming changes how stale the playlist may get and how long to wait after a failed refresh
+func (ph *PlaylistHandler) setRefreshTiming(refreshInterval, errorBackoff time.Duration) {
+	ph.mutex.Lock()
+	defer ph.mutex.Unlock()
+
+	ph.refreshInterval = refreshInterval
+	ph.errorBackoff = errorBackoff
+}
+
+func (ph *PlaylistHandler) currentPlaylistName() string {
+	ph.mutex.Lock()
+	defer ph.mutex.Unlock()
+
+	return ph.playlistName
+}
+
+// refreshNow refreshes immediately, replacing a rolled back playlist if one is pinned
+func (ph *PlaylistHandler) refreshNow(ctx context.Context) error {
+	ph.mutex.Lock()
+	ph.lastupdate = time.Now()
+	ph.mutex.Unlock()
+
+	return ph.refreshUploadData(ctx)
+}
+
+// setPlaylistName switches the tracked playlist, only if the new playlist can be fetched
+func (ph *PlaylistHandler) setPlaylistName(ctx context.Context, playlistName string) (*Playlist, error) {
+	playlist, err := ph.fetchPlaylist(ctx, playlistName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ph.mutex.Lock()
+	defer ph.mutex.Unlock()
+
+	ph.playlistName = playlistName
+	ph.playlist = playlist
+	ph.lastupdate = time.Now()
+	ph.pinned = false
+
+	ph.snapshots.record(playlist)
+
+	return playlist, nil
+}
+
+// rollback serves a previous snapshot, pinning it until the next manual refresh or title change
+func (ph *PlaylistHandler) rollback(snapshotID string) (*Playlist, error) {
+	playlist, err := ph.snapshots.load(snapshotID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ph.mutex.Lock()
+	defer ph.mutex.Unlock()
+
+	ph.playlist = playlist
+	ph.pinned = true
+
+	return playlist, nil
+}
+
+// Manage how often data is updated, keeping it up to date
+func (ph *PlaylistHandler) getUploadData(ctx context.Context) *Playlist {
+	ph.mutex.Lock()
+
+	if !ph.closed && !ph.pinned && time.Now().Sub(ph.lastupdate) > ph.refreshInterval {
+		ph.refreshes.Add(1)
+
+		refreshCtx := detachedContext(ctx)
+
+		go func(previousUpdateTime time.Time) {
+			defer ph.refreshes.Done()
+
+			ph.refreshUploadDataWithUpdateTime(refreshCtx, previousUpdateTime)
+		}(ph.lastupdate)
+
+		// Prevent new updates from happening for at least another interval while we're fetching new results
+		ph.lastupdate = time.Now()
+	}
+
+	playlist := ph.playlist
+
+	ph.mutex.Unlock()
+
+	return playlist
+}
+
+// Periodically persist the latest playlist until the handler is closed
+func (ph *PlaylistHandler) runSnapshotFlusher(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := ph.snapshots.flush(); err != nil {
+				playlistLog.error(context.Background(), "could not flush playlist snapshot", logFields{"error": err})
+			}
+		case <-ph.stopFlusher:
+			return
+		}
+	}
+}
+
+// Stop scheduling refreshes, wait for in-flight refreshes and flush the latest snapshot
+func (ph *PlaylistHandler) close(ctx context.Context) error {
+	ph.mutex.Lock()
+
+	if ph.closed {
+		ph.mutex.Unlock()
+
+		return nil
+	}
+
+	ph.closed = true
+
+	close(ph.stopFlusher)
+
+	ph.mutex.Unlock()
+
+	refreshesDone := make(chan struct{})
+
+	go func() {
+		ph.refreshes.Wait()
+
+		close(refreshesDone)
+	}()
+
+	select {
+	case <-refreshesDone:
+	case <-ctx.Done():
+		playlistLog.warn(ctx, "timed out waiting for playlist refreshes to finish", nil)
+	}
+
+	return ph.snapshots.flush()
+}
+
+type playlistStatus struct {
+	PlaylistName string    `json:"playlist_name"`
+	Source       string    `json:"source"`
+	TrackCount   int       `json:"track_count"`
+	LastUpdate   time.Time `json:"last_update"`
+	Pinned       bool      `json:"pinned"`
+}
+
+func (ph *PlaylistHandler) status() playlistStatus {
+	ph.mutex.Lock()
+	defer ph.mutex.Unlock()
+
+	status := playlistStatus{
+		PlaylistName: ph.playlistName,
+		LastUpdate:   ph.lastupdate,
+		Pinned:       ph.pinned,
+	}
+
+	if ph.playlist != nil {
+		status.Source = ph.playlist.Source
+		status.TrackCount = ph.playlist.TrackCount
+	}
+
+	return status
+}
+
+// registerRoutes serves the playlist, and the audio files of local tracks when the
+// local source is configured
+func (ph *PlaylistHandler) registerRoutes(apiGroup *gin.RouterGroup, local *localPlaylistSource) {
+	apiGroup.GET("/songs", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"err":  false,
+			"data": ph.getUploadData(c.Request.Context()),
+			"msg":  "",
+		})
+	})
+
+	if local != nil {
+		apiGroup.GET("/songs/local/:trackID", func(c *gin.Context) {
+			trackPath, ok := local.filePath(c.Param("trackID"))
+
+			if !ok {
+				abortWithError(c, http.StatusNotFound, "track not found")
+
+				return
+			}
+
+			c.File(trackPath)
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Playlist is the provider neutral playlist served by /api/songs
+type Playlist struct {
+	Source       string          `json:"source"`
+	ID           string          `json:"id"`
+	Title        string          `json:"title"`
+	Description  *string         `json:"description"`
+	ArtworkURL   *string         `json:"artwork_url"`
+	PermalinkURL *string         `json:"permalink_url"`
+	Duration     int64           `json:"duration"`
+	TrackCount   int             `json:"track_count"`
+	Tracks       []PlaylistTrack `json:"tracks"`
+}
+
+type PlaylistTrack struct {
+	ID           string  `json:"id"`
+	Title        string  `json:"title"`
+	Artist       string  `json:"artist"`
+	Album        *string `json:"album"`
+	Genre        *string `json:"genre"`
+	Duration     int64   `json:"duration"`
+	ArtworkURL   *string `json:"artwork_url"`
+	PermalinkURL *string `json:"permalink_url"`
+	StreamURL    *string `json:"stream_url"`
+}
+
+// PlaylistSource provides playlists by name, durations are in milliseconds
+type PlaylistSource interface {
+	Name() string
+	FetchPlaylist(ctx context.Context, playlistName string) (*Playlist, error)
+}
+
+// soundCloudImageOrigin serves SoundCloud's artwork, as i1.sndcdn.com and the like
+const soundCloudImageOrigin = "https://*.sndcdn.com"
+
+type soundCloudSource struct {
+	token *SoundCloudToken
+}
+
+func newSoundCloudSource() *soundCloudSource {
+	return &soundCloudSource{
+		token: newSoundCloudToken(),
+	}
+}
+
+func (scs *soundCloudSource) Name() string {
+	return "soundcloud"
+}
+
+func (scs *soundCloudSource) FetchPlaylist(ctx context.Context, playlistName string) (*Playlist, error) {
+	soundCloudPlaylist, err := getUploadData(ctx, scs.token, playlistName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return normaliseSoundCloudPlaylist(soundCloudPlaylist), nil
+}
+
+func normaliseSoundCloudPlaylist(soundCloudPlaylist *SoundCloudPlaylist) *Playlist {
+	permalinkURL := soundCloudPlaylist.PermalinkURL
+
+	playlist := &Playlist{
+		Source:       "soundcloud",
+		ID:           strconv.FormatInt(soundCloudPlaylist.ID, 10),
+		Title:        soundCloudPlaylist.Title,
+		Description:  soundCloudPlaylist.Description,
+		ArtworkURL:   soundCloudPlaylist.ArtworkURL,
+		PermalinkURL: &permalinkURL,
+		Duration:     soundCloudPlaylist.Duration,
+		Tracks:       make([]PlaylistTrack, 0, len(soundCloudPlaylist.Tracks)),
+	}
+
+	for _, soundCloudTrack := range soundCloudPlaylist.Tracks {
+		track := PlaylistTrack{
+			ID:         strconv.FormatInt(soundCloudTrack.ID, 10),
+			Genre:      soundCloudTrack.Genre,
+			ArtworkURL: soundCloudTrack.ArtworkURL,
+		}
+
+		if soundCloudTrack.Title != nil {
+			track.Title = *soundCloudTrack.Title
+		}
+
+		if soundCloudTrack.User != nil {
+			track.Artist = soundCloudTrack.User.Username
+		}
+
+		if soundCloudTrack.PublisherMetadata != nil {
+			if soundCloudTrack.PublisherMetadata.Artist != nil && *soundCloudTrack.PublisherMetadata.Artist != "" {
+				track.Artist = *soundCloudTrack.PublisherMetadata.Artist
+			}
+
+			track.Album = soundCloudTrack.PublisherMetadata.AlbumTitle
+		}
+
+		if soundCloudTrack.Duration != nil {
+			track.Duration = *soundCloudTrack.Duration
+		}
+
+		if soundCloudTrack.PermalinkURL != nil {
+			// Link to the track within the playlist so SoundCloud keeps playing through it
+			trackPermalinkURL := *soundCloudTrack.PermalinkURL
+
+			if soundCloudPlaylist.User.Permalink != "" && soundCloudPlaylist.Permalink != "" {
+				trackPermalinkURL += fmt.Sprintf("?in=%s/sets/%s", soundCloudPlaylist.User.Permalink, soundCloudPlaylist.Permalink)
+			}
+
+			track.PermalinkURL = &trackPermalinkURL
+		}
+
+		playlist.Tracks = append(playlist.Tracks, track)
+	}
+
+	playlist.TrackCount = len(playlist.Tracks)
+
+	return playlist
+}
+
+// playlistSources holds the configured sources in order of preference, alongside
+// the concrete providers that expose extra endpoints
+type playlistSources struct {
+	ordered    []PlaylistSource
+	soundCloud *soundCloudSource
+	local      *localPlaylistSource
+}
+
+// newPlaylistSources builds the named sources, keeping their order
+func newPlaylistSources(sourceNames []string, localDirectory string) (*playlistSources, error) {
+	sources := &playlistSources{}
+
+	for _, sourceName := range sourceNames {
+		switch strings.TrimSpace(sourceName) {
+		case "":
+			continue
+		case "soundcloud":
+			if sources.soundCloud == nil {
+				sources.soundCloud = newSoundCloudSource()
+			}
+
+			sources.ordered = append(sources.ordered, sources.soundCloud)
+		case "local":
+			if sources.local == nil {
+				sources.local = newLocalPlaylistSource(localDirectory)
+			}
+
+			sources.ordered = append(sources.ordered, sources.local)
+		default:
+			return nil, fmt.Errorf("unknown playlist source %q", sourceName)
+		}
+	}
+
+	if len(sources.ordered) == 0 {
+		return nil, errors.New("no playlist sources configured")
+	}
+
+	return sources, nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang/groupcache/lru"
+)
+
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+func validSlug(slug string) bool {
+	return len(slug) <= 191 && slugPattern.MatchString(slug)
+}
+
+const (
+	cacheStatusHit   = "HIT"
+	cacheStatusMiss  = "MISS"
+	cacheStatusStale = "STALE"
+)
+
+type postCacheEntry struct {
+	value      interface{}
+	fetchedAt  time.Time
+	generation uint64
+}
+
+type postFetch struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// postService caches Ghost responses, keeping the last good copy of each to fall
+// back on while Ghost or its database is down. Concurrent misses for the same key
+// share a single request to Ghost.
+type postService struct {
+	cache      *lru.Cache
+	client     *ghostClient
+	config     func() ghostConfig
+	enricher   *postEnricher
+	generation uint64
+	inFlight   map[string]*postFetch
+	mutex      *sync.Mutex
+}
+
+func newPostService(client *ghostClient, enricher *postEnricher, cacheSize int, config func() ghostConfig) *postService {
+	return &postService{
+		cache:    lru.New(cacheSize),
+		client:   client,
+		config:   config,
+		enricher: enricher,
+		inFlight: make(map[string]*postFetch),
+		mutex:    &sync.Mutex{},
+	}
+}
+
+var postsLog = newLogger("posts")
+
+// invalidate marks every cached response stale, they are refetched on next use but
+// still served if Ghost can't be reached
+func (ps *postService) invalidate() {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	ps.generation++
+}
+
+func (ps *postService) cached(ctx context.Context, key string, fetch func(ctx context.Context) (interface{}, error)) (interface{}, string, error) {
+	ps.mutex.Lock()
+
+	var stale *postCacheEntry
+
+	if cached, ok := ps.cache.Get(key); ok {
+		entry := cached.(*postCacheEntry)
+
+		if entry.generation == ps.generation && time.Since(entry.fetchedAt) < ps.config().CacheTTL {
+			ps.mutex.Unlock()
+
+			return entry.value, cacheStatusHit, nil
+		}
+
+		stale = entry
+	}
+
+	call, fetching := ps.inFlight[key]
+
+	if !fetching {
+		call = &postFetch{done: make(chan struct{})}
+
+		ps.inFlight[key] = call
+	}
+
+	generation := ps.generation
+
+	ps.mutex.Unlock()
+
+	if fetching {
+		<-call.done
+	} else {
+		// Other requests may be waiting on this fetch
+		fetchCtx := detachedContext(ctx)
+
+		call.value, call.err = fetch(fetchCtx)
+
+		ps.mutex.Lock()
+
+		delete(ps.inFlight, key)
+
+		switch call.err {
+		case nil:
+			ps.cache.Add(key, &postCacheEntry{
+				value:      call.value,
+				fetchedAt:  time.Now(),
+				generation: generation,
+			})
+		case errGhostNotFound:
+			ps.cache.Remove(key)
+		}
+
+		ps.mutex.Unlock()
+
+		close(call.done)
+	}
+
+	if call.err == nil {
+		return call.value, cacheStatusMiss, nil
+	}
+
+	if call.err != errGhostNotFound && stale != nil {
+		postsLog.warn(ctx, "ghost unavailable, serving stale posts", logFields{
+			"key":        key,
+			"fetched_at": stale.fetchedAt,
+			"error":      call.err,
+		})
+
+		return stale.value, cacheStatusStale, nil
+	}
+
+	return nil, "", call.err
+}
+
+func (ps *postService) listPosts(ctx context.Context, query ghostPostsQuery) (*PostsPage, string, error) {
+	key := "posts?page=" + strconv.Itoa(query.Page) + "&limit=" + strconv.Itoa(query.Limit) + "&tag=" + query.Tag + "&author=" + query.Author
+
+	page, cacheStatus, err := ps.cached(ctx, key, func(ctx context.Context) (interface{}, error) {
+		return ps.client.browsePosts(ctx, query)
+	})
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return page.(*PostsPage), cacheStatus, nil
+}
+
+// listAllPosts returns every post without its HTML, newest first
+func (ps *postService) listAllPosts(ctx context.Context) ([]Post, string, error) {
+	posts, cacheStatus, err := ps.cached(ctx, "posts/all", func(ctx context.Context) (interface{}, error) {
+		return ps.client.allPostListings(ctx)
+	})
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return posts.([]Post), cacheStatus, nil
+}
+
+// getPost returns the enriched post, enrichment happens once per fetch from Ghost
+func (ps *postService) getPost(ctx context.Context, slug string) (*EnrichedPost, string, error) {
+	post, cacheStatus, err := ps.cached(ctx, "post/"+slug, func(ctx context.Context) (interface{}, error) {
+		post, err := ps.client.readPost(ctx, slug)
+
+		if err != nil {
+			return nil, err
+		}
+
+		enriched, err := ps.enricher.enrich(ctx, post)
+
+		if err != nil {
+			postsLog.error(ctx, "could not enrich post, serving it as is", logFields{
+				"slug":  slug,
+				"error": err,
+			})
+
+			return &EnrichedPost{Post: *post, CodeLanguages: []string{}, TableOfContents: []PostHeading{}}, nil
+		}
+
+		return enriched, nil
+	})
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return post.(*EnrichedPost), cacheStatus, nil
+}
+
+func (ps *postService) registerRoutes(apiGroup *gin.RouterGroup, feeds *postFeeds) {
+	apiGroup.GET("/posts", ps.handleListPosts)
+	apiGroup.GET("/posts/:slug", feeds.orPost(ps.handleGetPost))
+}
+
+type listPostsQuery struct {
+	Page   int    `form:"page" json:"page" binding:"omitempty,min=1"`
+	Limit  int    `form:"limit" json:"limit" binding:"omitempty,min=1,max=100"`
+	Tag    string `form:"tag" json:"tag"`
+	Author string `form:"author" json:"author"`
+}
+
+func (ps *postService) handleListPosts(c *gin.Context) {
+	var request listPostsQuery
+
+	if err := c.ShouldBindQuery(&request); err != nil {
+		abortWithError(c, http.StatusBadRequest, bindingErrorMessage(err))
+
+		return
+	}
+
+	if (request.Tag != "" && !validSlug(request.Tag)) || (request.Author != "" && !validSlug(request.Author)) {
+		abortWithError(c, http.StatusBadRequest, "tag and author must be slugs")
+
+		return
+	}
+
+	query := ghostPostsQuery{
+		Page:   request.Page,
+		Limit:  request.Limit,
+		Tag:    request.Tag,
+		Author: request.Author,
+	}
+
+	if query.Page == 0 {
+		query.Page = 1
+	}
+
+	if query.Limit == 0 {
+		query.Limit = 15
+	}
+
+	page, cacheStatus, err := ps.listPosts(c.Request.Context(), query)
+
+	if err != nil {
+		abortWithError(c, http.StatusBadGateway, "posts are unavailable right now")
+
+		return
+	}
+
+	c.Header("X-Cache", cacheStatus)
+
+	respondWithData(c, page)
+}
+
+func (ps *postService) handleGetPost(c *gin.Context) {
+	slug := c.Param("slug")
+
+	if !validSlug(slug) {
+		abortWithError(c, http.StatusNotFound, "post not found")
+
+		return
+	}
+
+	post, cacheStatus, err := ps.getPost(c.Request.Context(), slug)
+
+	if err == errGhostNotFound {
+		abortWithError(c, http.StatusNotFound, "post not found")
+
+		return
+	}
+
+	if err != nil {
+		abortWithError(c, http.StatusBadGateway, "posts are unavailable right now")
+
+		return
+	}
+
+	c.Header("X-Cache", cacheStatus)
+
+	respondWithData(c, post)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newPostsRouter(posts *postService) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+
+	router.GET("/api/posts", posts.handleListPosts)
+	router.GET("/api/posts/:slug", posts.handleGetPost)
+
+	return router
+}
+
+// getPost requests the post, returning the status, the post's title or "" without one,
+// and the X-Cache header
+func getPost(t *testing.T, router http.Handler, slug string) (int, string, string) {
+	recorder := httptest.NewRecorder()
+
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/posts/"+slug, nil))
+
+	var response struct {
+		Data *EnrichedPost `json:"data"`
+	}
+
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("GET /api/posts/%s responded with invalid JSON: %v", slug, err)
+	}
+
+	title := ""
+
+	if response.Data != nil {
+		title = response.Data.Title
+	}
+
+	return recorder.Code, title, recorder.Header().Get("X-Cache")
+}
+
+func TestPostsAreCached(t *testing.T) {
+	ghost := newFakeGhost(Post{ID: "1", Slug: "hello", Title: "Hello", HTML: "<p>Hello</p>"})
+	defer ghost.close()
+
+	router := newPostsRouter(ghost.postService())
+
+	if status, title, cacheStatus := getPost(t, router, "hello"); status != http.StatusOK || title != "Hello" || cacheStatus != cacheStatusMiss {
+		t.Fatalf("first request = %d %q %s, want 200 \"Hello\" %s", status, title, cacheStatus, cacheStatusMiss)
+	}
+
+	if status, title, cacheStatus := getPost(t, router, "hello"); status != http.StatusOK || title != "Hello" || cacheStatus != cacheStatusHit {
+		t.Fatalf("second request = %d %q %s, want 200 \"Hello\" %s", status, title, cacheStatus, cacheStatusHit)
+	}
+
+	if requests := ghost.requestCount(); requests != 1 {
+		t.Errorf("Ghost got %d requests, want 1", requests)
+	}
+
+	if status, _, _ := getPost(t, router, "missing"); status != http.StatusNotFound {
+		t.Errorf("a post Ghost doesn't have = %d, want 404", status)
+	}
+}
+
+func TestPostsServeStaleWhileGhostIsDown(t *testing.T) {
+	ghost := newFakeGhost(Post{ID: "1", Slug: "hello", Title: "Hello"})
+	defer ghost.close()
+
+	posts := ghost.postService()
+	router := newPostsRouter(posts)
+
+	getPost(t, router, "hello")
+
+	posts.invalidate()
+	ghost.setDown(true)
+
+	if status, title, cacheStatus := getPost(t, router, "hello"); status != http.StatusOK || title != "Hello" || cacheStatus != cacheStatusStale {
+		t.Errorf("a cached post while Ghost is down = %d %q %s, want 200 \"Hello\" %s", status, title, cacheStatus, cacheStatusStale)
+	}
+
+	if status, _, _ := getPost(t, router, "never-fetched"); status != http.StatusBadGateway {
+		t.Errorf("a post never fetched while Ghost is down = %d, want 502", status)
+	}
+
+	ghost.setDown(false)
+
+	if status, title, cacheStatus := getPost(t, router, "hello"); status != http.StatusOK || title != "Hello" || cacheStatus != cacheStatusMiss {
+		t.Errorf("a stale post once Ghost is back = %d %q %s, want 200 \"Hello\" %s", status, title, cacheStatus, cacheStatusMiss)
+	}
+}
+
+func signGhostWebhook(secret string, body []byte, sentAt time.Time) string {
+	timestamp := strconv.FormatInt(sentAt.UnixNano()/int64(time.Millisecond), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+
+	mac.Write(body)
+	mac.Write([]byte(timestamp))
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil)) + ", t=" + timestamp
+}
+
+func TestGhostWebhookInvalidatesPosts(t *testing.T) {
+	ghost := newFakeGhost(Post{ID: "1", Slug: "hello", Title: "Hello", PublishedAt: time.Now()})
+	defer ghost.close()
+
+	config := ghost.config()
+	config.WebhookSecret = "webhook-secret"
+
+	ghostConfigFunc := func() ghostConfig { return config }
+	client := newGhostClient(config)
+	posts := ghost.postService()
+	site := func() siteConfig { return siteConfig{BaseURL: "https://example.com", Title: "Example"} }
+
+	webhooks := newGhostWebhooks(
+		posts,
+		newRevalidator(time.Second, defaultRevalidateConfig),
+		newSitemap(client, site, defaultSitemapConfig),
+		newPostSearch(client),
+		newAuditLog(""),
+		ghostConfigFunc,
+	)
+
+	router := newPostsRouter(posts)
+
+	webhooks.registerRoutes(router.Group("/api"))
+
+	getPost(t, router, "hello")
+
+	ghost.setPosts(Post{ID: "1", Slug: "hello", Title: "Hello again", PublishedAt: time.Now()})
+
+	if _, title, cacheStatus := getPost(t, router, "hello"); title != "Hello" || cacheStatus != cacheStatusHit {
+		t.Fatalf("before the webhook = %q %s, want \"Hello\" %s", title, cacheStatus, cacheStatusHit)
+	}
+
+	body := []byte(`{"post":{"current":{"slug":"hello","status":"published"},"previous":{"slug":"hello"}}}`)
+
+	deliver := func(signature string) int {
+		request := httptest.NewRequest(http.MethodPost, "/api/hooks/ghost", bytes.NewReader(body))
+		request.Header.Set("X-Ghost-Signature", signature)
+
+		recorder := httptest.NewRecorder()
+
+		router.ServeHTTP(recorder, request)
+
+		return recorder.Code
+	}
+
+	if status := deliver(signGhostWebhook("wrong-secret", body, time.Now())); status != http.StatusUnauthorized {
+		t.Errorf("a webhook with a bad signature = %d, want 401", status)
+	}
+
+	if _, title, _ := getPost(t, router, "hello"); title != "Hello" {
+		t.Errorf("a webhook with a bad signature changed the cached post to %q", title)
+	}
+
+	if status := deliver(signGhostWebhook(config.WebhookSecret, body, time.Now())); status != http.StatusOK {
+		t.Fatalf("a signed webhook = %d, want 200", status)
+	}
+
+	if _, title, cacheStatus := getPost(t, router, "hello"); title != "Hello again" || cacheStatus != cacheStatusMiss {
+		t.Errorf("after the webhook = %q %s, want \"Hello again\" %s", title, cacheStatus, cacheStatusMiss)
+	}
+}
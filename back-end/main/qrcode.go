@@ -0,0 +1,568 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"image/color"
+)
+
+// A QR code encoder for the short links, only what they need: byte mode, error
+// correction level M and versions 1 to 10, which hold up to 213 bytes. No QR
+// library is vendored, this follows ISO/IEC 18004.
+
+// qrBlocks describes how a version's codewords are split into error corrected blocks
+type qrBlocks struct {
+	eccPerBlock int
+	// Data codewords of the blocks in the first group, the second group's have one more
+	shortBlocks, shortBlockData int
+	longBlocks                  int
+}
+
+// Level M, indexed by version
+var qrVersionBlocks = [...]qrBlocks{
+	1:  {10, 1, 16, 0},
+	2:  {16, 1, 28, 0},
+	3:  {26, 1, 44, 0},
+	4:  {18, 2, 32, 0},
+	5:  {24, 2, 43, 0},
+	6:  {16, 4, 27, 0},
+	7:  {18, 4, 31, 0},
+	8:  {22, 2, 38, 2},
+	9:  {22, 3, 36, 2},
+	10: {26, 4, 43, 1},
+}
+
+var qrAlignmentPositions = [...][]int{
+	2:  {6, 18},
+	3:  {6, 22},
+	4:  {6, 26},
+	5:  {6, 30},
+	6:  {6, 34},
+	7:  {6, 22, 38},
+	8:  {6, 24, 42},
+	9:  {6, 26, 46},
+	10: {6, 28, 50},
+}
+
+const (
+	qrMaxVersion = 10
+	// Format bits of error correction level M
+	qrLevelMBits = 0
+	// Light modules around the code that readers need to find it
+	qrQuietZone = 4
+)
+
+func (qb qrBlocks) dataCodewords() int {
+	return qb.shortBlocks*qb.shortBlockData + qb.longBlocks*(qb.shortBlockData+1)
+}
+
+var errQRTooLong = errors.New("too much data for a QR code")
+
+type qrCode struct {
+	size       int
+	modules    [][]bool
+	isFunction [][]bool
+}
+
+// encodeQR returns the smallest QR code holding data
+func encodeQR(data []byte) (*qrCode, error) {
+	version, codewords, err := qrCodewords(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	qr := newQRCode(version)
+
+	qr.drawCodewords(codewords)
+
+	bestMask, bestPenalty := 0, -1
+
+	for mask := 0; mask < 8; mask++ {
+		qr.applyMask(mask)
+		qr.drawFormatBits(mask)
+
+		if penalty := qr.penalty(); bestPenalty == -1 || penalty < bestPenalty {
+			bestMask, bestPenalty = mask, penalty
+		}
+
+		qr.applyMask(mask)
+	}
+
+	qr.applyMask(bestMask)
+	qr.drawFormatBits(bestMask)
+
+	return qr, nil
+}
+
+// qrCodewords picks the smallest version data fits in and returns the codewords to
+// draw, data followed by its error correction
+func qrCodewords(data []byte) (int, []byte, error) {
+	version := 1
+
+	for ; version <= qrMaxVersion; version++ {
+		countBits := 8
+
+		if version >= 10 {
+			countBits = 16
+		}
+
+		if 4+countBits+len(data)*8 <= qrVersionBlocks[version].dataCodewords()*8 {
+			break
+		}
+	}
+
+	if version > qrMaxVersion {
+		return 0, nil, errQRTooLong
+	}
+
+	blocks := qrVersionBlocks[version]
+	capacity := blocks.dataCodewords() * 8
+
+	var bits qrBitBuffer
+
+	bits.append(0x4, 4)
+
+	if version >= 10 {
+		bits.append(len(data), 16)
+	} else {
+		bits.append(len(data), 8)
+	}
+
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+
+	terminator := capacity - len(bits)
+
+	if terminator > 4 {
+		terminator = 4
+	}
+
+	bits.append(0, terminator)
+	bits.append(0, (8-len(bits)%8)%8)
+
+	for pad := 0xec; len(bits) < capacity; pad ^= 0xec ^ 0x11 {
+		bits.append(pad, 8)
+	}
+
+	return version, qrInterleave(bits.bytes(), blocks), nil
+}
+
+type qrBitBuffer []bool
+
+func (bb *qrBitBuffer) append(value, length int) {
+	for bit := length - 1; bit >= 0; bit-- {
+		*bb = append(*bb, (value>>uint(bit))&1 == 1)
+	}
+}
+
+func (bb qrBitBuffer) bytes() []byte {
+	data := make([]byte, len(bb)/8)
+
+	for index, bit := range bb {
+		if bit {
+			data[index/8] |= 0x80 >> uint(index%8)
+		}
+	}
+
+	return data
+}
+
+// qrMultiply multiplies in GF(2^8) modulo the polynomial QR codes use
+func qrMultiply(x, y byte) byte {
+	var z int
+
+	for bit := 7; bit >= 0; bit-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11d)
+		z ^= int((y>>uint(bit))&1) * int(x)
+	}
+
+	return byte(z)
+}
+
+// qrDivisor returns the Reed-Solomon generator polynomial of degree, highest term dropped
+func qrDivisor(degree int) []byte {
+	divisor := make([]byte, degree)
+
+	divisor[degree-1] = 1
+
+	root := byte(1)
+
+	for i := 0; i < degree; i++ {
+		for j := range divisor {
+			divisor[j] = qrMultiply(divisor[j], root)
+
+			if j+1 < len(divisor) {
+				divisor[j] ^= divisor[j+1]
+			}
+		}
+
+		root = qrMultiply(root, 0x02)
+	}
+
+	return divisor
+}
+
+func qrRemainder(data, divisor []byte) []byte {
+	remainder := make([]byte, len(divisor))
+
+	for _, b := range data {
+		factor := b ^ remainder[0]
+
+		copy(remainder, remainder[1:])
+
+		remainder[len(remainder)-1] = 0
+
+		for index, coefficient := range divisor {
+			remainder[index] ^= qrMultiply(coefficient, factor)
+		}
+	}
+
+	return remainder
+}
+
+// qrInterleave splits data into blocks, adds their error correction codewords and
+// interleaves them in the order they are drawn
+func qrInterleave(data []byte, blocks qrBlocks) []byte {
+	divisor := qrDivisor(blocks.eccPerBlock)
+
+	var dataBlocks, eccBlocks [][]byte
+
+	for index := 0; index < blocks.shortBlocks+blocks.longBlocks; index++ {
+		length := blocks.shortBlockData
+
+		if index >= blocks.shortBlocks {
+			length++
+		}
+
+		dataBlocks = append(dataBlocks, data[:length])
+		eccBlocks = append(eccBlocks, qrRemainder(data[:length], divisor))
+
+		data = data[length:]
+	}
+
+	var codewords []byte
+
+	for index := 0; index <= blocks.shortBlockData; index++ {
+		for _, block := range dataBlocks {
+			if index < len(block) {
+				codewords = append(codewords, block[index])
+			}
+		}
+	}
+
+	for index := 0; index < blocks.eccPerBlock; index++ {
+		for _, block := range eccBlocks {
+			codewords = append(codewords, block[index])
+		}
+	}
+
+	return codewords
+}
+
+// newQRCode draws the patterns every code of version has, leaving room for the data
+func newQRCode(version int) *qrCode {
+	size := version*4 + 17
+
+	qr := &qrCode{
+		size:       size,
+		modules:    make([][]bool, size),
+		isFunction: make([][]bool, size),
+	}
+
+	for y := range qr.modules {
+		qr.modules[y] = make([]bool, size)
+		qr.isFunction[y] = make([]bool, size)
+	}
+
+	for i := 0; i < size; i++ {
+		qr.setFunction(6, i, i%2 == 0)
+		qr.setFunction(i, 6, i%2 == 0)
+	}
+
+	qr.drawFinder(3, 3)
+	qr.drawFinder(size-4, 3)
+	qr.drawFinder(3, size-4)
+
+	positions := qrAlignmentPositions[version]
+	last := len(positions) - 1
+
+	for i, x := range positions {
+		for j, y := range positions {
+			// The finder patterns take these corners
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					qr.setFunction(x+dx, y+dy, qrMax(qrAbs(dx), qrAbs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	// Reserved until the mask is picked
+	qr.drawFormatBits(0)
+
+	if version >= 7 {
+		remainder := version
+
+		for i := 0; i < 12; i++ {
+			remainder = (remainder << 1) ^ ((remainder >> 11) * 0x1f25)
+		}
+
+		bits := version<<12 | remainder
+
+		for i := 0; i < 18; i++ {
+			dark := (bits>>uint(i))&1 == 1
+			a, b := size-11+i%3, i/3
+
+			qr.setFunction(a, b, dark)
+			qr.setFunction(b, a, dark)
+		}
+	}
+
+	return qr
+}
+
+func qrAbs(x int) int {
+	if x < 0 {
+		return -x
+	}
+
+	return x
+}
+
+func qrMax(x, y int) int {
+	if x > y {
+		return x
+	}
+
+	return y
+}
+
+func (qr *qrCode) setFunction(x, y int, dark bool) {
+	qr.modules[y][x] = dark
+	qr.isFunction[y][x] = true
+}
+
+// drawFinder draws a finder pattern centred on x, y with its light separator
+func (qr *qrCode) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			distance := qrMax(qrAbs(dx), qrAbs(dy))
+
+			if x+dx >= 0 && x+dx < qr.size && y+dy >= 0 && y+dy < qr.size {
+				qr.setFunction(x+dx, y+dy, distance != 2 && distance != 4)
+			}
+		}
+	}
+}
+
+func (qr *qrCode) drawFormatBits(mask int) {
+	data := qrLevelMBits<<3 | mask
+	remainder := data
+
+	for i := 0; i < 10; i++ {
+		remainder = (remainder << 1) ^ ((remainder >> 9) * 0x537)
+	}
+
+	bits := (data<<10 | remainder) ^ 0x5412
+
+	bit := func(i int) bool {
+		return (bits>>uint(i))&1 == 1
+	}
+
+	for i := 0; i <= 5; i++ {
+		qr.setFunction(8, i, bit(i))
+	}
+
+	qr.setFunction(8, 7, bit(6))
+	qr.setFunction(8, 8, bit(7))
+	qr.setFunction(7, 8, bit(8))
+
+	for i := 9; i < 15; i++ {
+		qr.setFunction(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		qr.setFunction(qr.size-1-i, 8, bit(i))
+	}
+
+	for i := 8; i < 15; i++ {
+		qr.setFunction(8, qr.size-15+i, bit(i))
+	}
+
+	// Always dark
+	qr.setFunction(8, qr.size-8, true)
+}
+
+// drawCodewords fills the modules left free by the function patterns, zigzagging up
+// and down two columns at a time from the bottom right
+func (qr *qrCode) drawCodewords(codewords []byte) {
+	index := 0
+
+	for right := qr.size - 1; right >= 1; right -= 2 {
+		// The vertical timing pattern is skipped over
+		if right == 6 {
+			right = 5
+		}
+
+		for vertical := 0; vertical < qr.size; vertical++ {
+			for column := 0; column < 2; column++ {
+				x := right - column
+				y := vertical
+
+				if (right+1)&2 == 0 {
+					y = qr.size - 1 - vertical
+				}
+
+				if qr.isFunction[y][x] || index >= len(codewords)*8 {
+					continue
+				}
+
+				qr.modules[y][x] = (codewords[index/8]>>uint(7-index%8))&1 == 1
+
+				index++
+			}
+		}
+	}
+}
+
+// applyMask flips the data modules mask selects, applying it twice undoes it
+func (qr *qrCode) applyMask(mask int) {
+	for y := 0; y < qr.size; y++ {
+		for x := 0; x < qr.size; x++ {
+			var flip bool
+
+			switch mask {
+			case 0:
+				flip = (x+y)%2 == 0
+			case 1:
+				flip = y%2 == 0
+			case 2:
+				flip = x%3 == 0
+			case 3:
+				flip = (x+y)%3 == 0
+			case 4:
+				flip = (x/3+y/2)%2 == 0
+			case 5:
+				flip = x*y%2+x*y%3 == 0
+			case 6:
+				flip = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				flip = ((x+y)%2+x*y%3)%2 == 0
+			}
+
+			if flip && !qr.isFunction[y][x] {
+				qr.modules[y][x] = !qr.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores how hard the code is to read, the mask scoring lowest is used
+func (qr *qrCode) penalty() int {
+	penalty := 0
+	dark := 0
+
+	for line := 0; line < qr.size; line++ {
+		for _, horizontal := range []bool{true, false} {
+			module := func(i int) bool {
+				if horizontal {
+					return qr.modules[line][i]
+				}
+
+				return qr.modules[i][line]
+			}
+
+			run := 1
+
+			for i := 1; i <= qr.size; i++ {
+				if i < qr.size && module(i) == module(i-1) {
+					run++
+
+					continue
+				}
+
+				if run >= 5 {
+					penalty += run - 2
+				}
+
+				run = 1
+			}
+
+			// Patterns that look like a finder, with four light modules on either side
+			for i := 0; i+7 <= qr.size; i++ {
+				if !module(i) || module(i+1) || !module(i+2) || !module(i+3) || !module(i+4) || module(i+5) || !module(i+6) {
+					continue
+				}
+
+				lightBefore, lightAfter := true, true
+
+				for j := 1; j <= 4; j++ {
+					if i-j >= 0 && module(i-j) {
+						lightBefore = false
+					}
+
+					if i+6+j < qr.size && module(i+6+j) {
+						lightAfter = false
+					}
+				}
+
+				if lightBefore {
+					penalty += 40
+				}
+
+				if lightAfter {
+					penalty += 40
+				}
+			}
+		}
+	}
+
+	for y := 0; y < qr.size; y++ {
+		for x := 0; x < qr.size; x++ {
+			if qr.modules[y][x] {
+				dark++
+			}
+
+			if x+1 < qr.size && y+1 < qr.size {
+				module := qr.modules[y][x]
+
+				if module == qr.modules[y][x+1] && module == qr.modules[y+1][x] && module == qr.modules[y+1][x+1] {
+					penalty += 3
+				}
+			}
+		}
+	}
+
+	percent := dark * 100 / (qr.size * qr.size)
+
+	return penalty + qrAbs(percent-50)/5*10
+}
+
+// image draws the code with scale pixels per module, inside its quiet zone
+func (qr *qrCode) image(scale int) image.Image {
+	width := (qr.size + qrQuietZone*2) * scale
+
+	img := image.NewPaletted(image.Rect(0, 0, width, width), color.Palette{color.White, color.Black})
+
+	for y := 0; y < qr.size; y++ {
+		for x := 0; x < qr.size; x++ {
+			if !qr.modules[y][x] {
+				continue
+			}
+
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetColorIndex((x+qrQuietZone)*scale+dx, (y+qrQuietZone)*scale+dy, 1)
+				}
+			}
+		}
+	}
+
+	return img
+}
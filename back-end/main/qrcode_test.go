@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestQRRemainder checks the error correction of the version 1-M "HELLO WORLD"
+// example worked through in Thonky's QR code tutorial
+func TestQRRemainder(t *testing.T) {
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+
+	if got := qrRemainder(data, qrDivisor(10)); !bytes.Equal(got, want) {
+		t.Errorf("qrRemainder = %v, want %v", got, want)
+	}
+}
+
+// qrGoldenCases cover one block, several blocks, version information and blocks of
+// two lengths with a 16 bit character count
+var qrGoldenCases = []struct {
+	version int
+	data    string
+}{
+	{1, "rj.io/go/x1"},
+	{2, "https://rj.io/go/hello"},
+	{5, "https://therileyjohnson.com/posts/measuring-post-images-within-a-budget"},
+	{7, "https://therileyjohnson.com/posts/a-qr-code-encoder-for-short-links?utm_source=newsletter&utm_medium=email&utm_campaign=x"},
+	{10, "https://therileyjohnson.com/posts/generating-typescript-types-from-go-structs?utm_source=newsletter&utm_medium=email&utm_campaign=weekly-digest&utm_content=featured-post&ref=0123456789abcdef0123456789"},
+}
+
+// readQRGolden reads testdata/qrcode/version-N.txt, which holds the code drawn with
+// each mask in turn as rows of # for dark and . for light modules. They were made
+// with a separate encoder written from the standard, not with this one.
+func readQRGolden(t *testing.T, version int) [8]string {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "qrcode", fmt.Sprintf("version-%d.txt", version)))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var golden [8]string
+
+	for mask, section := range strings.Split(strings.TrimSpace(string(data)), "\n\n") {
+		header := fmt.Sprintf("mask %d\n", mask)
+
+		if mask >= len(golden) || !strings.HasPrefix(section, header) {
+			t.Fatalf("version-%d.txt should list masks 0 to 7 in order", version)
+		}
+
+		golden[mask] = strings.TrimPrefix(section, header)
+	}
+
+	return golden
+}
+
+func (qr *qrCode) String() string {
+	rows := make([]string, qr.size)
+
+	for y, row := range qr.modules {
+		var line strings.Builder
+
+		for _, dark := range row {
+			if dark {
+				line.WriteByte('#')
+			} else {
+				line.WriteByte('.')
+			}
+		}
+
+		rows[y] = line.String()
+	}
+
+	return strings.Join(rows, "\n")
+}
+
+func TestQRGolden(t *testing.T) {
+	for _, golden := range qrGoldenCases {
+		version, codewords, err := qrCodewords([]byte(golden.data))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if version != golden.version {
+			t.Errorf("%d bytes were encoded as version %d, want %d", len(golden.data), version, golden.version)
+
+			continue
+		}
+
+		want := readQRGolden(t, version)
+
+		for mask := 0; mask < 8; mask++ {
+			qr := newQRCode(version)
+
+			qr.drawCodewords(codewords)
+			qr.applyMask(mask)
+			qr.drawFormatBits(mask)
+
+			if got := qr.String(); got != want[mask] {
+				t.Errorf("version %d with mask %d doesn't match the golden code, got\n%s", version, mask, got)
+			}
+		}
+
+		qr, err := encodeQR([]byte(golden.data))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		matched := false
+
+		for mask := range want {
+			matched = matched || qr.String() == want[mask]
+		}
+
+		if !matched {
+			t.Errorf("encodeQR's version %d code doesn't match the golden code for any mask", version)
+		}
+	}
+}
+
+func TestQRTooLong(t *testing.T) {
+	if _, err := encodeQR(bytes.Repeat([]byte("a"), 213)); err != nil {
+		t.Errorf("213 bytes should fit in version 10: %v", err)
+	}
+
+	if _, err := encodeQR(bytes.Repeat([]byte("a"), 214)); err != errQRTooLong {
+		t.Errorf("214 bytes = %v, want errQRTooLong", err)
+	}
+}
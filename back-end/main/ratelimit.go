@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang/groupcache/lru"
+)
+
+type rateLimit struct {
+	// Requests allowed per second once the burst has been spent
+	Rate  float64
+	Burst int
+}
+
+// parseRateLimit parses limits in the form "<requests>/<s|m|h>:<burst>", e.g. "60/m:20"
+func parseRateLimit(limitSpec string) (rateLimit, error) {
+	limitParts := strings.SplitN(limitSpec, ":", 2)
+	rateParts := strings.SplitN(limitParts[0], "/", 2)
+
+	if len(rateParts) != 2 {
+		return rateLimit{}, fmt.Errorf("invalid rate limit %q, expected <requests>/<s|m|h>:<burst>", limitSpec)
+	}
+
+	requests, err := strconv.ParseFloat(strings.TrimSpace(rateParts[0]), 64)
+
+	if err != nil || requests <= 0 {
+		return rateLimit{}, fmt.Errorf("invalid request count in rate limit %q", limitSpec)
+	}
+
+	var period time.Duration
+
+	switch strings.TrimSpace(rateParts[1]) {
+	case "s":
+		period = time.Second
+	case "m":
+		period = time.Minute
+	case "h":
+		period = time.Hour
+	default:
+		return rateLimit{}, fmt.Errorf("invalid period in rate limit %q", limitSpec)
+	}
+
+	limit := rateLimit{
+		Rate:  requests / period.Seconds(),
+		Burst: int(math.Ceil(requests)),
+	}
+
+	if len(limitParts) == 2 {
+		burst, err := strconv.Atoi(strings.TrimSpace(limitParts[1]))
+
+		if err != nil || burst < 1 {
+			return rateLimit{}, fmt.Errorf("invalid burst in rate limit %q", limitSpec)
+		}
+
+		limit.Burst = burst
+	}
+
+	return limit, nil
+}
+
+type tokenBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+// rateLimiter holds a token bucket per client, the least recently seen clients
+// are evicted once maxClients buckets exist so memory stays bounded
+type rateLimiter struct {
+	limit   rateLimit
+	mutex   *sync.Mutex
+	buckets *lru.Cache
+}
+
+func newRateLimiter(limit rateLimit, maxClients int) *rateLimiter {
+	return &rateLimiter{
+		limit:   limit,
+		mutex:   &sync.Mutex{},
+		buckets: lru.New(maxClients),
+	}
+}
+
+// setLimit changes the limit, buckets already tracked keep their tokens
+func (rl *rateLimiter) setLimit(limit rateLimit) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	rl.limit = limit
+}
+
+// allow takes a token from the client's bucket, when none are left it reports
+// how long until the next token is available
+func (rl *rateLimiter) allow(clientKey string, now time.Time) (bool, time.Duration) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	var bucket *tokenBucket
+
+	if cachedBucket, ok := rl.buckets.Get(clientKey); ok {
+		bucket = cachedBucket.(*tokenBucket)
+
+		elapsed := now.Sub(bucket.lastRefill).Seconds()
+
+		bucket.tokens = math.Min(float64(rl.limit.Burst), bucket.tokens+elapsed*rl.limit.Rate)
+		bucket.lastRefill = now
+	} else {
+		bucket = &tokenBucket{
+			tokens:     float64(rl.limit.Burst),
+			lastRefill: now,
+		}
+
+		rl.buckets.Add(clientKey, bucket)
+	}
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+
+		return true, 0
+	}
+
+	secondsUntilToken := (1 - bucket.tokens) / rl.limit.Rate
+
+	return false, time.Duration(secondsUntilToken * float64(time.Second))
+}
+
+var rateLimitLog = newLogger("ratelimit")
+
+// rateLimitMiddleware rejects clients that have exhausted their bucket with a 429
+func rateLimitMiddleware(limiter *rateLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		allowed, retryAfter := limiter.allow(clientIP(c), time.Now())
+
+		if allowed {
+			c.Next()
+
+			return
+		}
+
+		retryAfterSeconds := int(math.Ceil(retryAfter.Seconds()))
+
+		rateLimitLog.info(c.Request.Context(), "rate limited client", logFields{
+			"client_ip":   clientIP(c),
+			"path":        c.FullPath(),
+			"retry_after": retryAfterSeconds,
+		})
+
+		c.Header("Retry-After", strconv.Itoa(retryAfterSeconds))
+
+		abortWithError(c, http.StatusTooManyRequests, "too many requests, try again later")
+	}
+}
+
+type rateLimitConfig struct {
+	// Limits per route group such as "api: 60/m:20", see parseRateLimit
+	Groups     map[string]string `yaml:"groups" env:"RATE_LIMITS" validate:"dive,keys,required,endkeys,ratelimit" reload:"true"`
+	MaxClients int               `yaml:"max_clients" env:"RATE_LIMIT_MAX_CLIENTS" validate:"min=1"`
+}
+
+func defaultRateLimitConfig() rateLimitConfig {
+	return rateLimitConfig{
+		Groups: map[string]string{
+			"default":   "120/m:40",
+			"contact":   "10/h:3",
+			"votes":     "30/m:10",
+			"login":     "10/m:5",
+			"analytics": "120/m:60",
+			"comments":  "10/h:5",
+			"subscribe": "10/h:3",
+		},
+		MaxClients: 10000,
+	}
+}
+
+// rateLimiters hands out one limiter per route group, groups without a
+// configured limit share the limits of the "default" group
+type rateLimiters struct {
+	mutex      *sync.Mutex
+	limits     map[string]rateLimit
+	limiters   map[string][]*rateLimiter
+	maxClients int
+}
+
+func newRateLimiters(config rateLimitConfig) (*rateLimiters, error) {
+	rls := &rateLimiters{
+		mutex:      &sync.Mutex{},
+		limiters:   make(map[string][]*rateLimiter),
+		maxClients: config.MaxClients,
+	}
+
+	return rls, rls.update(config.Groups)
+}
+
+func parseGroupRateLimits(groupLimits map[string]string) (map[string]rateLimit, error) {
+	limits, err := parseGroupRateLimitSpecs(defaultRateLimitConfig().Groups)
+
+	if err != nil {
+		return nil, err
+	}
+
+	configuredLimits, err := parseGroupRateLimitSpecs(groupLimits)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for group, limit := range configuredLimits {
+		limits[group] = limit
+	}
+
+	return limits, nil
+}
+
+func parseGroupRateLimitSpecs(groupLimits map[string]string) (map[string]rateLimit, error) {
+	limits := make(map[string]rateLimit, len(groupLimits))
+
+	for group, limitSpec := range groupLimits {
+		limit, err := parseRateLimit(limitSpec)
+
+		if err != nil {
+			return nil, fmt.Errorf("rate limit for %s: %s", group, err)
+		}
+
+		limits[group] = limit
+	}
+
+	return limits, nil
+}
+
+// update applies new limits to every limiter already handed out
+func (rls *rateLimiters) update(groupLimits map[string]string) error {
+	limits, err := parseGroupRateLimits(groupLimits)
+
+	if err != nil {
+		return err
+	}
+
+	rls.mutex.Lock()
+	defer rls.mutex.Unlock()
+
+	rls.limits = limits
+
+	for group, groupLimiters := range rls.limiters {
+		for _, limiter := range groupLimiters {
+			limiter.setLimit(rls.limitFor(group))
+		}
+	}
+
+	return nil
+}
+
+func (rls *rateLimiters) limitFor(group string) rateLimit {
+	limit, ok := rls.limits[group]
+
+	if !ok {
+		limit = rls.limits["default"]
+	}
+
+	return limit
+}
+
+func (rls *rateLimiters) middleware(group string) gin.HandlerFunc {
+	rls.mutex.Lock()
+	defer rls.mutex.Unlock()
+
+	limiter := newRateLimiter(rls.limitFor(group), rls.maxClients)
+
+	rls.limiters[group] = append(rls.limiters[group], limiter)
+
+	return rateLimitMiddleware(limiter)
+}
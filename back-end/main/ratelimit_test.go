@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRateLimitMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+
+	router.Use(clientIPMiddleware(nil), rateLimitMiddleware(newRateLimiter(rateLimit{Rate: 1.0 / 60, Burst: 2}, 16)))
+	router.GET("/api/ping", func(c *gin.Context) {
+		respondWithData(c, "pong")
+	})
+
+	request := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/ping", nil)
+		req.RemoteAddr = remoteAddr
+
+		recorder := httptest.NewRecorder()
+
+		router.ServeHTTP(recorder, req)
+
+		return recorder
+	}
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		if recorder := request("203.0.113.7:5000"); recorder.Code != http.StatusOK {
+			t.Fatalf("request %d within the burst = %d, want 200", attempt, recorder.Code)
+		}
+	}
+
+	limited := request("203.0.113.7:5001")
+
+	if limited.Code != http.StatusTooManyRequests {
+		t.Fatalf("a request past the burst = %d, want 429", limited.Code)
+	}
+
+	// One token a minute, so the next is almost a minute away
+	if retryAfter := limited.Header().Get("Retry-After"); retryAfter != "60" {
+		t.Errorf("Retry-After = %q, want \"60\"", retryAfter)
+	}
+
+	var response apiResponse
+
+	if err := json.Unmarshal(limited.Body.Bytes(), &response); err != nil {
+		t.Fatalf("the 429 isn't the JSON envelope: %v", err)
+	}
+
+	if !response.Err || response.Data != nil || response.Msg != "too many requests, try again later" {
+		t.Errorf("the 429 envelope = %+v", response)
+	}
+
+	if recorder := request("198.51.100.1:5000"); recorder.Code != http.StatusOK {
+		t.Errorf("another client was limited too, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type RelatedPost struct {
+	Slug         string    `json:"slug"`
+	Title        string    `json:"title"`
+	Excerpt      string    `json:"excerpt"`
+	FeatureImage *string   `json:"feature_image"`
+	PublishedAt  time.Time `json:"published_at"`
+	Tags         []PostTag `json:"tags"`
+	Score        float64   `json:"score"`
+}
+
+const (
+	// Sharing every tag adds this much to a similarity that is at most 1 otherwise
+	relatedTagBoost = 0.3
+
+	relatedMaxPosts = 20
+)
+
+var errRelatedIndexEmpty = errors.New("the search index is empty")
+
+// relatedPosts holds the TF-IDF vectors for one version of the index, the related
+// posts of each post are worked out the first time they are asked for
+type relatedPosts struct {
+	version uint64
+	vectors map[string]map[string]float64
+	norms   map[string]float64
+	ranked  map[string][]RelatedPost
+}
+
+// buildRelatedPostsLocked weighs every term by its log-scaled frequency in the
+// post and how rare it is across posts
+func (si *searchIndex) buildRelatedPostsLocked() *relatedPosts {
+	related := &relatedPosts{
+		version: si.version,
+		vectors: make(map[string]map[string]float64, len(si.documents)),
+		norms:   make(map[string]float64, len(si.documents)),
+		ranked:  make(map[string][]RelatedPost),
+	}
+
+	documentCount := float64(len(si.documents))
+
+	for postID, document := range si.documents {
+		vector := make(map[string]float64, len(document.terms))
+		norm := 0.0
+
+		for term, frequency := range document.terms {
+			idf := math.Log(documentCount / float64(len(si.postings[term])))
+
+			// Terms in every post say nothing about which posts are alike
+			if idf <= 0 {
+				continue
+			}
+
+			weight := (1 + math.Log(frequency)) * idf
+
+			vector[term] = weight
+			norm += weight * weight
+		}
+
+		related.vectors[postID] = vector
+		related.norms[postID] = math.Sqrt(norm)
+	}
+
+	return related
+}
+
+func cosineSimilarity(a, b map[string]float64, normA, normB float64) float64 {
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+
+	// Iterate over the smaller vector, the larger one is only looked up
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+
+	dot := 0.0
+
+	for term, weight := range a {
+		dot += weight * b[term]
+	}
+
+	return dot / (normA * normB)
+}
+
+// tagOverlap is the Jaccard index of the posts' public tags
+func tagOverlap(a, b Post) float64 {
+	tags := make(map[string]bool)
+
+	for _, tag := range a.Tags {
+		if tag.Visibility != "internal" {
+			tags[tag.Slug] = true
+		}
+	}
+
+	shared, union := 0, len(tags)
+
+	for _, tag := range b.Tags {
+		if tag.Visibility == "internal" {
+			continue
+		}
+
+		if tags[tag.Slug] {
+			shared++
+		} else {
+			union++
+		}
+	}
+
+	if union == 0 {
+		return 0
+	}
+
+	return float64(shared) / float64(union)
+}
+
+func (si *searchIndex) rankRelatedLocked(related *relatedPosts, postID string) []RelatedPost {
+	document := si.documents[postID]
+	ranked := []RelatedPost{}
+
+	for otherID, other := range si.documents {
+		if otherID == postID {
+			continue
+		}
+
+		score := cosineSimilarity(related.vectors[postID], related.vectors[otherID], related.norms[postID], related.norms[otherID]) +
+			relatedTagBoost*tagOverlap(document.post, other.post)
+
+		if score <= 0 {
+			continue
+		}
+
+		ranked = append(ranked, RelatedPost{
+			Slug:         other.post.Slug,
+			Title:        other.post.Title,
+			Excerpt:      postSummary(other.post),
+			FeatureImage: other.post.FeatureImage,
+			PublishedAt:  other.post.PublishedAt,
+			Tags:         other.post.Tags,
+			Score:        math.Round(score*1000) / 1000,
+		})
+	}
+
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Score != ranked[j].Score {
+			return ranked[i].Score > ranked[j].Score
+		}
+
+		return ranked[i].PublishedAt.After(ranked[j].PublishedAt)
+	})
+
+	if len(ranked) > relatedMaxPosts {
+		ranked = ranked[:relatedMaxPosts]
+	}
+
+	return ranked
+}
+
+// relatedTo returns the posts most like the one with slug, errGhostNotFound if it isn't indexed
+func (si *searchIndex) relatedTo(slug string, limit int) ([]RelatedPost, error) {
+	si.mutex.RLock()
+	defer si.mutex.RUnlock()
+
+	if len(si.documents) == 0 {
+		return nil, errRelatedIndexEmpty
+	}
+
+	postID, ok := si.slugs[slug]
+
+	if !ok {
+		return nil, errGhostNotFound
+	}
+
+	si.relatedMutex.Lock()
+	defer si.relatedMutex.Unlock()
+
+	if si.related == nil || si.related.version != si.version {
+		si.related = si.buildRelatedPostsLocked()
+	}
+
+	ranked, ok := si.related.ranked[postID]
+
+	if !ok {
+		ranked = si.rankRelatedLocked(si.related, postID)
+
+		si.related.ranked[postID] = ranked
+	}
+
+	if len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+
+	return ranked, nil
+}
+
+type relatedQuery struct {
+	Limit int `form:"limit" json:"limit" binding:"omitempty,min=1,max=20"`
+}
+
+func (ps *postSearch) handleRelated(c *gin.Context) {
+	var request relatedQuery
+
+	if err := c.ShouldBindQuery(&request); err != nil {
+		abortWithError(c, http.StatusBadRequest, bindingErrorMessage(err))
+
+		return
+	}
+
+	if request.Limit == 0 {
+		request.Limit = 3
+	}
+
+	related, err := ps.index.relatedTo(c.Param("slug"), request.Limit)
+
+	switch err {
+	case nil:
+		respondWithData(c, related)
+	case errGhostNotFound:
+		abortWithError(c, http.StatusNotFound, "post not found")
+	default:
+		abortWithError(c, http.StatusServiceUnavailable, "related posts are unavailable right now")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// apiResponse is the envelope every JSON endpoint responds with, mirrored by
+// ApiResponse in the front end's ApiInteractions.ts
+type apiResponse struct {
+	Err  bool        `json:"err"`
+	Data interface{} `json:"data"`
+	Msg  string      `json:"msg"`
+	// Tells the front end to drop its auth token
+	Logout bool `json:"logout,omitempty"`
+}
+
+func respondWithData(c *gin.Context, data interface{}) {
+	c.JSON(http.StatusOK, apiResponse{
+		Err:  false,
+		Data: data,
+		Msg:  "",
+	})
+}
+
+func abortWithError(c *gin.Context, status int, msg string) {
+	c.AbortWithStatusJSON(status, apiResponse{
+		Err:  true,
+		Data: nil,
+		Msg:  msg,
+	})
+}
+
+// abortWithLogout rejects a request whose session is missing, expired or revoked
+func abortWithLogout(c *gin.Context, msg string) {
+	c.AbortWithStatusJSON(http.StatusUnauthorized, apiResponse{
+		Err:    true,
+		Data:   nil,
+		Msg:    msg,
+		Logout: true,
+	})
+}
+
+// useJSONFieldNames makes binding errors name fields the way clients send them
+func useJSONFieldNames() {
+	if bindingValidator, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		bindingValidator.RegisterTagNameFunc(func(field reflect.StructField) string {
+			name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+
+			if name == "" || name == "-" {
+				return field.Name
+			}
+
+			return name
+		})
+	}
+}
+
+// bindingErrorMessage describes why a request body was rejected, naming the offending fields
+func bindingErrorMessage(err error) string {
+	validationErrors, ok := err.(validator.ValidationErrors)
+
+	if !ok {
+		return "invalid request"
+	}
+
+	problems := make([]string, 0, len(validationErrors))
+
+	for _, fieldError := range validationErrors {
+		problems = append(problems, fieldError.Field()+" "+describeFieldError(fieldError))
+	}
+
+	return strings.Join(problems, ", ")
+}
+
+// describeFieldError explains a failed validation rule in words
+func describeFieldError(fieldError validator.FieldError) string {
+	switch fieldError.Tag() {
+	case "required":
+		return "is required"
+	case "min":
+		switch fieldError.Kind() {
+		case reflect.String:
+			return fmt.Sprintf("must be at least %s characters long", fieldError.Param())
+		case reflect.Slice, reflect.Map:
+			return fmt.Sprintf("must have at least %s entries", fieldError.Param())
+		default:
+			return fmt.Sprintf("must be at least %s", fieldError.Param())
+		}
+	case "max":
+		switch fieldError.Kind() {
+		case reflect.String:
+			return fmt.Sprintf("must be at most %s characters long", fieldError.Param())
+		case reflect.Slice, reflect.Map:
+			return fmt.Sprintf("must have at most %s entries", fieldError.Param())
+		default:
+			return fmt.Sprintf("must be at most %s", fieldError.Param())
+		}
+	case "gt":
+		return fmt.Sprintf("must be greater than %s", fieldError.Param())
+	case "lte":
+		return fmt.Sprintf("must be at most %s", fieldError.Param())
+	case "email":
+		return "must be a valid email address"
+	case "mindur":
+		return fmt.Sprintf("must be a duration of at least %s", fieldError.Param())
+	case "oneof":
+		return fmt.Sprintf("must be one of %s, got %q", strings.Join(strings.Fields(fieldError.Param()), ", "), fieldError.Value())
+	case "hostname_port":
+		return fmt.Sprintf("must be a host:port address such as :80, got %q", fieldError.Value())
+	case "cidr":
+		return fmt.Sprintf("must be a CIDR such as 10.0.0.0/8, got %q", fieldError.Value())
+	case "loglevels":
+		return fmt.Sprintf(`must be log levels such as "info,soundcloud=debug", got %q`, fieldError.Value())
+	case "url":
+		return fmt.Sprintf("must be an absolute URL, got %q", fieldError.Value())
+	case "startswith":
+		return fmt.Sprintf("must start with %q, got %q", fieldError.Param(), fieldError.Value())
+	case "ratelimit":
+		return fmt.Sprintf(`must be a rate limit such as "60/m:20", got %q`, fieldError.Value())
+	default:
+		return fmt.Sprintf("failed the %s check", fieldError.Tag())
+	}
+}
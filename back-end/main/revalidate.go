@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type revalidateConfig struct {
+	// The front end's on-demand revalidation endpoint, revalidation is skipped when empty
+	URL          string        `yaml:"url" env:"REVALIDATE_URL" validate:"omitempty,url"`
+	Secret       string        `yaml:"secret" env:"REVALIDATE_SECRET" secret:"true" reload:"true"`
+	MaxAttempts  int           `yaml:"max_attempts" env:"REVALIDATE_MAX_ATTEMPTS" validate:"min=1" reload:"true"`
+	RetryBackoff time.Duration `yaml:"retry_backoff" env:"REVALIDATE_RETRY_BACKOFF" validate:"mindur=100ms" reload:"true"`
+	Timeout      time.Duration `yaml:"timeout" env:"REVALIDATE_TIMEOUT" validate:"mindur=1s"`
+}
+
+func defaultRevalidateConfig() revalidateConfig {
+	return revalidateConfig{
+		MaxAttempts:  4,
+		RetryBackoff: time.Second * 2,
+		Timeout:      time.Second * 10,
+	}
+}
+
+// revalidator asks Next.js to regenerate statically rendered pages, retrying with
+// a doubling backoff since the front end may be restarting when content changes.
+// Responses retrying can't change aren't retried.
+type revalidator struct {
+	config     func() revalidateConfig
+	httpClient *http.Client
+	pending    *sync.WaitGroup
+	stop       chan struct{}
+	stopOnce   *sync.Once
+}
+
+func newRevalidator(timeout time.Duration, config func() revalidateConfig) *revalidator {
+	return &revalidator{
+		config: config,
+		httpClient: &http.Client{
+			Timeout: timeout,
+		},
+		pending:  &sync.WaitGroup{},
+		stop:     make(chan struct{}),
+		stopOnce: &sync.Once{},
+	}
+}
+
+var revalidateLog = newLogger("revalidate")
+
+type revalidateRequest struct {
+	Paths []string `json:"paths"`
+}
+
+// revalidate regenerates the paths in the background
+func (rv *revalidator) revalidate(ctx context.Context, paths []string) {
+	if rv.config().URL == "" {
+		revalidateLog.debug(ctx, "no revalidation url configured, skipping", logFields{"paths": paths})
+
+		return
+	}
+
+	rv.pending.Add(1)
+
+	revalidateCtx := detachedContext(ctx)
+
+	go func() {
+		defer rv.pending.Done()
+
+		rv.revalidateWithRetries(revalidateCtx, paths)
+	}()
+}
+
+func (rv *revalidator) revalidateWithRetries(ctx context.Context, paths []string) {
+	config := rv.config()
+	backoff := config.RetryBackoff
+
+	for attempt := 1; ; attempt++ {
+		err := rv.send(ctx, config, paths)
+
+		if err == nil {
+			revalidateLog.info(ctx, "revalidated pages", logFields{
+				"paths":    paths,
+				"attempts": attempt,
+			})
+
+			return
+		}
+
+		if _, rejected := err.(revalidationRejected); rejected {
+			revalidateLog.error(ctx, "revalidation was rejected, not retrying", logFields{
+				"paths":    paths,
+				"attempts": attempt,
+				"error":    err,
+			})
+
+			return
+		}
+
+		if attempt >= config.MaxAttempts {
+			revalidateLog.error(ctx, "giving up on revalidating pages", logFields{
+				"paths":    paths,
+				"attempts": attempt,
+				"error":    err,
+			})
+
+			return
+		}
+
+		revalidateLog.warn(ctx, "could not revalidate pages, will retry", logFields{
+			"paths":   paths,
+			"attempt": attempt,
+			"error":   err,
+		})
+
+		select {
+		case <-time.After(backoff):
+		case <-rv.stop:
+			return
+		}
+
+		backoff *= 2
+	}
+}
+
+func (rv *revalidator) send(ctx context.Context, config revalidateConfig, paths []string) error {
+	body, err := json.Marshal(revalidateRequest{Paths: paths})
+
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, config.URL, bytes.NewReader(body))
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+config.Secret)
+
+	resp, err := rv.httpClient.Do(req.WithContext(ctx))
+
+	if err != nil {
+		return redactURLError(err)
+	}
+
+	defer resp.Body.Close()
+
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+		return revalidationRejected{status: resp.StatusCode}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("revalidation responded with %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// revalidationRejected is a response that won't change by retrying, like a wrong
+// secret or bad paths
+type revalidationRejected struct {
+	status int
+}
+
+func (rr revalidationRejected) Error() string {
+	return fmt.Sprintf("revalidation responded with %d", rr.status)
+}
+
+// close abandons retries that are waiting out their backoff, waiting for requests in flight
+func (rv *revalidator) close(ctx context.Context) error {
+	rv.stopOnce.Do(func() {
+		close(rv.stop)
+	})
+
+	done := make(chan struct{})
+
+	go func() {
+		rv.pending.Wait()
+
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		revalidateLog.warn(ctx, "timed out waiting for revalidations to finish", nil)
+	}
+
+	return nil
+}
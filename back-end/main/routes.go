@@ -0,0 +1,65 @@
+package main
+
+//go:generate go run ../tsgen -out ../../front-end/util/api/ApiTypes.ts
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+// apiServices are the parts of the server that have routes, main builds them and
+// registerAllRoutes wires them into the router
+type apiServices struct {
+	playlist      *PlaylistHandler
+	localTracks   *localPlaylistSource
+	posts         *postService
+	feeds         *postFeeds
+	siteMap       *sitemap
+	search        *postSearch
+	articles      *articleFeeds
+	analytics     *analyticsCollector
+	ghostHooks    *ghostWebhooks
+	emails        *outbox
+	contact       *contactAPI
+	comments      *commentsAPI
+	previews      *ogImages
+	subscriptions *newsletter
+	links         *shortLinks
+	admin         *adminAPI
+	auth          *authService
+	apiKeys       *apiKeyRoutes
+	docs          *apiDocs
+}
+
+// registerAllRoutes is the one place routes are added to the router, so the API
+// description built at the end covers every one of them
+func registerAllRoutes(router *gin.Engine, limiters *rateLimiters, adminToken func() string, services apiServices) {
+	apiGroup := router.Group("/api", limiters.middleware("api"))
+
+	services.playlist.registerRoutes(apiGroup, services.localTracks)
+	services.posts.registerRoutes(apiGroup, services.feeds)
+	services.siteMap.registerRoutes(router, limiters.middleware("sitemap"))
+	services.search.registerRoutes(apiGroup)
+	services.articles.registerRoutes(apiGroup, limiters.middleware("votes"))
+	services.analytics.registerRoutes(apiGroup, limiters.middleware("analytics"))
+	services.ghostHooks.registerRoutes(apiGroup)
+	services.contact.registerRoutes(apiGroup, limiters.middleware("contact"))
+	services.comments.registerRoutes(apiGroup, limiters.middleware("comments"))
+	services.previews.registerRoutes(apiGroup, limiters.middleware("og"))
+	services.subscriptions.registerRoutes(apiGroup, limiters.middleware("subscribe"))
+	services.links.registerRoutes(router, limiters.middleware("links"))
+	services.auth.registerRoutes(apiGroup, limiters.middleware("login"))
+	services.docs.registerRoutes(apiGroup)
+
+	adminGroup := apiGroup.Group("/admin", limiters.middleware("admin"), adminAuthMiddleware(adminToken, services.auth, services.apiKeys))
+
+	services.admin.registerRoutes(adminGroup, services.apiKeys)
+	services.contact.registerAdminRoutes(adminGroup, services.apiKeys)
+	services.emails.registerAdminRoutes(adminGroup)
+	services.ghostHooks.registerAdminRoutes(adminGroup, services.apiKeys)
+	services.analytics.registerAdminRoutes(adminGroup, services.apiKeys)
+	services.links.registerAdminRoutes(adminGroup, services.apiKeys)
+	services.comments.registerAdminRoutes(adminGroup)
+	services.subscriptions.registerAdminRoutes(adminGroup)
+
+	services.docs.build(router.Routes())
+}
@@ -0,0 +1,642 @@
+package main
+
+import (
+	"context"
+	"html"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+type searchConfig struct {
+	// The index follows Ghost's webhooks, full reindexes catch anything they missed
+	ReindexInterval time.Duration `yaml:"reindex_interval" env:"SEARCH_REINDEX_INTERVAL" validate:"mindur=1m"`
+}
+
+func defaultSearchConfig() searchConfig {
+	return searchConfig{
+		ReindexInterval: time.Hour * 6,
+	}
+}
+
+type SearchResult struct {
+	Slug         string    `json:"slug"`
+	Title        string    `json:"title"`
+	Excerpt      string    `json:"excerpt"`
+	FeatureImage *string   `json:"feature_image"`
+	PublishedAt  time.Time `json:"published_at"`
+	Tags         []PostTag `json:"tags"`
+	Score        float64   `json:"score"`
+	// Snippet is HTML escaped with the matched words wrapped in <mark>
+	Snippet string `json:"snippet"`
+}
+
+type SearchResults struct {
+	Query   string         `json:"query"`
+	Total   int            `json:"total"`
+	Results []SearchResult `json:"results"`
+}
+
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+
+	// Completions of the word being typed count for less than the words already finished
+	searchPrefixWeight     = 0.5
+	searchMaxPrefixMatches = 30
+
+	searchSnippetTokens = 30
+)
+
+// Matches in the title or tags say more about a post than matches in its body
+var searchFieldWeights = struct {
+	title, tags, excerpt, body float64
+}{3, 2, 1.5, 1}
+
+type searchDocument struct {
+	post   Post
+	text   string
+	terms  map[string]float64
+	words  []string
+	length float64
+}
+
+func newSearchDocument(post Post) *searchDocument {
+	document := &searchDocument{
+		post:  post,
+		text:  htmlPlainText(post.HTML),
+		terms: make(map[string]float64),
+	}
+
+	// The HTML is only needed for its text
+	document.post.HTML = ""
+
+	var tagNames []string
+
+	for _, tag := range post.Tags {
+		tagNames = append(tagNames, tag.Name)
+	}
+
+	seenWords := make(map[string]bool)
+
+	for _, field := range []struct {
+		text   string
+		weight float64
+	}{
+		{post.Title, searchFieldWeights.title},
+		{strings.Join(tagNames, " "), searchFieldWeights.tags},
+		{postSummary(post), searchFieldWeights.excerpt},
+		{document.text, searchFieldWeights.body},
+	} {
+		for _, token := range tokenizeSearchText(field.text) {
+			document.terms[token.term] += field.weight
+			document.length += field.weight
+
+			if !seenWords[token.word] {
+				seenWords[token.word] = true
+				document.words = append(document.words, token.word)
+			}
+		}
+	}
+
+	return document
+}
+
+// searchIndex is an inverted index of posts ranked with BM25
+type searchIndex struct {
+	documents   map[string]*searchDocument
+	mutex       *sync.RWMutex
+	postings    map[string]map[string]float64
+	slugs       map[string]string
+	totalLength float64
+	// version changes with every document added or removed, related posts are
+	// recomputed for the version they were asked for
+	version      uint64
+	related      *relatedPosts
+	relatedMutex *sync.Mutex
+	// Every distinct word with the number of posts using it, for completions
+	words    map[string]int
+	wordList []string
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		documents:    make(map[string]*searchDocument),
+		mutex:        &sync.RWMutex{},
+		postings:     make(map[string]map[string]float64),
+		relatedMutex: &sync.Mutex{},
+		slugs:        make(map[string]string),
+		words:        make(map[string]int),
+	}
+}
+
+func (si *searchIndex) addLocked(document *searchDocument) {
+	postID := document.post.ID
+
+	si.removeLocked(postID)
+
+	si.version++
+	si.documents[postID] = document
+	si.slugs[document.post.Slug] = postID
+	si.totalLength += document.length
+
+	for term, frequency := range document.terms {
+		if si.postings[term] == nil {
+			si.postings[term] = make(map[string]float64)
+		}
+
+		si.postings[term][postID] = frequency
+	}
+
+	for _, word := range document.words {
+		si.words[word]++
+	}
+}
+
+func (si *searchIndex) removeLocked(postID string) {
+	document, ok := si.documents[postID]
+
+	if !ok {
+		return
+	}
+
+	si.version++
+
+	delete(si.documents, postID)
+
+	if si.slugs[document.post.Slug] == postID {
+		delete(si.slugs, document.post.Slug)
+	}
+
+	si.totalLength -= document.length
+
+	for term := range document.terms {
+		delete(si.postings[term], postID)
+
+		if len(si.postings[term]) == 0 {
+			delete(si.postings, term)
+		}
+	}
+
+	for _, word := range document.words {
+		if si.words[word]--; si.words[word] <= 0 {
+			delete(si.words, word)
+		}
+	}
+}
+
+func (si *searchIndex) sortWordsLocked() {
+	si.wordList = make([]string, 0, len(si.words))
+
+	for word := range si.words {
+		si.wordList = append(si.wordList, word)
+	}
+
+	sort.Strings(si.wordList)
+}
+
+// replace swaps the whole index for the given posts
+func (si *searchIndex) replace(posts []Post) {
+	documents := make([]*searchDocument, 0, len(posts))
+
+	for _, post := range posts {
+		documents = append(documents, newSearchDocument(post))
+	}
+
+	si.mutex.Lock()
+	defer si.mutex.Unlock()
+
+	si.documents = make(map[string]*searchDocument)
+	si.postings = make(map[string]map[string]float64)
+	si.slugs = make(map[string]string)
+	si.totalLength = 0
+	si.version++
+	si.words = make(map[string]int)
+
+	for _, document := range documents {
+		si.addLocked(document)
+	}
+
+	si.sortWordsLocked()
+}
+
+// upsert indexes a post, replacing its previous version even if its slug changed
+func (si *searchIndex) upsert(post Post) {
+	document := newSearchDocument(post)
+
+	si.mutex.Lock()
+	defer si.mutex.Unlock()
+
+	si.addLocked(document)
+	si.sortWordsLocked()
+}
+
+func (si *searchIndex) removeSlug(slug string) bool {
+	si.mutex.Lock()
+	defer si.mutex.Unlock()
+
+	postID, ok := si.slugs[slug]
+
+	if !ok {
+		return false
+	}
+
+	si.removeLocked(postID)
+	si.sortWordsLocked()
+
+	return true
+}
+
+// wordsWithPrefixLocked returns the indexed words starting with prefix, most used first
+func (si *searchIndex) wordsWithPrefixLocked(prefix string, limit int) []string {
+	start := sort.SearchStrings(si.wordList, prefix)
+
+	var words []string
+
+	for index := start; index < len(si.wordList) && strings.HasPrefix(si.wordList[index], prefix); index++ {
+		words = append(words, si.wordList[index])
+	}
+
+	sort.SliceStable(words, func(i, j int) bool {
+		return si.words[words[i]] > si.words[words[j]]
+	})
+
+	if len(words) > limit {
+		words = words[:limit]
+	}
+
+	return words
+}
+
+// queryTermsLocked weighs the stems to look for, when the query doesn't end in a space its
+// last word is still being typed so words it is a prefix of count as well
+func (si *searchIndex) queryTermsLocked(query string) map[string]float64 {
+	tokens := tokenizeSearchText(query)
+	terms := make(map[string]float64)
+
+	for _, token := range tokens {
+		terms[token.term] = 1
+	}
+
+	lastRune, _ := utf8.DecodeLastRuneInString(query)
+
+	if len(tokens) == 0 || !isSearchWordRune(lastRune) {
+		return terms
+	}
+
+	for _, word := range si.wordsWithPrefixLocked(tokens[len(tokens)-1].word, searchMaxPrefixMatches) {
+		term := stemSearchWord(word)
+
+		if _, ok := terms[term]; !ok {
+			terms[term] = searchPrefixWeight
+		}
+	}
+
+	return terms
+}
+
+type searchScore struct {
+	postID string
+	score  float64
+}
+
+// search ranks the posts matching query, returning how many matched and the best of them
+func (si *searchIndex) search(query string, limit int) (int, []SearchResult) {
+	si.mutex.RLock()
+	defer si.mutex.RUnlock()
+
+	terms := si.queryTermsLocked(query)
+	documentCount := float64(len(si.documents))
+
+	if len(terms) == 0 || documentCount == 0 {
+		return 0, []SearchResult{}
+	}
+
+	averageLength := si.totalLength / documentCount
+	scores := make(map[string]float64)
+
+	for term, weight := range terms {
+		postings := si.postings[term]
+		documentFrequency := float64(len(postings))
+		idf := math.Log(1 + (documentCount-documentFrequency+0.5)/(documentFrequency+0.5))
+
+		for postID, frequency := range postings {
+			length := si.documents[postID].length
+
+			scores[postID] += weight * idf * frequency * (bm25K1 + 1) / (frequency + bm25K1*(1-bm25B+bm25B*length/averageLength))
+		}
+	}
+
+	ranked := make([]searchScore, 0, len(scores))
+
+	for postID, score := range scores {
+		ranked = append(ranked, searchScore{postID: postID, score: score})
+	}
+
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].score != ranked[j].score {
+			return ranked[i].score > ranked[j].score
+		}
+
+		return si.documents[ranked[i].postID].post.PublishedAt.After(si.documents[ranked[j].postID].post.PublishedAt)
+	})
+
+	if len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+
+	results := make([]SearchResult, 0, len(ranked))
+
+	for _, match := range ranked {
+		document := si.documents[match.postID]
+
+		results = append(results, SearchResult{
+			Slug:         document.post.Slug,
+			Title:        document.post.Title,
+			Excerpt:      postSummary(document.post),
+			FeatureImage: document.post.FeatureImage,
+			PublishedAt:  document.post.PublishedAt,
+			Tags:         document.post.Tags,
+			Score:        math.Round(match.score*1000) / 1000,
+			Snippet:      highlightSnippet(document.text, terms),
+		})
+	}
+
+	return len(scores), results
+}
+
+// suggest completes the word being typed from the words in the posts
+func (si *searchIndex) suggest(prefix string, limit int) []string {
+	tokens := tokenizeSearchText(prefix)
+
+	if len(tokens) == 0 {
+		return []string{}
+	}
+
+	si.mutex.RLock()
+	defer si.mutex.RUnlock()
+
+	words := si.wordsWithPrefixLocked(tokens[len(tokens)-1].word, limit)
+
+	if words == nil {
+		return []string{}
+	}
+
+	return words
+}
+
+// highlightSnippet picks the part of text with the most matches and marks them
+func highlightSnippet(text string, terms map[string]float64) string {
+	tokens := tokenizeSearchText(text)
+
+	if len(tokens) == 0 {
+		return ""
+	}
+
+	bestStart, bestMatches := 0, 0
+
+	for start := range tokens {
+		matches := 0
+
+		for index := start; index < len(tokens) && index < start+searchSnippetTokens; index++ {
+			if _, ok := terms[tokens[index].term]; ok {
+				matches++
+			}
+		}
+
+		if matches > bestMatches {
+			bestStart, bestMatches = start, matches
+		}
+	}
+
+	// Lead in with a few words of context before the first match
+	if bestStart -= 3; bestStart < 0 {
+		bestStart = 0
+	}
+
+	end := bestStart + searchSnippetTokens
+
+	if end > len(tokens) {
+		end = len(tokens)
+	}
+
+	var snippet strings.Builder
+
+	position := tokens[bestStart].start
+
+	if position > 0 {
+		snippet.WriteString("…")
+	}
+
+	for _, token := range tokens[bestStart:end] {
+		if _, ok := terms[token.term]; !ok {
+			continue
+		}
+
+		snippet.WriteString(html.EscapeString(text[position:token.start]))
+		snippet.WriteString("<mark>" + html.EscapeString(text[token.start:token.end]) + "</mark>")
+
+		position = token.end
+	}
+
+	snippet.WriteString(html.EscapeString(text[position:tokens[end-1].end]))
+
+	if tokens[end-1].end < len(text) {
+		snippet.WriteString("…")
+	}
+
+	return snippet.String()
+}
+
+type searchUpdate struct {
+	requestID string
+	slug      string
+	remove    bool
+}
+
+// postSearch keeps the index in step with Ghost, applying webhook updates one post
+// at a time and rebuilding it from scratch on an interval
+type postSearch struct {
+	client   *ghostClient
+	done     chan struct{}
+	index    *searchIndex
+	rebuild  chan struct{}
+	stop     chan struct{}
+	stopOnce *sync.Once
+	updates  chan searchUpdate
+}
+
+func newPostSearch(client *ghostClient) *postSearch {
+	return &postSearch{
+		client:   client,
+		done:     make(chan struct{}),
+		index:    newSearchIndex(),
+		rebuild:  make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		stopOnce: &sync.Once{},
+		updates:  make(chan searchUpdate, 64),
+	}
+}
+
+var searchLog = newLogger("search")
+
+// queueUpdate reindexes the post, falling back to a full reindex when updates are backed up
+func (ps *postSearch) queueUpdate(ctx context.Context, slug string, remove bool) {
+	select {
+	case ps.updates <- searchUpdate{requestID: requestIDFromContext(ctx), slug: slug, remove: remove}:
+	default:
+		ps.rebuildSoon()
+	}
+}
+
+func (ps *postSearch) rebuildSoon() {
+	select {
+	case ps.rebuild <- struct{}{}:
+	default:
+	}
+}
+
+func (ps *postSearch) reindex(ctx context.Context) error {
+	posts, err := ps.client.allPosts(ctx)
+
+	if err != nil {
+		searchLog.error(ctx, "could not reindex posts", logFields{"error": err})
+
+		return err
+	}
+
+	ps.index.replace(posts)
+
+	searchLog.info(ctx, "reindexed posts", logFields{"posts": len(posts)})
+
+	return nil
+}
+
+func (ps *postSearch) apply(ctx context.Context, update searchUpdate) {
+	if !update.remove {
+		post, err := ps.client.readPost(ctx, update.slug)
+
+		if err == nil {
+			ps.index.upsert(*post)
+
+			searchLog.info(ctx, "indexed post", logFields{"slug": update.slug})
+
+			return
+		}
+
+		if err != errGhostNotFound {
+			searchLog.error(ctx, "could not index post", logFields{"slug": update.slug, "error": err})
+
+			return
+		}
+	}
+
+	if ps.index.removeSlug(update.slug) {
+		searchLog.info(ctx, "removed post from the index", logFields{"slug": update.slug})
+	}
+}
+
+// run keeps the index up to date until the search is closed
+func (ps *postSearch) run(interval time.Duration) {
+	defer close(ps.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// A failed reindex is retried sooner than the interval, the index may still be empty
+	var retry <-chan time.Time
+
+	reindex := func() {
+		retry = nil
+
+		if ps.reindex(contextWithRequestID(context.Background(), "search-"+newRequestID())) != nil {
+			retry = time.After(ghostRetryDelay)
+		}
+	}
+
+	reindex()
+
+	for {
+		select {
+		case <-ticker.C:
+			reindex()
+		case <-ps.rebuild:
+			reindex()
+		case <-retry:
+			reindex()
+		case update := <-ps.updates:
+			ps.apply(contextWithRequestID(context.Background(), update.requestID), update)
+		case <-ps.stop:
+			return
+		}
+	}
+}
+
+func (ps *postSearch) close(ctx context.Context) error {
+	ps.stopOnce.Do(func() {
+		close(ps.stop)
+	})
+
+	select {
+	case <-ps.done:
+	case <-ctx.Done():
+		searchLog.warn(ctx, "timed out waiting for the search indexer to stop", nil)
+	}
+
+	return nil
+}
+
+func (ps *postSearch) registerRoutes(apiGroup *gin.RouterGroup) {
+	apiGroup.GET("/search", ps.handleSearch)
+	apiGroup.GET("/search/suggest", ps.handleSuggest)
+	apiGroup.GET("/posts/:slug/related", ps.handleRelated)
+}
+
+type searchQuery struct {
+	Query string `form:"q" json:"q" binding:"required,max=200"`
+	Limit int    `form:"limit" json:"limit" binding:"omitempty,min=1,max=50"`
+}
+
+func (ps *postSearch) handleSearch(c *gin.Context) {
+	var request searchQuery
+
+	if err := c.ShouldBindQuery(&request); err != nil {
+		abortWithError(c, http.StatusBadRequest, bindingErrorMessage(err))
+
+		return
+	}
+
+	if request.Limit == 0 {
+		request.Limit = 10
+	}
+
+	total, results := ps.index.search(request.Query, request.Limit)
+
+	respondWithData(c, SearchResults{
+		Query:   request.Query,
+		Total:   total,
+		Results: results,
+	})
+}
+
+func (ps *postSearch) handleSuggest(c *gin.Context) {
+	var request searchQuery
+
+	if err := c.ShouldBindQuery(&request); err != nil {
+		abortWithError(c, http.StatusBadRequest, bindingErrorMessage(err))
+
+		return
+	}
+
+	if request.Limit == 0 {
+		request.Limit = 8
+	}
+
+	respondWithData(c, ps.index.suggest(request.Query, request.Limit))
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/antchfx/htmlquery"
+	"golang.org/x/net/html"
+)
+
+// searchToken is a word as it appears in text, start and end are byte offsets
+type searchToken struct {
+	word  string
+	term  string
+	start int
+	end   int
+}
+
+var searchStopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true,
+	"but": true, "by": true, "for": true, "if": true, "in": true, "into": true, "is": true,
+	"it": true, "its": true, "of": true, "on": true, "or": true, "so": true, "such": true,
+	"that": true, "the": true, "their": true, "then": true, "there": true, "these": true,
+	"they": true, "this": true, "to": true, "was": true, "were": true, "will": true,
+	"with": true, "i": true, "you": true, "we": true, "my": true, "our": true,
+}
+
+func isSearchWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// tokenizeSearchText splits text into lowercase words with their stems, stop words
+// are kept out so they neither match nor count towards a document's length
+func tokenizeSearchText(text string) []searchToken {
+	var tokens []searchToken
+
+	start := -1
+
+	for index := 0; index <= len(text); {
+		r, size := utf8.RuneError, 1
+
+		if index < len(text) {
+			r, size = utf8.DecodeRuneInString(text[index:])
+		}
+
+		// Apostrophes inside words are dropped rather than splitting them, "don't" is "dont"
+		inWord := index < len(text) && (isSearchWordRune(r) || (r == '\'' && start != -1))
+
+		if inWord && start == -1 {
+			start = index
+		}
+
+		if !inWord && start != -1 {
+			word := strings.ToLower(strings.Replace(text[start:index], "'", "", -1))
+
+			if len(word) <= 40 && !searchStopWords[word] {
+				tokens = append(tokens, searchToken{
+					word:  word,
+					term:  stemSearchWord(word),
+					start: start,
+					end:   index,
+				})
+			}
+
+			start = -1
+		}
+
+		index += size
+	}
+
+	return tokens
+}
+
+func isConsonant(word string, index int) bool {
+	switch word[index] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		return index == 0 || !isConsonant(word, index-1)
+	}
+
+	return true
+}
+
+// stemMeasure counts the vowel-consonant sequences in word, Porter's m
+func stemMeasure(word string) int {
+	measure := 0
+	sawVowel := false
+
+	for index := range word {
+		if !isConsonant(word, index) {
+			sawVowel = true
+		} else if sawVowel {
+			measure++
+			sawVowel = false
+		}
+	}
+
+	return measure
+}
+
+func stemHasVowel(word string) bool {
+	for index := range word {
+		if !isConsonant(word, index) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func stemEndsDoubleConsonant(word string) bool {
+	length := len(word)
+
+	return length >= 2 && word[length-1] == word[length-2] && isConsonant(word, length-1)
+}
+
+// stemEndsCVC is Porter's *o, consonant-vowel-consonant where the last isn't w, x or y
+func stemEndsCVC(word string) bool {
+	length := len(word)
+
+	if length < 3 || !isConsonant(word, length-1) || isConsonant(word, length-2) || !isConsonant(word, length-3) {
+		return false
+	}
+
+	switch word[length-1] {
+	case 'w', 'x', 'y':
+		return false
+	}
+
+	return true
+}
+
+// stemSearchWord applies the first step of the Porter stemmer, folding plurals and
+// -ed/-ing forms together, which covers most of what readers search for
+func stemSearchWord(word string) string {
+	if len(word) <= 2 {
+		return word
+	}
+
+	for _, r := range word {
+		if r > unicode.MaxASCII || unicode.IsDigit(r) {
+			return word
+		}
+	}
+
+	// Step 1a
+	switch {
+	case strings.HasSuffix(word, "sses"):
+		word = word[:len(word)-2]
+	case strings.HasSuffix(word, "ies"):
+		word = word[:len(word)-2]
+	case strings.HasSuffix(word, "ss"):
+	case strings.HasSuffix(word, "s"):
+		word = word[:len(word)-1]
+	}
+
+	// Step 1b
+	trimmed := ""
+
+	switch {
+	case strings.HasSuffix(word, "eed"):
+		if stemMeasure(word[:len(word)-3]) > 0 {
+			word = word[:len(word)-1]
+		}
+	case strings.HasSuffix(word, "ed") && stemHasVowel(word[:len(word)-2]):
+		trimmed = word[:len(word)-2]
+	case strings.HasSuffix(word, "ing") && stemHasVowel(word[:len(word)-3]):
+		trimmed = word[:len(word)-3]
+	}
+
+	if trimmed != "" {
+		word = trimmed
+
+		switch {
+		case strings.HasSuffix(word, "at"), strings.HasSuffix(word, "bl"), strings.HasSuffix(word, "iz"):
+			word += "e"
+		case stemEndsDoubleConsonant(word) && !strings.HasSuffix(word, "l") && !strings.HasSuffix(word, "s") && !strings.HasSuffix(word, "z"):
+			word = word[:len(word)-1]
+		case stemMeasure(word) == 1 && stemEndsCVC(word):
+			word += "e"
+		}
+	}
+
+	// Step 1c
+	if strings.HasSuffix(word, "y") && stemHasVowel(word[:len(word)-1]) {
+		word = word[:len(word)-1] + "i"
+	}
+
+	return word
+}
+
+var searchSkippedElements = map[string]bool{
+	"script":   true,
+	"style":    true,
+	"noscript": true,
+	"iframe":   true,
+	"svg":      true,
+}
+
+// htmlPlainText extracts the readable text from post HTML, elements are separated
+// by spaces so words in adjacent paragraphs don't run together
+func htmlPlainText(postHTML string) string {
+	document, err := htmlquery.Parse(strings.NewReader(postHTML))
+
+	if err != nil {
+		return ""
+	}
+
+	var text strings.Builder
+
+	var walk func(node *html.Node)
+
+	walk = func(node *html.Node) {
+		switch node.Type {
+		case html.TextNode:
+			text.WriteString(node.Data)
+
+			return
+		case html.ElementNode:
+			if searchSkippedElements[node.Data] {
+				return
+			}
+
+			text.WriteByte(' ')
+		}
+
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+
+	walk(document)
+
+	return strings.Join(strings.Fields(text.String()), " ")
+}
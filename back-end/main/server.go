@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+type serverConfig struct {
+	Addr              string        `yaml:"addr" env:"LISTEN_ADDR" validate:"hostname_port"`
+	ReadTimeout       time.Duration `yaml:"read_timeout" env:"READ_TIMEOUT" validate:"mindur=1s"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout" env:"READ_HEADER_TIMEOUT" validate:"mindur=1s"`
+	WriteTimeout      time.Duration `yaml:"write_timeout" env:"WRITE_TIMEOUT" validate:"mindur=1s"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout" env:"IDLE_TIMEOUT" validate:"mindur=1s"`
+	MaxHeaderBytes    int           `yaml:"max_header_bytes" env:"MAX_HEADER_BYTES" validate:"min=1024"`
+	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" validate:"mindur=1s"`
+	TrustedProxies    []string      `yaml:"trusted_proxies" env:"TRUSTED_PROXIES" validate:"dive,cidr"`
+}
+
+func defaultServerConfig() serverConfig {
+	return serverConfig{
+		Addr:              ":80",
+		ReadTimeout:       time.Second * 15,
+		ReadHeaderTimeout: time.Second * 5,
+		WriteTimeout:      time.Second * 30,
+		IdleTimeout:       time.Minute * 2,
+		MaxHeaderBytes:    1 << 16,
+		ShutdownTimeout:   time.Second * 20,
+		TrustedProxies:    []string{"127.0.0.0/8", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "::1/128", "fc00::/7"},
+	}
+}
+
+func newHTTPServer(config serverConfig, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              config.Addr,
+		Handler:           handler,
+		ReadTimeout:       config.ReadTimeout,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+		MaxHeaderBytes:    config.MaxHeaderBytes,
+	}
+}
+
+var serverShutdownLog = newLogger("server")
+
+// shutdownHook is ran after the server has stopped accepting connections,
+// hooks are given whatever is left of the shutdown timeout
+type shutdownHook func(ctx context.Context) error
+
+// runServer serves until the listener fails or a SIGINT/SIGTERM is received, at
+// which point in-flight requests are drained and the hooks are ran in order. The
+// hooks run when the listener fails too, so background work is still flushed.
+func runServer(server *http.Server, shutdownTimeout time.Duration, hooks ...shutdownHook) error {
+	serverErr := make(chan error, 1)
+
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	signals := make(chan os.Signal, 1)
+
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	var shutdownErr error
+
+	select {
+	case shutdownErr = <-serverErr:
+		if shutdownErr == http.ErrServerClosed {
+			shutdownErr = nil
+		}
+
+		serverShutdownLog.info(context.Background(), "listener stopped, shutting down", nil)
+	case sig := <-signals:
+		serverShutdownLog.info(context.Background(), "shutting down", logFields{"signal": sig.String()})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); shutdownErr == nil {
+		shutdownErr = err
+	}
+
+	for _, hook := range hooks {
+		if err := hook(ctx); err != nil {
+			serverShutdownLog.error(ctx, "shutdown hook failed", logFields{"error": err})
+
+			if shutdownErr == nil {
+				shutdownErr = err
+			}
+		}
+	}
+
+	return shutdownErr
+}
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image/png"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// Clicks without a Referer, typed in or from an app
+	shortLinkDirectReferrer = "direct"
+	// Referrers past this many per link are counted together, Referer is easily forged
+	shortLinkMaxReferrers  = 100
+	shortLinkOtherReferrer = "other"
+
+	shortLinkMaxSlugLength = 64
+	shortLinkDefaultScale  = 8
+	shortLinkMaxScale      = 20
+)
+
+type shortLink struct {
+	Slug string `json:"slug"`
+	URL  string `json:"url"`
+	// Permanent links redirect with 301, browsers cache those so repeat clicks aren't counted
+	Permanent bool       `json:"permanent"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+func (sl *shortLink) expired(now time.Time) bool {
+	return sl.ExpiresAt != nil && !now.Before(*sl.ExpiresAt)
+}
+
+type shortLinkClicks struct {
+	Clicks        int            `json:"clicks"`
+	LastClickedAt *time.Time     `json:"last_clicked_at"`
+	Referrers     map[string]int `json:"referrers"`
+}
+
+// ShortLink is a link with how often it was followed and from where
+type ShortLink struct {
+	shortLink
+	shortLinkClicks
+}
+
+var (
+	errShortLinkNotFound = errors.New("link not found")
+	errShortLinkExists   = errors.New("a link with that slug already exists")
+)
+
+// shortLinks redirects /go/<slug> to the links managed through the admin API. Links
+// are saved as they change, clicks are kept in memory and saved every so often.
+type shortLinks struct {
+	audit       *auditLog
+	clicks      map[string]*shortLinkClicks
+	clicksDirty bool
+	clicksPath  string
+	done        chan struct{}
+	links       map[string]*shortLink
+	linksPath   string
+	mutex       *sync.Mutex
+	site        func() siteConfig
+	stop        chan struct{}
+	stopOnce    *sync.Once
+}
+
+var shortLinksLog = newLogger("links")
+
+func newShortLinks(directory string, audit *auditLog, site func() siteConfig) (*shortLinks, error) {
+	sl := &shortLinks{
+		audit:      audit,
+		clicks:     make(map[string]*shortLinkClicks),
+		clicksPath: filepath.Join(directory, "clicks.json"),
+		done:       make(chan struct{}),
+		links:      make(map[string]*shortLink),
+		linksPath:  filepath.Join(directory, "links.json"),
+		mutex:      &sync.Mutex{},
+		site:       site,
+		stop:       make(chan struct{}),
+		stopOnce:   &sync.Once{},
+	}
+
+	if err := readJSONFile(sl.linksPath, &sl.links); err != nil {
+		return nil, err
+	}
+
+	if err := readJSONFile(sl.clicksPath, &sl.clicks); err != nil {
+		return nil, err
+	}
+
+	return sl, nil
+}
+
+// update lets modify change the links and saves them, modify must leave the links
+// untouched when it fails
+func (sl *shortLinks) update(modify func(links map[string]*shortLink) error) error {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+
+	if err := modify(sl.links); err != nil {
+		return err
+	}
+
+	if err := writeJSONFile(sl.linksPath, sl.links); err != nil {
+		// The links last saved are served rather than ones that would be lost on restart
+		links := make(map[string]*shortLink)
+
+		if readErr := readJSONFile(sl.linksPath, &links); readErr == nil {
+			sl.links = links
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+func (sl *shortLinks) withClicksLocked(link *shortLink) ShortLink {
+	withClicks := ShortLink{shortLink: *link}
+
+	if clicks, ok := sl.clicks[link.Slug]; ok {
+		withClicks.shortLinkClicks = *clicks
+	}
+
+	if withClicks.Referrers == nil {
+		withClicks.Referrers = map[string]int{}
+	}
+
+	return withClicks
+}
+
+func (sl *shortLinks) get(slug string) (ShortLink, error) {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+
+	link, ok := sl.links[slug]
+
+	if !ok {
+		return ShortLink{}, errShortLinkNotFound
+	}
+
+	return sl.withClicksLocked(link), nil
+}
+
+// list returns every link ordered by slug
+func (sl *shortLinks) list() []ShortLink {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+
+	listed := make([]ShortLink, 0, len(sl.links))
+
+	for _, link := range sl.links {
+		listed = append(listed, sl.withClicksLocked(link))
+	}
+
+	sort.Slice(listed, func(i, j int) bool {
+		return listed[i].Slug < listed[j].Slug
+	})
+
+	return listed
+}
+
+func (sl *shortLinks) recordClick(slug, referrer string, now time.Time) {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+
+	clicks, ok := sl.clicks[slug]
+
+	if !ok {
+		clicks = &shortLinkClicks{Referrers: make(map[string]int)}
+
+		sl.clicks[slug] = clicks
+	}
+
+	if referrer == "" {
+		referrer = shortLinkDirectReferrer
+	}
+
+	if _, seen := clicks.Referrers[referrer]; !seen && len(clicks.Referrers) >= shortLinkMaxReferrers {
+		referrer = shortLinkOtherReferrer
+	}
+
+	clickedAt := now.UTC()
+
+	clicks.Clicks++
+	clicks.LastClickedAt = &clickedAt
+	clicks.Referrers[referrer]++
+
+	sl.clicksDirty = true
+}
+
+// saveClicks writes the clicks counted since they were last saved
+func (sl *shortLinks) saveClicks() error {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+
+	if !sl.clicksDirty {
+		return nil
+	}
+
+	if err := writeJSONFile(sl.clicksPath, sl.clicks); err != nil {
+		return err
+	}
+
+	sl.clicksDirty = false
+
+	return nil
+}
+
+// run saves clicks every interval until the links are closed
+func (sl *shortLinks) run(interval time.Duration) {
+	defer close(sl.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := sl.saveClicks(); err != nil {
+				ctx := contextWithRequestID(context.Background(), "links-"+newRequestID())
+
+				shortLinksLog.error(ctx, "could not save link clicks", logFields{"error": err})
+			}
+		case <-sl.stop:
+			return
+		}
+	}
+}
+
+func (sl *shortLinks) close(ctx context.Context) error {
+	sl.stopOnce.Do(func() {
+		close(sl.stop)
+	})
+
+	select {
+	case <-sl.done:
+	case <-ctx.Done():
+		shortLinksLog.warn(ctx, "timed out waiting for the link click saver to stop", nil)
+	}
+
+	return sl.saveClicks()
+}
+
+// registerRoutes serves the links from the site root, /go/<slug> is what gets shared
+func (sl *shortLinks) registerRoutes(router gin.IRoutes, limiter gin.HandlerFunc) {
+	router.GET("/go/:slug", limiter, sl.follow)
+	router.GET("/go/:slug/qr.png", limiter, sl.serveQRCode)
+}
+
+func (sl *shortLinks) registerAdminRoutes(adminGroup *gin.RouterGroup, keys *apiKeyRoutes) {
+	keys.scoped(adminGroup, http.MethodGet, "/links", scopeLinksRead, sl.listLinks)
+	keys.scoped(adminGroup, http.MethodPost, "/links", scopeLinksWrite, sl.createLink)
+	keys.scoped(adminGroup, http.MethodGet, "/links/:slug", scopeLinksRead, sl.readLink)
+	keys.scoped(adminGroup, http.MethodPut, "/links/:slug", scopeLinksWrite, sl.updateLink)
+	keys.scoped(adminGroup, http.MethodDelete, "/links/:slug", scopeLinksWrite, sl.deleteLink)
+}
+
+func (sl *shortLinks) follow(c *gin.Context) {
+	now := time.Now()
+
+	target, err := sl.get(c.Param("slug"))
+
+	if err != nil {
+		c.String(http.StatusNotFound, "link not found")
+
+		return
+	}
+
+	if target.expired(now) {
+		c.String(http.StatusGone, "link expired")
+
+		return
+	}
+
+	// Link previews and crawlers following the link aren't clicks
+	if userAgent := c.Request.UserAgent(); userAgent != "" && !analyticsBotPattern.MatchString(userAgent) {
+		sl.recordClick(target.Slug, referrerHost(c.GetHeader("Referer")), now)
+	}
+
+	status := http.StatusFound
+
+	if target.Permanent {
+		status = http.StatusMovedPermanently
+	} else {
+		c.Header("Cache-Control", "no-store")
+	}
+
+	c.Redirect(status, target.URL)
+}
+
+// serveQRCode draws a QR code of the link's /go/ URL, scale is pixels per module
+func (sl *shortLinks) serveQRCode(c *gin.Context) {
+	slug := c.Param("slug")
+
+	if _, err := sl.get(slug); err != nil {
+		c.String(http.StatusNotFound, "link not found")
+
+		return
+	}
+
+	scale := shortLinkDefaultScale
+
+	if requested := c.Query("scale"); requested != "" {
+		parsed, err := strconv.Atoi(requested)
+
+		if err != nil || parsed < 1 || parsed > shortLinkMaxScale {
+			c.String(http.StatusBadRequest, "scale must be from 1 to %d", shortLinkMaxScale)
+
+			return
+		}
+
+		scale = parsed
+	}
+
+	qr, err := encodeQR([]byte(sl.site().absoluteURL("/go/" + slug)))
+
+	if err != nil {
+		c.String(http.StatusInternalServerError, "could not encode QR code")
+
+		return
+	}
+
+	var image bytes.Buffer
+
+	if err = png.Encode(&image, qr.image(scale)); err != nil {
+		shortLinksLog.error(c.Request.Context(), "could not encode QR code", logFields{"error": err})
+
+		c.String(http.StatusInternalServerError, "could not encode QR code")
+
+		return
+	}
+
+	c.Header("Cache-Control", "public, max-age=86400")
+	c.Data(http.StatusOK, "image/png", image.Bytes())
+}
+
+func (sl *shortLinks) listLinks(c *gin.Context) {
+	respondWithData(c, sl.list())
+}
+
+func (sl *shortLinks) readLink(c *gin.Context) {
+	link, err := sl.get(c.Param("slug"))
+
+	if err != nil {
+		abortWithError(c, http.StatusNotFound, err.Error())
+
+		return
+	}
+
+	respondWithData(c, link)
+}
+
+type shortLinkRequest struct {
+	URL       string     `json:"url" binding:"required,url,max=2000"`
+	Permanent bool       `json:"permanent"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type createShortLinkRequest struct {
+	Slug string `json:"slug" binding:"required"`
+	shortLinkRequest
+}
+
+// validate returns why the request can't be saved, or an empty string if it can
+func (slr *shortLinkRequest) validate(now time.Time) string {
+	target, err := url.Parse(slr.URL)
+
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") {
+		return "url must be an http or https URL"
+	}
+
+	if slr.ExpiresAt != nil && !slr.ExpiresAt.After(now) {
+		return "expires_at must be in the future"
+	}
+
+	return ""
+}
+
+func (sl *shortLinks) createLink(c *gin.Context) {
+	var request createShortLinkRequest
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		abortWithError(c, http.StatusBadRequest, bindingErrorMessage(err))
+
+		return
+	}
+
+	now := time.Now().UTC()
+
+	if !validSlug(request.Slug) || len(request.Slug) > shortLinkMaxSlugLength {
+		abortWithError(c, http.StatusBadRequest, "slugs must be lowercase letters, digits and dashes")
+
+		return
+	}
+
+	if problem := request.validate(now); problem != "" {
+		abortWithError(c, http.StatusBadRequest, problem)
+
+		return
+	}
+
+	link := &shortLink{
+		Slug:      request.Slug,
+		URL:       request.URL,
+		Permanent: request.Permanent,
+		ExpiresAt: request.ExpiresAt,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	err := sl.update(func(links map[string]*shortLink) error {
+		if _, exists := links[link.Slug]; exists {
+			return errShortLinkExists
+		}
+
+		links[link.Slug] = link
+
+		return nil
+	})
+
+	if err == errShortLinkExists {
+		abortWithError(c, http.StatusConflict, err.Error())
+
+		return
+	}
+
+	sl.audit.recordRequest(c, "links.create", link.Slug, gin.H{"url": link.URL}, err)
+
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, "could not save link")
+
+		return
+	}
+
+	respondWithData(c, ShortLink{shortLink: *link, shortLinkClicks: shortLinkClicks{Referrers: map[string]int{}}})
+}
+
+// updateLink changes where a link goes, its clicks are kept
+func (sl *shortLinks) updateLink(c *gin.Context) {
+	var request shortLinkRequest
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		abortWithError(c, http.StatusBadRequest, bindingErrorMessage(err))
+
+		return
+	}
+
+	now := time.Now().UTC()
+
+	if problem := request.validate(now); problem != "" {
+		abortWithError(c, http.StatusBadRequest, problem)
+
+		return
+	}
+
+	slug := c.Param("slug")
+
+	err := sl.update(func(links map[string]*shortLink) error {
+		link, exists := links[slug]
+
+		if !exists {
+			return errShortLinkNotFound
+		}
+
+		link.URL = request.URL
+		link.Permanent = request.Permanent
+		link.ExpiresAt = request.ExpiresAt
+		link.UpdatedAt = now
+
+		return nil
+	})
+
+	if err == errShortLinkNotFound {
+		abortWithError(c, http.StatusNotFound, err.Error())
+
+		return
+	}
+
+	sl.audit.recordRequest(c, "links.update", slug, gin.H{"url": request.URL}, err)
+
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, "could not save link")
+
+		return
+	}
+
+	link, err := sl.get(slug)
+
+	if err != nil {
+		abortWithError(c, http.StatusNotFound, err.Error())
+
+		return
+	}
+
+	respondWithData(c, link)
+}
+
+// deleteLink removes a link along with its clicks
+func (sl *shortLinks) deleteLink(c *gin.Context) {
+	slug := c.Param("slug")
+
+	err := sl.update(func(links map[string]*shortLink) error {
+		if _, exists := links[slug]; !exists {
+			return errShortLinkNotFound
+		}
+
+		delete(links, slug)
+		delete(sl.clicks, slug)
+
+		sl.clicksDirty = true
+
+		return nil
+	})
+
+	if err == errShortLinkNotFound {
+		abortWithError(c, http.StatusNotFound, err.Error())
+
+		return
+	}
+
+	sl.audit.recordRequest(c, "links.delete", slug, nil, err)
+
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, "could not delete link")
+
+		return
+	}
+
+	respondWithData(c, nil)
+}
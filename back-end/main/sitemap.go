@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type sitemapConfig struct {
+	// Next.js pages that aren't generated from Ghost
+	StaticPaths        []string      `yaml:"static_paths" env:"SITEMAP_STATIC_PATHS" validate:"dive,startswith=/" reload:"true"`
+	RegenerateInterval time.Duration `yaml:"regenerate_interval" env:"SITEMAP_REGENERATE_INTERVAL" validate:"mindur=1m"`
+	// Once there are more URLs than this the sitemap is split behind a sitemap index,
+	// the protocol allows at most 50000
+	MaxURLsPerSitemap int      `yaml:"max_urls_per_sitemap" env:"SITEMAP_MAX_URLS" validate:"min=1,max=50000" reload:"true"`
+	RobotsDisallow    []string `yaml:"robots_disallow" env:"ROBOTS_DISALLOW" validate:"dive,startswith=/" reload:"true"`
+}
+
+func defaultSitemapConfig() sitemapConfig {
+	return sitemapConfig{
+		StaticPaths:        []string{"/", "/about", "/contact", "/posts"},
+		RegenerateInterval: time.Hour,
+		MaxURLsPerSitemap:  50000,
+		RobotsDisallow:     []string{"/api/", "/cms/", "/go/"},
+	}
+}
+
+const (
+	sitemapNamespace      = "http://www.sitemaps.org/schemas/sitemap/0.9"
+	sitemapImageNamespace = "http://www.google.com/schemas/sitemap-image/1.1"
+)
+
+type sitemapImage struct {
+	Loc   string `xml:"image:loc"`
+	Title string `xml:"image:title,omitempty"`
+}
+
+type sitemapURL struct {
+	Loc     string         `xml:"loc"`
+	LastMod string         `xml:"lastmod,omitempty"`
+	Images  []sitemapImage `xml:"image:image"`
+}
+
+type sitemapURLSet struct {
+	XMLName        xml.Name     `xml:"urlset"`
+	Namespace      string       `xml:"xmlns,attr"`
+	ImageNamespace string       `xml:"xmlns:image,attr"`
+	URLs           []sitemapURL `xml:"url"`
+}
+
+type sitemapIndexEntry struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+type sitemapIndex struct {
+	XMLName   xml.Name            `xml:"sitemapindex"`
+	Namespace string              `xml:"xmlns,attr"`
+	Sitemaps  []sitemapIndexEntry `xml:"sitemap"`
+}
+
+// sitemapFiles is one generation of the sitemap, pages is empty unless the URLs
+// had to be split behind an index
+type sitemapFiles struct {
+	root        []byte
+	pages       [][]byte
+	generatedAt time.Time
+}
+
+// sitemap regenerates the sitemaps from Ghost on an interval, or sooner when a
+// webhook reports a change, serving the last good generation in between
+type sitemap struct {
+	client     *ghostClient
+	config     func() sitemapConfig
+	files      *sitemapFiles
+	mutex      *sync.RWMutex
+	regenerate chan struct{}
+	site       func() siteConfig
+	stop       chan struct{}
+	done       chan struct{}
+	stopOnce   *sync.Once
+}
+
+func newSitemap(client *ghostClient, site func() siteConfig, config func() sitemapConfig) *sitemap {
+	return &sitemap{
+		client:     client,
+		config:     config,
+		mutex:      &sync.RWMutex{},
+		regenerate: make(chan struct{}, 1),
+		site:       site,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+		stopOnce:   &sync.Once{},
+	}
+}
+
+var sitemapLog = newLogger("sitemap")
+
+func sitemapDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.UTC().Format(time.RFC3339)
+}
+
+func marshalXMLDocument(document interface{}) ([]byte, error) {
+	encoded, err := xml.MarshalIndent(document, "", "  ")
+
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(xml.Header), encoded...), nil
+}
+
+// build renders the sitemaps for the static pages and the posts
+func (sm *sitemap) build(posts []Post, now time.Time) (*sitemapFiles, error) {
+	config := sm.config()
+	site := sm.site()
+
+	urls := make([]sitemapURL, 0, len(config.StaticPaths)+len(posts))
+
+	for _, path := range config.StaticPaths {
+		urls = append(urls, sitemapURL{Loc: site.absoluteURL(path)})
+	}
+
+	for _, post := range posts {
+		if !validSlug(post.Slug) {
+			continue
+		}
+
+		entry := sitemapURL{
+			Loc:     site.absoluteURL("/posts/" + post.Slug),
+			LastMod: sitemapDate(post.UpdatedAt),
+		}
+
+		if post.FeatureImage != nil && *post.FeatureImage != "" {
+			entry.Images = []sitemapImage{{Loc: *post.FeatureImage, Title: post.Title}}
+		}
+
+		urls = append(urls, entry)
+	}
+
+	files := &sitemapFiles{generatedAt: now}
+
+	if len(urls) <= config.MaxURLsPerSitemap {
+		root, err := marshalXMLDocument(sitemapURLSet{
+			Namespace:      sitemapNamespace,
+			ImageNamespace: sitemapImageNamespace,
+			URLs:           urls,
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		files.root = root
+
+		return files, nil
+	}
+
+	index := sitemapIndex{Namespace: sitemapNamespace}
+
+	for start := 0; start < len(urls); start += config.MaxURLsPerSitemap {
+		end := start + config.MaxURLsPerSitemap
+
+		if end > len(urls) {
+			end = len(urls)
+		}
+
+		page, err := marshalXMLDocument(sitemapURLSet{
+			Namespace:      sitemapNamespace,
+			ImageNamespace: sitemapImageNamespace,
+			URLs:           urls[start:end],
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		files.pages = append(files.pages, page)
+
+		index.Sitemaps = append(index.Sitemaps, sitemapIndexEntry{
+			Loc:     site.absoluteURL("/sitemaps/" + strconv.Itoa(len(files.pages)) + ".xml"),
+			LastMod: sitemapDate(now),
+		})
+	}
+
+	root, err := marshalXMLDocument(index)
+
+	if err != nil {
+		return nil, err
+	}
+
+	files.root = root
+
+	return files, nil
+}
+
+// generate rebuilds the sitemaps, keeping the previous ones if Ghost can't be reached
+func (sm *sitemap) generate(ctx context.Context) error {
+	posts, err := sm.client.allPostSummaries(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	files, err := sm.build(posts, time.Now())
+
+	if err != nil {
+		return err
+	}
+
+	sm.mutex.Lock()
+	sm.files = files
+	sm.mutex.Unlock()
+
+	sitemapLog.info(ctx, "sitemap generated", logFields{
+		"posts":    len(posts),
+		"sitemaps": len(files.pages),
+	})
+
+	return nil
+}
+
+// regenerateSoon queues a regeneration, requests made while one is queued are folded into it
+func (sm *sitemap) regenerateSoon() {
+	select {
+	case sm.regenerate <- struct{}{}:
+	default:
+	}
+}
+
+// run generates the sitemaps until the sitemap is closed
+func (sm *sitemap) run(interval time.Duration) {
+	defer close(sm.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		ctx := contextWithRequestID(context.Background(), "sitemap-"+newRequestID())
+
+		var retry <-chan time.Time
+
+		if err := sm.generate(ctx); err != nil {
+			sitemapLog.error(ctx, "could not generate sitemap", logFields{"error": err})
+
+			retry = time.After(ghostRetryDelay)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-sm.regenerate:
+		case <-retry:
+		case <-sm.stop:
+			return
+		}
+	}
+}
+
+func (sm *sitemap) close(ctx context.Context) error {
+	sm.stopOnce.Do(func() {
+		close(sm.stop)
+	})
+
+	select {
+	case <-sm.done:
+	case <-ctx.Done():
+		sitemapLog.warn(ctx, "timed out waiting for the sitemap generator to stop", nil)
+	}
+
+	return nil
+}
+
+func (sm *sitemap) current() *sitemapFiles {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+
+	return sm.files
+}
+
+// registerRoutes serves from the site root, crawlers only look for these there
+func (sm *sitemap) registerRoutes(router gin.IRoutes, limiter gin.HandlerFunc) {
+	router.GET("/robots.txt", limiter, sm.serveRobots)
+	router.GET("/sitemap.xml", limiter, sm.serveRoot)
+	router.GET("/sitemaps/:page", limiter, sm.servePage)
+}
+
+func (sm *sitemap) serveRobots(c *gin.Context) {
+	var robots bytes.Buffer
+
+	robots.WriteString("User-agent: *\n")
+
+	disallowed := sm.config().RobotsDisallow
+
+	if len(disallowed) == 0 {
+		robots.WriteString("Disallow:\n")
+	}
+
+	for _, path := range disallowed {
+		robots.WriteString("Disallow: " + path + "\n")
+	}
+
+	robots.WriteString("\nSitemap: " + sm.site().absoluteURL("/sitemap.xml") + "\n")
+
+	c.Data(http.StatusOK, "text/plain; charset=utf-8", robots.Bytes())
+}
+
+func (sm *sitemap) serveXML(c *gin.Context, files *sitemapFiles, document []byte) {
+	c.Header("Last-Modified", files.generatedAt.UTC().Format(http.TimeFormat))
+	c.Data(http.StatusOK, "application/xml; charset=utf-8", document)
+}
+
+func (sm *sitemap) serveRoot(c *gin.Context) {
+	files := sm.current()
+
+	if files == nil {
+		c.Header("Retry-After", "60")
+		c.String(http.StatusServiceUnavailable, "sitemap is being generated")
+
+		return
+	}
+
+	sm.serveXML(c, files, files.root)
+}
+
+func (sm *sitemap) servePage(c *gin.Context) {
+	files := sm.current()
+
+	page, err := strconv.Atoi(strings.TrimSuffix(c.Param("page"), ".xml"))
+
+	if files == nil || err != nil || !strings.HasSuffix(c.Param("page"), ".xml") || page < 1 || page > len(files.pages) {
+		c.String(http.StatusNotFound, "sitemap not found")
+
+		return
+	}
+
+	sm.serveXML(c, files, files.pages[page-1])
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// playlistSnapshotStore buffers the latest successfully fetched playlist and
+// persists it to disk when flushed, identical consecutive playlists are only written once
+type playlistSnapshotStore struct {
+	directory   string
+	mutex       *sync.Mutex
+	pending     *Playlist
+	pendingAt   time.Time
+	lastFlushed []byte
+}
+
+func newPlaylistSnapshotStore(directory string) *playlistSnapshotStore {
+	return &playlistSnapshotStore{
+		directory: directory,
+		mutex:     &sync.Mutex{},
+	}
+}
+
+func (pss *playlistSnapshotStore) record(playlist *Playlist) {
+	pss.mutex.Lock()
+	defer pss.mutex.Unlock()
+
+	pss.pending = playlist
+	pss.pendingAt = time.Now()
+}
+
+func (pss *playlistSnapshotStore) flush() error {
+	pss.mutex.Lock()
+	defer pss.mutex.Unlock()
+
+	if pss.pending == nil || pss.directory == "" {
+		return nil
+	}
+
+	playlistBytes, err := json.Marshal(pss.pending)
+
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(playlistBytes, pss.lastFlushed) {
+		pss.pending = nil
+
+		return nil
+	}
+
+	snapshotPath := filepath.Join(pss.directory, fmt.Sprintf("%d.json", pss.pendingAt.UnixNano()))
+
+	if err = writeFileAtomic(snapshotPath, playlistBytes); err != nil {
+		return err
+	}
+
+	pss.lastFlushed = playlistBytes
+	pss.pending = nil
+
+	return nil
+}
+
+type playlistSnapshotInfo struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Size      int64     `json:"size"`
+}
+
+// list returns the snapshots on disk, newest first
+func (pss *playlistSnapshotStore) list() ([]playlistSnapshotInfo, error) {
+	fileInfos, err := ioutil.ReadDir(pss.directory)
+
+	if os.IsNotExist(err) {
+		return []playlistSnapshotInfo{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]playlistSnapshotInfo, 0, len(fileInfos))
+
+	for _, fileInfo := range fileInfos {
+		snapshotID := strings.TrimSuffix(fileInfo.Name(), ".json")
+
+		createdAtNano, err := strconv.ParseInt(snapshotID, 10, 64)
+
+		if fileInfo.IsDir() || !strings.HasSuffix(fileInfo.Name(), ".json") || err != nil {
+			continue
+		}
+
+		snapshots = append(snapshots, playlistSnapshotInfo{
+			ID:        snapshotID,
+			CreatedAt: time.Unix(0, createdAtNano).UTC(),
+			Size:      fileInfo.Size(),
+		})
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].CreatedAt.After(snapshots[j].CreatedAt)
+	})
+
+	return snapshots, nil
+}
+
+var errSnapshotNotFound = errors.New("snapshot not found")
+
+func (pss *playlistSnapshotStore) load(snapshotID string) (*Playlist, error) {
+	if _, err := strconv.ParseInt(snapshotID, 10, 64); err != nil {
+		return nil, errSnapshotNotFound
+	}
+
+	snapshotBytes, err := ioutil.ReadFile(filepath.Join(pss.directory, snapshotID+".json"))
+
+	if os.IsNotExist(err) {
+		return nil, errSnapshotNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var playlist Playlist
+
+	if err = json.Unmarshal(snapshotBytes, &playlist); err != nil {
+		return nil, err
+	}
+
+	return &playlist, nil
+}
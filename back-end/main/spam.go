@@ -0,0 +1,270 @@
+package main
+
+import (
+	"math"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+var (
+	linkPattern = regexp.MustCompile(`(?i)(https?://|www\.)\S+`)
+
+	spamPhrases = []string{
+		"backlinks",
+		"bitcoin",
+		"casino",
+		"click here",
+		"crypto",
+		"dear sir",
+		"first page of google",
+		"guest post",
+		"increase your traffic",
+		"limited time offer",
+		"make money",
+		"seo services",
+		"viagra",
+		"web design services",
+		"work from home",
+	}
+)
+
+// Both classes need this many training messages before the model is consulted
+const minSpamTrainingMessages = 5
+
+type spamVerdict struct {
+	Score   float64  `json:"score"`
+	Reasons []string `json:"reasons"`
+}
+
+// naiveBayesModel counts in how many spam and ham messages each token appeared
+type naiveBayesModel struct {
+	SpamMessages int            `json:"spam_messages"`
+	HamMessages  int            `json:"ham_messages"`
+	SpamTokens   map[string]int `json:"spam_tokens"`
+	HamTokens    map[string]int `json:"ham_tokens"`
+}
+
+// spamScorer combines fixed heuristics with a naive Bayes model trained from the admin API
+type spamScorer struct {
+	modelPath string
+	mutex     *sync.Mutex
+	model     naiveBayesModel
+}
+
+func newSpamScorer(modelPath string) (*spamScorer, error) {
+	ss := &spamScorer{
+		modelPath: modelPath,
+		mutex:     &sync.Mutex{},
+	}
+
+	if err := readJSONFile(modelPath, &ss.model); err != nil {
+		return nil, err
+	}
+
+	if ss.model.SpamTokens == nil {
+		ss.model.SpamTokens = make(map[string]int)
+	}
+
+	if ss.model.HamTokens == nil {
+		ss.model.HamTokens = make(map[string]int)
+	}
+
+	return ss, nil
+}
+
+// tokenizeMessage returns the distinct lowercase words in text
+func tokenizeMessage(text string) []string {
+	seen := make(map[string]bool)
+
+	var tokens []string
+
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if len(word) < 2 || len(word) > 30 || seen[word] {
+			continue
+		}
+
+		seen[word] = true
+		tokens = append(tokens, word)
+	}
+
+	return tokens
+}
+
+// heuristicScore scores the signals that need no training, between 0 and 1
+func heuristicScore(text string) (float64, []string) {
+	var (
+		score   float64
+		reasons []string
+	)
+
+	switch links := len(linkPattern.FindAllString(text, -1)); {
+	case links >= 3:
+		score += 0.6
+		reasons = append(reasons, "many links")
+	case links == 2:
+		score += 0.3
+		reasons = append(reasons, "multiple links")
+	case links == 1:
+		score += 0.1
+	}
+
+	lowerText := strings.ToLower(text)
+
+	var phraseScore float64
+
+	for _, phrase := range spamPhrases {
+		if strings.Contains(lowerText, phrase) {
+			phraseScore += 0.25
+			reasons = append(reasons, "spam phrase: "+phrase)
+		}
+	}
+
+	score += math.Min(phraseScore, 0.75)
+
+	var letters, upperLetters int
+
+	for _, r := range text {
+		if unicode.IsLetter(r) {
+			letters++
+
+			if unicode.IsUpper(r) {
+				upperLetters++
+			}
+		}
+	}
+
+	if letters >= 20 && float64(upperLetters)/float64(letters) > 0.5 {
+		score += 0.2
+		reasons = append(reasons, "mostly capitals")
+	}
+
+	return math.Min(score, 1), reasons
+}
+
+// bayesProbability is the probability the tokens are spam, ok is false until the model is trained
+func (ss *spamScorer) bayesProbability(tokens []string) (float64, bool) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	model := ss.model
+
+	if model.SpamMessages < minSpamTrainingMessages || model.HamMessages < minSpamTrainingMessages {
+		return 0, false
+	}
+
+	totalMessages := float64(model.SpamMessages + model.HamMessages)
+
+	spamLog := math.Log(float64(model.SpamMessages) / totalMessages)
+	hamLog := math.Log(float64(model.HamMessages) / totalMessages)
+
+	// Laplace smoothed per token likelihoods, tokens never seen in training are skipped
+	for _, token := range tokens {
+		spamCount, inSpam := model.SpamTokens[token]
+		hamCount, inHam := model.HamTokens[token]
+
+		if !inSpam && !inHam {
+			continue
+		}
+
+		spamLog += math.Log(float64(spamCount+1) / float64(model.SpamMessages+2))
+		hamLog += math.Log(float64(hamCount+1) / float64(model.HamMessages+2))
+	}
+
+	return 1 / (1 + math.Exp(hamLog-spamLog)), true
+}
+
+func (ss *spamScorer) score(text string) spamVerdict {
+	heuristic, reasons := heuristicScore(text)
+
+	verdict := spamVerdict{
+		Score:   heuristic,
+		Reasons: reasons,
+	}
+
+	if probability, ok := ss.bayesProbability(tokenizeMessage(text)); ok {
+		verdict.Score = 0.4*heuristic + 0.6*probability
+
+		if probability >= 0.5 {
+			verdict.Reasons = append(verdict.Reasons, "resembles previous spam")
+		}
+	}
+
+	if verdict.Reasons == nil {
+		verdict.Reasons = []string{}
+	}
+
+	return verdict
+}
+
+// train adds a labelled message to the model, previousLabel undoes an earlier
+// training of the same message so relabelling does not count it twice. A copy is
+// trained and only used once saved, so a failed save can be retried.
+func (ss *spamScorer) train(text string, spam bool, previousLabel string) error {
+	tokens := tokenizeMessage(text)
+
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	trained := ss.model.clone()
+
+	switch previousLabel {
+	case contactLabelSpam:
+		trained.SpamMessages--
+		removeTokenCounts(trained.SpamTokens, tokens)
+	case contactLabelHam:
+		trained.HamMessages--
+		removeTokenCounts(trained.HamTokens, tokens)
+	}
+
+	if spam {
+		trained.SpamMessages++
+		addTokenCounts(trained.SpamTokens, tokens)
+	} else {
+		trained.HamMessages++
+		addTokenCounts(trained.HamTokens, tokens)
+	}
+
+	if err := writeJSONFile(ss.modelPath, trained); err != nil {
+		return err
+	}
+
+	ss.model = trained
+
+	return nil
+}
+
+func (model naiveBayesModel) clone() naiveBayesModel {
+	cloned := model
+	cloned.SpamTokens = make(map[string]int, len(model.SpamTokens))
+	cloned.HamTokens = make(map[string]int, len(model.HamTokens))
+
+	for token, count := range model.SpamTokens {
+		cloned.SpamTokens[token] = count
+	}
+
+	for token, count := range model.HamTokens {
+		cloned.HamTokens[token] = count
+	}
+
+	return cloned
+}
+
+func addTokenCounts(counts map[string]int, tokens []string) {
+	for _, token := range tokens {
+		counts[token]++
+	}
+}
+
+func removeTokenCounts(counts map[string]int, tokens []string) {
+	for _, token := range tokens {
+		if counts[token] <= 1 {
+			delete(counts, token)
+		} else {
+			counts[token]--
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic writes to a temporary file in the same directory and renames it
+// over the destination so readers never observe a partially written file
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tempFile, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = tempFile.Write(data); err != nil {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+
+		return err
+	}
+
+	if err = tempFile.Sync(); err != nil {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+
+		return err
+	}
+
+	if err = tempFile.Close(); err != nil {
+		os.Remove(tempFile.Name())
+
+		return err
+	}
+
+	return os.Rename(tempFile.Name(), path)
+}
+
+func writeJSONFile(path string, value interface{}) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, data)
+}
+
+// readJSONFile decodes the file at path into value, a missing file is not an error
+// and leaves value untouched
+func readJSONFile(path string, value interface{}) error {
+	data, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, value)
+}
+
+// validRecordID checks an ID generated by newRequestID before it is used in a file name
+func validRecordID(recordID string) bool {
+	_, err := hex.DecodeString(recordID)
+
+	return err == nil && len(recordID) == 24
+}
@@ -9,6 +9,7 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"regexp"
 	"regexp/syntax"
 	"strings"
@@ -435,32 +436,6 @@ var (
 	cleanupMu = &sync.Mutex{}
 )
 
-func watchFiles(filePath string, delay time.Duration) (*os.FileInfo, error) {
-	initialStat, err := os.Stat(filePath)
-
-	if err != nil {
-		return nil, err
-	}
-
-	var stat os.FileInfo
-
-	for {
-		stat, err = os.Stat(filePath)
-
-		if err != nil {
-			return nil, err
-		}
-
-		if stat.Size() != initialStat.Size() || stat.ModTime() != initialStat.ModTime() {
-			break
-		}
-
-		time.Sleep(delay)
-	}
-
-	return &stat, nil
-}
-
 func normalize(path string, dir bool) string {
 	path = strings.TrimPrefix(path, "./")
 
@@ -471,23 +446,43 @@ func normalize(path string, dir bool) string {
 	return path
 }
 
-func watch(watchPath string, changes chan<- string) {
-	var (
-		fileStat    os.FileInfo
-		newFileStat *os.FileInfo
-		err         error
-	)
+// watchGlob polls the files matching pattern for changes, globbing again on every
+// poll so files created after startup are watched too and deleted ones are noticed
+func watchGlob(pattern string, delay time.Duration, changes chan<- string) {
+	var previous map[string]os.FileInfo
 
 	for {
-		newFileStat, err = watchFiles(watchPath, 500*time.Millisecond)
+		current := make(map[string]os.FileInfo)
 
-		if err != nil || newFileStat == nil {
-			continue
+		paths, err := filepath.Glob(pattern)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for _, path := range paths {
+			if stat, err := os.Stat(path); err == nil {
+				current[path] = stat
+			}
 		}
 
-		fileStat = *newFileStat
+		if previous != nil {
+			for path, stat := range current {
+				if old, ok := previous[path]; !ok || stat.Size() != old.Size() || stat.ModTime() != old.ModTime() {
+					changes <- normalize(path, stat.IsDir())
+				}
+			}
+
+			for path := range previous {
+				if _, ok := current[path]; !ok {
+					changes <- normalize(path, false)
+				}
+			}
+		}
 
-		changes <- normalize(fileStat.Name(), fileStat.IsDir())
+		previous = current
+
+		time.Sleep(delay)
 	}
 }
 
@@ -558,7 +553,7 @@ func main() {
 		cleanup(reason, reflex)
 	}()
 
-	go watch("./main/main.go", changes)
+	go watchGlob("./main/*.go", 500*time.Millisecond, changes)
 
 	reflex.Start(changes)
 
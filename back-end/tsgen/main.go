@@ -0,0 +1,425 @@
+// tsgen writes TypeScript interfaces for the API's Go types, so the front end's
+// types can't drift from what the back end sends. It is run by go generate in
+// ../main, with -check it only reports whether the file is out of date.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// apiType is a Go type the front end uses, the types its fields refer to are
+// written out after it
+type apiType struct {
+	name string
+	// Request types are sent by the front end, fields without binding:"required"
+	// are optional rather than those with omitempty
+	request bool
+}
+
+var apiTypes = []apiType{
+	{name: "Playlist"},
+	{name: "PlaylistTrack"},
+	{name: "SoundCloudPlaylist"},
+	{name: "PostTag"},
+	{name: "PostAuthor"},
+	{name: "Pagination"},
+	{name: "SearchResults"},
+	{name: "ArticleFeed"},
+	{name: "articleFeedRequest", request: true},
+	{name: "ArticleVoteResult"},
+	{name: "VisitorToken"},
+	{name: "AuthSession"},
+	{name: "AuthStatus"},
+	{name: "RelatedPost"},
+	{name: "AnalyticsReport"},
+	{name: "CommentThread"},
+	{name: "commentRequest", request: true},
+	{name: "commentSubmission"},
+	{name: "subscribeRequest", request: true},
+}
+
+const header = `// Generated from the back end's Go types by back-end/tsgen, don't edit by hand.
+// Change the Go types and run go generate in back-end/main instead.
+`
+
+func main() {
+	dir := flag.String("dir", ".", "directory of the Go package declaring the API types")
+	out := flag.String("out", "", "TypeScript file to write")
+	check := flag.Bool("check", false, "exit with an error when the TypeScript file is out of date instead of writing it")
+
+	flag.Parse()
+
+	if *out == "" {
+		fmt.Fprintln(os.Stderr, "-out is required")
+
+		os.Exit(2)
+	}
+
+	generated, err := generate(*dir)
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+
+		os.Exit(1)
+	}
+
+	if *check {
+		existing, err := ioutil.ReadFile(*out)
+
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Fprintln(os.Stderr, err)
+
+			os.Exit(1)
+		}
+
+		if !bytes.Equal(existing, generated) {
+			fmt.Fprintf(os.Stderr, "%s is out of date, run go generate in back-end/main\n", *out)
+
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	if err := ioutil.WriteFile(*out, generated, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+
+		os.Exit(1)
+	}
+}
+
+// goType is a type declared in the package
+type goType struct {
+	spec *ast.TypeSpec
+	doc  *ast.CommentGroup
+}
+
+type generator struct {
+	types map[string]goType
+	// Go types already written, and which Go type each TypeScript name came from
+	written map[string]bool
+	tsNames map[string]string
+	output  bytes.Buffer
+}
+
+func generate(dir string) ([]byte, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	g := &generator{
+		types:   make(map[string]goType),
+		written: make(map[string]bool),
+		tsNames: make(map[string]string),
+	}
+
+	fileSet := token.NewFileSet()
+
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+
+		parsed, err := parser.ParseFile(fileSet, file, nil, parser.ParseComments)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, decl := range parsed.Decls {
+			genDecl, ok := decl.(*ast.GenDecl)
+
+			if !ok || genDecl.Tok != token.TYPE {
+				continue
+			}
+
+			for _, spec := range genDecl.Specs {
+				typeSpec := spec.(*ast.TypeSpec)
+				doc := typeSpec.Doc
+
+				if doc == nil && len(genDecl.Specs) == 1 {
+					doc = genDecl.Doc
+				}
+
+				g.types[typeSpec.Name.Name] = goType{spec: typeSpec, doc: doc}
+			}
+		}
+	}
+
+	g.output.WriteString(header)
+
+	for _, root := range apiTypes {
+		if err := g.writeInterface(root.name, root.request); err != nil {
+			return nil, err
+		}
+	}
+
+	return g.output.Bytes(), nil
+}
+
+// tsName exports the Go name, TypeScript has no unexported types
+func tsName(goName string) string {
+	runes := []rune(goName)
+	runes[0] = unicode.ToUpper(runes[0])
+
+	return string(runes)
+}
+
+// writeInterface writes the struct type name, then the struct types its fields use
+func (g *generator) writeInterface(name string, request bool) error {
+	if g.written[name] {
+		return nil
+	}
+
+	declared, ok := g.types[name]
+
+	if !ok {
+		return fmt.Errorf("type %s isn't declared", name)
+	}
+
+	structType, ok := declared.spec.Type.(*ast.StructType)
+
+	if !ok {
+		return fmt.Errorf("type %s isn't a struct", name)
+	}
+
+	interfaceName := tsName(name)
+
+	if other, taken := g.tsNames[interfaceName]; taken {
+		return fmt.Errorf("types %s and %s would both be called %s", other, name, interfaceName)
+	}
+
+	g.written[name] = true
+	g.tsNames[interfaceName] = name
+
+	var extends []string
+	var body bytes.Buffer
+
+	// Types used by the fields are written after this one, in the order they're used
+	var uses []string
+
+	for _, field := range structType.Fields.List {
+		tag := reflect.StructTag("")
+
+		if field.Tag != nil {
+			unquoted, err := strconv.Unquote(field.Tag.Value)
+
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+
+			tag = reflect.StructTag(unquoted)
+		}
+
+		jsonTag := tag.Get("json")
+
+		if jsonTag == "-" {
+			continue
+		}
+
+		tagParts := strings.Split(jsonTag, ",")
+
+		// encoding/json flattens embedded structs without a name of their own
+		if len(field.Names) == 0 && tagParts[0] == "" {
+			embedded := field.Type
+
+			if pointer, ok := embedded.(*ast.StarExpr); ok {
+				embedded = pointer.X
+			}
+
+			ident, ok := embedded.(*ast.Ident)
+
+			if !ok {
+				return fmt.Errorf("%s embeds an unsupported type", name)
+			}
+
+			extends = append(extends, tsName(ident.Name))
+			uses = append(uses, ident.Name)
+
+			continue
+		}
+
+		names := field.Names
+
+		if len(names) == 0 {
+			names = []*ast.Ident{embeddedName(field.Type)}
+		}
+
+		omitEmpty, asString := false, false
+
+		for _, option := range tagParts[1:] {
+			omitEmpty = omitEmpty || option == "omitempty"
+			asString = asString || option == "string"
+		}
+
+		optional := omitEmpty
+
+		if request {
+			optional = !strings.Contains(","+tag.Get("binding")+",", ",required,")
+		}
+
+		fieldType, err := g.tsType(field.Type, !omitEmpty, &uses)
+
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+
+		if asString {
+			fieldType = "string"
+		}
+
+		for _, fieldName := range names {
+			if !fieldName.IsExported() {
+				continue
+			}
+
+			jsonName := tagParts[0]
+
+			if jsonName == "" {
+				jsonName = fieldName.Name
+			}
+
+			writeComment(&body, field.Doc, "  ")
+
+			if optional {
+				jsonName += "?"
+			}
+
+			fmt.Fprintf(&body, "  %s: %s;\n", jsonName, fieldType)
+		}
+	}
+
+	g.output.WriteString("\n")
+
+	writeComment(&g.output, declared.doc, "")
+
+	fmt.Fprintf(&g.output, "export interface %s ", interfaceName)
+
+	if len(extends) != 0 {
+		fmt.Fprintf(&g.output, "extends %s ", strings.Join(extends, ", "))
+	}
+
+	fmt.Fprintf(&g.output, "{\n%s}\n", body.String())
+
+	for _, used := range uses {
+		if err := g.writeInterface(used, request); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func embeddedName(expr ast.Expr) *ast.Ident {
+	switch embedded := expr.(type) {
+	case *ast.StarExpr:
+		return embeddedName(embedded.X)
+	case *ast.SelectorExpr:
+		return embedded.Sel
+	case *ast.Ident:
+		return embedded
+	}
+
+	return ast.NewIdent("")
+}
+
+func writeComment(output *bytes.Buffer, doc *ast.CommentGroup, indent string) {
+	if doc == nil {
+		return
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(doc.Text()), "\n") {
+		fmt.Fprintf(output, "%s// %s\n", indent, line)
+	}
+}
+
+var errUnsupported = errors.New("unsupported type")
+
+// tsType is the TypeScript for a Go type as encoding/json encodes it. Pointers are
+// null when nil unless omitempty leaves them out, so nullable is false then.
+func (g *generator) tsType(expr ast.Expr, nullable bool, uses *[]string) (string, error) {
+	switch goType := expr.(type) {
+	case *ast.StarExpr:
+		element, err := g.tsType(goType.X, nullable, uses)
+
+		if err != nil || !nullable {
+			return element, err
+		}
+
+		return element + " | null", nil
+	case *ast.ArrayType:
+		if ident, ok := goType.Elt.(*ast.Ident); ok && ident.Name == "byte" {
+			return "string", nil
+		}
+
+		element, err := g.tsType(goType.Elt, true, uses)
+
+		if err != nil {
+			return "", err
+		}
+
+		if strings.Contains(element, " | ") {
+			element = "(" + element + ")"
+		}
+
+		return element + "[]", nil
+	case *ast.MapType:
+		value, err := g.tsType(goType.Value, true, uses)
+
+		return "Record<string, " + value + ">", err
+	case *ast.InterfaceType:
+		return "unknown", nil
+	case *ast.SelectorExpr:
+		switch fmt.Sprintf("%s.%s", goType.X, goType.Sel.Name) {
+		case "time.Time":
+			return "string", nil
+		case "time.Duration":
+			return "number", nil
+		case "json.RawMessage":
+			return "unknown", nil
+		}
+
+		return "", fmt.Errorf("%w %s.%s", errUnsupported, goType.X, goType.Sel.Name)
+	case *ast.Ident:
+		switch goType.Name {
+		case "string":
+			return "string", nil
+		case "bool":
+			return "boolean", nil
+		case "int", "int8", "int16", "int32", "int64", "uint", "uint8", "uint16", "uint32", "uint64", "float32", "float64", "byte", "rune":
+			return "number", nil
+		}
+
+		declared, ok := g.types[goType.Name]
+
+		if !ok {
+			return "", fmt.Errorf("%w %s", errUnsupported, goType.Name)
+		}
+
+		// Named types that aren't structs are written as what they're made of
+		if _, isStruct := declared.spec.Type.(*ast.StructType); !isStruct {
+			return g.tsType(declared.spec.Type, nullable, uses)
+		}
+
+		*uses = append(*uses, goType.Name)
+
+		return tsName(goType.Name), nil
+	}
+
+	return "", fmt.Errorf("%w %T", errUnsupported, expr)
+}
@@ -10,10 +10,15 @@ const routes = [
   { path: "/contact", text: "Contact", footer: true, header: false },
 ];
 
+// Preview images are linked absolutely, social sites don't resolve relative URLs
+const siteURL = "https://therileyjohnson.com";
+
 type Props = {
   children?: ReactNode;
   contentPadding?: boolean;
   title?: string;
+  // Path of the Open Graph preview image, such as "/api/og/post/<slug>.png"
+  image?: string;
 };
 
 const linkStyles = (theme: Theme) => ({
@@ -109,6 +114,7 @@ const Layout = ({
   children,
   title = "RJ's Site",
   contentPadding = true,
+  image,
 }: Props) => {
   const styles = useLayoutStyles();
 
@@ -118,6 +124,28 @@ const Layout = ({
         <title>{title}</title>
         <meta charSet="utf-8" />
         <meta name="viewport" content="initial-scale=1.0, width=device-width" />
+        <link
+          rel="alternate"
+          type="application/rss+xml"
+          title="RJ's Site"
+          href="/api/posts/feed.rss"
+        />
+        <link
+          rel="alternate"
+          type="application/atom+xml"
+          title="RJ's Site"
+          href="/api/posts/feed.atom"
+        />
+        <meta property="og:title" content={title} />
+        <meta property="og:site_name" content="RJ's Site" />
+        {image && (
+          <>
+            <meta property="og:image" content={`${siteURL}${image}`} />
+            <meta property="og:image:width" content="1200" />
+            <meta property="og:image:height" content="630" />
+            <meta name="twitter:card" content="summary_large_image" />
+          </>
+        )}
       </Head>
       <div className={styles.overArching}>
         <header className={styles.headerContainer}>
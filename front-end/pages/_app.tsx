@@ -16,10 +16,10 @@ import {
 
 import "./styling/fonts.css";
 
-import googleAnalytics from "../util/googleAnalytics";
+import analytics from "../util/analytics";
 
 // Track pageview when route is changed
-Router.events.on("routeChangeComplete", (url) => googleAnalytics.pageview(url));
+Router.events.on("routeChangeComplete", (url) => analytics.pageview(url));
 
 const app = ({ Component, pageProps }: AppProps) => {
   React.useEffect(() => {
@@ -29,6 +29,9 @@ const app = ({ Component, pageProps }: AppProps) => {
     if (jssStyles) {
       jssStyles?.parentElement?.removeChild(jssStyles);
     }
+
+    // Route changes are tracked above, the page the visit started on is tracked here
+    analytics.pageview(window.location.pathname);
   }, []);
 
   return (
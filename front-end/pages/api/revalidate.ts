@@ -0,0 +1,37 @@
+import { NextApiRequest, NextApiResponse } from "next";
+
+const REVALIDATE_SECRET = process.env.REVALIDATE_SECRET || "";
+
+// Regenerates statically rendered pages on demand, the back end calls this when
+// Ghost reports post changes
+export default async (req: NextApiRequest, res: NextApiResponse) => {
+  if (req.method !== "POST") {
+    res.setHeader("Allow", "POST");
+
+    return res.status(405).json({ err: true, msg: "method not allowed" });
+  }
+
+  if (
+    REVALIDATE_SECRET === "" ||
+    req.headers.authorization !== `Bearer ${REVALIDATE_SECRET}`
+  ) {
+    return res.status(401).json({ err: true, msg: "invalid token" });
+  }
+
+  const paths: unknown = req.body && req.body.paths;
+
+  if (
+    !Array.isArray(paths) ||
+    !paths.every((path) => typeof path === "string" && path.startsWith("/"))
+  ) {
+    return res.status(400).json({ err: true, msg: "paths must be absolute" });
+  }
+
+  try {
+    await Promise.all(paths.map((path: string) => res.revalidate(path)));
+  } catch (error) {
+    return res.status(500).json({ err: true, msg: "could not revalidate" });
+  }
+
+  return res.status(200).json({ err: false, data: paths, msg: "" });
+};
@@ -8,7 +8,7 @@ import { useState, useEffect, ReactNode, useRef, memo, createRef } from "react";
 import { GetStaticProps } from "next";
 
 import consumeApi from "../util/api/ApiInteractions";
-import { SoundCloudPlaylist, Track } from "../util/api/ApiTypes";
+import { Playlist, PlaylistTrack } from "../util/api/ApiTypes";
 import { AppTheme } from "../components/Theme/ThemeContext";
 import Resume from "../components/Resume/Resume";
 
@@ -262,8 +262,8 @@ const useTracksModalStyles = makeStyles((theme: Theme) => ({
 }));
 
 interface ITracksModalProps {
-  shownTrack: Track | null;
-  soundcloudTracks: Track[];
+  shownTrack: PlaylistTrack | null;
+  soundcloudTracks: PlaylistTrack[];
   handleCloseModal: () => void;
 }
 
@@ -377,7 +377,7 @@ const TracksModal: React.FC<ITracksModalProps> = ({
                   ref={trackRefMap.current[track.id]}
                 >
                   <a
-                    href={`${track.permalink_url}?in=riley-johnson-734562913/sets/lovethemgunsounds`}
+                    href={track.permalink_url ?? track.stream_url ?? undefined}
                     style={{
                       display: "flex",
                       columnGap: "1rem",
@@ -410,7 +410,7 @@ const TracksModal: React.FC<ITracksModalProps> = ({
                         }}
                       >
                         <div>{track.title}</div>
-                        <div>{track.user.username}</div>
+                        <div>{track.artist}</div>
                       </div>
                     </div>
                   </a>
@@ -427,7 +427,7 @@ const TracksModal: React.FC<ITracksModalProps> = ({
 // const useAppLandingStyles = makeStyles((theme: Theme) => ({}));
 
 interface IAppLandingProps {
-  soundcloudPlaylist: SoundCloudPlaylist | null;
+  soundcloudPlaylist: Playlist | null;
 }
 
 const MemoHeaderChyrons = memo<IHeaderChyronsProps>(
@@ -440,7 +440,7 @@ const AppLanding: React.FC<IAppLandingProps> = ({
 }: IAppLandingProps) => {
   // const styles = useAppLandingStyles();
 
-  const [shownTrack, setShownTrack] = useState<Track | null>(null);
+  const [shownTrack, setShownTrack] = useState<PlaylistTrack | null>(null);
 
   if (soundcloudPlaylist === null) {
     return (
@@ -482,7 +482,7 @@ const AppLanding: React.FC<IAppLandingProps> = ({
   const randomSongs = useRef(
     randomIndexes.current.map(
       (randomIndex) =>
-        `${soundcloudTracks[randomIndex].title} - ${soundcloudTracks[randomIndex].user.username}`
+        `${soundcloudTracks[randomIndex].title} - ${soundcloudTracks[randomIndex].artist}`
     )
   );
 
@@ -518,14 +518,14 @@ const AppLanding: React.FC<IAppLandingProps> = ({
 // }));
 
 interface Props {
-  soundcloudPlaylist: SoundCloudPlaylist | null;
+  soundcloudPlaylist: Playlist | null;
 }
 
 const IndexPage = ({ soundcloudPlaylist }: Props) => {
   // const styles = useIndexStyles();
 
   return (
-    <Layout contentPadding={false}>
+    <Layout contentPadding={false} image="/api/og/playlist/songs.png">
       <AppLanding soundcloudPlaylist={soundcloudPlaylist} />
       {/* ) : null} */}
       {/* <div className={styles.offeringsWrapper}>
@@ -552,7 +552,7 @@ export const getStaticProps: GetStaticProps<Props> = async () => {
   try {
     // const resp = await axios.get<string>("http://rj-site-back-end/api/songs");
 
-    const [responsePromise] = consumeApi.get<SoundCloudPlaylist>("/songs");
+    const [responsePromise] = consumeApi.get<Playlist>("/songs");
 
     const response = await responsePromise;
 
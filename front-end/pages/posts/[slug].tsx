@@ -38,7 +38,10 @@ const Post = ({ err, post }: Props) => {
   }, []);
 
   return (
-    <Layout title={`${post.title} | RJ's Site`}>
+    <Layout
+      title={`${post.title} | RJ's Site`}
+      image={`/api/og/post/${encodeURIComponent(String(post.slug))}.png`}
+    >
       <HorizonalResizableContainer defaultWidth={66} minWidth={33}>
         <div style={{ display: "flex", justifyContent: "flex-start", width: "100%" }}>
           <h1>
@@ -0,0 +1,60 @@
+// First party analytics, page views and events are posted to the back end which
+// counts them without cookies, see back-end/main/analytics.go
+
+const ANALYTICS_ENDPOINT = "/api/analytics/event";
+
+// Only the first page view carries where the visitor came from, the rest are within the site
+let referrer: string | undefined;
+
+const send = (body: object) => {
+  if (typeof window === "undefined") {
+    return;
+  }
+
+  const payload = JSON.stringify(body);
+
+  // sendBeacon survives the page unloading, it posts the JSON as text/plain
+  if (navigator.sendBeacon && navigator.sendBeacon(ANALYTICS_ENDPOINT, payload)) {
+    return;
+  }
+
+  fetch(ANALYTICS_ENDPOINT, {
+    method: "POST",
+    body: payload,
+    headers: { "Content-Type": "application/json" },
+    keepalive: true,
+  }).catch(() => {});
+};
+
+export default {
+  pageview(url: string) {
+    if (referrer === undefined) {
+      referrer = document.referrer;
+    } else {
+      referrer = "";
+    }
+
+    send({ type: "pageview", path: url, referrer });
+  },
+
+  event({
+    action,
+    event_category,
+    event_label,
+    value,
+  }: {
+    action: string;
+    event_category?: string;
+    event_label?: string;
+    value?: number;
+  }) {
+    send({
+      type: "event",
+      path: window.location.pathname,
+      name: action,
+      category: event_category,
+      label: event_label,
+      value,
+    });
+  },
+};
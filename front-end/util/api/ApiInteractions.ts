@@ -1,4 +1,19 @@
 import axios, { AxiosResponse, AxiosRequestConfig } from "axios";
+import {
+  AnalyticsReport,
+  ArticleFeed,
+  ArticleFeedRequest,
+  ArticleVoteResult,
+  AuthSession,
+  AuthStatus,
+  CommentRequest,
+  CommentSubmission,
+  CommentThread,
+  RelatedPost,
+  SearchResults,
+  SubscribeRequest,
+  VisitorToken,
+} from "./ApiTypes";
 
 export const ApiURL = `http://rj-site-back-end/api`;
 
@@ -144,53 +159,132 @@ export default class consumeApi {
     );
   }
 
-  //   static getLatestFeed(
-  //     token: string,
-  //     data?: any
-  //   ): [Promise<ApiResponse<FeedResponse>>, () => void] {
-  //     if (token !== "")
-  //       return this.post<FeedResponse>(
-  //         `/api/a/article/feed/latest?auth_token=${token}`,
-  //         data
-  //       );
+  static searchPosts(
+    query: string,
+    limit?: number
+  ): [Promise<ApiResponse<SearchResults>>, () => void] {
+    return this.get<SearchResults>("/search", { params: { q: query, limit } });
+  }
 
-  //     return this.post<FeedResponse>("/api/n/article/feed/latest", data);
-  //   }
+  static suggestSearchWords(
+    prefix: string
+  ): [Promise<ApiResponse<string[]>>, () => void] {
+    return this.get<string[]>("/search/suggest", { params: { q: prefix } });
+  }
 
-  //   static getHottestFeed(
-  //     token: string,
-  //     data?: any
-  //   ): [Promise<ApiResponse<FeedResponse>>, () => void] {
-  //     if (token !== "")
-  //       return this.post<FeedResponse>(
-  //         `/api/a/article/feed/hottest?auth_token=${token}`,
-  //         data
-  //       );
+  static relatedPosts(
+    slug: string,
+    limit?: number
+  ): [Promise<ApiResponse<RelatedPost[]>>, () => void] {
+    return this.get<RelatedPost[]>(
+      `/posts/${encodeURIComponent(slug)}/related`,
+      { params: { limit } }
+    );
+  }
 
-  //     return this.post<FeedResponse>("/api/n/article/feed/hottest", data);
-  //   }
+  static getLatestFeed(
+    data?: ArticleFeedRequest
+  ): [Promise<ApiResponse<ArticleFeed>>, () => void] {
+    return this.post<ArticleFeed>("/n/article/feed/latest", data);
+  }
 
-  //   static voteOnArticle(
-  //     token: string,
-  //     data: any
-  //   ): [Promise<ApiResponse<ArticleVoteResponse>>, () => void] {
-  //     return this.post<ArticleVoteResponse>(
-  //       `/api/a/article/vote?auth_token=${token}`,
-  //       data
-  //     );
-  //   }
+  static getHottestFeed(
+    data?: ArticleFeedRequest
+  ): [Promise<ApiResponse<ArticleFeed>>, () => void] {
+    return this.post<ArticleFeed>("/n/article/feed/hottest", data);
+  }
 
-  //   static logoutUser(token: string): [Promise<ApiResponse<{}>>, () => void] {
-  //     return this.post<{}>(`/api/a/auth/logout?auth_token=${token}`);
-  //   }
+  static getVisitorToken(): [Promise<ApiResponse<VisitorToken>>, () => void] {
+    return this.post<VisitorToken>("/n/article/visitor");
+  }
 
-  //   static checkUserStatus(
-  //     token: string
-  //   ): [Promise<ApiResponse<CheckUserStatusResponse>>, () => void] {
-  //     return this.post<CheckUserStatusResponse>(
-  //       `/api/a/auth/status?auth_token=${encodeURIComponent(token)}`
-  //     );
-  //   }
+  // vote is 1 or -1, 0 withdraws the visitor's vote
+  static voteOnArticle(
+    visitorToken: string,
+    slug: string,
+    vote: number
+  ): [Promise<ApiResponse<ArticleVoteResult>>, () => void] {
+    return this.post<ArticleVoteResult>("/n/article/vote", {
+      slug,
+      vote,
+      visitor_token: visitorToken,
+    });
+  }
+
+  static login(
+    username: string,
+    password: string,
+    totpCode?: string
+  ): [Promise<ApiResponse<AuthSession>>, () => void] {
+    return this.post<AuthSession>("/n/auth/login", {
+      username,
+      password,
+      totp_code: totpCode,
+    });
+  }
+
+  static logoutUser(token: string): [Promise<ApiResponse<{}>>, () => void] {
+    return this.post<{}>(
+      `/a/auth/logout?auth_token=${encodeURIComponent(token)}`
+    );
+  }
+
+  static checkUserStatus(
+    token: string
+  ): [Promise<ApiResponse<AuthStatus>>, () => void] {
+    return this.post<AuthStatus>(
+      `/a/auth/status?auth_token=${encodeURIComponent(token)}`
+    );
+  }
+
+  // The old token stops working once the new one is issued
+  static refreshSession(
+    token: string
+  ): [Promise<ApiResponse<AuthSession>>, () => void] {
+    return this.post<AuthSession>(
+      `/a/auth/refresh?auth_token=${encodeURIComponent(token)}`
+    );
+  }
+
+  // Only approved comments are returned, new ones wait for moderation
+  static getComments(
+    slug: string
+  ): [Promise<ApiResponse<CommentThread>>, () => void] {
+    return this.get<CommentThread>(
+      `/posts/${encodeURIComponent(slug)}/comments`
+    );
+  }
+
+  static postComment(
+    slug: string,
+    comment: CommentRequest
+  ): [Promise<ApiResponse<CommentSubmission>>, () => void] {
+    return this.post<CommentSubmission>(
+      `/posts/${encodeURIComponent(slug)}/comments`,
+      comment
+    );
+  }
+
+  // The response is the same whether or not the address was already subscribed,
+  // a confirmation link is emailed to new subscribers
+  static subscribe(
+    subscription: SubscribeRequest
+  ): [Promise<ApiResponse<{}>>, () => void] {
+    return this.post<{}>("/subscribe", subscription);
+  }
+
+  // Dates are "YYYY-MM-DD", the last 30 days are reported without them
+  static getAnalyticsReport(
+    token: string,
+    from?: string,
+    to?: string
+  ): [Promise<ApiResponse<AnalyticsReport>>, () => void] {
+    return this.get<AnalyticsReport>(
+      "/admin/analytics",
+      { params: { from, to } },
+      token
+    );
+  }
 
   //   static checkArticleCache(
   //     data: any
@@ -1,13 +1,43 @@
+// Generated from the back end's Go types by back-end/tsgen, don't edit by hand.
+// Change the Go types and run go generate in back-end/main instead.
+
+// Playlist is the provider neutral playlist served by /api/songs
+export interface Playlist {
+  source: string;
+  id: string;
+  title: string;
+  description: string | null;
+  artwork_url: string | null;
+  permalink_url: string | null;
+  duration: number;
+  track_count: number;
+  tracks: PlaylistTrack[];
+}
+
+export interface PlaylistTrack {
+  id: string;
+  title: string;
+  artist: string;
+  album: string | null;
+  genre: string | null;
+  duration: number;
+  artwork_url: string | null;
+  permalink_url: string | null;
+  stream_url: string | null;
+}
+
 export interface SoundCloudPlaylist {
   artwork_url: string | null;
   created_at: string;
   description: string | null;
   duration: number;
+  embeddable_by: string;
   genre: string | null;
   id: number;
   kind: string;
   label_name: string | null;
   last_modified: string;
+  license: string;
   likes_count: number;
   managed_by_feeds: boolean;
   permalink: string;
@@ -18,6 +48,7 @@ export interface SoundCloudPlaylist {
   release_date: string | null;
   reposts_count: number;
   secret_token: string | null;
+  sharing: string;
   tag_list: string;
   title: string;
   uri: string;
@@ -27,62 +58,116 @@ export interface SoundCloudPlaylist {
   published_at: string;
   display_date: string;
   user: User;
-  tracks: Track[];
+  tracks: TrackElement[];
   track_count: number;
 }
 
-export interface Track {
-  artwork_url: string | null;
-  comment_count: number;
-  commentable: boolean;
-  created_at: string;
-  description: string;
-  display_date: string;
-  download_count: number;
-  downloadable: boolean;
-  duration: number;
-  full_duration: number;
-  genre: string;
-  has_downloads_left: boolean;
+export interface User {
+  avatar_url: string;
+  first_name: string;
+  full_name: string;
   id: number;
-  label_name: null;
+  kind: string;
   last_modified: string;
-  likes_count: number;
+  last_name: string;
   permalink: string;
   permalink_url: string;
-  playback_count: number;
-  public: boolean;
-  // publisher_metadata: PublisherMetadata;
-  purchase_title: null;
-  purchase_url: null;
-  release_date: null | string;
-  reposts_count: number;
-  streamable: boolean;
-  tag_list: string;
-  title: string;
   uri: string;
   urn: string;
-  user: User;
-  user_id: number;
-  waveform_url: string;
+  username: string;
+  verified: boolean;
+}
+
+export interface TrackElement {
+  artwork_url?: string;
+  comment_count?: number;
+  commentable?: boolean;
+  created_at?: string;
+  description?: string;
+  display_date?: string;
+  download_count?: number;
+  downloadable?: boolean;
+  duration?: number;
+  embeddable_by?: string;
+  full_duration?: number;
+  genre?: string;
+  has_downloads_left?: boolean;
+  id: number;
+  kind: string;
+  label_name: string | null;
+  last_modified?: string;
+  license?: string;
+  likes_count?: number;
+  media?: Media;
+  monetization_model: string;
+  permalink?: string;
+  permalink_url?: string;
+  playback_count?: number;
+  policy: string;
+  public?: boolean;
+  publisher_metadata?: PublisherMetadata;
+  purchase_title: string | null;
+  purchase_url: string | null;
+  release_date: string | null;
+  reposts_count?: number;
+  sharing?: string;
+  state?: string;
+  streamable?: boolean;
+  tag_list?: string;
+  title?: string;
+  uri?: string;
+  urn?: string;
+  user?: UserClass;
+  user_id?: number;
+  waveform_url?: string;
+}
+
+export interface Media {
+  transcodings: Transcoding[];
+}
+
+export interface Transcoding {
+  duration: number;
+  format: Format;
+  preset: string;
+  quality: string;
+  snipped: boolean;
+  url: string;
+}
+
+export interface Format {
+  mime_type: string;
+  protocol: string;
 }
 
 export interface PublisherMetadata {
-  artist: string | null;
-  contains_music: boolean;
+  artist?: string;
+  contains_music?: boolean;
   id: number;
-  isrc: string | null;
+  isrc?: string;
   urn: string;
-  writer_composer: string | null;
+  album_title?: string;
+  c_line?: string;
+  c_line_for_display?: string;
+  explicit?: boolean;
+  p_line?: string;
+  p_line_for_display?: string;
+  release_title?: string;
+  upc_or_ean?: string;
+  publisher?: string;
+  writer_composer?: string;
 }
 
-export interface User {
+export interface UserClass {
   avatar_url: string;
   city: string | null;
+  country_code: string | null;
   first_name: string;
   full_name: string;
   id: number;
+  kind: string;
   last_modified: string;
+  last_name: string;
   permalink: string;
   permalink_url: string;
   uri: string;
@@ -90,3 +175,185 @@ export interface User {
   username: string;
   verified: boolean;
 }
+
+export interface PostTag {
+  id: string;
+  name: string;
+  slug: string;
+  description: string | null;
+  visibility: string;
+}
+
+export interface PostAuthor {
+  id: string;
+  name: string;
+  slug: string;
+  profile_image: string | null;
+  bio: string | null;
+  website: string | null;
+}
+
+export interface Pagination {
+  page: number;
+  limit: number;
+  pages: number;
+  total: number;
+  next: number | null;
+  prev: number | null;
+}
+
+export interface SearchResults {
+  query: string;
+  total: number;
+  results: SearchResult[];
+}
+
+export interface SearchResult {
+  slug: string;
+  title: string;
+  excerpt: string;
+  feature_image: string | null;
+  published_at: string;
+  tags: PostTag[];
+  score: number;
+  // Snippet is HTML escaped with the matched words wrapped in <mark>
+  snippet: string;
+}
+
+export interface ArticleFeed {
+  articles: Article[];
+  pagination: Pagination;
+}
+
+// Article is a post in an article feed along with its votes
+export interface Article {
+  slug: string;
+  title: string;
+  excerpt: string;
+  feature_image: string | null;
+  featured: boolean;
+  reading_time: number;
+  published_at: string;
+  tags: PostTag[];
+  primary_author: PostAuthor | null;
+  votes: ArticleVotes;
+  hot_score: number;
+  // The requesting visitor's vote, 0 when they haven't voted or sent no visitor token
+  vote: number;
+}
+
+export interface ArticleVotes {
+  up: number;
+  down: number;
+  score: number;
+}
+
+export interface ArticleFeedRequest {
+  page?: number;
+  limit?: number;
+  tag?: string;
+  visitor_token?: string;
+}
+
+export interface ArticleVoteResult {
+  slug: string;
+  vote: number;
+  votes: ArticleVotes;
+}
+
+export interface VisitorToken {
+  visitor_token: string;
+}
+
+export interface AuthSession {
+  auth_token: string;
+  account: string;
+  expires_at: string;
+}
+
+export interface AuthStatus {
+  account: string;
+  totp_enabled: boolean;
+  logged_in_at: string;
+  expires_at: string;
+}
+
+export interface RelatedPost {
+  slug: string;
+  title: string;
+  excerpt: string;
+  feature_image: string | null;
+  published_at: string;
+  tags: PostTag[];
+  score: number;
+}
+
+// AnalyticsReport sums the days from From to To, visitors are counted per day as
+// visitor hashes don't carry over from one day to the next
+export interface AnalyticsReport {
+  from: string;
+  to: string;
+  totals: AnalyticsTotals;
+  days: AnalyticsDay[];
+  pages: AnalyticsPage[];
+  referrers: AnalyticsCount[];
+  events: AnalyticsCount[];
+}
+
+export interface AnalyticsTotals {
+  pageviews: number;
+  visitors: number;
+  events: number;
+  bots: number;
+}
+
+export interface AnalyticsDay extends AnalyticsTotals {
+  date: string;
+}
+
+export interface AnalyticsPage {
+  path: string;
+  pageviews: number;
+  visitors: number;
+}
+
+export interface AnalyticsCount {
+  name: string;
+  count: number;
+}
+
+export interface CommentThread {
+  count: number;
+  comments: Comment[];
+}
+
+// Comment is an approved comment as shown under a post, with its approved replies
+export interface Comment {
+  id: string;
+  parent_id?: string;
+  author: string;
+  html: string;
+  created_at: string;
+  replies: Comment[];
+}
+
+export interface CommentRequest {
+  parent_id?: string;
+  author: string;
+  // Never shown, only used to reach the author and to ban them
+  email: string;
+  body: string;
+  // Hidden from people by the form, anything filled in here came from a bot
+  website?: string;
+}
+
+export interface CommentSubmission {
+  id: string;
+  status: string;
+}
+
+export interface SubscribeRequest {
+  email: string;
+  // Hidden from people by the form, anything filled in here came from a bot
+  website?: string;
+}